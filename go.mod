@@ -3,6 +3,7 @@ module github.com/grailbio/doppelmark
 go 1.13
 
 require (
+	github.com/aws/aws-sdk-go v1.29.24
 	github.com/grailbio/base v0.0.10-0.20200817015340-8e5f8ec2e457
 	github.com/grailbio/bio v0.0.0-20200818183458-d966d878d120
 	github.com/grailbio/hts v1.0.2-0.20200303061016-030e6b9f995e
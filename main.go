@@ -17,113 +17,300 @@ package main
   doppelmark is a tool for marking and removing PCR and optical
   duplicates. For more information, see
   github.com/grailbio/doppelmark/markduplicates/doc.go
+
+  Subcommands follow the flags:
+
+    doppelmark [flags]           mark duplicates (default)
+    doppelmark [flags] validate  check the duplicate flags of an already
+                                 marked --bam against a single-threaded
+                                 reference implementation, which
+                                 requires --max-depth=0, and doesn't
+                                 support --unmapped-mate-policy=mate,
+                                 --pass-through-refs or --regions
+    doppelmark [flags] coverage  only write the intervals of --bam with
+                                 coverage above --max-depth to
+                                 --high-cov-regions, without marking
+                                 duplicates
 */
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"os"
 	"runtime"
 	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/file/s3file"
 	"github.com/grailbio/base/grail"
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/base/vcontext"
-	gbam "github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/bio/encoding/bamprovider"
 	md "github.com/grailbio/doppelmark/markduplicates"
+	"github.com/grailbio/hts/sam"
 )
 
 var (
 	bamFile              = flag.String("bam", "", "Input BAM filename")
 	indexFile            = flag.String("index", "", "Input BAM index filename. By default, set to input BAM filename + .bai")
+	sequential           = flag.Bool("sequential", false, "read a coordinate-sorted BAM without an index from a single reader. The shards are spooled to scratch-dir for the distant mate scan, which needs about as much disk as the BAM, and marking streams the BAM again, handing each shard to the workers as it is read")
 	outputPath           = flag.String("output", "", "Output filename")
 	format               = flag.String("format", "bam", "Output format. Value is either 'bam' or 'pam'.")
+	sortByName           = flag.Bool("sort-by-name", false, "sort the output by queryname instead of coordinate, only for bam output")
+	sortChunkSize        = flag.Int("sort-chunk-size", 1000000, "number of records to sort in memory at a time when sort-by-name is set")
+	preserveOrder        = flag.Bool("preserve-order", false, "guarantee that the output contains every input record in input order, modified only in flags and tags")
+	estimateFraction     = flag.Float64("estimate-fraction", 0, "if positive, write no output, and only estimate the duplication rate and library size in the metrics from this fraction of the mapped shards")
+	downsampleFraction   = flag.Float64("downsample-fraction", 0, "if positive, randomly keep only this fraction of the readpairs genome-wide before marking duplicates, like samtools view -s; both reads of a pair are kept or removed together")
+	seed                 = flag.Int64("seed", 0, "seed for downsample-fraction, max-depth subsampling and estimate-fraction shard sampling")
 	metricsFile          = flag.String("metrics", "", "Output metrics file")
-	highCovFile          = flag.String("high-cov-regions", "", "Output high coverage regions file")
+	highCovFile          = flag.String("high-cov-regions", "", "Output high coverage regions file, in BED format if the name ends in .bed")
 	tileSizeFile         = flag.String("tile-size", "", "Output width and height of tile to file")
+	ioRetries            = flag.Int("io-retries", 0, "number of times to retry opening files, reading input and uploading outputs that fail with transient errors, such as connection resets and 503s from cloud storage")
+	ioRetryBackoff       = flag.Duration("io-retry-backoff", time.Second, "initial wait before retrying a transient error, doubled on each retry")
 	scratchDir           = flag.String("scratch-dir", "/tmp", "Directory to put scratch files")
 	parallelism          = flag.Int("parallelism", runtime.NumCPU(), "Number of parallel computations to run during the markdup phase")
-	queueLength          = flag.Int("queue-length", runtime.NumCPU()*5, "Number shards to queue while waiting for flush")
+	queueLength          = flag.Int("queue-length", runtime.NumCPU()*5, "Number of shards of compressed output to buffer while waiting for flush")
 	shardSize            = flag.Int("shard-size", 5000000, "approx shard size in bytes")
 	maxDepth             = flag.Int("max-depth", 3000000, "maximum coverage depth at a position, set to 0 to disable")
+	coverageExcludeSkips = flag.Bool("coverage-exclude-skips", false, "do not count reference skips (N cigar operations) as covered bases when computing coverage for max-depth, e.g. for spliced RNA-seq reads")
 	minBases             = flag.Int("min-bases", 5000, "minimum number of bases per shard")
-	padding              = flag.Int("clip-padding", 143, "padding in bp, this must be larger than the largest per-read clipping distance")
+	padding              = flag.Int("clip-padding", 143, "padding in bp, this must be larger than the largest per-read clipping distance, not counting the introns of spliced reads")
+	alignDistPolicyName  = flag.String("align-dist-policy", "fail", "what to do when a read's 5' alignment distance exceeds clip-padding: 'fail' exits with an error, 'warn' logs the number of such reads and continues")
 	clearExisting        = flag.Bool("clear-existing", false, "clear existing duplicate flag before marking")
 	removeDups           = flag.Bool("remove-dups", false, "remove duplicates instead of flagging them")
+	unmappedPolicyName   = flag.String("unmapped-mate-policy", "unmarked", "how to flag unmapped reads whose mates are mapped: 'unmarked' always leaves them unmarked, 'mate' marks them as duplicates when their mate is, like Picard")
+	corruptPolicyName    = flag.String("corrupt-block-policy", "fail", "what to do when the input can't be read because it is corrupt, e.g. a bad BGZF block: 'fail' exits with an error, 'skip' logs the region and the byte offset of the corrupt block, skips ahead to where the input can be read again, leaves reads whose mates were skipped unmarked, and reports the regions in the metrics")
 	tagDups              = flag.Bool("tag-duplicates", false, "tag duplicates as DT:Z:SQ (optical) or DT:Z:LB (pcr), and include DI and DS tags")
+	tagConfidence        = flag.Bool("tag-confidence", false, "tag each read whose bag was chosen by umi with DC:f, the confidence of that choice given the umi edits it needed and the distance to the next best bag at its position; requires umi-file")
 	useUmis              = flag.Bool("use-umis", false, "use Umi information in read names for grouping duplicates")
-	umiFile              = flag.String("umi-file", "", "perform UMI error correction with the known UMIs in this file")
+	umiFile              = flag.String("umi-file", "", "perform UMI error correction with the known UMIs in this file, which may be gzip, zstd or bzip2 compressed, and may be an s3:// URL")
 	scavengeUmis         = flag.Int("scavenge-umis", -1, "scavenge UMIs with at most this edit distance")
+	umiNPolicyName       = flag.String("umi-n-policy", "split", "how to handle umis containing N: 'split' never bags them with other reads unless corrected, 'wildcard' only corrects them against umi-file by letting N match any base, 'fail' sets the QC fail flag and excludes them from duplicate detection, 'drop' excludes them from duplicate detection")
 	separateSingletons   = flag.Bool("separate-singletons", false, "keep singletons separate from pairs, don't bag them together")
+	useBarcodes          = flag.Bool("use-barcodes", false, "only consider reads with the same linked-read barcode in the BX tag as duplicates of each other")
+	rnaSeq               = flag.Bool("rna-seq", false, "tune for spliced RNA-seq alignments; implies coverage-exclude-skips")
+	useSpliceJunctions   = flag.Bool("use-splice-junctions", false, "only consider reads with the same splice junctions as duplicates of each other; requires rna-seq")
+	separateReadGroups   = flag.Bool("separate-read-groups", false, "only consider reads from the same read group as duplicates of each other")
+	minMapQ              = flag.Int("min-mapq", 0, "minimum mapping quality for a read to participate in duplicate detection, reads below pass through unmarked. Both reads of a pair must pass.")
+	includeFlags         = flag.Int("include-flags", 0, "only reads with all of these sam flags participate in duplicate detection, other reads pass through unmarked")
+	excludeFlags         = flag.Int("exclude-flags", 0, "reads with any of these sam flags do not participate in duplicate detection and pass through unmarked")
+	passThroughRefs      = flag.String("pass-through-refs", "", "comma separated list of reference names or glob patterns, e.g. 'chrEBV,*_decoy', whose records are copied to the output unmodified, without duplicate marking or coverage counting")
+	regions              = flag.String("regions", "", "space separated list of samtools-style regions, e.g. 'chr1 chr2:1,000,000-2,000,000', to restrict marking to. Mates outside the regions are looked up in the index, so the regions' reads are flagged as in a full run. Requires an index.")
 	intDI                = flag.Bool("int-di", false, "use integer formatting for DI tags, sets the maximum number of reads to 2147483647 (use for testing only)")
 	opticalDistance      = flag.Int("optical-distance", 2500, "pixel distance threshold for optical duplicates, use -1 to disable")
+	opticalMetricName    = flag.String("optical-distance-metric", "chebyshev", "how to measure optical-distance: 'chebyshev' uses the larger of the x and y distances like Picard, 'euclidean' the straight line distance, and 'manhattan' the sum of the x and y distances")
 	diskMateShards       = flag.Int("disk-mate-shards", 0, "number of disk shards to use for distant mate storage, use 0 to keep mates in memory.  A value of 1000 is a reasonable choice when using disk, but will require an increase in file descriptor limit, e.g. 'ulimit -n 2000'.")
 	emitUnmodifiedFields = flag.Bool("emit-unmodified-fields", false, "Write fields that are not modified. This flag is meaningful only when --format=pam.")
+	fieldPolicyList      = flag.String("field-policy", "", "comma separated field=policy pairs that control which fields of each record may be rewritten, e.g. 'qual=preserve,templen=regenerate'. 'auto' rewrites or drops the field as other flags require, 'preserve' writes the field exactly as in the input, and 'regenerate' recomputes it for every readpair (templen only)")
+	fixMate              = flag.Bool("fix-mate", false, "repair mate flags, mate positions, MC tags and TLEN of readpairs, like samtools fixmate. Reads are paired by name, so mate positions that point to the wrong place are repaired too, at the cost of an extra pass over the input")
 	strandSpecific       = flag.Bool("strand-specific", false, "mark reads only if their r1 strands match")
 	opticalHistogram     = flag.String("optical-histogram", "", "path to optical distance histogram output file")
+	opticalPairs         = flag.String("optical-pairs", "", "path to output file listing each optical duplicate pair with its tile, x/y coordinates and distance")
+	laneMetricsFile      = flag.String("lane-metrics", "", "path to output file with the optical duplicate metrics of each library broken down by flowcell lane")
+	bagMetrics           = flag.Bool("bag-metrics", false, "add per-library strand balance and position jitter statistics over the bags of duplicates to the metrics file")
+	umiCollisionsFile    = flag.String("umi-collisions", "", "path to output file with per-library counts of positions shared by distinct umis, and a list of those positions; requires use-umis")
+	flagstatFile         = flag.String("flagstat", "", "path to output file for samtools flagstat equivalent counts of the output")
+	logFlagstat          = flag.Bool("log-flagstat", false, "log samtools flagstat equivalent counts of the output")
+	qcFile               = flag.String("qc", "", "path to output file for the QC status as json, with the metrics that exceed the max-duplication, max-optical-duplication and max-high-coverage-bases thresholds")
+	maxDuplication       = flag.Float64("max-duplication", 0, "if positive, fail QC when the percent duplication of any library exceeds it")
+	maxOpticalDup        = flag.Float64("max-optical-duplication", 0, "if positive, fail QC when the percent of read pairs that are optical duplicates in any library exceeds it")
+	maxHighCovBases      = flag.Int("max-high-coverage-bases", 0, "if positive, fail QC when the total length of the high coverage intervals exceeds it")
 	// The default opticalHistogramMax is set to 2000. Experimentally, the runtimes with 2000 seem reasonable, and it will still consider many duplicate pairs.
 	// The histograms looked the same between the full set of duplicate pairs and when capped at 2000.
 	opticalHistogramMax = flag.Int("optical-histogram-max", 2000, "maximum number of bag entries to compare when computing optical histogram. Setting to -1 reports for all bag entries.")
 )
 
+// qcFailedExitCode is the exit status when the output is complete, but
+// the metrics exceed the QC thresholds.
+const qcFailedExitCode = 3
+
+// subcommands maps each subcommand to the function that runs it. The
+// empty subcommand marks duplicates.
+var subcommands = map[string]func(ctx context.Context, provider bamprovider.Provider, opts *md.Opts) error{
+	"":         md.SetupAndMark,
+	"validate": validate,
+	"coverage": coverage,
+}
+
+// validate compares the duplicate flags in the input bam against the
+// flags computed by the reference implementation, and writes each
+// disagreeing record, and each record whose mate is missing, to stdout.
+func validate(ctx context.Context, provider bamprovider.Provider, opts *md.Opts) error {
+	mismatches, err := md.ValidateMarked(provider, opts)
+	if err != nil {
+		return err
+	}
+	if len(mismatches) == 0 {
+		log.Printf("all duplicate flags agree with the reference implementation")
+		return nil
+	}
+	fmt.Fprintln(os.Stdout, "#file_idx\tname\tref\tpos\tflags\tactual\texpected\tmissing_mate")
+	for _, m := range mismatches {
+		fmt.Fprintln(os.Stdout, m.String())
+	}
+	return fmt.Errorf("%d records disagree with the reference implementation", len(mismatches))
+}
+
+// coverage writes the intervals whose coverage exceeds opts.CoverageMax
+// to opts.HighCoverageIntervalFile.
+func coverage(ctx context.Context, provider bamprovider.Provider, opts *md.Opts) error {
+	if opts.HighCoverageIntervalFile == "" {
+		return fmt.Errorf("you must specify an output file with --high-cov-regions")
+	}
+	intervals, err := md.ComputeHighCoverageIntervals(provider, opts)
+	if err != nil {
+		return err
+	}
+	header, err := provider.GetHeader()
+	if err != nil {
+		return err
+	}
+	log.Printf("found %d high coverage intervals", len(intervals))
+	return md.WriteHighCoverageIntervals(ctx, md.NewFileSink(opts), opts.HighCoverageIntervalFile, header, intervals, nil)
+}
+
 func main() {
 	shutdown := grail.Init()
 	defer shutdown()
+	file.RegisterImplementation("s3", func() file.Implementation {
+		return s3file.NewImplementation(s3file.NewDefaultProvider(session.Options{}), s3file.Options{})
+	})
 
 	// Validate parameters.
-	if flag.NArg() > 0 {
+	run, ok := subcommands[flag.Arg(0)]
+	if !ok || flag.NArg() > 1 {
 		a := flag.Args()
 		log.Fatalf("unparsed flags, please check flag syntax: '%s'", strings.Join(a[len(a)-flag.NArg():], " "))
 	}
 
+	umiNPolicy, err := md.ParseUmiNPolicy(*umiNPolicyName)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	fieldPolicies, err := md.ParseFieldPolicies(*fieldPolicyList)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	alignDistPolicy, err := md.ParseAlignDistPolicy(*alignDistPolicyName)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	unmappedMatePolicy, err := md.ParseUnmappedMatePolicy(*unmappedPolicyName)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	corruptBlockPolicy, err := md.ParseCorruptBlockPolicy(*corruptPolicyName)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	var passThroughRefPatterns []string
+	if *passThroughRefs != "" {
+		passThroughRefPatterns = strings.Split(*passThroughRefs, ",")
+	}
+
 	opts := md.Opts{
 		BamFile:                  *bamFile,
 		IndexFile:                *indexFile,
+		Sequential:               *sequential,
 		MetricsFile:              *metricsFile,
 		HighCoverageIntervalFile: *highCovFile,
 		TileSizeFile:             *tileSizeFile,
 		Format:                   *format,
+		SortByName:               *sortByName,
+		SortChunkSize:            *sortChunkSize,
+		PreserveOrder:            *preserveOrder,
+		EstimateFraction:         *estimateFraction,
+		DownsampleFraction:       *downsampleFraction,
 		CoverageMax:              *maxDepth,
+		CoverageExcludeSkips:     *coverageExcludeSkips,
 		ShardSize:                *shardSize,
 		MinBases:                 *minBases,
 		Padding:                  *padding,
+		AlignDistPolicy:          alignDistPolicy,
 		DiskMateShards:           *diskMateShards,
 		ScratchDir:               *scratchDir,
+		IORetries:                *ioRetries,
+		IORetryBackoff:           *ioRetryBackoff,
 		Parallelism:              *parallelism,
 		QueueLength:              *queueLength,
 		ClearExisting:            *clearExisting,
 		RemoveDups:               *removeDups,
+		UnmappedMatePolicy:       unmappedMatePolicy,
+		CorruptBlockPolicy:       corruptBlockPolicy,
 		TagDups:                  *tagDups,
+		TagConfidence:            *tagConfidence,
 		IntDI:                    *intDI,
 		UseUmis:                  *useUmis,
 		UmiFile:                  *umiFile,
 		ScavengeUmis:             *scavengeUmis,
+		UmiNPolicy:               umiNPolicy,
 		EmitUnmodifiedFields:     *emitUnmodifiedFields,
+		FieldPolicies:            fieldPolicies,
+		FixMate:                  *fixMate,
 		SeparateSingletons:       *separateSingletons,
+		SeparateReadGroups:       *separateReadGroups,
+		UseBarcodes:              *useBarcodes,
+		RnaSeq:                   *rnaSeq,
+		UseSpliceJunctions:       *useSpliceJunctions,
+		MinMapQ:                  *minMapQ,
+		IncludeFlags:             sam.Flags(*includeFlags),
+		ExcludeFlags:             sam.Flags(*excludeFlags),
+		PassThroughRefs:          passThroughRefPatterns,
+		Regions:                  strings.Fields(*regions),
 		OutputPath:               *outputPath,
 		StrandSpecific:           *strandSpecific,
 		OpticalHistogram:         *opticalHistogram,
 		OpticalHistogramMax:      *opticalHistogramMax,
+		OpticalPairsFile:         *opticalPairs,
+		LaneMetricsFile:          *laneMetricsFile,
+		BagMetrics:               *bagMetrics,
+		UmiCollisionsFile:        *umiCollisionsFile,
+		FlagstatFile:             *flagstatFile,
+		LogFlagstat:              *logFlagstat,
+		QCFile:                   *qcFile,
+		MaxDuplication:           *maxDuplication,
+		MaxOpticalDuplication:    *maxOpticalDup,
+		MaxHighCoverageBases:     *maxHighCovBases,
+		Seed:                     *seed,
 	}
 
 	// Create the provider.
-	bamOpts := bamprovider.ProviderOpts{Index: opts.IndexFile}
-	if !opts.EmitUnmodifiedFields {
-		bamOpts.DropFields = []gbam.FieldType{
-			gbam.FieldMapq,
-			gbam.FieldTempLen,
-		}
+	bamOpts := bamprovider.ProviderOpts{Index: opts.IndexFile, DropFields: md.InputDropFields(&opts)}
+	var provider bamprovider.Provider
+	if opts.Sequential {
+		provider = md.NewSequentialProvider(*bamFile, opts.ScratchDir, opts.Parallelism)
+	} else {
+		provider = bamprovider.NewProvider(*bamFile, bamOpts)
 	}
-	provider := bamprovider.NewProvider(*bamFile, bamOpts)
 
 	// Create optical duplicate detector if necessary.
 	if *opticalDistance >= 0 {
+		opticalMetric, err := md.ParseOpticalDistanceMetric(*opticalMetricName)
+		if err != nil {
+			log.Fatalf(err.Error())
+		}
 		opts.OpticalDetector = &md.TileOpticalDetector{
 			OpticalDistance: *opticalDistance,
+			Metric:          opticalMetric,
 		}
 	}
 
 	ctx := vcontext.Background()
-	if err := md.SetupAndMark(ctx, provider, &opts); err != nil {
+	err = run(ctx, provider, &opts)
+	// Close the provider even on error, to remove the spooled shards of
+	// a sequential provider.
+	if err2 := provider.Close(); err == nil {
+		err = err2
+	}
+	if _, ok := err.(*md.QCError); ok {
+		log.Error.Printf(err.Error())
+		shutdown()
+		os.Exit(qcFailedExitCode)
+	}
+	if err != nil {
 		log.Fatalf(err.Error())
 	}
 	log.Debug.Printf("exiting")
@@ -0,0 +1,125 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/sam"
+)
+
+// AlignDistPolicy tells Mark what to do when a read's 5' alignment
+// distance, the distance between its alignment position and its
+// unclipped 5' position, exceeds Opts.Padding. When that happens,
+// the read's mate may look for it in a shard that does not contain
+// it, so duplicate marking can silently miss the pair. The policy does
+// not apply to spliced reverse reads whose distance exceeds the padding
+// only because of their reference skips, since Mark resolves the reads
+// at their 5' ends separately.
+type AlignDistPolicy int
+
+const (
+	// AlignDistFail fails Mark on the first read that exceeds the
+	// padding.
+	AlignDistFail AlignDistPolicy = iota
+	// AlignDistWarn logs the number of reads that exceed the padding,
+	// and continues.
+	AlignDistWarn
+)
+
+var alignDistPolicyNames = []string{"fail", "warn"}
+
+// ParseAlignDistPolicy returns the AlignDistPolicy with the given
+// name, one of "fail" or "warn".
+func ParseAlignDistPolicy(name string) (AlignDistPolicy, error) {
+	i, err := parseName("align dist policy", name, alignDistPolicyNames)
+	return AlignDistPolicy(i), err
+}
+
+func (p AlignDistPolicy) String() string {
+	return alignDistPolicyNames[p]
+}
+
+// maxAlignDistCheck computes the maximum 5' alignment distance of
+// each library, and applies the AlignDistPolicy to reads whose
+// distance exceeds padding.
+type maxAlignDistCheck struct {
+	clearExisting      bool
+	padding            int
+	policy             AlignDistPolicy
+	readGroupLibrary   map[string]string
+	maxAlignDist       map[string]int
+	exceeded           int
+	globalMaxAlignDist map[string]int
+	globalExceeded     *int
+	spliced            *splicedEnds
+	globalSpliced      *splicedEnds
+	mutex              *sync.Mutex
+}
+
+func (m *maxAlignDistCheck) Process(_ bam.Shard, r *sam.Record) error {
+	if m.clearExisting {
+		clearDupFlagTags(r)
+	}
+
+	d := r.Pos - bam.UnclippedFivePrimePosition(r)
+	if d < 0 {
+		d = -d
+	}
+	if d > m.padding && bam.IsReversedRead(r) && d-referenceSkips(r) <= m.padding {
+		// The distance exceeds the padding only because of the read's
+		// introns, and Mark resolves the reads at its 5' end in
+		// findSplicedPairs. Reads that are not marked need nothing.
+		if m.globalSpliced != nil && isPrimaryMapped(r) {
+			if m.spliced == nil {
+				m.spliced = newSplicedEnds()
+			}
+			m.spliced.add(r)
+		}
+	} else if d > m.padding {
+		if m.policy == AlignDistFail {
+			return fmt.Errorf("5' alignment distance(%d) exceeds padding(%d) on read: %v", d, m.padding, r.Name)
+		}
+		m.exceeded++
+	}
+	if m.maxAlignDist == nil {
+		m.maxAlignDist = make(map[string]int)
+	}
+	library := GetLibrary(m.readGroupLibrary, r)
+	if max, found := m.maxAlignDist[library]; !found || d > max {
+		m.maxAlignDist[library] = d
+	}
+	return nil
+}
+
+func (m *maxAlignDistCheck) Close(_ bam.Shard) {
+	log.Debug.Printf("maximum alignment distance: %v", m.maxAlignDist)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for library, d := range m.maxAlignDist {
+		if max, found := m.globalMaxAlignDist[library]; !found || d > max {
+			m.globalMaxAlignDist[library] = d
+		}
+	}
+	if m.globalExceeded != nil {
+		*m.globalExceeded += m.exceeded
+	}
+	if m.spliced != nil {
+		m.globalSpliced.merge(m.spliced)
+		m.spliced = nil
+	}
+}
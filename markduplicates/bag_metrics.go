@@ -0,0 +1,141 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/grailbio/hts/sam"
+)
+
+// BagMetrics contains statistics over the bags of a library that
+// contain more than one read pair, when Opts.BagMetrics is set. The
+// reads of a bag share their unclipped 5' positions, so differences
+// in their alignment positions and read order reveal clipping and
+// adapter trimming problems that the duplication rate hides.
+type BagMetrics struct {
+	// Bags is the number of bags with more than one read pair.
+	Bags int
+	// ReadPairs is the number of read pairs in those bags.
+	ReadPairs int
+	// R1LeftPairs and R2LeftPairs are the number of those read pairs
+	// whose left read, by unclipped 5' position, is read 1 and read
+	// 2, respectively.
+	R1LeftPairs int
+	R2LeftPairs int
+	// MixedBags is the number of bags that contain both R1LeftPairs
+	// and R2LeftPairs.
+	MixedBags int
+	// PositionJitter[i] is the number of bags whose left reads'
+	// alignment positions span i bases, that is, the difference
+	// between the largest and smallest position is i.
+	PositionJitter []int64
+}
+
+// addBag adds the statistics of the bag of read pairs to m.
+func (m *BagMetrics) addBag(pairs []*readPair) {
+	r1Left, r2Left := 0, 0
+	minPos, maxPos := pairs[0].left.Pos, pairs[0].left.Pos
+	for _, p := range pairs {
+		if p.left.Flags&sam.Read1 != 0 {
+			r1Left++
+		} else {
+			r2Left++
+		}
+		if p.left.Pos < minPos {
+			minPos = p.left.Pos
+		}
+		if p.left.Pos > maxPos {
+			maxPos = p.left.Pos
+		}
+	}
+	m.Bags++
+	m.ReadPairs += len(pairs)
+	m.R1LeftPairs += r1Left
+	m.R2LeftPairs += r2Left
+	if r1Left > 0 && r2Left > 0 {
+		m.MixedBags++
+	}
+	jitter := maxPos - minPos
+	if jitter >= len(m.PositionJitter) {
+		temp := make([]int64, jitter+1)
+		copy(temp, m.PositionJitter)
+		m.PositionJitter = temp
+	}
+	m.PositionJitter[jitter]++
+}
+
+// Add adds the metrics in other to m.
+func (m *BagMetrics) Add(other *BagMetrics) {
+	m.Bags += other.Bags
+	m.ReadPairs += other.ReadPairs
+	m.R1LeftPairs += other.R1LeftPairs
+	m.R2LeftPairs += other.R2LeftPairs
+	m.MixedBags += other.MixedBags
+	if len(m.PositionJitter) < len(other.PositionJitter) {
+		temp := make([]int64, len(other.PositionJitter))
+		copy(temp, m.PositionJitter)
+		m.PositionJitter = temp
+	}
+	for i, n := range other.PositionJitter {
+		m.PositionJitter[i] += n
+	}
+}
+
+// String returns the metrics as a row of the bag metrics section of
+// the metrics file.
+func (m *BagMetrics) String() string {
+	r1Percent, meanJitter, maxJitter := 0.0, 0.0, 0
+	if m.ReadPairs > 0 {
+		r1Percent = 100 * float64(m.R1LeftPairs) / float64(m.ReadPairs)
+	}
+	for jitter, n := range m.PositionJitter {
+		if n > 0 {
+			meanJitter += float64(jitter) * float64(n)
+			maxJitter = jitter
+		}
+	}
+	if m.Bags > 0 {
+		meanJitter /= float64(m.Bags)
+	}
+	return fmt.Sprintf("%d\t%d\t%d\t%d\t%0.6f\t%d\t%0.6f\t%d", m.Bags, m.ReadPairs, m.R1LeftPairs,
+		m.R2LeftPairs, r1Percent, m.MixedBags, meanJitter, maxJitter)
+}
+
+// bagMetricsSection returns the bag metrics of each library, followed
+// by the position jitter histogram of each library, as sections of
+// the metrics file.
+func bagMetricsSection(bagMetrics map[string]*BagMetrics) string {
+	libraries := make([]string, 0, len(bagMetrics))
+	for library := range bagMetrics {
+		libraries = append(libraries, library)
+	}
+	sort.Strings(libraries)
+
+	s := "\nLIBRARY\tBAGS\tBAG_READ_PAIRS\tR1_LEFT_READ_PAIRS\tR2_LEFT_READ_PAIRS\tPERCENT_R1_LEFT\t" +
+		"MIXED_STRAND_BAGS\tMEAN_POSITION_JITTER\tMAX_POSITION_JITTER\n"
+	for _, library := range libraries {
+		s += library + "\t" + bagMetrics[library].String() + "\n"
+	}
+	s += "\nLIBRARY\tPOSITION_JITTER\tBAGS\n"
+	for _, library := range libraries {
+		for jitter, n := range bagMetrics[library].PositionJitter {
+			if n > 0 {
+				s += fmt.Sprintf("%s\t%d\t%d\n", library, jitter, n)
+			}
+		}
+	}
+	return s
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBagMetrics(t *testing.T) {
+	records := []*sam.Record{
+		NewRecord("A:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecord("B:1:1:1:1:1:1", chr1, 0, r2F, 10, chr1, cigar0),
+		NewRecord("C:1:1:1:1:1:1", chr1, 1, r1F, 10, chr1, cigarSoft1),
+		NewRecord("A:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+		NewRecord("B:1:1:1:1:1:1", chr1, 10, r1R, 0, chr1, cigar0),
+		NewRecord("C:1:1:1:1:1:1", chr1, 10, r2R, 1, chr1, cigar0),
+		NewRecord("X:1:1:1:1:1:1", chr1, 50, r1F, 60, chr1, cigar0),
+		NewRecord("X:1:1:1:1:1:1", chr1, 60, r2R, 50, chr1, cigar0),
+	}
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	memory := &MemorySink{}
+	opts := defaultOpts
+	opts.OutputPath = NewTestOutput(tempDir, 0, "bam")
+	opts.Format = "bam"
+	opts.BagMetrics = true
+	opts.MetricsFile = "metrics"
+	opts.Sink = memory
+	markDuplicates := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(header, records),
+		Opts:     &opts,
+	}
+	metrics, err := markDuplicates.Mark(nil)
+	assert.NoError(t, err)
+
+	// A, B and C form one bag, and C's soft clip shifts its position
+	// by one base. X is alone in its bag, so it is not counted.
+	assert.Equal(t, map[string]*BagMetrics{
+		"Unknown Library": {
+			Bags:           1,
+			ReadPairs:      3,
+			R1LeftPairs:    2,
+			R2LeftPairs:    1,
+			MixedBags:      1,
+			PositionJitter: []int64{0, 1},
+		},
+	}, metrics.BagMetrics)
+
+	assert.NoError(t, writeMetrics(vcontext.Background(), &opts, metrics))
+	b, ok := memory.Get("metrics")
+	assert.True(t, ok)
+	s := string(b)
+	assert.True(t, strings.Contains(s, "\nUnknown Library\t1\t3\t2\t1\t66.666667\t1\t1.000000\t1\n"), s)
+	assert.True(t, strings.HasSuffix(s, "\nLIBRARY\tPOSITION_JITTER\tBAGS\nUnknown Library\t1\t1\n"), s)
+}
+
+func TestBagMetricsAdd(t *testing.T) {
+	m := BagMetrics{Bags: 1, ReadPairs: 2, R1LeftPairs: 2, PositionJitter: []int64{1}}
+	m.Add(&BagMetrics{Bags: 2, ReadPairs: 5, R1LeftPairs: 1, R2LeftPairs: 4, MixedBags: 1,
+		PositionJitter: []int64{0, 0, 2}})
+	assert.Equal(t, BagMetrics{Bags: 3, ReadPairs: 7, R1LeftPairs: 3, R2LeftPairs: 4, MixedBags: 1,
+		PositionJitter: []int64{1, 0, 2}}, m)
+	assert.Equal(t, "3\t7\t3\t4\t42.857143\t1\t1.333333\t2", m.String())
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/hts/sam"
+)
+
+// positionUmiKeys returns the keys in keySets that remain in
+// umiToGroup, without repeats. keySets hold the keys of the bags at
+// one duplicate position, so the result is the umi bags at that
+// position after scavenging.
+func positionUmiKeys(umiToGroup map[umiKey][]DuplicateEntry, keySets ...map[umiKey]bool) []umiKey {
+	seen := make(map[umiKey]bool)
+	var keys []umiKey
+	for _, keySet := range keySets {
+		for key := range keySet {
+			if _, ok := umiToGroup[key]; ok && !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// umiConfidence returns the confidence that an entry whose umis, as
+// read from its name, are in raw belongs to the bag with key, rather
+// than to one of the other bags at the same position in keys. It is 1
+// when raw matches key exactly and no other bag is as close, falls as
+// more edits are needed to reach key, and is 0 when another bag is at
+// most as far from raw as key is.
+func umiConfidence(raw, key umiKey, keys []umiKey) float32 {
+	edits := raw.distance(&key)
+	nextBest := -1
+	for i := range keys {
+		if keys[i] == key {
+			continue
+		}
+		if dist := raw.distance(&keys[i]); nextBest < 0 || dist < nextBest {
+			nextBest = dist
+		}
+	}
+	confidence := 1 / float32(1+edits)
+	if nextBest >= 0 {
+		if nextBest <= edits {
+			return 0
+		}
+		confidence *= float32(nextBest-edits) / float32(nextBest)
+	}
+	return confidence
+}
+
+// addConfidences records the umiConfidence of each entry in the bags
+// with keys, which share one duplicate position.
+func (d *duplicateIndex) addConfidences(umiToGroup map[umiKey][]DuplicateEntry, keys []umiKey) {
+	if d.confidences == nil {
+		d.confidences = make(map[string]float32)
+	}
+	for _, key := range keys {
+		for _, e := range umiToGroup[key] {
+			raw := key
+			switch v := e.(type) {
+			case IndexedPair:
+				raw.leftUmi, raw.rightUmi, _ = getCanonicalUmis(v)
+			case IndexedSingle:
+				raw.leftUmi, _, _ = getCanonicalUmi(v)
+			}
+			d.confidences[e.Name()] = umiConfidence(raw, key, keys)
+		}
+	}
+}
+
+// tagConfidence adds the DC tag with the confidence of the read's bag
+// assignment to r, if there is one.
+func tagConfidence(r *sam.Record, confidences map[string]float32) {
+	confidence, ok := confidences[r.Name]
+	if !ok {
+		return
+	}
+	tag, err := sam.NewAux(dcTag, confidence)
+	if err != nil {
+		log.Fatalf("error creating DC:f:%f tag: %v", confidence, err)
+	}
+	r.AuxFields = append(r.AuxFields, tag)
+}
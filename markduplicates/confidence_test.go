@@ -0,0 +1,89 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"testing"
+
+	"github.com/grailbio/hts/sam"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUmiConfidence(t *testing.T) {
+	key := func(leftUmi, rightUmi string) umiKey {
+		return umiKey{leftPos: 10, rightPos: 20, Orientation: fr, leftUmi: leftUmi, rightUmi: rightUmi}
+	}
+	keys := []umiKey{key("AAA", "CCC"), key("GGG", "CCC")}
+	tests := []struct {
+		raw      umiKey
+		bag      umiKey
+		keys     []umiKey
+		expected float32
+	}{
+		{key("AAA", "CCC"), keys[0], keys[:1], 1},
+		{key("AAT", "CCC"), keys[0], keys[:1], 0.5},
+		{key("AAA", "CCC"), keys[0], keys, 1},
+		{key("AGA", "CCC"), keys[0], keys, 0.25},
+		// GAG is two edits from either bag.
+		{key("GAG", "CCC"), keys[0], keys, 0},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, umiConfidence(test.raw, test.bag, test.keys), "raw %v", test.raw)
+	}
+}
+
+func TestTagConfidence(t *testing.T) {
+	opts := defaultOpts
+	opts.UseUmis = true
+	opts.KnownUmis = []byte("AAA\nCCC\nGGG\nTTT")
+	opts.ScavengeUmis = 2
+	opts.TagConfidence = true
+
+	cases := []TestCase{
+		{
+			// B is scavenged to A's bag after three edits.
+			[]TestRecord{
+				{R: NewRecord("A:1:1:1:1:1:1:AAA+CCC", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false,
+					ExpectedAuxs: []sam.Aux{NewAux("DC", float32(1))}},
+				{R: NewRecord("B:1:1:1:1:1:1:TAC+CCG", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: true,
+					ExpectedAuxs: []sam.Aux{NewAux("DC", float32(0.25))}},
+				{R: NewRecord("A:1:1:1:1:1:1:AAA+CCC", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false,
+					ExpectedAuxs: []sam.Aux{NewAux("DC", float32(1))}},
+				{R: NewRecord("B:1:1:1:1:1:1:TAC+CCG", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: true,
+					ExpectedAuxs: []sam.Aux{NewAux("DC", float32(0.25))}},
+			},
+			opts,
+		},
+		{
+			// D is corrected to A's bag with one edit, but is only two
+			// edits from C's bag.
+			[]TestRecord{
+				{R: NewRecord("A:1:1:1:1:1:1:AAA+CCC", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false,
+					ExpectedAuxs: []sam.Aux{NewAux("DC", float32(1))}},
+				{R: NewRecord("C:1:1:1:1:1:1:GGG+CCC", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false,
+					ExpectedAuxs: []sam.Aux{NewAux("DC", float32(1))}},
+				{R: NewRecord("D:1:1:1:1:1:1:AGA+CCC", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: true,
+					ExpectedAuxs: []sam.Aux{NewAux("DC", float32(0.25))}},
+				{R: NewRecord("A:1:1:1:1:1:1:AAA+CCC", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false,
+					ExpectedAuxs: []sam.Aux{NewAux("DC", float32(1))}},
+				{R: NewRecord("C:1:1:1:1:1:1:GGG+CCC", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false,
+					ExpectedAuxs: []sam.Aux{NewAux("DC", float32(1))}},
+				{R: NewRecord("D:1:1:1:1:1:1:AGA+CCC", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: true,
+					ExpectedAuxs: []sam.Aux{NewAux("DC", float32(0.25))}},
+			},
+			opts,
+		},
+	}
+	RunTestCases(t, header, cases)
+}
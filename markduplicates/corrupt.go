@@ -0,0 +1,556 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/biopb"
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	htsbam "github.com/grailbio/hts/bam"
+	"github.com/grailbio/hts/bgzf"
+	"github.com/grailbio/hts/sam"
+)
+
+// CorruptBlockPolicy tells Mark what to do when the input can't be
+// read because it is corrupt, for example because of a BGZF block
+// that fails to decompress.
+type CorruptBlockPolicy int
+
+const (
+	// CorruptBlockFail fails the run.
+	CorruptBlockFail CorruptBlockPolicy = iota
+	// CorruptBlockSkip skips the records from the last record read
+	// before the corruption up to a later position where the input can
+	// be read again, and continues from there. Reads whose mates were
+	// skipped are left unmarked.
+	CorruptBlockSkip
+)
+
+var corruptBlockPolicyNames = []string{"fail", "skip"}
+
+// ParseCorruptBlockPolicy returns the CorruptBlockPolicy with the given
+// name, one of "fail" or "skip".
+func ParseCorruptBlockPolicy(name string) (CorruptBlockPolicy, error) {
+	i, err := parseName("corrupt block policy", name, corruptBlockPolicyNames)
+	return CorruptBlockPolicy(i), err
+}
+
+func (p CorruptBlockPolicy) String() string {
+	return corruptBlockPolicyNames[p]
+}
+
+// corruptSkipStep is the distance, in bases, past the last record read
+// before a corrupt block at which the first attempt to resume reading
+// starts. It is the width of a window of the BAM linear index, so that
+// the index usually points the resumed read past the corrupt block.
+// The distance doubles each time the resumed read fails again.
+const corruptSkipStep = 16384
+
+// CorruptRegion is a 0-based, half-open range of positions on Ref whose
+// records were skipped, because the input was corrupt, and the error
+// that reading it returned. Ref is "*" for the unmapped records. Offset
+// is the byte offset in the input of the bgzf block that failed to
+// read, or -1 if it is unknown, because the input is not an indexed bam
+// file.
+type CorruptRegion struct {
+	Ref        string
+	Start, End int
+	Offset     int64
+	Err        string
+}
+
+func (r CorruptRegion) String() string {
+	var at string
+	if r.Offset >= 0 {
+		at = fmt.Sprintf(" at byte offset %d", r.Offset)
+	}
+	if r.Ref == "*" {
+		return fmt.Sprintf("*%s: %s", at, r.Err)
+	}
+	return fmt.Sprintf("%s:%d-%d%s: %s", r.Ref, r.Start+1, r.End, at, r.Err)
+}
+
+// corruptKey identifies a corrupt block by the virtual offset of the
+// first data that fails to read, when it is known. Otherwise it
+// identifies it by the reference and position after which reading
+// failed.
+type corruptKey struct {
+	offset bgzf.Offset
+	ref    string
+	start  int
+}
+
+// skipCorruptProvider is a Provider whose iterators skip the parts of
+// the input that fail to read, instead of failing, and records them.
+type skipCorruptProvider struct {
+	bamprovider.Provider
+	// input reads the input, if it is an indexed bam file. The
+	// provider reads it again to find the offsets of the corrupt blocks.
+	input *bamFileProvider
+
+	mutex sync.Mutex
+	// regions holds the skipped region of each corrupt block. The
+	// distant mate scan and overlapping padded shards read the same
+	// corrupt blocks, from different positions and up to different
+	// limits, so each region spans every range skipped for its block.
+	regions map[corruptKey]*CorruptRegion
+}
+
+// newSkipCorruptProvider returns a skipCorruptProvider that wraps
+// provider. input is the provider that provider reads from, or nil if
+// the input is not an indexed bam file.
+func newSkipCorruptProvider(provider bamprovider.Provider, input *bamFileProvider) *skipCorruptProvider {
+	return &skipCorruptProvider{Provider: provider, input: input, regions: make(map[corruptKey]*CorruptRegion)}
+}
+
+func (p *skipCorruptProvider) NewIterator(shard bam.Shard) bamprovider.Iterator {
+	return &skipCorruptIterator{
+		provider: p,
+		shard:    shard,
+		iter:     p.Provider.NewIterator(shard),
+		resume:   bam.NewCoord(shard.StartRef, shard.PaddedStart(), 0),
+		step:     corruptSkipStep,
+	}
+}
+
+// addRegion records a region skipped because of the corrupt block
+// identified by key, and logs the block the first time.
+func (p *skipCorruptProvider) addRegion(shard bam.Shard, key corruptKey, region CorruptRegion) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	r := p.regions[key]
+	if r == nil {
+		p.regions[key] = &region
+		log.Error.Printf("shard %s: skipping corrupt input %s", shard.String(), region)
+		return
+	}
+	if r.Ref == region.Ref {
+		r.Start = min(r.Start, region.Start)
+		if region.End > r.End {
+			r.End = region.End
+		}
+	}
+}
+
+// corruptOffset reads p.input from the records at resume, which must be
+// mapped, and returns the virtual offset of the first data that fails
+// to read. It returns false if p.input is not an indexed bam file, or
+// if reading does not fail before limit.
+func (p *skipCorruptProvider) corruptOffset(resume, limit biopb.Coord) (bgzf.Offset, bool) {
+	if p.input == nil {
+		return bgzf.Offset{}, false
+	}
+	offset, ok := p.failedOffset(resume, limit)
+	if !ok {
+		return bgzf.Offset{}, false
+	}
+	// Reading failed at offset, in its block or, if a record continues
+	// past that block, in the next one. If neither block is corrupt, the
+	// record data is.
+	ctx := vcontext.Background()
+	in, err := file.Open(ctx, p.input.Path)
+	if err != nil {
+		return bgzf.Offset{}, false
+	}
+	defer in.Close(ctx) // nolint: errcheck
+	blockLen, err := readBlock(in.Reader(ctx), offset.File)
+	if err != nil {
+		return bgzf.Offset{File: offset.File}, true
+	}
+	if _, err := readBlock(in.Reader(ctx), offset.File+blockLen); err != nil && err != io.EOF {
+		return bgzf.Offset{File: offset.File + blockLen}, true
+	}
+	return offset, true
+}
+
+// failedOffset reads p.input from the records at resume, and returns
+// the virtual offset at which reading fails, or false if it does not
+// fail before limit.
+func (p *skipCorruptProvider) failedOffset(resume, limit biopb.Coord) (bgzf.Offset, bool) {
+	ctx := vcontext.Background()
+	in, err := file.Open(ctx, p.input.Path)
+	if err != nil {
+		return bgzf.Offset{}, false
+	}
+	defer in.Close(ctx) // nolint: errcheck
+	reader, err := htsbam.NewReader(in.Reader(ctx), 1)
+	if err != nil {
+		return bgzf.Offset{}, false
+	}
+	defer reader.Close() // nolint: errcheck
+	offset, ok, err := p.input.seekOffset(reader.Header(), reader.Header().Refs()[resume.RefId], int(resume.Pos))
+	if err != nil || !ok {
+		return bgzf.Offset{}, false
+	}
+	if err := reader.Seek(offset); err != nil {
+		return offset, true
+	}
+	for {
+		r, err := reader.Read()
+		if err == io.EOF {
+			return bgzf.Offset{}, false
+		}
+		if err != nil {
+			return offset, true
+		}
+		if !bam.CoordFromSAMRecord(r, 0).LT(limit) {
+			return bgzf.Offset{}, false
+		}
+		offset = reader.LastChunk().End
+	}
+}
+
+// readBlock reads the bgzf block at offset in r, and returns its
+// compressed length, or an error if it is corrupt.
+func readBlock(r io.ReadSeeker, offset int64) (int64, error) {
+	// The header of a bgzf block holds its compressed length minus one
+	// at bytes 16-17.
+	var header [18]byte
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	if header[0] != 0x1f || header[1] != 0x8b || header[12] != 'B' || header[13] != 'C' {
+		return 0, bgzf.ErrCorrupt
+	}
+	block := make([]byte, int(binary.LittleEndian.Uint16(header[16:]))+1)
+	copy(block, header[:])
+	if _, err := io.ReadFull(r, block[len(header):]); err != nil {
+		return 0, err
+	}
+	// gzip checks the crc and the length of the uncompressed data.
+	gz, err := gzip.NewReader(bytes.NewReader(block))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+		return 0, err
+	}
+	return int64(len(block)), nil
+}
+
+// getRegions returns the skipped regions in coordinate order.
+func (p *skipCorruptProvider) getRegions(header *sam.Header) []CorruptRegion {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	refIDs := make(map[string]int)
+	for _, ref := range header.Refs() {
+		refIDs[ref.Name()] = ref.ID()
+	}
+	refID := func(name string) int {
+		if id, ok := refIDs[name]; ok {
+			return id
+		}
+		return len(refIDs)
+	}
+	regions := make([]CorruptRegion, 0, len(p.regions))
+	for _, r := range p.regions {
+		regions = append(regions, *r)
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		a, b := regions[i], regions[j]
+		if a.Ref != b.Ref {
+			return refID(a.Ref) < refID(b.Ref)
+		}
+		if a.Start != b.Start {
+			return a.Start < b.Start
+		}
+		if a.End != b.End {
+			return a.End < b.End
+		}
+		return a.Offset < b.Offset
+	})
+	return regions
+}
+
+// skipCorruptIterator is an Iterator that, when reading fails, reopens
+// the rest of its shard at a later position.
+type skipCorruptIterator struct {
+	provider *skipCorruptProvider
+	shard    bam.Shard
+	iter     bamprovider.Iterator
+	// resume is the coordinate of the last record returned, or the
+	// start of the shard. Reading resumes after it.
+	resume biopb.Coord
+	step   int
+}
+
+func (i *skipCorruptIterator) Scan() bool {
+	for i.iter != nil {
+		if i.iter.Scan() {
+			i.resume = bam.CoordFromSAMRecord(i.iter.Record(), 0)
+			i.step = corruptSkipStep
+			return true
+		}
+		err := i.iter.Close()
+		i.iter = nil
+		if err == nil {
+			return false
+		}
+		i.skip(err)
+	}
+	return false
+}
+
+// skip records the region after i.resume that failed to read with err,
+// and reopens the rest of the shard after it, if any remains.
+func (i *skipCorruptIterator) skip(err error) {
+	header, herr := i.provider.GetHeader()
+	if herr != nil || i.resume.RefId == biopb.UnmappedRefID {
+		// The unmapped records have no positions to resume at.
+		i.provider.addRegion(i.shard, corruptKey{ref: "*"}, CorruptRegion{Ref: "*", Offset: -1, Err: err.Error()})
+		return
+	}
+	refs := header.Refs()
+	ref := refs[i.resume.RefId]
+	start := int(i.resume.Pos)
+	end := start + i.step
+	i.step *= 2
+	next := bam.NewCoord(ref, end, 0)
+	if end >= ref.Len() {
+		end = ref.Len()
+		if ref.ID()+1 < len(refs) {
+			next = bam.NewCoord(refs[ref.ID()+1], 0, 0)
+		} else {
+			next = bam.NewCoord(nil, 0, 0)
+		}
+	}
+	limit := bam.NewCoord(i.shard.EndRef, i.shard.PaddedEnd(), 0)
+	if limit.RefId == i.resume.RefId && int(limit.Pos) < end {
+		end = int(limit.Pos)
+	}
+	region := CorruptRegion{Ref: ref.Name(), Start: start, End: end, Offset: -1, Err: err.Error()}
+	key := corruptKey{ref: ref.Name(), start: start}
+	if offset, ok := i.provider.corruptOffset(i.resume, limit); ok {
+		region.Offset = offset.File
+		key = corruptKey{offset: offset}
+	}
+	i.provider.addRegion(i.shard, key, region)
+	if !next.LT(limit) {
+		return
+	}
+	var nextRef *sam.Reference
+	if next.RefId != biopb.UnmappedRefID {
+		nextRef = refs[next.RefId]
+	}
+	i.resume = next
+	i.iter = i.provider.Provider.NewIterator(bam.Shard{
+		StartRef: nextRef,
+		Start:    int(next.Pos),
+		EndRef:   i.shard.EndRef,
+		End:      i.shard.PaddedEnd(),
+		ShardIdx: i.shard.ShardIdx,
+	})
+}
+
+func (i *skipCorruptIterator) Record() *sam.Record {
+	return i.iter.Record()
+}
+
+func (i *skipCorruptIterator) Err() error {
+	if i.iter != nil {
+		return i.iter.Err()
+	}
+	return nil
+}
+
+func (i *skipCorruptIterator) Close() error {
+	var err error
+	if i.iter != nil {
+		err = i.iter.Close()
+		i.iter = nil
+	}
+	return err
+}
+
+// bamFileProvider reads an indexed bam file like
+// bamprovider.BAMProvider, but each of its iterators reads the file with
+// its own reader. Once one of the iterators of a BAMProvider fails, the
+// BAMProvider fails every later call, so skipCorruptProvider could not
+// read past a corrupt block.
+type bamFileProvider struct {
+	*bamprovider.BAMProvider
+
+	indexOnce sync.Once
+	bindex    *htsbam.Index
+	gindex    *bam.GIndex
+	indexErr  error
+}
+
+// readIndex reads the index of the bam file, once.
+func (p *bamFileProvider) readIndex() error {
+	p.indexOnce.Do(func() {
+		index := p.Index
+		if index == "" {
+			index = p.Path + ".bai"
+		}
+		ctx := vcontext.Background()
+		in, err := file.Open(ctx, index)
+		if err != nil {
+			p.indexErr = err
+			return
+		}
+		if strings.HasSuffix(index, ".gbai") {
+			p.gindex, err = bam.ReadGIndex(in.Reader(ctx))
+		} else {
+			p.bindex, err = htsbam.ReadIndex(in.Reader(ctx))
+		}
+		if err2 := in.Close(ctx); err == nil {
+			err = err2
+		}
+		p.indexErr = err
+	})
+	return p.indexErr
+}
+
+// seekOffset returns the virtual offset of the first record at or after
+// pos on ref, or of the first unmapped record if ref is nil. It may
+// return an earlier offset. It returns false if the records that
+// follow the header should be read instead.
+func (p *bamFileProvider) seekOffset(header *sam.Header, ref *sam.Reference, pos int) (bgzf.Offset, bool, error) {
+	if err := p.readIndex(); err != nil {
+		return bgzf.Offset{}, false, err
+	}
+	for ref != nil {
+		if p.gindex != nil {
+			return p.gindex.RecordOffset(int32(ref.ID()), int32(pos), 0), true, nil
+		}
+		// References without records have no chunks.
+		if chunks, err := p.bindex.Chunks(ref, pos, ref.Len()); err == nil && len(chunks) > 0 {
+			return chunks[0].Begin, true, nil
+		}
+		if ref.ID()+1 < len(header.Refs()) {
+			ref, pos = header.Refs()[ref.ID()+1], 0
+		} else {
+			ref = nil
+		}
+	}
+	if p.gindex != nil {
+		return p.gindex.UnmappedOffset(), true, nil
+	}
+	// The unmapped records follow the last chunk of every reference.
+	var offset bgzf.Offset
+	found := false
+	for _, ref := range header.Refs() {
+		chunks, err := p.bindex.Chunks(ref, 0, ref.Len())
+		if err != nil || len(chunks) == 0 {
+			continue
+		}
+		end := chunks[len(chunks)-1].End
+		if !found || end.File > offset.File || (end.File == offset.File && end.Block > offset.Block) {
+			offset = end
+		}
+		found = true
+	}
+	return offset, found, nil
+}
+
+// NewIterator implements bamprovider.Provider.
+func (p *bamFileProvider) NewIterator(shard bam.Shard) bamprovider.Iterator {
+	header, err := p.GetHeader()
+	if err != nil {
+		return bamprovider.NewErrorIterator(err)
+	}
+	ctx := vcontext.Background()
+	in, err := file.Open(ctx, p.Path)
+	if err != nil {
+		return bamprovider.NewErrorIterator(err)
+	}
+	iter := &bamFileIterator{
+		in:    in,
+		start: bam.NewCoord(shard.StartRef, shard.PaddedStart(), 0),
+		limit: bam.NewCoord(shard.EndRef, shard.PaddedEnd(), 0),
+	}
+	if iter.reader, iter.err = htsbam.NewReader(in.Reader(ctx), 1); iter.err != nil {
+		return iter
+	}
+	offset, ok, err := p.seekOffset(header, shard.StartRef, shard.PaddedStart())
+	if err != nil {
+		iter.err = err
+	} else if ok {
+		iter.err = iter.reader.Seek(offset)
+	}
+	return iter
+}
+
+// bamFileIterator reads the records of a shard from a bam file.
+type bamFileIterator struct {
+	in           file.File
+	reader       *htsbam.Reader
+	start, limit biopb.Coord
+	record       *sam.Record
+	err          error
+}
+
+// Scan implements bamprovider.Iterator.
+func (i *bamFileIterator) Scan() bool {
+	for i.err == nil {
+		i.record, i.err = i.reader.Read()
+		if i.err != nil {
+			return false
+		}
+		coord := bam.CoordFromSAMRecord(i.record, 0)
+		if coord.LT(i.start) {
+			continue
+		}
+		if !coord.LT(i.limit) {
+			i.err = io.EOF
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// Record implements bamprovider.Iterator.
+func (i *bamFileIterator) Record() *sam.Record {
+	return i.record
+}
+
+// Err implements bamprovider.Iterator.
+func (i *bamFileIterator) Err() error {
+	if i.err == io.EOF {
+		return nil
+	}
+	return i.err
+}
+
+// Close implements bamprovider.Iterator.
+func (i *bamFileIterator) Close() error {
+	err := i.Err()
+	if i.reader != nil {
+		if err2 := i.reader.Close(); err == nil {
+			err = err2
+		}
+	}
+	if err2 := i.in.Close(vcontext.Background()); err == nil {
+		err = err2
+	}
+	return err
+}
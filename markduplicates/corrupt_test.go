@@ -0,0 +1,237 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/base/vcontext"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	htsbam "github.com/grailbio/hts/bam"
+	"github.com/grailbio/hts/bgzf"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// corruptProvider returns iterators that fail with bgzf.ErrCorrupt
+// when they reach a record on ref in [start, end).
+type corruptProvider struct {
+	bamprovider.Provider
+	ref        *sam.Reference
+	start, end int
+}
+
+func (p *corruptProvider) NewIterator(shard gbam.Shard) bamprovider.Iterator {
+	return &corruptIterator{Iterator: p.Provider.NewIterator(shard), provider: p}
+}
+
+type corruptIterator struct {
+	bamprovider.Iterator
+	provider *corruptProvider
+	err      error
+}
+
+func (i *corruptIterator) Scan() bool {
+	if i.err != nil || !i.Iterator.Scan() {
+		return false
+	}
+	r := i.Iterator.Record()
+	if r.Ref == i.provider.ref && r.Pos >= i.provider.start && r.Pos < i.provider.end {
+		i.err = bgzf.ErrCorrupt
+		return false
+	}
+	return true
+}
+
+func (i *corruptIterator) Err() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.Iterator.Err()
+}
+
+func (i *corruptIterator) Close() error {
+	if err := i.Iterator.Close(); err != nil {
+		return err
+	}
+	return i.err
+}
+
+func TestParseCorruptBlockPolicy(t *testing.T) {
+	for _, name := range []string{"fail", "skip"} {
+		policy, err := ParseCorruptBlockPolicy(name)
+		assert.NoError(t, err)
+		assert.Equal(t, name, policy.String())
+	}
+	_, err := ParseCorruptBlockPolicy("ignore")
+	assert.Error(t, err)
+}
+
+func TestCorruptBlockSkip(t *testing.T) {
+	newProvider := func() bamprovider.Provider {
+		records := []*sam.Record{
+			NewRecord("A:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("B:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("A:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+			NewRecord("B:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+			NewRecord("C:1:1:1:1:1:1", chr1, 100, r1F, 600, chr1, cigar0),
+			NewRecord("D:1:1:1:1:1:1", chr1, 550, r1F, 560, chr1, cigar0),
+			NewRecord("D:1:1:1:1:1:1", chr1, 560, r2R, 550, chr1, cigar0),
+			NewRecord("C:1:1:1:1:1:1", chr1, 600, r2R, 100, chr1, cigar0),
+			NewRecord("E:1:1:1:1:1:1", chr2, 0, r1F, 10, chr2, cigar0),
+			NewRecord("F:1:1:1:1:1:1", chr2, 0, r1F, 10, chr2, cigar0),
+			NewRecord("E:1:1:1:1:1:1", chr2, 10, r2R, 0, chr2, cigar0),
+			NewRecord("F:1:1:1:1:1:1", chr2, 10, r2R, 0, chr2, cigar0),
+		}
+		return &corruptProvider{bamprovider.NewFakeProvider(header, records), chr1, 500, 700}
+	}
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	opts := defaultOpts
+	opts.OutputPath = NewTestOutput(tempDir, 0, "bam")
+	opts.Format = "bam"
+
+	// By default, the corrupt block fails the run.
+	markDuplicates := &MarkDuplicates{Provider: newProvider(), Opts: &opts}
+	_, err := markDuplicates.Mark(nil)
+	assert.Error(t, err)
+
+	// With the skip policy, chr1 is skipped from C's first read, the
+	// last record read before the corrupt block, to its end. C's first
+	// read is left unmarked, since its mate was skipped.
+	opts.CorruptBlockPolicy = CorruptBlockSkip
+	markDuplicates = &MarkDuplicates{Provider: newProvider(), Opts: &opts}
+	metrics, err := markDuplicates.Mark(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []CorruptRegion{{"chr1", 100, 1000, -1, bgzf.ErrCorrupt.Error()}}, metrics.CorruptRegions)
+	assert.Equal(t, 1, metrics.MissingMates)
+
+	var actual []string
+	for _, r := range ReadRecords(t, opts.OutputPath) {
+		actual = append(actual, fmt.Sprintf("%s %s:%d %v", r.Name[:1], r.Ref.Name(), r.Pos, r.Flags&sam.Duplicate != 0))
+	}
+	assert.Equal(t, []string{
+		"A chr1:0 false",
+		"B chr1:0 true",
+		"A chr1:10 false",
+		"B chr1:10 true",
+		"C chr1:100 false",
+		"E chr2:0 false",
+		"F chr2:0 true",
+		"E chr2:10 false",
+		"F chr2:10 true",
+	}, actual)
+
+	memory := &MemorySink{}
+	opts.MetricsFile = "metrics"
+	opts.Sink = memory
+	assert.NoError(t, writeMetrics(vcontext.Background(), &opts, metrics))
+	b, ok := memory.Get("metrics")
+	assert.True(t, ok)
+	assert.True(t, strings.Contains(string(b), "# corrupt regions skipped: 1, reads with missing mates: 1\n"+
+		"# corrupt region: chr1:101-1000: bgzf: corrupt block\n"), "metrics: %s", b)
+}
+
+func TestCorruptBlockOffset(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	// Write and index a bam file of many bgzf blocks.
+	var records []*sam.Record
+	for pos := 0; pos < 800; pos++ {
+		for i := 0; i < 8; i++ {
+			name := fmt.Sprintf("P%d-%d:1:1:1:1:1:1", pos, i)
+			records = append(records, NewRecord(name, chr1, pos, r1F, pos+100, chr1, cigar0))
+			records = append(records, NewRecord(name, chr1, pos+100, r2R, pos, chr1, cigar0))
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Pos < records[j].Pos })
+	path := filepath.Join(tempDir, "corrupt.bam")
+	writeBAM(t, path, records)
+	in, err := os.Open(path)
+	assert.NoError(t, err)
+	reader, err := htsbam.NewReader(in, 1)
+	assert.NoError(t, err)
+	var index htsbam.Index
+	blockPositions := make(map[int64][]int)
+	for {
+		r, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		chunk := reader.LastChunk()
+		assert.NoError(t, index.Add(r, chunk))
+		blockPositions[chunk.Begin.File] = append(blockPositions[chunk.Begin.File], r.Pos)
+	}
+	assert.NoError(t, reader.Close())
+	assert.NoError(t, in.Close())
+	indexFile, err := os.Create(path + ".bai")
+	assert.NoError(t, err)
+	assert.NoError(t, htsbam.WriteIndex(indexFile, &index))
+	assert.NoError(t, indexFile.Close())
+
+	// Corrupt the header of a block in the middle of chr1.
+	var blocks []int64
+	for block := range blockPositions {
+		blocks = append(blocks, block)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	if !assert.True(t, len(blocks) > 4, "blocks %v", blocks) {
+		return
+	}
+	corrupt := blocks[len(blocks)/2]
+	positions := blockPositions[corrupt]
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte{0, 0}, corrupt)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	// The distant mate scan and both padded shards read the corrupt
+	// block, from different positions, but report it once, at its
+	// offset.
+	mid := (positions[0] + positions[len(positions)-1]) / 2
+	shards := []gbam.Shard{
+		{StartRef: chr1, EndRef: chr1, Start: 0, End: mid, Padding: 10, ShardIdx: 0},
+		{StartRef: chr1, EndRef: chr2, Start: mid, End: 0, Padding: 10, ShardIdx: 1},
+		{StartRef: chr2, EndRef: chr2, Start: 0, End: 2000, Padding: 10, ShardIdx: 2},
+		{StartRef: nil, EndRef: nil, Start: 0, End: math.MaxInt32, ShardIdx: 3},
+	}
+	opts := defaultOpts
+	opts.OutputPath = NewTestOutput(tempDir, 0, "bam")
+	opts.Format = "bam"
+	opts.CorruptBlockPolicy = CorruptBlockSkip
+	markDuplicates := &MarkDuplicates{Provider: bamprovider.NewProvider(path), Opts: &opts}
+	metrics, err := markDuplicates.Mark(shards)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(metrics.CorruptRegions), "regions %v", metrics.CorruptRegions) {
+		region := metrics.CorruptRegions[0]
+		assert.Equal(t, corrupt, region.Offset)
+		assert.Equal(t, "chr1", region.Ref)
+		assert.True(t, region.Start <= positions[0] && region.End > positions[len(positions)-1],
+			"region %v, positions %d-%d", region, positions[0], positions[len(positions)-1])
+		assert.Contains(t, region.String(), fmt.Sprintf(" at byte offset %d: ", corrupt))
+	}
+	assert.NoError(t, markDuplicates.Provider.Close())
+}
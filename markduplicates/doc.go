@@ -90,6 +90,16 @@
   reads.  It is set to "SQ" for optical duplicates, and "LB" for all
   other duplicates.
 
+  With --umi-file, the "tag-confidence" parameter also attaches DC, a
+  float between 0 and 1 that says how unambiguous the umi bag of a
+  read is.  Let e be the number of umi edits between the read's umis
+  and the umis of its bag, whether they come from umi correction or
+  scavenging, and n the number of edits to the closest other bag at the
+  same position.  DC is 1/(1+e) when there is no other bag, 0 when n is
+  at most e, and 1/(1+e) * (n-e)/n otherwise.  A read that needed no
+  edits and has no equally close competitor gets 1, so downstream
+  filters can treat reads with low DC as borderline duplicates.
+
   Implementation:
 
   The implementation splits the input bam file into non-overlapping
@@ -163,6 +173,12 @@
   Clip-padding and pair-padding serve different purposes.
   Clip-padding is for correctness and must exceed the largest clip
   distance in the input file.  Pair-padding is a memory optization.
+  While scanning for distant mates, Mark computes the maximum 5'
+  alignment distance of each library and reports it in the metrics
+  file.  By default, a read whose distance exceeds the clip-padding
+  fails the run; with align-dist-policy=warn, Mark instead logs how
+  many reads exceeded it and continues, which may leave some
+  duplicates unmarked.
   The complete shard diagram looks like this:
 
    shard-pad  clip-pad            shard1            clip-pad   shard-pad
@@ -171,12 +187,206 @@
 
   Output ordering:
 
-  As the workers complete each shard, they output the shard's marked
-  reads to an output queue that preserves the original order of the
-  shards.  A writer reads shards from the queue in order, and writes the
-  records to the bam file output.  The output queue has a maximum size,
-  and when full only allows a worker to insert the shard that the writer
-  currently needs.  This ensures that the queue does not grow too long
-  when a worker takes a long time to process a particular shard.
+  The workers take shards in shard order.  As a worker processes a
+  shard, it splits the shard's marked reads into bgzf blocks, and a pool
+  of --parallelism goroutines compresses the blocks concurrently.  A
+  writer commits the compressed blocks to the bam file output in shard
+  order, and within a shard in block order, as soon as each block is
+  compressed.  The number of buffered blocks is bounded by
+  --queue-length, and when the limit is reached only the worker of the
+  shard that the writer currently needs may add blocks.  This ensures
+  that the buffer does not grow too long when a worker takes a long
+  time to process a particular shard, and that no single goroutine
+  compresses the whole output.
+
+  With --preserve-order, doppelmark guarantees that the output contains
+  every input record in exactly the input order, including records with
+  the same coordinate, and that records differ from the input only in
+  their flags and tags.  Options that remove or rewrite records, such
+  as --remove-dups, subsampling with --max-depth, --fix-mate,
+  --sort-by-name, and a RecordPredicate, which may drop records, are
+  rejected in this mode, and each worker verifies that it wrote every
+  record of its shard.
+
+
+  Estimation:
+
+  With --estimate-fraction, doppelmark skips the distant mate scan,
+  runs duplicate detection on a random sample of that fraction of the
+  mapped shards, chosen using --seed, and writes no output.  It
+  scales the library metrics up by the inverse of the sampled
+  fraction, so the metrics file reports an extrapolated duplication
+  rate and library size.  Because shards are byte-based, each shard
+  holds about the same number of reads.  The estimate ignores
+  unmapped reads, readpairs whose mates lie outside the padded shard,
+  and high-coverage subsampling.
+
+
+  Downsampling:
+
+  With --downsample-fraction, doppelmark keeps a random fraction of the
+  readpairs genome-wide, in the same pass as duplicate marking, so that
+  samples can be normalized to the same depth without a separate
+  samtools view -s pass.  Whether a readpair is kept depends only on
+  its name and --seed, so both reads of a pair, and their secondary and
+  supplementary alignments, are kept or removed together, and a run is
+  reproducible.  Removed readpairs do not appear in the output or the
+  metrics.  Downsampling is independent of high-coverage subsampling,
+  which subsamples to --max-depth the coverage that remains after
+  downsampling.
+
+
+  Sequential mode:
+
+  Shards are normally read in parallel, seeking to each shard with the
+  bam index.  With --sequential, doppelmark reads a coordinate-sorted
+  bam that has no index.  It streams the whole file once from a single
+  reader, chooses the shard boundaries as it reads, and spools the
+  records of each padded shard to a file in --scratch-dir.  The distant
+  mate scan, which reads the shards in parallel and out of order, then
+  reads them from the spool files.  Duplicate marking streams the file
+  again from a single reader, and hands each shard to the workers as
+  soon as it is cut, keeping only the shards being marked and the
+  padding of the next shard in memory.  With --format=pam, marking
+  reads the shards out of order, so it reads them from the spool files
+  instead.  The spool files need about as much disk as the input, and
+  are removed when marking starts, or with --format=pam, when
+  doppelmark exits.  Like the byte-based shards of the indexed mode,
+  each mapped shard holds about --shard-size bytes of records, though
+  measured before compression.
+
+
+  Pass-through references:
+
+  References such as decoys, EBV, or unlocalized contigs can hold many
+  reads that are not worth marking.  Records on the references named
+  by --pass-through-refs, which may be glob patterns, are copied to the
+  output unmodified, in order.  They are hidden from the distant mate
+  scan, so they are never counted for coverage or stored as distant
+  mates, and shards that lie entirely on them are not read until the
+  output is written.  A readpair with one end on a pass-through
+  reference passes through unmarked, like a read that fails the read
+  filter.  Pass-through records are counted in the flagstat output,
+  but not in the library metrics.
+
+
+  Regions:
+
+  --regions restricts marking to a space separated list of
+  samtools-style regions, such as "chr1" or "chr2:1,000-2,000", which
+  is handy for quickly re-marking a single chromosome.  The output
+  holds only the mapped records whose positions fall in the regions.
+  Doppelmark first scans the regions for reads whose mates lie outside
+  them, and then reads only the parts of the input around those mates,
+  using the index.  So each read in the regions gets the same duplicate
+  flags as it would in a full run.  If one of those mates is missing
+  from the input, doppelmark fails, unless --corrupt-block-policy is
+  skip.  The DI tag values may differ from a full run, because they
+  count only the records that were read, and the metrics count only the
+  records in the regions.  --regions requires bam output and an index,
+  and can't be combined with --max-depth, since the coverage outside
+  the regions is unknown.
+
+
+  Unmapped mates:
+
+  An unmapped read whose mate is mapped is placed at its mate's
+  position in a coordinate-sorted bam, but it has no alignment, so it
+  never participates in duplicate detection.  By default it is left
+  unmarked.  With --unmapped-mate-policy=mate, it is marked as a
+  duplicate whenever its mapped mate is, like Picard, and it is
+  removed along with its mate by --remove-dups.  Unmapped reads that
+  were not placed at their mate's position are always left unmarked.
+
+
+  Bag metrics:
+
+  With --bag-metrics, the metrics file gets two more sections about the
+  bags that hold more than one read pair.  The first reports, for each
+  library, the number of such bags and their read pairs, how many of
+  those read pairs have read 1 or read 2 as their left read, and how
+  many bags mix both, which reveals strand bias in the duplicates.
+  The second is a histogram of position jitter, the span of the
+  alignment positions of the left reads in each bag.  Since the reads
+  of a bag share their unclipped 5' positions, jitter comes from
+  differences in clipping, and a wide histogram points to adapter
+  trimming or clipping problems.
+
+
+  UMI collisions:
+
+  With --use-umis, --umi-collisions writes a report of the positions
+  where readpairs with distinct corrected umis share the same duplicate
+  coordinates.  Without umis these would be marked as duplicates of one
+  another, so each such position is a umi collision.  The first section
+  reports, for each library, the number of positions examined, how
+  many are collisions, and the mean and maximum number of distinct umis
+  at a position.  The second lists each collision position with its
+  1-based coordinates, orientation, number of umis and number of
+  readpairs or reads.  A high collision rate means the umi space is
+  close to saturation, and that coordinate+umi keys start merging
+  distinct molecules.
+
+
+  Corrupt input:
+
+  By default, the run fails when part of the input can't be read, for
+  example because a BGZF block fails to decompress.  To salvage a
+  partially corrupted bam, --corrupt-block-policy=skip instead logs
+  the error and the affected region, starting at the last record read
+  before the corruption, and resumes reading 16kb further on, doubling
+  the distance each time the resumed read fails again.  The records in
+  the skipped region are left out of the output, and reads whose mates
+  were skipped are left unmarked.  The metrics file reports the number
+  of skipped regions and of reads with missing mates, and lists each
+  region with its error.  For an indexed bam, doppelmark also finds the
+  corrupt block, and reports each block once, at its byte offset in
+  the file, though the distant mate scan and several padded shards
+  skip it.
+
+
+  Optical distance metric:
+
+  Two duplicate read pairs in the same tile are optical duplicates if
+  their locations are within --optical-distance of each other.  By
+  default the distance is the larger of the x and y distances, like
+  Picard.  --optical-distance-metric=euclidean uses the straight line
+  distance instead, and --optical-distance-metric=manhattan the sum of
+  the x and y distances.  The metrics file records the distance and
+  metric that were used.  The optical histogram and the optical pairs
+  file always report Euclidean distances.
+
+
+  QC thresholds:
+
+  --max-duplication, --max-optical-duplication and
+  --max-high-coverage-bases set QC thresholds on the percent
+  duplication and percent optical duplication of each library, and on
+  the total length of the high-coverage intervals.  When a metric
+  exceeds its threshold, doppelmark still writes the complete output
+  and metrics, but Mark returns a QCError listing the failures, and
+  the command exits with status 3 instead of 0 or 1.  With --qc, the
+  QC status and the failures are also written as json, so pipelines
+  can gate samples without parsing the metrics file.
+
+  RNA-seq:
+
+  With --rna-seq, doppelmark is tuned for spliced alignments.  The
+  unclipped 5' position of a reverse read includes the reference skips
+  (N cigar operations) of its introns, so reads from the same
+  transcript fragment share a duplicate key regardless of their
+  splicing.  --clip-padding does not need to cover the introns: when a
+  spliced reverse read's 5' end is beyond the padding only because of
+  its reference skips, doppelmark records the 5' end while scanning
+  for distant mates, collects the readpairs with a read at that end in
+  one more pass over the input, and gives each shard the readpairs it
+  cannot see, the same way it gives shards their distant mates.  Those
+  readpairs are held in memory.  Reference skips are not counted as
+  covered bases when computing coverage for --max-depth, so introns
+  spanned by many reads are not subsampled as phantom high-coverage
+  intervals.  With --use-splice-junctions, the reference interval of
+  each splice junction is also included in the duplicate key, so reads
+  from the same position with different splicing are not duplicates of
+  each other.
 */
 package markduplicates
@@ -30,12 +30,17 @@ var umiRe = regexp.MustCompile(`([ACGTNacgtn]+)\+([ACGTNacgtn]+)`)
 // If the set has any pairs, the primary will be in pairs[0],
 // otherwise, the primary will be in singles[0].  Each name in
 // opticals will also be in pairs.  This is the externally visible
-// data structure.
+// data structure.  opticalPairs is only populated when
+// opts.OpticalPairsFile is set.
 type duplicateSet struct {
-	pairs     []string
-	singles   []string
-	opticals  []string
-	corrected map[string]string
+	pairs        []string
+	singles      []string
+	opticals     []string
+	opticalPairs []OpticalPair
+	corrected    map[string]string
+	// confidences maps read names to the confidence of their bag
+	// assignment, when opts.TagConfidence is set.
+	confidences map[string]float32
 }
 
 type DuplicateEntry interface {
@@ -114,14 +119,18 @@ type IntermediateDuplicateSet struct {
 }
 
 type umiKey struct {
-	leftRefId   int
-	leftPos     int
-	rightRefId  int
-	rightPos    int
-	Orientation Orientation
-	Strand      strand
-	leftUmi     string
-	rightUmi    string
+	leftRefId      int
+	leftPos        int
+	rightRefId     int
+	rightPos       int
+	Orientation    Orientation
+	Strand         strand
+	readGroup      string
+	barcode        string
+	leftJunctions  string
+	rightJunctions string
+	leftUmi        string
+	rightUmi       string
 }
 
 func (k *umiKey) isSingle() bool {
@@ -149,9 +158,16 @@ type duplicateIndex struct {
 	readGroupLibrary map[string]string
 	queue            []*duplicateSet
 	umiCorrector     *umi.SnapCorrector
+	umiWildcard      *umiWildcardMatcher
 	opts             *Opts
 	bagProcessors    []BagProcessor
 	startedRemoving  bool
+	// umiPositions holds each duplicate position and its number of
+	// distinct umis, when Opts.UmiCollisionsFile is set.
+	umiPositions []*UmiPosition
+	// confidences maps the names of the entries to the confidence of
+	// their bag assignment, when Opts.TagConfidence is set.
+	confidences map[string]float32
 }
 
 // newDuplicateIndex returns a duplicateIndex with the given
@@ -163,13 +179,15 @@ func newDuplicateIndex(
 	header *sam.Header,
 	readGroupLibrary map[string]string,
 	opts *Opts,
-	umiCorrector *umi.SnapCorrector) *duplicateIndex {
+	umiCorrector *umi.SnapCorrector,
+	umiWildcard *umiWildcardMatcher) *duplicateIndex {
 	di := &duplicateIndex{
 		worker:           worker,
 		entries:          make(map[duplicateKey][]DuplicateEntry),
 		readGroupLibrary: readGroupLibrary,
 		queue:            make([]*duplicateSet, 0),
 		umiCorrector:     umiCorrector,
+		umiWildcard:      umiWildcard,
 		opts:             opts,
 	}
 
@@ -185,14 +203,20 @@ func (d *duplicateIndex) insertSingleton(r *sam.Record, fileIdx uint64) {
 		log.Fatalf("cannot insert after started removing")
 	}
 
+	key := d.singleKey(r)
+	d.entries[key] = append(d.entries[key], IndexedSingle{r, fileIdx})
+}
+
+// singleKey returns the duplicateKey of a read that is mate-unmapped.
+func (d *duplicateIndex) singleKey(r *sam.Record) duplicateKey {
 	fivePosition := bam.UnclippedFivePrimePosition(r)
 	orientation := orientationByteSingle(bam.IsReversedRead(r))
 	var s strand
 	if d.opts.StrandSpecific {
 		s = r1Strand(r)
 	}
-	key := duplicateKey{r.Ref.ID(), fivePosition, -1, -1, orientation, s}
-	d.entries[key] = append(d.entries[key], IndexedSingle{r, fileIdx})
+	return duplicateKey{r.Ref.ID(), fivePosition, -1, -1, orientation, s, d.readGroup(r), d.barcode(r),
+		d.junctions(r), ""}
 }
 
 // insert a read pair.  a and b need not be in any particular order;
@@ -214,17 +238,57 @@ func (d *duplicateIndex) insertPair(a, b *sam.Record, aFileIdx, bFileIdx uint64)
 	}
 
 	// Update duplicate set.
+	key := d.pairKey(a, left.R, right.R)
+	d.entries[key] = append(d.entries[key], IndexedPair{left, right})
+}
+
+// pairKey returns the duplicateKey of the readpair left and right,
+// which must be in canonical order. a is either left or right, and
+// determines the strand, read group and barcode of the key.
+func (d *duplicateIndex) pairKey(a, left, right *sam.Record) duplicateKey {
 	var s strand
 	if d.opts.StrandSpecific {
 		s = r1Strand(a)
 	}
-	key := duplicateKey{
-		left.R.Ref.ID(), bam.UnclippedFivePrimePosition(left.R),
-		right.R.Ref.ID(), bam.UnclippedFivePrimePosition(right.R),
-		orientationBytePair(bam.IsReversedRead(left.R), bam.IsReversedRead(right.R)),
+	return duplicateKey{
+		left.Ref.ID(), bam.UnclippedFivePrimePosition(left),
+		right.Ref.ID(), bam.UnclippedFivePrimePosition(right),
+		orientationBytePair(bam.IsReversedRead(left), bam.IsReversedRead(right)),
 		s,
+		d.readGroup(a),
+		d.barcode(a),
+		d.junctions(left),
+		d.junctions(right),
 	}
-	d.entries[key] = append(d.entries[key], IndexedPair{left, right})
+}
+
+// readGroup returns the read group used to confine duplicate sets
+// when opts.SeparateReadGroups is set, and "" otherwise.
+func (d *duplicateIndex) readGroup(r *sam.Record) string {
+	if !d.opts.SeparateReadGroups {
+		return ""
+	}
+	readGroup, _ := getReadGroup(r)
+	return readGroup
+}
+
+// barcode returns the linked-read barcode used to confine duplicate
+// sets when opts.UseBarcodes is set, and "" otherwise.
+func (d *duplicateIndex) barcode(r *sam.Record) string {
+	if !d.opts.UseBarcodes {
+		return ""
+	}
+	return getBarcode(r)
+}
+
+// junctions returns the splice junction signature used to confine
+// duplicate sets when opts.UseSpliceJunctions is set, and ""
+// otherwise.
+func (d *duplicateIndex) junctions(r *sam.Record) string {
+	if !d.opts.UseSpliceJunctions {
+		return ""
+	}
+	return getSpliceJunctions(r)
 }
 
 func ChoosePrimary(entries []DuplicateEntry) int {
@@ -272,7 +336,8 @@ func (d *duplicateIndex) computeDupSets(metrics *MetricsCollection) {
 	// Choose primary & compute opticals.
 	for _, g := range groups {
 		set := duplicateSet{
-			corrected: g.Corrected,
+			corrected:   g.Corrected,
+			confidences: d.confidences,
 		}
 
 		if len(g.Pairs) > 0 {
@@ -286,7 +351,12 @@ func (d *duplicateIndex) computeDupSets(metrics *MetricsCollection) {
 			for _, single := range g.Singles {
 				set.singles = append(set.singles, single.(IndexedSingle).R.Name)
 			}
-			if d.opts.OpticalDetector != nil {
+			if pairDetector, ok := d.opts.OpticalDetector.(OpticalPairDetector); ok && d.opts.OpticalPairsFile != "" {
+				set.opticalPairs = pairDetector.DetectPairs(d.readGroupLibrary, g.Pairs, bestIndex)
+				for _, p := range set.opticalPairs {
+					set.opticals = append(set.opticals, p.Duplicate)
+				}
+			} else if d.opts.OpticalDetector != nil {
 				set.opticals = d.opts.OpticalDetector.Detect(d.readGroupLibrary, g.Pairs, bestIndex)
 			}
 			if len(d.opts.OpticalHistogram) > 0 {
@@ -307,8 +377,8 @@ func (d *duplicateIndex) computeDupSets(metrics *MetricsCollection) {
 }
 
 func (d *duplicateIndex) groupByPosition() []*IntermediateDuplicateSet {
-	getDupSingles := func(refId, pos int, orientation Orientation, strand strand) []DuplicateEntry {
-		k := duplicateKey{refId, pos, -1, -1, orientation, strand}
+	getDupSingles := func(refId, pos int, orientation Orientation, strand strand, readGroup, barcode, junctions string) []DuplicateEntry {
+		k := duplicateKey{refId, pos, -1, -1, orientation, strand, readGroup, barcode, junctions, ""}
 		singles, ok := d.entries[k]
 		if ok {
 			delete(d.entries, k)
@@ -323,8 +393,8 @@ func (d *duplicateIndex) groupByPosition() []*IntermediateDuplicateSet {
 		if !k.isSingle() {
 			singles := make([]DuplicateEntry, 0)
 			if !d.opts.SeparateSingletons {
-				singles = append(getDupSingles(k.leftRefId, k.leftPos, leftOrientation(k.Orientation), k.Strand),
-					getDupSingles(k.rightRefId, k.rightPos, rightOrientation(k.Orientation), k.Strand)...)
+				singles = append(getDupSingles(k.leftRefId, k.leftPos, leftOrientation(k.Orientation), k.Strand, k.readGroup, k.barcode, k.leftJunctions),
+					getDupSingles(k.rightRefId, k.rightPos, rightOrientation(k.Orientation), k.Strand, k.readGroup, k.barcode, k.rightJunctions)...)
 			}
 
 			groups = append(groups, &IntermediateDuplicateSet{
@@ -399,7 +469,7 @@ func (d *duplicateIndex) groupByPositionAndUmi() []*IntermediateDuplicateSet {
 
 			// Put each pair into the duplicate umi map.
 			key := umiKey{k.leftRefId, k.leftPos, k.rightRefId, k.rightPos, k.Orientation,
-				k.Strand, leftUmi, rightUmi}
+				k.Strand, k.readGroup, k.barcode, k.leftJunctions, k.rightJunctions, leftUmi, rightUmi}
 			umiToGroup[key] = append(umiToGroup[key], e)
 
 			// remember which keys were not fully corrected.
@@ -414,11 +484,20 @@ func (d *duplicateIndex) groupByPositionAndUmi() []*IntermediateDuplicateSet {
 			// Attempt to match scavengeCandidates against bags that have known umis.
 			scavenge(scavengeCandidates, knownUmis, umiToGroup)
 		}
+		if d.opts.UmiCollisionsFile != "" || d.opts.TagConfidence {
+			keys := positionUmiKeys(umiToGroup, scavengeCandidates, knownUmis)
+			if d.opts.UmiCollisionsFile != "" {
+				d.umiPositions = append(d.umiPositions, newUmiPosition(d.readGroupLibrary, entries, len(keys)))
+			}
+			if d.opts.TagConfidence {
+				d.addConfidences(umiToGroup, keys)
+			}
+		}
 		delete(d.entries, k)
 	}
 
-	getDupSingles := func(refId, pos int, orientation Orientation, strand strand, umi string) []DuplicateEntry {
-		k := umiKey{refId, pos, -1, -1, orientation, strand, umi, ""}
+	getDupSingles := func(refId, pos int, orientation Orientation, strand strand, readGroup, barcode, junctions, umi string) []DuplicateEntry {
+		k := umiKey{refId, pos, -1, -1, orientation, strand, readGroup, barcode, junctions, "", umi, ""}
 		singles, ok := umiToGroup[k]
 		if ok {
 			delete(umiToGroup, k)
@@ -490,11 +569,11 @@ func (d *duplicateIndex) groupByPositionAndUmi() []*IntermediateDuplicateSet {
 			// Collect matching singles for each read who's umi lacks N.
 			if !strings.ContainsAny(k.leftUmi, "Nn") {
 				singles = append(singles, getDupSingles(k.leftRefId, k.leftPos, leftOrientation(k.Orientation),
-					k.Strand, k.leftUmi)...)
+					k.Strand, k.readGroup, k.barcode, k.leftJunctions, k.leftUmi)...)
 			}
 			if !strings.ContainsAny(k.rightUmi, "Nn") {
 				singles = append(singles, getDupSingles(k.rightRefId, k.rightPos, rightOrientation(k.Orientation),
-					k.Strand, k.rightUmi)...)
+					k.Strand, k.readGroup, k.barcode, k.rightJunctions, k.rightUmi)...)
 			}
 		}
 
@@ -533,8 +612,8 @@ func (d *duplicateIndex) tryCorrectUmis(e DuplicateEntry) (leftUmi, rightUmi str
 	case IndexedPair:
 		leftUmi, rightUmi, _ = getCanonicalUmis(v)
 		if d.umiCorrector != nil {
-			correctedLeftUmi, leftDist, correctedLeft := d.umiCorrector.CorrectUMI(leftUmi)
-			correctedRightUmi, rightDist, correctedRight := d.umiCorrector.CorrectUMI(rightUmi)
+			correctedLeftUmi, leftDist, correctedLeft := d.correctUmi(leftUmi)
+			correctedRightUmi, rightDist, correctedRight := d.correctUmi(rightUmi)
 
 			leftUmi = correctedLeftUmi
 			rightUmi = correctedRightUmi
@@ -547,7 +626,7 @@ func (d *duplicateIndex) tryCorrectUmis(e DuplicateEntry) (leftUmi, rightUmi str
 	case IndexedSingle:
 		leftUmi, _, _ = getCanonicalUmi(v)
 		if d.umiCorrector != nil {
-			correctedUmi, dist, corrected := d.umiCorrector.CorrectUMI(leftUmi)
+			correctedUmi, dist, corrected := d.correctUmi(leftUmi)
 
 			leftUmi = correctedUmi
 			rightUmi = ""
@@ -561,6 +640,19 @@ func (d *duplicateIndex) tryCorrectUmis(e DuplicateEntry) (leftUmi, rightUmi str
 	return
 }
 
+// correctUmi corrects umi with the umiCorrector, or with the
+// umiWildcard if opts.UmiNPolicy is UmiNWildcard and umi contains N.
+// It returns the same values as CorrectUMI.
+func (d *duplicateIndex) correctUmi(umi string) (correctedUmi string, edits int, corrected bool) {
+	if d.opts.UmiNPolicy == UmiNWildcard && strings.ContainsAny(umi, "Nn") {
+		if known, ok := d.umiWildcard.match(umi); ok {
+			return known, strings.Count(strings.ToUpper(umi), "N"), true
+		}
+		return umi, -1, false
+	}
+	return d.umiCorrector.CorrectUMI(umi)
+}
+
 func getUmiField(name string) string {
 	idx := strings.LastIndexByte(name, ':')
 	if idx < 0 {
@@ -583,22 +675,27 @@ func getCanonicalUmis(pair IndexedPair) (leftUmi string, rightUmi string, swappe
 	if umis == nil {
 		log.Fatalf("Could not parse UMI in qname: %s", pair.Left.R.Name)
 	}
+	return canonicalUmis(pair.Left.R, pair.Right.R, umis[1], umis[2])
+}
 
+// canonicalUmis orders the R1 and R2 umis, umi1 and umi2, of the
+// readpair left and right, which must be in canonical order.
+func canonicalUmis(left, right *sam.Record, umi1, umi2 string) (leftUmi string, rightUmi string, swapped bool) {
 	// If it's a tie based on ref, pos, and orientation, then order by umi value.
-	if pair.Left.R.Ref.ID() == pair.Right.R.Ref.ID() &&
-		bam.UnclippedFivePrimePosition(pair.Left.R) == bam.UnclippedFivePrimePosition(pair.Right.R) &&
-		bam.IsReversedRead(pair.Left.R) == bam.IsReversedRead(pair.Right.R) {
-		if strings.Compare(umis[1], umis[2]) < 0 {
-			return umis[1], umis[2], false
+	if left.Ref.ID() == right.Ref.ID() &&
+		bam.UnclippedFivePrimePosition(left) == bam.UnclippedFivePrimePosition(right) &&
+		bam.IsReversedRead(left) == bam.IsReversedRead(right) {
+		if strings.Compare(umi1, umi2) < 0 {
+			return umi1, umi2, false
 		}
-		return umis[2], umis[1], true
+		return umi2, umi1, true
 	}
 
 	// Otheriwse keep the left/right order as given by the pair.
-	if (pair.Left.R.Flags & sam.Read1) != 0 {
-		return umis[1], umis[2], false
+	if (left.Flags & sam.Read1) != 0 {
+		return umi1, umi2, false
 	}
-	return umis[2], umis[1], true
+	return umi2, umi1, true
 }
 
 // getCanonicalUmi returns the UMI associated with read, and also the
@@ -615,6 +712,12 @@ func getCanonicalUmi(read IndexedSingle) (umi string, mateUmi string, swapped bo
 	return umis[2], umis[1], true
 }
 
+// getUmiPositions returns the duplicate positions found by
+// computeDupSets, when Opts.UmiCollisionsFile is set.
+func (d *duplicateIndex) getUmiPositions() []*UmiPosition {
+	return d.umiPositions
+}
+
 // This is the method for outside users.  This will remove and return
 // one set of duplicates.  The duplicateSet might be based on a pair
 // or a singleton.  If there are no more duplicateSets, returns (nil,
@@ -15,8 +15,11 @@ package markduplicates
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/log"
+	"github.com/grailbio/hts/sam"
 )
 
 type Orientation uint8
@@ -33,19 +36,27 @@ const (
 // duplicateKey is a unique key for each group of duplicates.  If both
 // left and right are populated, the left most unclipped 5' position will
 // reside in left.  If only one read is populated, it will reside in left,
-// and .isSingle() returns true.
+// and .isSingle() returns true.  readGroup is only populated when
+// Opts.SeparateReadGroups is set, barcode is only populated when
+// Opts.UseBarcodes is set, and leftJunctions and rightJunctions are
+// only populated when Opts.UseSpliceJunctions is set.
 type duplicateKey struct {
-	leftRefId   int
-	leftPos     int
-	rightRefId  int
-	rightPos    int
-	Orientation Orientation
-	Strand      strand
+	leftRefId      int
+	leftPos        int
+	rightRefId     int
+	rightPos       int
+	Orientation    Orientation
+	Strand         strand
+	readGroup      string
+	barcode        string
+	leftJunctions  string
+	rightJunctions string
 }
 
 func (k *duplicateKey) String() string {
-	return fmt.Sprintf("(%d,%d,%d,%d,0x%x,%d)", k.leftRefId, k.leftPos,
-		k.rightRefId, k.rightPos, k.Orientation, k.Strand)
+	return fmt.Sprintf("(%d,%d,%d,%d,0x%x,%d,%s,%s,%s,%s)", k.leftRefId, k.leftPos,
+		k.rightRefId, k.rightPos, k.Orientation, k.Strand, k.readGroup, k.barcode,
+		k.leftJunctions, k.rightJunctions)
 }
 
 func (k *duplicateKey) isSingle() bool {
@@ -93,3 +104,100 @@ func orientationBytePair(leftReversed, rightReversed bool) Orientation {
 	}
 	return ff
 }
+
+// DuplicateKey is the key that Mark uses to group a read whose mate is
+// unmapped, or a readpair, with its duplicates. Two reads, or two
+// readpairs, are duplicates of each other if their keys are equal, so
+// keys may be compared with ==. Unless opts.SeparateSingletons is set,
+// a read is also a duplicate of a readpair if its key is equal to one
+// of the keys returned by the readpair key's Ends(). Keys only depend
+// on the reads, so they do not reflect any read filters, umi
+// correction, or high-coverage subsampling.
+type DuplicateKey struct {
+	key      duplicateKey
+	leftUmi  string
+	rightUmi string
+}
+
+// GetDuplicateKey returns the DuplicateKey that Mark assigns to a when
+// b is nil, or to the readpair a and b otherwise. a and b need not be
+// in any particular order. The key honors opts.StrandSpecific,
+// opts.SeparateReadGroups, opts.UseBarcodes and
+// opts.UseSpliceJunctions. If opts.UseUmis is set, the key also
+// includes the umis, which are read from umi in the same "R1+R2" format
+// as read names, or from a's name if umi is empty. The umis are not
+// corrected against any known umis.
+func GetDuplicateKey(opts *Opts, a, b *sam.Record, umi string) (DuplicateKey, error) {
+	if a == nil || a.Flags&sam.Unmapped != 0 || (b != nil && b.Flags&sam.Unmapped != 0) {
+		return DuplicateKey{}, errors.E(errors.Invalid, "duplicate keys require mapped reads")
+	}
+	d := &duplicateIndex{opts: opts}
+
+	var umi1, umi2 string
+	if opts.UseUmis {
+		if umi == "" {
+			idx := strings.LastIndexByte(a.Name, ':')
+			if idx < 0 {
+				return DuplicateKey{}, errors.E(errors.Invalid, "could not parse umi in qname:", a.Name)
+			}
+			umi = a.Name[idx+1:]
+		}
+		umis := umiRe.FindStringSubmatch(umi)
+		if umis == nil {
+			return DuplicateKey{}, errors.E(errors.Invalid, "could not parse umi:", umi)
+		}
+		umi1, umi2 = umis[1], umis[2]
+	}
+
+	if b == nil {
+		k := DuplicateKey{key: d.singleKey(a), leftUmi: umi1}
+		if a.Flags&sam.Read1 == 0 {
+			k.leftUmi = umi2
+		}
+		return k, nil
+	}
+	left, right := IndexedSingle{a, 0}, IndexedSingle{b, 0}
+	if !left.lessThan(right) {
+		left, right = right, left
+	}
+	k := DuplicateKey{key: d.pairKey(a, left.R, right.R)}
+	if opts.UseUmis {
+		k.leftUmi, k.rightUmi, _ = canonicalUmis(left.R, right.R, umi1, umi2)
+	}
+	return k, nil
+}
+
+// IsSingle returns true if k is the key of a single read.
+func (k DuplicateKey) IsSingle() bool {
+	return k.key.isSingle()
+}
+
+// Ends returns the keys of single reads that match the left and right
+// reads of the readpair key k. Reads whose umi contains N never match
+// a readpair.
+func (k DuplicateKey) Ends() (left, right DuplicateKey) {
+	if k.IsSingle() {
+		log.Fatalf("Ends called on single key %v", k)
+	}
+	left = DuplicateKey{
+		key: duplicateKey{k.key.leftRefId, k.key.leftPos, -1, -1, leftOrientation(k.key.Orientation),
+			k.key.Strand, k.key.readGroup, k.key.barcode, k.key.leftJunctions, ""},
+		leftUmi: k.leftUmi,
+	}
+	right = DuplicateKey{
+		key: duplicateKey{k.key.rightRefId, k.key.rightPos, -1, -1, rightOrientation(k.key.Orientation),
+			k.key.Strand, k.key.readGroup, k.key.barcode, k.key.rightJunctions, ""},
+		leftUmi: k.rightUmi,
+	}
+	return left, right
+}
+
+func (k DuplicateKey) String() string {
+	if k.leftUmi == "" && k.rightUmi == "" {
+		return k.key.String()
+	}
+	if k.IsSingle() {
+		return fmt.Sprintf("%s:%s", k.key.String(), k.leftUmi)
+	}
+	return fmt.Sprintf("%s:%s+%s", k.key.String(), k.leftUmi, k.rightUmi)
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"testing"
+
+	"github.com/grailbio/hts/sam"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetDuplicateKey(t *testing.T) {
+	key := func(opts Opts, a, b *sam.Record, umi string) DuplicateKey {
+		k, err := GetDuplicateKey(&opts, a, b, umi)
+		assert.NoError(t, err)
+		return k
+	}
+	umiOpts := defaultOpts
+	umiOpts.UseUmis = true
+
+	a1 := NewRecord("A:1:1:1:1:1:1:AAA+CCC", chr1, 0, r1F, 10, chr1, cigar0)
+	a2 := NewRecord("A:1:1:1:1:1:1:AAA+CCC", chr1, 10, r2R, 0, chr1, cigar0)
+	b1 := NewRecord("B:1:1:1:1:1:1:AAA+GGG", chr1, 0, r1F, 10, chr1, cigar0)
+	b2 := NewRecord("B:1:1:1:1:1:1:AAA+GGG", chr1, 10, r2R, 0, chr1, cigar0)
+	c1 := NewRecord("C:1:1:1:1:1:1:AAA+CCC", chr1, 1, r1F, 10, chr1, cigar0)
+	c2 := NewRecord("C:1:1:1:1:1:1:AAA+CCC", chr1, 10, r2R, 1, chr1, cigar0)
+	s := NewRecord("S:1:1:1:1:1:1:AAA+TTT", chr1, 0, s1F, 10, chr1, cigar0)
+
+	// Readpairs are duplicates if they share their 5' positions, in
+	// any order.
+	ka := key(defaultOpts, a1, a2, "")
+	assert.False(t, ka.IsSingle())
+	assert.Equal(t, ka, key(defaultOpts, a2, a1, ""))
+	assert.Equal(t, ka, key(defaultOpts, b2, b1, ""))
+	assert.NotEqual(t, ka, key(defaultOpts, c1, c2, ""))
+
+	// A single read matches the readpair end with the same 5' position.
+	ks := key(defaultOpts, s, nil, "")
+	assert.True(t, ks.IsSingle())
+	left, right := ka.Ends()
+	assert.Equal(t, ks, left)
+	assert.NotEqual(t, ks, right)
+
+	// With umis, the keys also depend on the umis in the read names,
+	// or the given umi.
+	ka = key(umiOpts, a1, a2, "")
+	assert.NotEqual(t, ka, key(umiOpts, b1, b2, ""))
+	assert.Equal(t, ka, key(umiOpts, b1, b2, "AAA+CCC"))
+	left, _ = ka.Ends()
+	assert.Equal(t, left, key(umiOpts, s, nil, ""))
+	assert.NotEqual(t, left, key(umiOpts, s, nil, "GGG+TTT"))
+
+	_, err := GetDuplicateKey(&umiOpts, s, nil, "123")
+	assert.Error(t, err)
+	unmapped := NewRecord("U", nil, -1, sam.Unmapped, -1, nil, nil)
+	_, err = GetDuplicateKey(&defaultOpts, unmapped, nil, "")
+	assert.Error(t, err)
+}
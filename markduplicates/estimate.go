@@ -0,0 +1,110 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/sam"
+)
+
+// sampleShards returns about fraction of the mapped shards in shards,
+// chosen pseudo-randomly using seed, in their original order. It
+// always returns at least one shard if shards contains a mapped shard.
+func sampleShards(shards []bam.Shard, fraction float64, seed int64) []bam.Shard {
+	var mapped []bam.Shard
+	for _, shard := range shards {
+		if shard.StartRef != nil {
+			mapped = append(mapped, shard)
+		}
+	}
+	n := int(fraction*float64(len(mapped)) + 0.5)
+	if n < 1 {
+		n = 1
+	}
+	if n >= len(mapped) {
+		return mapped
+	}
+	perm := rand.New(rand.NewSource(seed)).Perm(len(mapped))[:n]
+	sort.Ints(perm)
+	sample := make([]bam.Shard, n)
+	for i, j := range perm {
+		sample[i] = mapped[j]
+	}
+	return sample
+}
+
+// estimate runs duplicate detection on a sample of
+// Opts.EstimateFraction of the mapped shards without writing any
+// output, and returns library metrics extrapolated to the whole
+// input. This is much faster than Mark because it reads only the
+// sampled shards, but it ignores the unmapped reads, readpairs whose
+// mates are outside the padded shard, and high-coverage subsampling.
+func (m *MarkDuplicates) estimate() (*MetricsCollection, error) {
+	mapped := 0
+	for _, shard := range m.shardList {
+		if shard.StartRef != nil {
+			mapped++
+		}
+	}
+	if mapped == 0 {
+		return nil, errors.E(errors.Invalid, "estimate-fraction is set, but the input has no mapped shards")
+	}
+	sample := sampleShards(m.shardList, m.Opts.EstimateFraction, m.Opts.Seed)
+	log.Printf("estimating duplication from %d of %d mapped shards", len(sample), mapped)
+
+	shardChannel := make(chan bam.Shard, len(sample))
+	for _, shard := range sample {
+		shardChannel <- shard
+	}
+	close(shardChannel)
+
+	e := errors.Once{}
+	var wg sync.WaitGroup
+	for i := 0; i < m.Opts.Parallelism; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for shard := range shardChannel {
+				iter := m.provider.NewIterator(shard)
+				m.processShard(iter, shard, worker, sam.PutInFreePool)
+				if err := iter.Close(); err != nil {
+					e.Set(errors.E(err, "close shard", shard.String()))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := e.Err(); err != nil {
+		return nil, err
+	}
+	m.mergeWorkerMetrics()
+
+	factor := float64(mapped) / float64(len(sample))
+	for library, metrics := range m.globalMetrics.LibraryMetrics {
+		metrics.scale(factor)
+		log.Printf("library %s estimated metrics: %s", library, metrics.String())
+	}
+	for _, lanes := range m.globalMetrics.LaneMetrics {
+		for _, metrics := range lanes {
+			metrics.scale(factor)
+		}
+	}
+	return m.globalMetrics, nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"testing"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampleShards(t *testing.T) {
+	var shards []gbam.Shard
+	for i := 0; i < 10; i++ {
+		shards = append(shards, gbam.Shard{StartRef: chr1, EndRef: chr1, Start: i * 100, End: (i + 1) * 100, ShardIdx: i})
+	}
+	shards = append(shards, gbam.Shard{StartRef: nil, EndRef: nil, ShardIdx: 10})
+
+	sample := sampleShards(shards, 0.3, 1)
+	assert.Equal(t, 3, len(sample))
+	for i, shard := range sample {
+		assert.NotNil(t, shard.StartRef)
+		if i > 0 {
+			assert.True(t, sample[i-1].ShardIdx < shard.ShardIdx)
+		}
+	}
+	assert.Equal(t, sample, sampleShards(shards, 0.3, 1))
+
+	assert.Equal(t, 1, len(sampleShards(shards, 0.01, 1)))
+	assert.Equal(t, shards[:10], sampleShards(shards, 1, 1))
+}
+
+func TestMetricsScale(t *testing.T) {
+	m := Metrics{
+		UnpairedReads:     3,
+		ReadPairsExamined: 10,
+		UnpairedDups:      1,
+		ReadPairDups:      4,
+	}
+	m.scale(2.5)
+	assert.Equal(t, Metrics{
+		UnpairedReads:     8,
+		ReadPairsExamined: 26,
+		UnpairedDups:      3,
+		ReadPairDups:      10,
+	}, m)
+}
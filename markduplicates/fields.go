@@ -0,0 +1,146 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grailbio/bio/encoding/bam"
+)
+
+// FieldPolicy tells Mark whether it may rewrite a field of the output
+// records.
+type FieldPolicy int
+
+const (
+	// FieldAuto rewrites the field when another option, such as
+	// fix-mate, requires it. Unless Opts.EmitUnmodifiedFields is set,
+	// pam output omits the field when it is not modified.
+	FieldAuto FieldPolicy = iota
+	// FieldPreserve emits the field exactly as it is in the input.
+	FieldPreserve
+	// FieldRegenerate recomputes the field of both reads of every
+	// readpair. Only templen supports it.
+	FieldRegenerate
+)
+
+var fieldPolicyNames = []string{"auto", "preserve", "regenerate"}
+
+func (p FieldPolicy) String() string {
+	return fieldPolicyNames[p]
+}
+
+// ParseFieldPolicies parses a comma separated list of field=policy
+// pairs, for example "qual=preserve,templen=regenerate". Each field is
+// one of bam.FieldNames, and each policy is one of "auto", "preserve",
+// or "regenerate".
+func ParseFieldPolicies(s string) (map[bam.FieldType]FieldPolicy, error) {
+	policies := map[bam.FieldType]FieldPolicy{}
+	if s == "" {
+		return policies, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.Split(pair, "=")
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("field policy %s must have the form field=policy", pair)
+		}
+		field, err := bam.ParseFieldType(kv[0])
+		if err != nil {
+			return nil, err
+		}
+		policy, err := parseName("field policy", kv[1], fieldPolicyNames)
+		if err != nil {
+			return nil, err
+		}
+		policies[field] = FieldPolicy(policy)
+	}
+	return policies, nil
+}
+
+// fieldPolicy returns the policy of field in opts.
+func fieldPolicy(opts *Opts, field bam.FieldType) FieldPolicy {
+	return opts.FieldPolicies[field]
+}
+
+// pamDropFields returns the fields that pam output omits because Mark
+// does not modify them.
+func pamDropFields(opts *Opts) []bam.FieldType {
+	if opts.EmitUnmodifiedFields {
+		return nil
+	}
+	var fields []bam.FieldType
+	for _, field := range []bam.FieldType{bam.FieldMapq, bam.FieldName, bam.FieldSeq, bam.FieldQual} {
+		if fieldPolicy(opts, field) == FieldAuto {
+			fields = append(fields, field)
+		}
+	}
+	// FixMate modifies the mate fields.
+	if !opts.FixMate {
+		for _, field := range []bam.FieldType{bam.FieldMateRefID, bam.FieldMatePos, bam.FieldTempLen} {
+			if fieldPolicy(opts, field) == FieldAuto {
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields
+}
+
+// InputDropFields returns the fields that a pam input provider may
+// omit, because Mark neither uses nor modifies them. It omits none
+// when opts.PreserveOrder is set, so that every field of the input
+// reaches the output unchanged.
+func InputDropFields(opts *Opts) []bam.FieldType {
+	if opts.EmitUnmodifiedFields || opts.PreserveOrder {
+		return nil
+	}
+	var fields []bam.FieldType
+	if fieldPolicy(opts, bam.FieldTempLen) != FieldPreserve {
+		fields = append(fields, bam.FieldTempLen)
+	}
+	// The mapq is needed to apply min-mapq.
+	if opts.MinMapQ == 0 && fieldPolicy(opts, bam.FieldMapq) != FieldPreserve {
+		fields = append(fields, bam.FieldMapq)
+	}
+	return fields
+}
+
+// validateFieldPolicies checks that no other option rewrites a field
+// that opts.FieldPolicies preserves.
+func validateFieldPolicies(opts *Opts) error {
+	for field, policy := range opts.FieldPolicies {
+		if policy < FieldAuto || policy > FieldRegenerate {
+			return fmt.Errorf("invalid field policy %d for %s", policy, field)
+		}
+		if policy == FieldRegenerate && field != bam.FieldTempLen {
+			return fmt.Errorf("field-policy can only regenerate templen, not %s", field)
+		}
+		if policy != FieldPreserve {
+			continue
+		}
+		switch field {
+		case bam.FieldFlags:
+			return fmt.Errorf("field-policy cannot preserve flags, which mark duplicates")
+		case bam.FieldMateRefID, bam.FieldMatePos, bam.FieldTempLen:
+			if opts.FixMate {
+				return fmt.Errorf("field-policy preserves %s, but fix-mate modifies it", field)
+			}
+		case bam.FieldAux:
+			if opts.FixMate || opts.TagDups || opts.TagConfidence || opts.ClearExisting {
+				return fmt.Errorf("field-policy preserves aux, but fix-mate, tag-duplicates, tag-confidence and clear-existing modify it")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"testing"
+
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFieldPolicies(t *testing.T) {
+	policies, err := ParseFieldPolicies("qual=preserve,templen=regenerate,aux=auto")
+	assert.NoError(t, err)
+	assert.Equal(t, map[bam.FieldType]FieldPolicy{
+		bam.FieldQual:    FieldPreserve,
+		bam.FieldTempLen: FieldRegenerate,
+		bam.FieldAux:     FieldAuto,
+	}, policies)
+
+	policies, err = ParseFieldPolicies("")
+	assert.NoError(t, err)
+	assert.Empty(t, policies)
+
+	for _, s := range []string{"qual", "qual=keep", "quality=preserve", "qual=preserve,"} {
+		_, err := ParseFieldPolicies(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestPamDropFields(t *testing.T) {
+	opts := Opts{}
+	assert.Equal(t, []bam.FieldType{bam.FieldMapq, bam.FieldName, bam.FieldSeq, bam.FieldQual,
+		bam.FieldMateRefID, bam.FieldMatePos, bam.FieldTempLen}, pamDropFields(&opts))
+
+	opts.FieldPolicies = map[bam.FieldType]FieldPolicy{
+		bam.FieldQual:    FieldPreserve,
+		bam.FieldTempLen: FieldRegenerate,
+	}
+	assert.Equal(t, []bam.FieldType{bam.FieldMapq, bam.FieldName, bam.FieldSeq,
+		bam.FieldMateRefID, bam.FieldMatePos}, pamDropFields(&opts))
+
+	opts.FixMate = true
+	assert.Equal(t, []bam.FieldType{bam.FieldMapq, bam.FieldName, bam.FieldSeq}, pamDropFields(&opts))
+
+	opts.EmitUnmodifiedFields = true
+	assert.Empty(t, pamDropFields(&opts))
+}
+
+func TestInputDropFields(t *testing.T) {
+	opts := Opts{}
+	assert.Equal(t, []bam.FieldType{bam.FieldTempLen, bam.FieldMapq}, InputDropFields(&opts))
+
+	opts.MinMapQ = 20
+	assert.Equal(t, []bam.FieldType{bam.FieldTempLen}, InputDropFields(&opts))
+
+	// Preserving the order must give the input back unchanged.
+	opts.PreserveOrder = true
+	assert.Empty(t, InputDropFields(&opts))
+}
+
+func TestValidateFieldPolicies(t *testing.T) {
+	for _, test := range []struct {
+		field  bam.FieldType
+		policy FieldPolicy
+		opts   Opts
+		ok     bool
+	}{
+		{bam.FieldQual, FieldPreserve, Opts{}, true},
+		{bam.FieldQual, FieldRegenerate, Opts{}, false},
+		{bam.FieldTempLen, FieldRegenerate, Opts{FixMate: true}, true},
+		{bam.FieldTempLen, FieldPreserve, Opts{FixMate: true}, false},
+		{bam.FieldFlags, FieldPreserve, Opts{}, false},
+		{bam.FieldAux, FieldPreserve, Opts{}, true},
+		{bam.FieldAux, FieldPreserve, Opts{TagDups: true}, false},
+		{bam.FieldAux, FieldPreserve, Opts{TagConfidence: true}, false},
+	} {
+		test.opts.FieldPolicies = map[bam.FieldType]FieldPolicy{test.field: test.policy}
+		err := validateFieldPolicies(&test.opts)
+		assert.Equal(t, test.ok, err == nil, "%s=%s: %v", test.field, test.policy, err)
+	}
+}
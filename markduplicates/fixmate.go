@@ -0,0 +1,256 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+)
+
+// fixMate repairs the mate information of a and b, which must be the
+// two mapped reads of a readpair, similar to samtools fixmate. It sets
+// each read's mate reference, mate position, mate reverse and mate
+// unmapped flags, and MC tag from the other read, and recomputes the
+// template length of both reads.
+func fixMate(a, b *sam.Record) {
+	syncMate(a, b)
+	syncMate(b, a)
+	fixTempLen(a, b)
+}
+
+// fixTempLen recomputes the template length of a and b, which must be
+// the two mapped reads of a readpair.
+func fixTempLen(a, b *sam.Record) {
+	// The template length spans from the leftmost mapped base to the
+	// rightmost mapped base. The leftmost read gets a positive value
+	// and the other read a negative value.
+	if a.Ref.ID() != b.Ref.ID() {
+		a.TempLen = 0
+		b.TempLen = 0
+		return
+	}
+	start := min(a.Pos, b.Pos)
+	end := a.End()
+	if b.End() > end {
+		end = b.End()
+	}
+	tlen := end - start
+	if a.Pos < b.Pos || (a.Pos == b.Pos && a.Flags&sam.Read1 != 0) {
+		a.TempLen, b.TempLen = tlen, -tlen
+	} else {
+		a.TempLen, b.TempLen = -tlen, tlen
+	}
+}
+
+// syncMate copies the mate information from mate into r.
+func syncMate(r, mate *sam.Record) {
+	setMate(r, newMateInfo(mate))
+
+	bam.ClearAuxTags(r, []sam.Tag{mcTag})
+	if len(mate.Cigar) > 0 {
+		aux, err := sam.NewAux(mcTag, mate.Cigar.String())
+		if err != nil {
+			log.Fatalf("error creating MC:Z:%s tag: %v", mate.Cigar.String(), err)
+		}
+		r.AuxFields = append(r.AuxFields, aux)
+	}
+}
+
+// mateInfo is the position, and the unmapped and reverse flags, of a
+// read, as recorded in its mate's mate fields.
+type mateInfo struct {
+	ref   *sam.Reference
+	pos   int
+	flags sam.Flags
+}
+
+// newMateInfo returns the mateInfo of r.
+func newMateInfo(r *sam.Record) mateInfo {
+	return mateInfo{r.Ref, r.Pos, r.Flags & (sam.Unmapped | sam.Reverse)}
+}
+
+// setMate sets the mate reference, mate position, and mate unmapped and
+// mate reverse flags of r to mate.
+func setMate(r *sam.Record, mate mateInfo) {
+	r.MateRef = mate.ref
+	r.MatePos = mate.pos
+	if mate.flags&sam.Unmapped != 0 {
+		r.Flags |= sam.MateUnmapped
+	} else {
+		r.Flags &^= sam.MateUnmapped
+	}
+	if mate.flags&sam.Reverse != 0 {
+		r.Flags |= sam.MateReverse
+	} else {
+		r.Flags &^= sam.MateReverse
+	}
+}
+
+// recordedMate returns the mateInfo of r's mate as recorded in r.
+func recordedMate(r *sam.Record) mateInfo {
+	flags := sam.Flags(0)
+	if r.Flags&sam.MateUnmapped != 0 {
+		flags |= sam.Unmapped
+	}
+	if r.Flags&sam.MateReverse != 0 {
+		flags |= sam.Reverse
+	}
+	return mateInfo{r.MateRef, r.MatePos, flags}
+}
+
+// fixMateEntry is a primary read waiting to be paired with its mate.
+type fixMateEntry struct {
+	// actual is the read's own position and flags.
+	actual mateInfo
+	// recorded is the position and flags of the read's mate according
+	// to the read's mate fields.
+	recorded mateInfo
+}
+
+// findMateFixes pairs the primary reads in shards by name and read1
+// flag, regardless of their mate fields, and returns the mate of each
+// read whose mate fields disagree with its mate, keyed by the read's
+// name and read1 flag. Most mates are paired within a shard, and only
+// the rest are kept until all shards are read, so the memory use is
+// similar to the distant mate table's.
+func (m *MarkDuplicates) findMateFixes(provider bamprovider.Provider, shards []bam.Shard) (map[mateKey]mateInfo, error) {
+	fixes := make(map[mateKey]mateInfo)
+	unpaired := make(map[mateKey]fixMateEntry)
+	var mutex sync.Mutex
+	// pair compares the mate fields of two reads of a readpair against
+	// each other. It must be called with mutex held.
+	pair := func(name string, read1, read2 fixMateEntry) {
+		if read1.recorded != read2.actual {
+			fixes[mateKey{name, true}] = read2.actual
+		}
+		if read2.recorded != read1.actual {
+			fixes[mateKey{name, false}] = read1.actual
+		}
+	}
+
+	shardChannel := make(chan bam.Shard, len(shards))
+	for _, shard := range shards {
+		shardChannel <- shard
+	}
+	close(shardChannel)
+	e := errors.Once{}
+	var wg sync.WaitGroup
+	for i := 0; i < m.Opts.Parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for shard := range shardChannel {
+				local := make(map[mateKey]fixMateEntry)
+				iter := provider.NewIterator(shard)
+				for iter.Scan() {
+					r := iter.Record()
+					if shard.RecordInShard(r) && r.Flags&sam.Paired != 0 &&
+						r.Flags&(sam.Secondary|sam.Supplementary) == 0 &&
+						!isPassThroughRef(m.passThrough, r.Ref) && !isPassThroughRef(m.passThrough, r.MateRef) {
+						entry := fixMateEntry{newMateInfo(r), recordedMate(r)}
+						read1 := r.Flags&sam.Read1 != 0
+						if mate, ok := local[mateKey{r.Name, !read1}]; ok {
+							delete(local, mateKey{r.Name, !read1})
+							mutex.Lock()
+							if read1 {
+								pair(r.Name, entry, mate)
+							} else {
+								pair(r.Name, mate, entry)
+							}
+							mutex.Unlock()
+						} else {
+							local[mateKey{r.Name, read1}] = entry
+						}
+					}
+					sam.PutInFreePool(r)
+				}
+				if err := iter.Close(); err != nil {
+					e.Set(errors.E(err, "fix-mate scan of shard", shard.String()))
+				}
+
+				// Pair the reads whose mates are in other shards.
+				mutex.Lock()
+				for key, entry := range local {
+					other := mateKey{key.name, !key.read1}
+					mate, ok := unpaired[other]
+					if !ok {
+						unpaired[key] = entry
+						continue
+					}
+					delete(unpaired, other)
+					if key.read1 {
+						pair(key.name, entry, mate)
+					} else {
+						pair(key.name, mate, entry)
+					}
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if err := e.Err(); err != nil {
+		return nil, err
+	}
+	if len(unpaired) > 0 {
+		log.Error.Printf("fix-mate could not find the mates of %d reads", len(unpaired))
+	}
+	log.Debug.Printf("fix-mate found %d reads with mate fields that disagree with their mates", len(fixes))
+	return fixes, nil
+}
+
+// fixMateProvider is a Provider whose iterators set the mate fields of
+// the reads in fixes to their mates' actual positions and flags, so
+// that the distant mate scan and processShard find each read's mate.
+// The template length and MC tag are recomputed by fixMate once the
+// reads are paired.
+type fixMateProvider struct {
+	bamprovider.Provider
+	fixes map[mateKey]mateInfo
+}
+
+func (p *fixMateProvider) NewIterator(shard bam.Shard) bamprovider.Iterator {
+	return &fixMateIterator{Iterator: p.Provider.NewIterator(shard), fixes: p.fixes}
+}
+
+type fixMateIterator struct {
+	bamprovider.Iterator
+	fixes  map[mateKey]mateInfo
+	record *sam.Record
+}
+
+func (i *fixMateIterator) Scan() bool {
+	if !i.Iterator.Scan() {
+		return false
+	}
+	r := i.Iterator.Record()
+	i.record = r
+	if r.Flags&(sam.Secondary|sam.Supplementary) == 0 {
+		if mate, ok := i.fixes[mateKey{r.Name, r.Flags&sam.Read1 != 0}]; ok {
+			setMate(r, mate)
+			if r.Flags&(sam.Unmapped|sam.MateUnmapped) != 0 {
+				r.TempLen = 0
+				bam.ClearAuxTags(r, []sam.Tag{mcTag})
+			}
+		}
+	}
+	return true
+}
+
+func (i *fixMateIterator) Record() *sam.Record { return i.record }
@@ -0,0 +1,157 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grailbio/hts/sam"
+)
+
+// Flagstat contains the same counts as samtools flagstat, computed
+// over the records written to the output. Each count has two
+// elements, the first for QC-passed reads, and the second for
+// QC-failed reads.
+type Flagstat struct {
+	Total             [2]int
+	Primary           [2]int
+	Secondary         [2]int
+	Supplementary     [2]int
+	Duplicates        [2]int
+	PrimaryDuplicates [2]int
+	Mapped            [2]int
+	PrimaryMapped     [2]int
+	Paired            [2]int
+	Read1             [2]int
+	Read2             [2]int
+	ProperlyPaired    [2]int
+	BothMapped        [2]int
+	Singletons        [2]int
+	MateDiffChr       [2]int
+	// MateDiffChrMapQ5 requires mapping qualities, so it is always
+	// zero for pam input when the mapq field is dropped.
+	MateDiffChrMapQ5 [2]int
+}
+
+// add updates f with record r, following samtools flagstat.
+func (f *Flagstat) add(r *sam.Record) {
+	w := 0
+	if r.Flags&sam.QCFail != 0 {
+		w = 1
+	}
+	f.Total[w]++
+	if r.Flags&sam.Secondary != 0 {
+		f.Secondary[w]++
+	} else if r.Flags&sam.Supplementary != 0 {
+		f.Supplementary[w]++
+	} else {
+		f.Primary[w]++
+		if r.Flags&sam.Paired != 0 {
+			f.Paired[w]++
+			if r.Flags&sam.ProperPair != 0 && r.Flags&sam.Unmapped == 0 {
+				f.ProperlyPaired[w]++
+			}
+			if r.Flags&sam.Read1 != 0 {
+				f.Read1[w]++
+			}
+			if r.Flags&sam.Read2 != 0 {
+				f.Read2[w]++
+			}
+			if r.Flags&sam.MateUnmapped != 0 && r.Flags&sam.Unmapped == 0 {
+				f.Singletons[w]++
+			}
+			if r.Flags&sam.Unmapped == 0 && r.Flags&sam.MateUnmapped == 0 {
+				f.BothMapped[w]++
+				if r.Ref.ID() != r.MateRef.ID() {
+					f.MateDiffChr[w]++
+					if r.MapQ >= 5 {
+						f.MateDiffChrMapQ5[w]++
+					}
+				}
+			}
+		}
+		if r.Flags&sam.Unmapped == 0 {
+			f.PrimaryMapped[w]++
+		}
+		if r.Flags&sam.Duplicate != 0 {
+			f.PrimaryDuplicates[w]++
+		}
+	}
+	if r.Flags&sam.Unmapped == 0 {
+		f.Mapped[w]++
+	}
+	if r.Flags&sam.Duplicate != 0 {
+		f.Duplicates[w]++
+	}
+}
+
+// Add adds the counts in other to f.
+func (f *Flagstat) Add(other *Flagstat) {
+	for w := 0; w < 2; w++ {
+		f.Total[w] += other.Total[w]
+		f.Primary[w] += other.Primary[w]
+		f.Secondary[w] += other.Secondary[w]
+		f.Supplementary[w] += other.Supplementary[w]
+		f.Duplicates[w] += other.Duplicates[w]
+		f.PrimaryDuplicates[w] += other.PrimaryDuplicates[w]
+		f.Mapped[w] += other.Mapped[w]
+		f.PrimaryMapped[w] += other.PrimaryMapped[w]
+		f.Paired[w] += other.Paired[w]
+		f.Read1[w] += other.Read1[w]
+		f.Read2[w] += other.Read2[w]
+		f.ProperlyPaired[w] += other.ProperlyPaired[w]
+		f.BothMapped[w] += other.BothMapped[w]
+		f.Singletons[w] += other.Singletons[w]
+		f.MateDiffChr[w] += other.MateDiffChr[w]
+		f.MateDiffChrMapQ5[w] += other.MateDiffChrMapQ5[w]
+	}
+}
+
+// String returns f in the samtools flagstat text format.
+func (f *Flagstat) String() string {
+	percent := func(n, total [2]int) string {
+		s := make([]string, 2)
+		for w := range s {
+			if total[w] == 0 {
+				s[w] = "N/A"
+			} else {
+				s[w] = fmt.Sprintf("%.2f%%", 100*float64(n[w])/float64(total[w]))
+			}
+		}
+		return fmt.Sprintf(" (%s : %s)", s[0], s[1])
+	}
+
+	var b strings.Builder
+	line := func(n [2]int, desc string) {
+		fmt.Fprintf(&b, "%d + %d %s\n", n[0], n[1], desc)
+	}
+	line(f.Total, "in total (QC-passed reads + QC-failed reads)")
+	line(f.Primary, "primary")
+	line(f.Secondary, "secondary")
+	line(f.Supplementary, "supplementary")
+	line(f.Duplicates, "duplicates")
+	line(f.PrimaryDuplicates, "primary duplicates")
+	line(f.Mapped, "mapped"+percent(f.Mapped, f.Total))
+	line(f.PrimaryMapped, "primary mapped"+percent(f.PrimaryMapped, f.Primary))
+	line(f.Paired, "paired in sequencing")
+	line(f.Read1, "read1")
+	line(f.Read2, "read2")
+	line(f.ProperlyPaired, "properly paired"+percent(f.ProperlyPaired, f.Paired))
+	line(f.BothMapped, "with itself and mate mapped")
+	line(f.Singletons, "singletons"+percent(f.Singletons, f.Paired))
+	line(f.MateDiffChr, "with mate mapped to a different chr")
+	line(f.MateDiffChrMapQ5, "with mate mapped to a different chr (mapQ>=5)")
+	return b.String()
+}
@@ -14,6 +14,10 @@
 package markduplicates
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/base/simd"
 	"github.com/grailbio/bio/encoding/bam"
@@ -29,6 +33,9 @@ var (
 	dsTag = sam.Tag{'D', 'S'}
 	dtTag = sam.Tag{'D', 'T'}
 	duTag = sam.Tag{'D', 'U'}
+	dcTag = sam.Tag{'D', 'C'}
+	mcTag = sam.Tag{'M', 'C'}
+	bxTag = sam.Tag{'B', 'X'}
 )
 
 func mateInPaddedShard(shard *bam.Shard, r *sam.Record) bool {
@@ -49,6 +56,33 @@ func min(x, y int) int {
 	return y
 }
 
+// passesReadFilter returns true if r should participate in duplicate
+// detection according to opts.MinMapQ, opts.IncludeFlags and
+// opts.ExcludeFlags.
+func passesReadFilter(opts *Opts, r *sam.Record) bool {
+	return int(r.MapQ) >= opts.MinMapQ &&
+		r.Flags&opts.IncludeFlags == opts.IncludeFlags &&
+		r.Flags&opts.ExcludeFlags == 0
+}
+
+// parseName returns the index of name in names, the names of the values
+// of an option. kind describes the option in the error, if name is
+// not one of names.
+func parseName(kind, name string, names []string) (int, error) {
+	for i, n := range names {
+		if name == n {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown %s %s, expected one of %s", kind, name, strings.Join(names, ", "))
+}
+
+// participates returns true if r passes the read filter and
+// opts.RecordPredicate returns Process for r.
+func participates(opts *Opts, r *sam.Record) bool {
+	return passesReadFilter(opts, r) && (opts.RecordPredicate == nil || opts.RecordPredicate(r) == Process)
+}
+
 func baseQScore(r *sam.Record) int {
 	s := simd.Accumulate8Greater(r.Qual, 14)
 	s = min(s, 32767/2) // use the same clamping as picard
@@ -66,6 +100,39 @@ func getReadGroup(r *sam.Record) (string, bool) {
 	return aux.Value().(string), true
 }
 
+// getBarcode returns the linked-read barcode in r's BX tag, or "" if
+// r has no BX tag.
+func getBarcode(r *sam.Record) string {
+	aux := r.AuxFields.Get(bxTag)
+	if aux == nil {
+		return ""
+	}
+	barcode, _ := aux.Value().(string)
+	return barcode
+}
+
+// getSpliceJunctions returns the splice junctions in r's cigar as a
+// comma separated list of 0-based half-open reference intervals, for
+// example "100-250,300-410", or "" if r has no reference skips.
+func getSpliceJunctions(r *sam.Record) string {
+	var b strings.Builder
+	pos := r.Pos
+	for _, co := range r.Cigar {
+		if co.Type() == sam.CigarSkipped {
+			if b.Len() > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(strconv.Itoa(pos))
+			b.WriteByte('-')
+			b.WriteString(strconv.Itoa(pos + co.Len()))
+		}
+		if co.Type().Consumes().Reference == 1 {
+			pos += co.Len()
+		}
+	}
+	return b.String()
+}
+
 // GetLibrary returns the library for the given record's read group.
 // If the library is not defined in readGroupLibrary, returns "Unknown
 // Library".
@@ -87,7 +154,7 @@ func GetLibrary(readGroupLibrary map[string]string, record *sam.Record) string {
 func clearDupFlagTags(r *sam.Record) {
 	r.Flags &^= sam.Duplicate
 
-	tagsToRemove := []sam.Tag{diTag, dlTag, dsTag, dtTag, duTag}
+	tagsToRemove := []sam.Tag{diTag, dlTag, dsTag, dtTag, duTag, dcTag}
 	bam.ClearAuxTags(r, tagsToRemove)
 }
 
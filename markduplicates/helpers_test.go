@@ -54,3 +54,26 @@ func TestClearDupFlagTags(t *testing.T) {
 		assert.Equal(t, aux, r.AuxFields[i])
 	}
 }
+
+func TestGetSpliceJunctions(t *testing.T) {
+	for _, test := range []struct {
+		cigar    []sam.CigarOp
+		expected string
+	}{
+		{[]sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 10)}, ""},
+		{[]sam.CigarOp{
+			sam.NewCigarOp(sam.CigarSoftClipped, 2),
+			sam.NewCigarOp(sam.CigarMatch, 3),
+			sam.NewCigarOp(sam.CigarSkipped, 100),
+			sam.NewCigarOp(sam.CigarMatch, 2),
+			sam.NewCigarOp(sam.CigarDeletion, 1),
+			sam.NewCigarOp(sam.CigarInsertion, 4),
+			sam.NewCigarOp(sam.CigarMatch, 1),
+			sam.NewCigarOp(sam.CigarSkipped, 50),
+			sam.NewCigarOp(sam.CigarMatch, 5),
+		}, "13-113,117-167"},
+	} {
+		r := NewRecord("A", chr1, 10, r1F, 20, chr1, test.cigar)
+		assert.Equal(t, test.expected, getSpliceJunctions(r))
+	}
+}
@@ -1,23 +1,61 @@
 package markduplicates
 
 import (
+	"sync"
+
+	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/intervalmap"
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bampair"
+	"github.com/grailbio/bio/encoding/bamprovider"
 	"github.com/grailbio/hts/sam"
 )
 
-type coverageInterval struct {
-	refId        int
-	start        int
-	end          int
-	meanCoverage float64
+// CoverageInterval is a 0-based, half-open reference interval whose
+// per-base coverage exceeds the maximum depth, along with its mean
+// coverage.
+type CoverageInterval struct {
+	RefId        int
+	Start        int
+	End          int
+	MeanCoverage float64
+}
+
+// HighCoverageReads counts the reads that Mark subsamples in a
+// high-coverage interval. A read is counted in the interval that
+// contains either its position or its mate's position, whichever has
+// the higher mean coverage.
+type HighCoverageReads struct {
+	// Reads is the number of reads observed in the interval.
+	Reads int
+	// Removed is the number of those reads removed by subsampling.
+	Removed int
+}
+
+// Add adds the counts in other to r.
+func (r *HighCoverageReads) Add(other *HighCoverageReads) {
+	r.Reads += other.Reads
+	r.Removed += other.Removed
+}
+
+// subsampledCoverage estimates the mean coverage of interval after
+// subsampling, assuming the removed reads covered the interval as
+// much as the remaining ones.
+func (r *HighCoverageReads) subsampledCoverage(interval CoverageInterval) float64 {
+	if r.Reads == 0 {
+		return interval.MeanCoverage
+	}
+	return interval.MeanCoverage * float64(r.Reads-r.Removed) / float64(r.Reads)
 }
 
 // coverageCalculator calculates the per-base coverage from within GetDistantMates.
 // It writes the coverage counts to coverageCounts.
 type coverageCalculator struct {
 	coverageCounts *map[int][]int
+	// excludeSkips, if set, does not count bases in reference skips
+	// (N cigar operations) as covered, e.g. introns in spliced reads.
+	excludeSkips bool
 }
 
 func (m *coverageCalculator) Process(shard bam.Shard, r *sam.Record) error {
@@ -51,9 +89,12 @@ func (m *coverageCalculator) Process(shard bam.Shard, r *sam.Record) error {
 	offset := 0
 	for _, co := range r.Cigar {
 		if co.Type().Consumes().Reference == 1 {
+			skip := m.excludeSkips && co.Type() == sam.CigarSkipped
 			for i := 0; i < co.Len() && counted < basesInShard && pos+offset < r.Ref.Len(); i++ {
 				if offset >= basesPreShard {
-					(*m.coverageCounts)[r.Ref.ID()][pos+offset]++
+					if !skip {
+						(*m.coverageCounts)[r.Ref.ID()][pos+offset]++
+					}
 					counted++
 				}
 				offset++
@@ -65,11 +106,89 @@ func (m *coverageCalculator) Process(shard bam.Shard, r *sam.Record) error {
 
 func (m *coverageCalculator) Close(_ bam.Shard) {}
 
+// newCoverageCounts returns zeroed per-base coverage counts for each
+// reference in header.
+func newCoverageCounts(header *sam.Header) map[int][]int {
+	coverageCounts := make(map[int][]int, len(header.Refs()))
+	for _, ref := range header.Refs() {
+		coverageCounts[ref.ID()] = make([]int, ref.Len())
+	}
+	return coverageCounts
+}
+
+// ComputeHighCoverageIntervals computes the per-base coverage of the input
+// in provider, and returns the intervals where the coverage is higher
+// than opts.CoverageMax, sorted by refId and then position. It
+// computes the same intervals that Mark uses to subsample reads, but
+// does not mark duplicates, so it also works on inputs that are
+// already marked or deduplicated. It honors opts.Parallelism,
+// opts.ShardSize, opts.MinBases, opts.Padding,
+// opts.CoverageExcludeSkips and the records that opts.RecordPredicate
+// drops.
+func ComputeHighCoverageIntervals(provider bamprovider.Provider, opts *Opts) ([]CoverageInterval, error) {
+	if opts.CoverageMax <= 0 {
+		return nil, errors.E(errors.Invalid, "max-depth must be positive to compute high coverage intervals")
+	}
+	header, err := provider.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	shards, err := generateShards(provider, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	shardChannel := make(chan bam.Shard, len(shards))
+	for _, shard := range shards {
+		if shard.StartRef != nil {
+			shardChannel <- shard
+		}
+	}
+	close(shardChannel)
+
+	// Shards do not overlap, so each worker increments different
+	// counters.
+	coverageCounts := newCoverageCounts(header)
+	e := errors.Once{}
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var c bampair.RecordProcessor = &coverageCalculator{
+				coverageCounts: &coverageCounts,
+				excludeSkips:   opts.CoverageExcludeSkips,
+			}
+			if opts.RecordPredicate != nil {
+				c = &dropFilter{c, opts.RecordPredicate}
+			}
+			for shard := range shardChannel {
+				iter := provider.NewIterator(shard)
+				for iter.Scan() {
+					r := iter.Record()
+					if err := c.Process(shard, r); err != nil {
+						e.Set(err)
+					}
+					sam.PutInFreePool(r)
+				}
+				if err := iter.Close(); err != nil {
+					e.Set(errors.E(err, "close shard", shard.String()))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := e.Err(); err != nil {
+		return nil, err
+	}
+	return getHighCoverageIntervals(coverageCounts, opts.CoverageMax), nil
+}
+
 // getHighCoverageIntervals takes the coverageCounts computed by coverageCalculator
 // and returns a slice of coverageIntervals where the coverage is higher than maxCoverage.
 // The output is sorted by refId and then position.
-func getHighCoverageIntervals(coverage map[int][]int, maxCoverage int) []coverageInterval {
-	highCovIntervals := make([]coverageInterval, 0)
+func getHighCoverageIntervals(coverage map[int][]int, maxCoverage int) []CoverageInterval {
+	highCovIntervals := make([]CoverageInterval, 0)
 	for refId := 0; refId < len(coverage); refId++ {
 		refCoverage := coverage[refId]
 		var start, end, total int
@@ -83,11 +202,11 @@ func getHighCoverageIntervals(coverage map[int][]int, maxCoverage int) []coverag
 				total += refCoverage[pos]
 				if pos == len(refCoverage)-1 {
 					end = pos + 1
-					highCovIntervals = append(highCovIntervals, coverageInterval{
-						refId:        refId,
-						start:        start,
-						end:          end,
-						meanCoverage: float64(total) / float64(end-start),
+					highCovIntervals = append(highCovIntervals, CoverageInterval{
+						RefId:        refId,
+						Start:        start,
+						End:          end,
+						MeanCoverage: float64(total) / float64(end-start),
 					})
 					log.Printf("highcoverage range: %d %d-%d depth %f", refId, start, end,
 						float64(total)/float64(end-start))
@@ -96,11 +215,11 @@ func getHighCoverageIntervals(coverage map[int][]int, maxCoverage int) []coverag
 			if refCoverage[pos] <= maxCoverage {
 				if pos > 0 && refCoverage[pos-1] > maxCoverage {
 					end = pos
-					highCovIntervals = append(highCovIntervals, coverageInterval{
-						refId:        refId,
-						start:        start,
-						end:          end,
-						meanCoverage: float64(total) / float64(end-start),
+					highCovIntervals = append(highCovIntervals, CoverageInterval{
+						RefId:        refId,
+						Start:        start,
+						End:          end,
+						MeanCoverage: float64(total) / float64(end-start),
 					})
 					log.Printf("highcoverage range: %d %d-%d depth %f", refId, start, end,
 						float64(total)/float64(end-start))
@@ -117,17 +236,17 @@ type coverageMap map[int]*intervalmap.T
 
 // getCoverageMap returns a coverageMap that allows efficient
 // intersection calls, given a slice of coverageIntervals.
-func getCoverageMap(intervals []coverageInterval) coverageMap {
+func getCoverageMap(intervals []CoverageInterval) coverageMap {
 	allEntries := make(map[int][]intervalmap.Entry)
 	for _, interval := range intervals {
-		allEntries[interval.refId] = append(
-			allEntries[interval.refId],
+		allEntries[interval.RefId] = append(
+			allEntries[interval.RefId],
 			intervalmap.Entry{
 				Interval: intervalmap.Interval{
-					Start: int64(interval.start),
-					Limit: int64(interval.end),
+					Start: int64(interval.Start),
+					Limit: int64(interval.End),
 				},
-				Data: interval.meanCoverage,
+				Data: interval,
 			})
 	}
 
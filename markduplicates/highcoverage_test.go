@@ -2,9 +2,11 @@ package markduplicates
 
 import (
 	"fmt"
+	"io/ioutil"
 	"path/filepath"
 	"testing"
 
+	"github.com/grailbio/base/vcontext"
 	gbam "github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/bio/encoding/bamprovider"
 	"github.com/grailbio/hts/sam"
@@ -54,7 +56,7 @@ func TestHighCoverage(t *testing.T) {
 		shard                    gbam.Shard
 		records                  []*sam.Record
 		expectedCoverageCounts   map[int][]int
-		expectedHighCovIntervals []coverageInterval
+		expectedHighCovIntervals []CoverageInterval
 	}{
 		{
 			name:  "shard0-only",
@@ -66,7 +68,7 @@ func TestHighCoverage(t *testing.T) {
 				0: []int{1, 1, 0},
 				1: []int{0, 0, 0},
 			},
-			expectedHighCovIntervals: []coverageInterval{},
+			expectedHighCovIntervals: []CoverageInterval{},
 		},
 		{
 			name:  "shard0-partial",
@@ -78,7 +80,7 @@ func TestHighCoverage(t *testing.T) {
 				0: []int{0, 1, 0},
 				1: []int{0, 0, 0},
 			},
-			expectedHighCovIntervals: []coverageInterval{},
+			expectedHighCovIntervals: []CoverageInterval{},
 		},
 		{
 			name:  "shard1-partial",
@@ -90,7 +92,7 @@ func TestHighCoverage(t *testing.T) {
 				0: []int{0, 0, 1},
 				1: []int{0, 0, 0},
 			},
-			expectedHighCovIntervals: []coverageInterval{},
+			expectedHighCovIntervals: []CoverageInterval{},
 		},
 		{
 			name:  "shard1-partial2",
@@ -102,7 +104,7 @@ func TestHighCoverage(t *testing.T) {
 				0: []int{0, 0, 0},
 				1: []int{1, 0, 0},
 			},
-			expectedHighCovIntervals: []coverageInterval{},
+			expectedHighCovIntervals: []CoverageInterval{},
 		},
 		{
 			name:  "shard2-starts-before-shard",
@@ -114,7 +116,7 @@ func TestHighCoverage(t *testing.T) {
 				0: []int{0, 0, 0},
 				1: []int{0, 1, 0},
 			},
-			expectedHighCovIntervals: []coverageInterval{},
+			expectedHighCovIntervals: []CoverageInterval{},
 		},
 		{
 			name:  "shard2-inshard",
@@ -126,7 +128,7 @@ func TestHighCoverage(t *testing.T) {
 				0: []int{0, 0, 0},
 				1: []int{0, 1, 1},
 			},
-			expectedHighCovIntervals: []coverageInterval{},
+			expectedHighCovIntervals: []CoverageInterval{},
 		},
 		{
 			name:  "shard2-partial",
@@ -138,7 +140,7 @@ func TestHighCoverage(t *testing.T) {
 				0: []int{0, 0, 0},
 				1: []int{0, 0, 1},
 			},
-			expectedHighCovIntervals: []coverageInterval{},
+			expectedHighCovIntervals: []CoverageInterval{},
 		},
 		{
 			name:  "shard0-two",
@@ -151,12 +153,12 @@ func TestHighCoverage(t *testing.T) {
 				0: []int{1, 2, 0},
 				1: []int{0, 0, 0},
 			},
-			expectedHighCovIntervals: []coverageInterval{
-				coverageInterval{
-					refId:        0,
-					start:        1,
-					end:          2,
-					meanCoverage: 2.0,
+			expectedHighCovIntervals: []CoverageInterval{
+				CoverageInterval{
+					RefId:        0,
+					Start:        1,
+					End:          2,
+					MeanCoverage: 2.0,
 				},
 			},
 		},
@@ -171,12 +173,12 @@ func TestHighCoverage(t *testing.T) {
 				0: []int{0, 0, 2},
 				1: []int{0, 0, 0},
 			},
-			expectedHighCovIntervals: []coverageInterval{
-				coverageInterval{
-					refId:        0,
-					start:        2,
-					end:          3,
-					meanCoverage: 2.0,
+			expectedHighCovIntervals: []CoverageInterval{
+				CoverageInterval{
+					RefId:        0,
+					Start:        2,
+					End:          3,
+					MeanCoverage: 2.0,
 				},
 			},
 		},
@@ -191,12 +193,12 @@ func TestHighCoverage(t *testing.T) {
 				0: []int{0, 0, 0},
 				1: []int{0, 1, 2},
 			},
-			expectedHighCovIntervals: []coverageInterval{
-				coverageInterval{
-					refId:        1,
-					start:        2,
-					end:          3,
-					meanCoverage: 2.0,
+			expectedHighCovIntervals: []CoverageInterval{
+				CoverageInterval{
+					RefId:        1,
+					Start:        2,
+					End:          3,
+					MeanCoverage: 2.0,
 				},
 			},
 		},
@@ -225,12 +227,46 @@ func TestHighCoverage(t *testing.T) {
 	}
 }
 
+func TestCoverageExcludeSkips(t *testing.T) {
+	ref, _ := sam.NewReference("ref", "", "", 10, nil, nil)
+	_, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+	shard := gbam.Shard{
+		StartRef: ref,
+		EndRef:   ref,
+		Start:    0,
+		End:      9,
+	}
+	cigar := []sam.CigarOp{
+		sam.NewCigarOp(sam.CigarMatch, 2),
+		sam.NewCigarOp(sam.CigarSkipped, 3),
+		sam.NewCigarOp(sam.CigarDeletion, 1),
+		sam.NewCigarOp(sam.CigarMatch, 4),
+	}
+
+	for _, test := range []struct {
+		excludeSkips bool
+		expected     []int
+	}{
+		{false, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 0}},
+		{true, []int{1, 1, 0, 0, 0, 1, 1, 1, 1, 0}},
+	} {
+		coverageCounts := map[int][]int{0: make([]int, ref.Len())}
+		c := coverageCalculator{
+			coverageCounts: &coverageCounts,
+			excludeSkips:   test.excludeSkips,
+		}
+		assert.NoError(t, c.Process(shard, NewRecord("A", ref, 0, r1F, 10, ref, cigar)))
+		assert.Equal(t, test.expected, coverageCounts[0], "excludeSkips %v", test.excludeSkips)
+	}
+}
+
 func TestGetHighCoverageIntervals(t *testing.T) {
 	testCases := []struct {
 		name        string
 		coverage    map[int][]int
 		maxCoverage int
-		expected    []coverageInterval
+		expected    []CoverageInterval
 	}{
 		{
 			name: "basic",
@@ -241,36 +277,36 @@ func TestGetHighCoverageIntervals(t *testing.T) {
 				3: []int{1, 1, 4, 1, 1},
 			},
 			maxCoverage: 1,
-			expected: []coverageInterval{
-				coverageInterval{
-					refId:        0,
-					start:        3,
-					end:          5,
-					meanCoverage: 2.5,
+			expected: []CoverageInterval{
+				CoverageInterval{
+					RefId:        0,
+					Start:        3,
+					End:          5,
+					MeanCoverage: 2.5,
 				},
-				coverageInterval{
-					refId:        1,
-					start:        0,
-					end:          2,
-					meanCoverage: 2,
+				CoverageInterval{
+					RefId:        1,
+					Start:        0,
+					End:          2,
+					MeanCoverage: 2,
 				},
-				coverageInterval{
-					refId:        1,
-					start:        3,
-					end:          4,
-					meanCoverage: 3,
+				CoverageInterval{
+					RefId:        1,
+					Start:        3,
+					End:          4,
+					MeanCoverage: 3,
 				},
-				coverageInterval{
-					refId:        2,
-					start:        2,
-					end:          4,
-					meanCoverage: 3,
+				CoverageInterval{
+					RefId:        2,
+					Start:        2,
+					End:          4,
+					MeanCoverage: 3,
 				},
-				coverageInterval{
-					refId:        3,
-					start:        2,
-					end:          3,
-					meanCoverage: 4,
+				CoverageInterval{
+					RefId:        3,
+					Start:        2,
+					End:          3,
+					MeanCoverage: 4,
 				},
 			},
 		},
@@ -285,18 +321,18 @@ func TestGetHighCoverageIntervals(t *testing.T) {
 }
 
 func TestIsInHighCoverageShard(t *testing.T) {
-	highCovMap := getCoverageMap([]coverageInterval{
-		coverageInterval{
-			refId:        0,
-			start:        22,
-			end:          23,
-			meanCoverage: 5,
+	highCovMap := getCoverageMap([]CoverageInterval{
+		CoverageInterval{
+			RefId:        0,
+			Start:        22,
+			End:          23,
+			MeanCoverage: 5,
 		},
-		coverageInterval{
-			refId:        1,
-			start:        43,
-			end:          45,
-			meanCoverage: 10,
+		CoverageInterval{
+			RefId:        1,
+			Start:        43,
+			End:          45,
+			MeanCoverage: 10,
 		},
 	})
 
@@ -383,7 +419,7 @@ func TestSubsampleCoverageMax(t *testing.T) {
 		Provider: provider,
 		Opts:     &opts,
 	}
-	_, err := markDuplicates.Mark(nil)
+	metrics, err := markDuplicates.Mark(nil)
 	assert.NoError(t, err)
 	for i, r := range records {
 		t.Logf("input[%v]: %v begin %d end %d", i, r, r.Start(), r.End())
@@ -406,4 +442,72 @@ func TestSubsampleCoverageMax(t *testing.T) {
 	assert.Less(t, float64(counts["C"]), expectedCount*1.1)
 	assert.Greater(t, float64(counts["D"]), expectedCount*0.9)
 	assert.Less(t, float64(counts["D"]), expectedCount*1.1)
+
+	// Every C and D read is counted in a high-coverage interval, and
+	// the reads that remain are the ones in the output.
+	var reads HighCoverageReads
+	for _, r := range metrics.HighCoverageReads {
+		reads.Add(r)
+	}
+	assert.Equal(t, 4*numRecords, reads.Reads)
+	assert.Equal(t, counts["C"]+counts["D"], reads.Reads-reads.Removed)
+}
+
+func TestComputeHighCoverageIntervals(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	// Coverage is 1 at chr1:0-5, 3 at chr1:5-10, 2 at chr1:10-15 and 1
+	// at chr2:0-10.
+	records := []*sam.Record{
+		NewRecord("A", chr1, 0, r1F, 0, chr2, cigar0),
+		NewRecord("B", chr1, 5, s1F, 0, nil, cigar0),
+		NewRecord("C", chr1, 5, s1F, 0, nil, cigar0),
+		NewRecord("A", chr2, 0, r2R, 0, chr1, cigar0),
+	}
+	opts := Opts{
+		ShardSize:   100,
+		Padding:     10,
+		MinBases:    1,
+		Parallelism: 2,
+		CoverageMax: 1,
+	}
+	intervals, err := ComputeHighCoverageIntervals(bamprovider.NewFakeProvider(header, records), &opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []CoverageInterval{{RefId: 0, Start: 5, End: 15, MeanCoverage: 2.5}}, intervals)
+
+	for _, test := range []struct {
+		name     string
+		expected string
+	}{
+		{"high.bed", "chr1\t5\t15\t2.500\n"},
+		{"high.tsv", "start_chr\tstart_chr_start\tend_chr\tend_chr_end\tmean_coverage\nchr1\t6\tchr1\t16\t2.500\n"},
+	} {
+		path := filepath.Join(tempDir, test.name)
+		assert.NoError(t, WriteHighCoverageIntervals(vcontext.Background(), nil, path, header, intervals, nil))
+		actual, err := ioutil.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(actual))
+	}
+
+	// With read counts, the report includes the reads removed by
+	// subsampling and the resulting coverage.
+	path := filepath.Join(tempDir, "reads.tsv")
+	reads := map[CoverageInterval]*HighCoverageReads{intervals[0]: {Reads: 4, Removed: 1}}
+	assert.NoError(t, WriteHighCoverageIntervals(vcontext.Background(), nil, path, header, intervals, reads))
+	actual, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "start_chr\tstart_chr_start\tend_chr\tend_chr_end\tmean_coverage\treads\tremoved_reads\tsubsampled_mean_coverage\n"+
+		"chr1\t6\tchr1\t16\t2.500\t4\t1\t1.875\n", string(actual))
+
+	// BED files keep only the name column after the positions.
+	path = filepath.Join(tempDir, "reads.bed")
+	assert.NoError(t, WriteHighCoverageIntervals(vcontext.Background(), nil, path, header, intervals, reads))
+	actual, err = ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "chr1\t5\t15\t2.500\n", string(actual))
+
+	opts.CoverageMax = 0
+	_, err = ComputeHighCoverageIntervals(bamprovider.NewFakeProvider(header, records), &opts)
+	assert.Error(t, err)
 }
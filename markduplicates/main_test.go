@@ -16,12 +16,19 @@ package markduplicates
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/grailbio/base/vcontext"
 	gbam "github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/bam"
 	"github.com/grailbio/hts/sam"
 	"github.com/grailbio/testutil"
 	"github.com/stretchr/testify/assert"
@@ -785,6 +792,111 @@ func TestUmiSnapCorrection(t *testing.T) {
 	RunTestCases(t, header, cases)
 }
 
+func TestUmiNPolicy(t *testing.T) {
+	policyOpts := func(policy UmiNPolicy, knownUmis string) Opts {
+		opts := defaultOpts
+		opts.UseUmis = true
+		opts.KnownUmis = []byte(knownUmis)
+		opts.UmiNPolicy = policy
+		return opts
+	}
+
+	cases := []TestCase{
+		{
+			// CNG snaps to AGG, so B is a duplicate of A.
+			[]TestRecord{
+				{R: NewRecord("A:::1:10:1:1:AGG+AGT", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:::1:10:1:1:CNG+AGT", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: true},
+				{R: NewRecord("A:::1:10:1:1:AGG+AGT", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:::1:10:1:1:CNG+AGT", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: true},
+			},
+			policyOpts(UmiNSplit, "AGT\nAGG"),
+		},
+		{
+			// CNG does not match AGG with a wildcard, so B is not a
+			// duplicate, but ANG does, so C is.
+			[]TestRecord{
+				{R: NewRecord("A:::1:10:1:1:AGG+AGT", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:::1:10:1:1:CNG+AGT", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("C:::1:10:1:1:ANG+AGT", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: true},
+				{R: NewRecord("A:::1:10:1:1:AGG+AGT", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:::1:10:1:1:CNG+AGT", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("C:::1:10:1:1:ANG+AGT", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: true},
+			},
+			policyOpts(UmiNWildcard, "AGT\nAGG"),
+		},
+		{
+			// NAA snaps to AAA, so C and S are duplicates with the
+			// default policy.
+			[]TestRecord{
+				{R: NewRecord("A:::1:10:1:1:AAA+CCC", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("C:::1:10:1:1:NAA+CCC", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: true},
+				{R: NewRecord("S:::1:10:1:1:NAA+CCC", chr1, 0, s1F, 0, nil, cigar0), DupFlag: true},
+				{R: NewRecord("S:::1:10:1:1:NAA+CCC", chr1, 0, u2, 0, nil, cigar0), DupFlag: false},
+				{R: NewRecord("A:::1:10:1:1:AAA+CCC", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("C:::1:10:1:1:NAA+CCC", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: true},
+			},
+			policyOpts(UmiNSplit, "AAA\nCCC\nGGG\nTTT"),
+		},
+		{
+			// With drop, C and S are excluded from duplicate detection.
+			[]TestRecord{
+				{R: NewRecord("A:::1:10:1:1:AAA+CCC", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("C:::1:10:1:1:NAA+CCC", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("S:::1:10:1:1:NAA+CCC", chr1, 0, s1F, 0, nil, cigar0), DupFlag: false},
+				{R: NewRecord("S:::1:10:1:1:NAA+CCC", chr1, 0, u2, 0, nil, cigar0), DupFlag: false},
+				{R: NewRecord("A:::1:10:1:1:AAA+CCC", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("C:::1:10:1:1:NAA+CCC", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+			},
+			policyOpts(UmiNDrop, "AAA\nCCC\nGGG\nTTT"),
+		},
+	}
+	RunTestCases(t, header, cases)
+
+	// With fail, C and S are also flagged as QC failed, and all
+	// policies count the reads with N.
+	newRecords := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecord("A:::1:10:1:1:AAA+CCC", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("B:::1:10:1:1:AAA+CCC", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("C:::1:10:1:1:NNA+CCC", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("S:::1:10:1:1:NNA+CCC", chr1, 0, s1F, 0, nil, cigar0),
+			NewRecord("S:::1:10:1:1:NNA+CCC", chr1, 0, u2, 0, nil, cigar0),
+			NewRecord("A:::1:10:1:1:AAA+CCC", chr1, 10, r2R, 0, chr1, cigar0),
+			NewRecord("B:::1:10:1:1:AAA+CCC", chr1, 10, r2R, 0, chr1, cigar0),
+			NewRecord("C:::1:10:1:1:NNA+CCC", chr1, 10, r2R, 0, chr1, cigar0),
+		}
+	}
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, test := range []struct {
+		policy   UmiNPolicy
+		expected UmiNCounts
+	}{
+		{UmiNSplit, UmiNCounts{Reads: 3}},
+		{UmiNWildcard, UmiNCounts{Reads: 3, Corrected: 3}},
+		{UmiNFail, UmiNCounts{Reads: 3, Failed: 3}},
+		{UmiNDrop, UmiNCounts{Reads: 3, Dropped: 3}},
+	} {
+		opts := policyOpts(test.policy, "AAA\nCCC\nGGG\nTTT")
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.Format = "bam"
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, newRecords()),
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, actualMetrics.UmiN, "policy %v", test.policy)
+
+		actualRecords := ReadRecords(t, opts.OutputPath)
+		for i, r := range actualRecords {
+			failed := test.policy == UmiNFail && umiHasN(r.Name) && r.Flags&sam.Unmapped == 0
+			assert.Equal(t, failed, r.Flags&sam.QCFail != 0, "policy %v record %d", test.policy, i)
+		}
+	}
+}
+
 func TestUmiScavengeCorrection(t *testing.T) {
 	noScavenge := defaultOpts
 	noScavenge.UseUmis = true
@@ -892,7 +1004,991 @@ func TestSeparateSingletons(t *testing.T) {
 	RunTestCases(t, header, cases)
 }
 
+func TestSeparateReadGroups(t *testing.T) {
+	separateReadGroups := defaultOpts
+	separateReadGroups.SeparateReadGroups = true
+
+	rgA := NewAux("RG", "rgA")
+	rgB := NewAux("RG", "rgB")
+
+	cases := []TestCase{
+		{
+			// A and B are from different read groups, if
+			// separateReadGroups = false, they should be duplicates.
+			[]TestRecord{
+				{R: NewRecordAux("A:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0, rgA), DupFlag: false},
+				{R: NewRecordAux("B:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0, rgB), DupFlag: true},
+				{R: NewRecordAux("S:1:1:1:1:1:1", chr1, 0, s1F, 10, chr1, cigar0, rgB), DupFlag: true},
+				{R: NewRecordAux("A:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0, rgA), DupFlag: false},
+				{R: NewRecordAux("B:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0, rgB), DupFlag: true},
+			},
+			defaultOpts,
+		},
+		{
+			// A and B are from different read groups, if
+			// separateReadGroups = true, they should not be duplicates,
+			// and the singleton should only match B.
+			[]TestRecord{
+				{R: NewRecordAux("A:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0, rgA), DupFlag: false},
+				{R: NewRecordAux("B:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0, rgB), DupFlag: false},
+				{R: NewRecordAux("S:1:1:1:1:1:1", chr1, 0, s1F, 10, chr1, cigar0, rgB), DupFlag: true},
+				{R: NewRecordAux("A:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0, rgA), DupFlag: false},
+				{R: NewRecordAux("B:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0, rgB), DupFlag: false},
+			},
+			separateReadGroups,
+		},
+		{
+			// A and B are from the same read group, they should be
+			// duplicates even if separateReadGroups = true.
+			[]TestRecord{
+				{R: NewRecordAux("A:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0, rgA), DupFlag: false},
+				{R: NewRecordAux("B:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0, rgA), DupFlag: true},
+				{R: NewRecordAux("A:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0, rgA), DupFlag: false},
+				{R: NewRecordAux("B:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0, rgA), DupFlag: true},
+			},
+			separateReadGroups,
+		},
+	}
+	RunTestCases(t, header, cases)
+}
+
+func TestUseBarcodes(t *testing.T) {
+	useBarcodes := defaultOpts
+	useBarcodes.UseBarcodes = true
+	useBarcodesUmis := useBarcodes
+	useBarcodesUmis.UseUmis = true
+
+	bxA := NewAux("BX", "AAAA-1")
+	bxB := NewAux("BX", "CCCC-1")
+
+	cases := []TestCase{
+		{
+			// A and B have different barcodes, if useBarcodes =
+			// false, they should be duplicates.
+			[]TestRecord{
+				{R: NewRecordAux("A:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0, bxA), DupFlag: false},
+				{R: NewRecordAux("B:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0, bxB), DupFlag: true},
+				{R: NewRecordAux("S:1:1:1:1:1:1", chr1, 0, s1F, 10, chr1, cigar0, bxB), DupFlag: true},
+				{R: NewRecordAux("A:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0, bxA), DupFlag: false},
+				{R: NewRecordAux("B:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0, bxB), DupFlag: true},
+			},
+			defaultOpts,
+		},
+		{
+			// A and B have different barcodes, if useBarcodes =
+			// true, they should not be duplicates, and the
+			// singleton should only match B.
+			[]TestRecord{
+				{R: NewRecordAux("A:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0, bxA), DupFlag: false},
+				{R: NewRecordAux("B:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0, bxB), DupFlag: false},
+				{R: NewRecordAux("S:1:1:1:1:1:1", chr1, 0, s1F, 10, chr1, cigar0, bxB), DupFlag: true},
+				{R: NewRecordAux("A:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0, bxA), DupFlag: false},
+				{R: NewRecordAux("B:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0, bxB), DupFlag: false},
+			},
+			useBarcodes,
+		},
+		{
+			// A and B have the same barcode, and C has none, so
+			// only A and B should be duplicates.
+			[]TestRecord{
+				{R: NewRecordAux("A:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0, bxA), DupFlag: false},
+				{R: NewRecordAux("B:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0, bxA), DupFlag: true},
+				{R: NewRecord("C:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecordAux("A:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0, bxA), DupFlag: false},
+				{R: NewRecordAux("B:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0, bxA), DupFlag: true},
+				{R: NewRecord("C:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+			},
+			useBarcodes,
+		},
+		{
+			// With umis, A and B have the same umis but different
+			// barcodes, so they should not be duplicates.
+			[]TestRecord{
+				{R: NewRecordAux("A:1:1:1:1:1:1:AAA+CCC", chr1, 0, r1F, 10, chr1, cigar0, bxA), DupFlag: false},
+				{R: NewRecordAux("B:1:1:1:1:1:1:AAA+CCC", chr1, 0, r1F, 10, chr1, cigar0, bxB), DupFlag: false},
+				{R: NewRecordAux("A:1:1:1:1:1:1:AAA+CCC", chr1, 10, r2R, 0, chr1, cigar0, bxA), DupFlag: false},
+				{R: NewRecordAux("B:1:1:1:1:1:1:AAA+CCC", chr1, 10, r2R, 0, chr1, cigar0, bxB), DupFlag: false},
+			},
+			useBarcodesUmis,
+		},
+	}
+	RunTestCases(t, header, cases)
+}
+
+func TestRnaSeq(t *testing.T) {
+	rnaSeq := defaultOpts
+	rnaSeq.RnaSeq = true
+	rnaSeq.Padding = 50
+	useJunctions := rnaSeq
+	useJunctions.UseSpliceJunctions = true
+
+	spliced := []sam.CigarOp{
+		sam.NewCigarOp(sam.CigarMatch, 4),
+		sam.NewCigarOp(sam.CigarSkipped, 20),
+		sam.NewCigarOp(sam.CigarMatch, 6),
+	}
+	splicedOther := []sam.CigarOp{
+		sam.NewCigarOp(sam.CigarMatch, 4),
+		sam.NewCigarOp(sam.CigarSkipped, 30),
+		sam.NewCigarOp(sam.CigarMatch, 6),
+	}
+
+	cases := []TestCase{
+		{
+			// A and B share their 5' positions, so they are
+			// duplicates even though A is spliced.
+			[]TestRecord{
+				{R: NewRecord("A:1:1:1:1:1:1", chr1, 0, r1F, 100, chr1, spliced), DupFlag: false},
+				{R: NewRecord("B:1:1:1:1:1:1", chr1, 0, r1F, 100, chr1, cigar0), DupFlag: true},
+				{R: NewRecord("A:1:1:1:1:1:1", chr1, 100, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:1:1:1:1:1:1", chr1, 100, r2R, 0, chr1, cigar0), DupFlag: true},
+			},
+			rnaSeq,
+		},
+		{
+			// The 5' position of a reverse read includes its
+			// reference skips, so reverse reads that span the same
+			// fragment are duplicates.
+			[]TestRecord{
+				{R: NewRecord("A:1:1:1:1:1:1", chr1, 0, r1F, 120, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:1:1:1:1:1:1", chr1, 0, r1F, 100, chr1, cigar0), DupFlag: true},
+				{R: NewRecord("B:1:1:1:1:1:1", chr1, 100, r2R, 0, chr1, spliced), DupFlag: true},
+				{R: NewRecord("A:1:1:1:1:1:1", chr1, 120, r2R, 0, chr1, cigar0), DupFlag: false},
+			},
+			rnaSeq,
+		},
+		{
+			// With use-splice-junctions, A and B have different
+			// junctions, so they are not duplicates, and C matches A.
+			[]TestRecord{
+				{R: NewRecord("A:1:1:1:1:1:1", chr1, 0, r1F, 100, chr1, spliced), DupFlag: false},
+				{R: NewRecord("B:1:1:1:1:1:1", chr1, 0, r1F, 100, chr1, splicedOther), DupFlag: false},
+				{R: NewRecord("C:1:1:1:1:1:1", chr1, 0, r1F, 100, chr1, spliced), DupFlag: true},
+				{R: NewRecord("A:1:1:1:1:1:1", chr1, 100, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:1:1:1:1:1:1", chr1, 100, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("C:1:1:1:1:1:1", chr1, 100, r2R, 0, chr1, cigar0), DupFlag: true},
+			},
+			useJunctions,
+		},
+	}
+	RunTestCases(t, header, cases)
+}
+
+func TestRnaSeqSplicedBeyondPadding(t *testing.T) {
+	// A's reverse read spans a 1000bp intron, so its 5' position is
+	// far beyond the default padding from its alignment position, and
+	// in a different shard from B's reverse read, which shares it.
+	spliced := []sam.CigarOp{
+		sam.NewCigarOp(sam.CigarMatch, 50),
+		sam.NewCigarOp(sam.CigarSkipped, 1000),
+		sam.NewCigarOp(sam.CigarMatch, 50),
+	}
+	unspliced := []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 100)}
+	newRecords := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecord("A:1:1:1:1:1:1", chr2, 100, r1F, 200, chr2, cigar0),
+			NewRecord("B:1:1:1:1:1:1", chr2, 100, r1F, 1200, chr2, cigar0),
+			NewRecord("A:1:1:1:1:1:1", chr2, 200, r2R, 100, chr2, spliced),
+			NewRecord("B:1:1:1:1:1:1", chr2, 1200, r2R, 100, chr2, unspliced),
+		}
+	}
+	shards := []gbam.Shard{
+		{StartRef: chr1, EndRef: chr1, Start: 0, End: chr1.Len(), Padding: 143, ShardIdx: 0},
+		{StartRef: chr2, EndRef: chr2, Start: 0, End: 500, Padding: 143, ShardIdx: 1},
+		{StartRef: chr2, EndRef: chr2, Start: 500, End: 1000, Padding: 143, ShardIdx: 2},
+		{StartRef: chr2, EndRef: chr2, Start: 1000, End: 1500, Padding: 143, ShardIdx: 3},
+		{StartRef: chr2, EndRef: chr2, Start: 1500, End: chr2.Len(), Padding: 143, ShardIdx: 4},
+		{StartRef: nil, EndRef: nil, Start: 0, End: math.MaxInt32, ShardIdx: 5},
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.RnaSeq = true
+		opts.Padding = 143
+		opts.AlignDistPolicy = AlignDistFail
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, newRecords()),
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(shards)
+		assert.NoError(t, err)
+
+		// The shard that writes B's reverse read sees A through the
+		// distant 5' table, so both ends of B are duplicates of A, and
+		// all four reads share one duplicate set.
+		actualRecords := ReadRecords(t, opts.OutputPath)
+		assert.Equal(t, 4, len(actualRecords))
+		var di []byte
+		for _, r := range actualRecords {
+			assert.Equal(t, strings.HasPrefix(r.Name, "B"), r.Flags&sam.Duplicate != 0, "record %v", r)
+			actual, ok := r.Tag([]byte("DI"))
+			assert.True(t, ok, "record %v", r)
+			if di == nil {
+				di = actual
+			} else {
+				assert.True(t, bytes.Equal(di, actual), "record %v", r)
+			}
+		}
+	}
+}
+
+func TestReadFilter(t *testing.T) {
+	minMapQ := defaultOpts
+	minMapQ.MinMapQ = 20
+	excludeQCFail := defaultOpts
+	excludeQCFail.ExcludeFlags = sam.QCFail
+	includeProperPair := defaultOpts
+	includeProperPair.IncludeFlags = sam.ProperPair
+
+	withMapQ := func(r *sam.Record, mapq byte) *sam.Record {
+		r.MapQ = mapq
+		return r
+	}
+
+	cases := []TestCase{
+		{
+			// C has one read below min-mapq, so neither read of C
+			// participates. S is below min-mapq, so it passes through.
+			[]TestRecord{
+				{R: withMapQ(NewRecord("A:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0), 30), DupFlag: false},
+				{R: withMapQ(NewRecord("B:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0), 30), DupFlag: true},
+				{R: withMapQ(NewRecord("C:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0), 30), DupFlag: false},
+				{R: withMapQ(NewRecord("S:1:1:1:1:1:1", chr1, 0, s1F, 10, chr1, cigar0), 10), DupFlag: false},
+				{R: withMapQ(NewRecord("A:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0), 30), DupFlag: false},
+				{R: withMapQ(NewRecord("B:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0), 30), DupFlag: true},
+				{R: withMapQ(NewRecord("C:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0), 10), DupFlag: false},
+			},
+			minMapQ,
+		},
+		{
+			// B is QC failed, so it does not participate when excluded.
+			[]TestRecord{
+				{R: NewRecord("A:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:1:1:1:1:1:1", chr1, 0, r1F|sam.QCFail, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("C:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: true},
+				{R: NewRecord("A:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:1:1:1:1:1:1", chr1, 10, r2R|sam.QCFail, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("C:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: true},
+			},
+			excludeQCFail,
+		},
+		{
+			// Only properly paired reads participate.
+			[]TestRecord{
+				{R: NewRecord("A:1:1:1:1:1:1", chr1, 0, r1F|sam.ProperPair, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("C:1:1:1:1:1:1", chr1, 0, r1F|sam.ProperPair, 10, chr1, cigar0), DupFlag: true},
+				{R: NewRecord("A:1:1:1:1:1:1", chr1, 10, r2R|sam.ProperPair, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("C:1:1:1:1:1:1", chr1, 10, r2R|sam.ProperPair, 0, chr1, cigar0), DupFlag: true},
+			},
+			includeProperPair,
+		},
+	}
+	RunTestCases(t, header, cases)
+}
+
+func TestReadFilterMetrics(t *testing.T) {
+	withMapQ := func(r *sam.Record, mapq byte) *sam.Record {
+		r.MapQ = mapq
+		return r
+	}
+	records := []*sam.Record{
+		withMapQ(NewRecord("A:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0), 30),
+		withMapQ(NewRecord("B:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0), 30),
+		withMapQ(NewRecord("C:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0), 30),
+		withMapQ(NewRecord("S:1:1:1:1:1:1", chr1, 5, s1F, 5, chr1, cigar0), 10),
+		withMapQ(NewRecord("A:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0), 30),
+		withMapQ(NewRecord("B:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0), 30),
+		withMapQ(NewRecord("C:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0), 10),
+	}
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	opts := defaultOpts
+	opts.OutputPath = NewTestOutput(tempDir, 0, "bam")
+	opts.Format = "bam"
+	opts.MinMapQ = 20
+	markDuplicates := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(header, records),
+		Opts:     &opts,
+	}
+	metrics, err := markDuplicates.Mark(nil)
+	assert.NoError(t, err)
+
+	// C has an end below min-mapq, and S is below min-mapq, so neither
+	// counts as examined.
+	m := metrics.LibraryMetrics["Unknown Library"]
+	assert.Equal(t, 4, m.ReadPairsExamined)
+	assert.Equal(t, 0, m.UnpairedReads)
+	assert.Equal(t, 2, m.ReadPairDups)
+}
+
+func TestRecordPredicate(t *testing.T) {
+	newRecords := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecord("A:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("B:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("C:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("D:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("A:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+			NewRecord("B:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+			NewRecord("C:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+			NewRecord("D:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+			NewRecord("E:1:1:1:1:1:1", nil, -1, up1, -1, nil, nil),
+			NewRecord("E:1:1:1:1:1:1", nil, -1, up2, -1, nil, nil),
+		}
+	}
+	predicate := func(r *sam.Record) Action {
+		switch r.Name[0] {
+		case 'C':
+			return PassThrough
+		case 'D', 'E':
+			return Drop
+		}
+		return Process
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.RecordPredicate = predicate
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, newRecords()),
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		// C passes through and D is dropped, so only A and B are examined.
+		assert.Equal(t, 4, actualMetrics.LibraryMetrics["Unknown Library"].ReadPairsExamined)
+		assert.Equal(t, 0, actualMetrics.LibraryMetrics["Unknown Library"].UnmappedReads)
+
+		expected := []struct {
+			name    string
+			dupFlag bool
+		}{
+			{"A:1:1:1:1:1:1", false},
+			{"B:1:1:1:1:1:1", true},
+			{"C:1:1:1:1:1:1", false},
+			{"A:1:1:1:1:1:1", false},
+			{"B:1:1:1:1:1:1", true},
+			{"C:1:1:1:1:1:1", false},
+		}
+		actualRecords := ReadRecords(t, opts.OutputPath)
+		assert.Equal(t, len(expected), len(actualRecords))
+		for i, r := range actualRecords {
+			assert.Equal(t, expected[i].name, r.Name)
+			assert.Equal(t, expected[i].dupFlag, r.Flags&sam.Duplicate != 0)
+		}
+	}
+}
+
+func TestRecordPredicateCoverage(t *testing.T) {
+	var records []*sam.Record
+	for _, name := range []string{"A", "B", "D", "E", "F", "G"} {
+		records = append(records, NewRecord(name+":1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0))
+	}
+	for _, name := range []string{"A", "B", "D", "E", "F", "G"} {
+		records = append(records, NewRecord(name+":1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0))
+	}
+	predicate := func(r *sam.Record) Action {
+		if r.Name[0] == 'A' || r.Name[0] == 'B' {
+			return Process
+		}
+		return Drop
+	}
+
+	// Only A and B are kept, so the coverage is 2 and nothing is
+	// subsampled, even though the input's coverage is 6.
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	opts := defaultOpts
+	opts.OutputPath = NewTestOutput(tempDir, 0, "bam")
+	opts.Format = "bam"
+	opts.CoverageMax = 2
+	opts.RecordPredicate = predicate
+	markDuplicates := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(header, records),
+		Opts:     &opts,
+	}
+	metrics, err := markDuplicates.Mark(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(metrics.HighCoverageReads))
+	assert.Equal(t, 4, len(ReadRecords(t, opts.OutputPath)))
+
+	intervals, err := ComputeHighCoverageIntervals(bamprovider.NewFakeProvider(header, records), &opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(intervals))
+}
+
+func TestPassThroughRefs(t *testing.T) {
+	dup := sam.Paired | sam.Read1 | sam.Duplicate
+	newRecords := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecord("A:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("B:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("C:1:1:1:1:1:1", chr1, 0, r1F, 10, chr2, cigar0),
+			NewRecord("D:1:1:1:1:1:1", chr1, 0, r1F, 10, chr2, cigar0),
+			NewRecord("A:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+			NewRecord("B:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+			NewRecord("E:1:1:1:1:1:1", chr2, 0, dup, 10, chr2, cigar0),
+			NewRecord("F:1:1:1:1:1:1", chr2, 0, r1F, 10, chr2, cigar0),
+			NewRecord("C:1:1:1:1:1:1", chr2, 10, r2R, 0, chr1, cigar0),
+			NewRecord("D:1:1:1:1:1:1", chr2, 10, r2R, 0, chr1, cigar0),
+			NewRecord("E:1:1:1:1:1:1", chr2, 10, r2R, 0, chr2, cigar0),
+			NewRecord("F:1:1:1:1:1:1", chr2, 10, r2R, 0, chr2, cigar0),
+		}
+	}
+	// Only the readpair on chr1 is marked. The pairs on chr2, and the
+	// pairs with one end on chr2, pass through unmarked, and E keeps
+	// its input duplicate flag despite clear-existing.
+	expected := []struct {
+		name    string
+		dupFlag bool
+	}{
+		{"A:1:1:1:1:1:1", false},
+		{"B:1:1:1:1:1:1", true},
+		{"C:1:1:1:1:1:1", false},
+		{"D:1:1:1:1:1:1", false},
+		{"A:1:1:1:1:1:1", false},
+		{"B:1:1:1:1:1:1", true},
+		{"E:1:1:1:1:1:1", true},
+		{"F:1:1:1:1:1:1", false},
+		{"C:1:1:1:1:1:1", false},
+		{"D:1:1:1:1:1:1", false},
+		{"E:1:1:1:1:1:1", false},
+		{"F:1:1:1:1:1:1", false},
+	}
+
+	// Mark the records with one shard for both references, and with a
+	// separate shard for the pass-through reference.
+	separateShards := []gbam.Shard{
+		{StartRef: chr1, EndRef: chr1, Start: 0, End: chr1.Len(), Padding: 10, ShardIdx: 0},
+		{StartRef: chr2, EndRef: chr2, Start: 0, End: chr2.Len(), Padding: 10, ShardIdx: 1},
+		{StartRef: nil, EndRef: nil, Start: 0, End: math.MaxInt32, ShardIdx: 2},
+	}
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, shards := range [][]gbam.Shard{nil, separateShards} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.Format = "bam"
+		opts.ClearExisting = true
+		opts.PassThroughRefs = []string{"chr[2-9]"}
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, newRecords()),
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(shards)
+		assert.NoError(t, err)
+		// Only A and B are examined, since C and D have a mate on chr2.
+		assert.Equal(t, 4, actualMetrics.LibraryMetrics["Unknown Library"].ReadPairsExamined)
+		assert.Equal(t, 12, actualMetrics.Flagstat.Total[0])
+
+		actualRecords := ReadRecords(t, opts.OutputPath)
+		assert.Equal(t, len(expected), len(actualRecords))
+		for i, r := range actualRecords {
+			assert.Equal(t, expected[i].name, r.Name, "shards %v", shards)
+			assert.Equal(t, expected[i].dupFlag, r.Flags&sam.Duplicate != 0, "shards %v, record %v", shards, r)
+		}
+	}
+}
+
+func TestUnmappedMatePolicy(t *testing.T) {
+	followMate := defaultOpts
+	followMate.UnmappedMatePolicy = UnmappedMateFollow
+
+	newRecords := func(followMate bool) []TestRecord {
+		return []TestRecord{
+			{R: NewRecord("A:1:1:1:1:1:1", chr1, 0, s1F, 0, chr1, cigar0), DupFlag: false},
+			{R: NewRecord("A:1:1:1:1:1:1", chr1, 0, u2, 0, chr1, nil), DupFlag: false},
+			{R: NewRecord("B:1:1:1:1:1:1", chr1, 0, s1F, 0, chr1, cigar0), DupFlag: true},
+			{R: NewRecord("B:1:1:1:1:1:1", chr1, 0, u2, 0, chr1, nil), DupFlag: followMate},
+			{R: NewRecord("C:1:1:1:1:1:1", chr1, 20, s1F, 20, chr1, cigar0), DupFlag: false},
+			{R: NewRecord("C:1:1:1:1:1:1", chr1, 20, u2, 20, chr1, nil), DupFlag: false},
+			{R: NewRecord("U:1:1:1:1:1:1", nil, -1, up1, -1, nil, nil), DupFlag: false},
+			{R: NewRecord("U:1:1:1:1:1:1", nil, -1, up2, -1, nil, nil), DupFlag: false},
+		}
+	}
+	cases := []TestCase{
+		{newRecords(false), defaultOpts},
+		{newRecords(true), followMate},
+	}
+	RunTestCases(t, header, cases)
+}
+
+func TestFixMate(t *testing.T) {
+	newRecords := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecordAux("A:1:1:1:1:1:1", chr1, 0, r1F, 50, chr1, cigar0, NewAux("MC", "5M")),
+			NewRecord("B:1:1:1:1:1:1", chr1, 40, r1F|sam.MateReverse, 40, chr1, cigar100M),
+			NewRecord("B:1:1:1:1:1:1", chr1, 40, r2F|sam.MateReverse, 40, chr1, cigar0),
+			NewRecord("A:1:1:1:1:1:1", chr1, 50, r2R, 0, chr1, cigar0),
+			NewRecord("C:1:1:1:1:1:1", chr1, 60, r1F, 55, chr2, cigar0),
+			NewRecord("C:1:1:1:1:1:1", chr2, 55, r2R, 60, chr1, cigar0),
+		}
+	}
+	expected := []struct {
+		flags   sam.Flags
+		tempLen int
+		mc      string
+	}{
+		{r1F | sam.MateReverse, 60, "10M"},
+		{r1F, 100, "10M"},
+		{r2F, -100, "100M"},
+		{r2R, -60, "10M"},
+		{r1F | sam.MateReverse, 0, "10M"},
+		{r2R, 0, "10M"},
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.TagDups = false
+		opts.FixMate = true
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, newRecords()),
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+
+		actualRecords := ReadRecords(t, opts.OutputPath)
+		assert.Equal(t, len(expected), len(actualRecords))
+		for i, r := range actualRecords {
+			assert.Equal(t, expected[i].flags, r.Flags, "flags of record %d", i)
+			assert.Equal(t, expected[i].tempLen, r.TempLen, "tlen of record %d", i)
+			assert.Equal(t, sam.AuxFields{NewAux("MC", expected[i].mc)}, r.AuxFields, "aux of record %d", i)
+		}
+	}
+}
+
+func TestFixMateStalePosition(t *testing.T) {
+	// A's mates point far past the padding, B's read2 points to the
+	// wrong reference, and C's read1 points to the wrong position in
+	// another shard and claims its mate is unmapped. D's read2 is
+	// unmapped, but read1 doesn't know it.
+	newRecords := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecord("A:1:1:1:1:1:1", chr1, 0, r1F, 500, chr1, cigar0),
+			NewRecord("B:1:1:1:1:1:1", chr1, 5, r1F, 25, chr1, cigar0),
+			NewRecord("A:1:1:1:1:1:1", chr1, 20, r2R, 700, chr1, cigar0),
+			NewRecord("B:1:1:1:1:1:1", chr1, 25, r2R, 5, chr2, cigar0),
+			NewRecord("C:1:1:1:1:1:1", chr1, 250, r1F|sam.MateUnmapped, 900, chr2, cigar0),
+			NewRecord("D:1:1:1:1:1:1", chr1, 300, r1F, 600, chr1, cigar0),
+			NewRecord("D:1:1:1:1:1:1", chr1, 300, r2F|sam.Unmapped, 300, chr1, nil),
+			NewRecord("C:1:1:1:1:1:1", chr2, 100, r2R, 250, chr1, cigar0),
+		}
+	}
+	expected := []struct {
+		flags   sam.Flags
+		mateRef *sam.Reference
+		matePos int
+		tempLen int
+	}{
+		{r1F | sam.MateReverse, chr1, 20, 30},
+		{r1F | sam.MateReverse, chr1, 25, 30},
+		{r2R, chr1, 0, -30},
+		{r2R, chr1, 5, -30},
+		{r1F | sam.MateReverse, chr2, 100, 0},
+		{r1F | sam.MateUnmapped, chr1, 300, 0},
+		{r2F | sam.Unmapped, chr1, 300, 0},
+		{r2R, chr1, 250, 0},
+	}
+
+	// Mark the records with a single shard, and with shards that put
+	// the ends of A and C in different shards.
+	shards := []gbam.Shard{
+		{StartRef: chr1, EndRef: chr1, Start: 0, End: 10, Padding: 5, ShardIdx: 0},
+		{StartRef: chr1, EndRef: chr1, Start: 10, End: chr1.Len(), Padding: 5, ShardIdx: 1},
+		{StartRef: chr2, EndRef: chr2, Start: 0, End: chr2.Len(), Padding: 5, ShardIdx: 2},
+		{StartRef: nil, EndRef: nil, Start: 0, End: math.MaxInt32, ShardIdx: 3},
+	}
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, shards := range [][]gbam.Shard{nil, shards} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.Format = "bam"
+		opts.TagDups = false
+		opts.FixMate = true
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, newRecords()),
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(shards)
+		assert.NoError(t, err)
+
+		actualRecords := ReadRecords(t, opts.OutputPath)
+		assert.Equal(t, len(expected), len(actualRecords))
+		for i, r := range actualRecords {
+			assert.Equal(t, expected[i].flags, r.Flags, "flags of record %d", i)
+			assert.Equal(t, expected[i].mateRef.Name(), r.MateRef.Name(), "mate ref of record %d", i)
+			assert.Equal(t, expected[i].matePos, r.MatePos, "mate pos of record %d", i)
+			assert.Equal(t, expected[i].tempLen, r.TempLen, "tlen of record %d", i)
+		}
+	}
+}
+
+func TestRegenerateTempLen(t *testing.T) {
+	newRecords := func() []*sam.Record {
+		records := []*sam.Record{
+			NewRecordAux("A:1:1:1:1:1:1", chr1, 0, r1F, 50, chr1, cigar0, NewAux("MC", "5M")),
+			NewRecord("B:1:1:1:1:1:1", chr1, 40, r1F, 40, chr1, cigar100M),
+			NewRecord("B:1:1:1:1:1:1", chr1, 40, r2F, 40, chr1, cigar0),
+			NewRecord("A:1:1:1:1:1:1", chr1, 50, r2R, 0, chr1, cigar0),
+			NewRecord("C:1:1:1:1:1:1", chr1, 60, r1F, 55, chr2, cigar0),
+			NewRecord("C:1:1:1:1:1:1", chr2, 55, r2R, 60, chr1, cigar0),
+		}
+		for _, r := range records {
+			r.TempLen = 7
+		}
+		return records
+	}
+	// Only the template lengths change, the mate fields and MC tags are
+	// not fixed.
+	expected := []struct {
+		tempLen int
+		auxs    sam.AuxFields
+	}{
+		{60, sam.AuxFields{NewAux("MC", "5M")}},
+		{100, nil},
+		{-100, nil},
+		{-60, nil},
+		{0, nil},
+		{0, nil},
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.TagDups = false
+		opts.FieldPolicies = map[gbam.FieldType]FieldPolicy{gbam.FieldTempLen: FieldRegenerate}
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, newRecords()),
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+
+		actualRecords := ReadRecords(t, opts.OutputPath)
+		assert.Equal(t, len(expected), len(actualRecords))
+		for i, r := range actualRecords {
+			assert.Equal(t, expected[i].tempLen, r.TempLen, "tlen of record %d", i)
+			assert.Equal(t, len(expected[i].auxs), len(r.AuxFields), "aux of record %d", i)
+		}
+	}
+}
+
+func TestSortByName(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	testrecords := []*sam.Record{
+		NewRecord("C:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecord("A:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecord("B:1:1:1:1:1:1", chr1, 5, r1F, 20, chr1, cigar0),
+		NewRecord("A:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+		NewRecord("C:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+		NewRecord("B:1:1:1:1:1:1", chr1, 20, r2R, 5, chr1, cigar0),
+		NewRecord("D:1:1:1:1:1:1", nil, -1, up2, -1, nil, nil),
+		NewRecord("D:1:1:1:1:1:1", nil, -1, up1, -1, nil, nil),
+	}
+	opts := defaultOpts
+	opts.OutputPath = NewTestOutput(tempDir, 0, "bam")
+	opts.Format = "bam"
+	opts.ScratchDir = tempDir
+	opts.SortByName = true
+	opts.SortChunkSize = 3
+	markDuplicates := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(header, testrecords),
+		Opts:     &opts,
+	}
+	_, err := markDuplicates.Mark(nil)
+	assert.NoError(t, err)
+
+	expected := []struct {
+		name    string
+		flags   sam.Flags
+		dupFlag bool
+	}{
+		{"A:1:1:1:1:1:1", r1F, true},
+		{"A:1:1:1:1:1:1", r2R, true},
+		{"B:1:1:1:1:1:1", r1F, false},
+		{"B:1:1:1:1:1:1", r2R, false},
+		{"C:1:1:1:1:1:1", r1F, false},
+		{"C:1:1:1:1:1:1", r2R, false},
+		{"D:1:1:1:1:1:1", up1, false},
+		{"D:1:1:1:1:1:1", up2, false},
+	}
+	actualRecords := ReadRecords(t, opts.OutputPath)
+	assert.Equal(t, len(expected), len(actualRecords))
+	for i, r := range actualRecords {
+		assert.Equal(t, expected[i].name, r.Name)
+		assert.Equal(t, expected[i].flags, r.Flags&^sam.Duplicate)
+		assert.Equal(t, expected[i].dupFlag, r.Flags&sam.Duplicate != 0)
+	}
+
+	in, err := os.Open(opts.OutputPath)
+	assert.NoError(t, err)
+	defer in.Close() // nolint: errcheck
+	reader, err := bam.NewReader(in, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, sam.QueryName, reader.Header().SortOrder)
+
+	// The scratch files should be removed.
+	files, err := ioutil.ReadDir(tempDir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+}
+
+func TestSortByNameFanIn(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	scratchDir := filepath.Join(tempDir, "scratch")
+	assert.NoError(t, os.Mkdir(scratchDir, 0700))
+
+	// E's secondary alignments compare equal, so they must keep their
+	// input order through each level of the merge.
+	inputPath := filepath.Join(tempDir, "unsorted.bam")
+	assert.NoError(t, writeRecords(inputPath, header, []*sam.Record{
+		NewRecord("C:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecord("E:1:1:1:1:1:1", chr1, 1, r1F|sam.Secondary, 10, chr1, cigar0),
+		NewRecord("A:1:1:1:1:1:1", chr1, 2, r1F, 10, chr1, cigar0),
+		NewRecord("E:1:1:1:1:1:1", chr1, 3, r1F|sam.Secondary, 10, chr1, cigar0),
+		NewRecord("B:1:1:1:1:1:1", chr1, 5, r1F, 20, chr1, cigar0),
+		NewRecord("A:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+		NewRecord("C:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+		NewRecord("E:1:1:1:1:1:1", chr1, 15, r1F|sam.Secondary, 10, chr1, cigar0),
+		NewRecord("B:1:1:1:1:1:1", chr1, 20, r2R, 5, chr1, cigar0),
+	}, 1))
+
+	// With one record per chunk and a fan-in of 2, the 9 chunks take
+	// three levels of merging before the final merge.
+	outputPath := filepath.Join(tempDir, "sorted.bam")
+	assert.NoError(t, sortByName(vcontext.Background(), &defaultOpts, inputPath, outputPath, scratchDir, 1, 2, 1))
+	var actual []string
+	for _, r := range ReadRecords(t, outputPath) {
+		actual = append(actual, fmt.Sprintf("%s %d", r.Name[:1], r.Pos))
+	}
+	assert.Equal(t, []string{"A 2", "A 10", "B 5", "B 20", "C 0", "C 10", "E 1", "E 3", "E 15"}, actual)
+
+	// Only the final merge's chunks are left in the scratch directory.
+	files, err := ioutil.ReadDir(scratchDir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(files))
+}
+
+func TestPreserveOrder(t *testing.T) {
+	newRecords := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecord("Z:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("B:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("X:1:1:1:1:1:1", chr1, 0, sec, 10, chr1, cigar0),
+			NewRecord("M:1:1:1:1:1:1", chr1, 0, s1F, 0, chr1, cigar0),
+			NewRecord("M:1:1:1:1:1:1", chr1, 0, u2|sam.MateUnmapped, 0, chr1, cigar0),
+			NewRecord("B:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+			NewRecord("Z:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+			NewRecord("A:1:1:1:1:1:1", chr1, 50, r1F, 55, chr2, cigar0),
+			NewRecord("A:1:1:1:1:1:1", chr2, 55, r2F, 50, chr1, cigar0),
+			NewRecord("E:1:1:1:1:1:1", nil, -1, up2, -1, nil, nil),
+			NewRecord("D:1:1:1:1:1:1", nil, -1, up1, -1, nil, nil),
+			NewRecord("E:1:1:1:1:1:1", nil, -1, up1, -1, nil, nil),
+			NewRecord("D:1:1:1:1:1:1", nil, -1, up2, -1, nil, nil),
+		}
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.PreserveOrder = true
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, newRecords()),
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+
+		// Apart from flags and tags, the output should match the input.
+		expected := newRecords()
+		actualRecords := ReadRecords(t, opts.OutputPath)
+		assert.Equal(t, len(expected), len(actualRecords))
+		for i, r := range actualRecords {
+			assert.Equal(t, expected[i].Name, r.Name, "record %d", i)
+			assert.Equal(t, expected[i].Ref.ID(), r.Ref.ID(), "record %d", i)
+			assert.Equal(t, expected[i].Pos, r.Pos, "record %d", i)
+			assert.Equal(t, expected[i].Flags, r.Flags&^sam.Duplicate, "record %d", i)
+		}
+		assert.Equal(t, sam.Duplicate, actualRecords[1].Flags&sam.Duplicate)
+		assert.Equal(t, sam.Duplicate, actualRecords[3].Flags&sam.Duplicate)
+		assert.Equal(t, sam.Duplicate, actualRecords[5].Flags&sam.Duplicate)
+	}
+
+	// A RecordPredicate could drop records.
+	opts := defaultOpts
+	opts.BamFile = "input.bam"
+	opts.MinBases = 1
+	opts.ScavengeUmis = -1
+	opts.Format = "bam"
+	opts.PreserveOrder = true
+	assert.NoError(t, validate(&opts))
+	opts.RecordPredicate = func(r *sam.Record) Action { return Process }
+	assert.Error(t, validate(&opts))
+}
+
 // Ensure that int-di mode correctly formats DI aux tag as 'i' integer.
+func TestEstimate(t *testing.T) {
+	newRecords := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecord("A:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("B:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("C:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("S:1:1:1:1:1:1", chr1, 5, s1F, 0, chr1, cigar0),
+			NewRecord("A:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+			NewRecord("B:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+			NewRecord("C:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+			NewRecord("D:1:1:1:1:1:1", chr1, 20, r1F, 30, chr1, cigar0),
+			NewRecord("D:1:1:1:1:1:1", chr1, 30, r2R, 20, chr1, cigar0),
+			NewRecord("E:1:1:1:1:1:1", nil, -1, up1, -1, nil, nil),
+			NewRecord("E:1:1:1:1:1:1", nil, -1, up2, -1, nil, nil),
+		}
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	opts := defaultOpts
+	opts.OutputPath = NewTestOutput(tempDir, 0, "bam")
+	opts.Format = "bam"
+	markDuplicates := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(header, newRecords()),
+		Opts:     &opts,
+	}
+	expectedMetrics, err := markDuplicates.Mark(nil)
+	assert.NoError(t, err)
+	expected := *expectedMetrics.LibraryMetrics["Unknown Library"]
+	// The estimate ignores unmapped reads.
+	expected.UnmappedReads = 0
+
+	estimateOpts := defaultOpts
+	estimateOpts.OutputPath = NewTestOutput(tempDir, 1, "bam")
+	estimateOpts.Format = "bam"
+	estimateOpts.EstimateFraction = 0.5
+	markDuplicates = &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(header, newRecords()),
+		Opts:     &estimateOpts,
+	}
+	actualMetrics, err := markDuplicates.Mark(nil)
+	assert.NoError(t, err)
+
+	// The fake provider has a single mapped shard, so the sample is
+	// the whole input and the estimate is exact.
+	assert.Equal(t, 1, len(actualMetrics.LibraryMetrics))
+	assert.Equal(t, expected, *actualMetrics.LibraryMetrics["Unknown Library"])
+	assert.Equal(t, 4, expected.ReadPairDups)
+
+	// No output is written.
+	_, err = os.Stat(estimateOpts.OutputPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownsample(t *testing.T) {
+	const numPairs = 2000
+	newRecords := func() []*sam.Record {
+		// Pair i has its R1 at chr1:i%400 and its R2 100 bases after.
+		var records []*sam.Record
+		for pos := 0; pos < 500; pos++ {
+			for i := pos; pos < 400 && i < numPairs; i += 400 {
+				records = append(records, NewRecord(fmt.Sprintf("A%d:1:1:1:1:1:1", i), chr1, pos, r1F, pos+100, chr1, cigar0))
+			}
+			for i := pos - 100; pos >= 100 && i < numPairs; i += 400 {
+				records = append(records, NewRecord(fmt.Sprintf("A%d:1:1:1:1:1:1", i), chr1, pos, r2R, pos-100, chr1, cigar0))
+			}
+		}
+		for i := 0; i < 100; i++ {
+			records = append(records, NewRecord(fmt.Sprintf("U%d:1:1:1:1:1:1", i), nil, -1, up1, -1, nil, nil))
+			records = append(records, NewRecord(fmt.Sprintf("U%d:1:1:1:1:1:1", i), nil, -1, up2, -1, nil, nil))
+		}
+		return records
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	downsample := func(i int, fraction float64, seed int64) ([]*sam.Record, *MetricsCollection) {
+		opts := defaultOpts
+		opts.Padding = 150
+		opts.OutputPath = NewTestOutput(tempDir, i, "bam")
+		opts.Format = "bam"
+		opts.DownsampleFraction = fraction
+		opts.Seed = seed
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, newRecords()),
+			Opts:     &opts,
+		}
+		metrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		return ReadRecords(t, opts.OutputPath), metrics
+	}
+
+	all, _ := downsample(0, 0, 0)
+	assert.Equal(t, 2*numPairs+200, len(all))
+
+	names := func(records []*sam.Record) map[string]int {
+		counts := map[string]int{}
+		for _, r := range records {
+			counts[r.Name]++
+		}
+		return counts
+	}
+	actual, metrics := downsample(1, 0.3, 1)
+	counts := names(actual)
+	// Both reads of each pair are kept or removed together.
+	for name, count := range counts {
+		assert.Equal(t, 2, count, name)
+	}
+	kept := float64(len(counts))
+	assert.Greater(t, kept, 0.3*(numPairs+100)*0.9)
+	assert.Less(t, kept, 0.3*(numPairs+100)*1.1)
+	// The removed readpairs are not in the metrics.
+	mapped := 0
+	for name := range counts {
+		if name[0] == 'A' {
+			mapped++
+		}
+	}
+	assert.Equal(t, 2*mapped, metrics.LibraryMetrics["Unknown Library"].ReadPairsExamined)
+
+	// The same seed keeps the same readpairs, and a different seed
+	// keeps different ones.
+	again, _ := downsample(2, 0.3, 1)
+	assert.Equal(t, counts, names(again))
+	other, _ := downsample(3, 0.3, 2)
+	assert.NotEqual(t, counts, names(other))
+
+	// A fraction of 1 keeps every readpair.
+	whole, _ := downsample(4, 1, 1)
+	assert.Equal(t, names(all), names(whole))
+}
+
 func TestIntDI(t *testing.T) {
 	tempDir, cleanup := testutil.TempDir(t, "", "")
 	defer cleanup()
@@ -1079,6 +2175,195 @@ func TestOpticalHistogram(t *testing.T) {
 	}
 }
 
+// Verify that each optical duplicate pair is reported, including the
+// readpair it was a duplicate of.
+func TestOpticalPairs(t *testing.T) {
+	records := []*sam.Record{
+		NewRecord("oA:::1:10:1:1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("oB:::1:10:4:5", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("oC:::1:11:1:1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("oD:::1:10:5000:5000", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("oA:::1:10:1:1", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("oB:::1:10:4:5", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("oC:::1:11:1:1", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("oD:::1:10:5000:5000", chr1, 100, r2R, 0, chr1, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.OpticalPairsFile = filepath.Join(tempDir, "optical-pairs.txt")
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []OpticalPair{
+			{
+				Duplicate:         "oB:::1:10:4:5",
+				DuplicateLocation: PhysicalLocation{Lane: 1, TileName: 10, TileNumber: 10, X: 4, Y: 5},
+				Original:          "oA:::1:10:1:1",
+				OriginalLocation:  PhysicalLocation{Lane: 1, TileName: 10, TileNumber: 10, X: 1, Y: 1},
+				Distance:          5,
+			},
+		}, actualMetrics.OpticalPairs)
+
+		assert.NoError(t, writeOpticalPairs(vcontext.Background(), &opts, actualMetrics))
+		contents, err := ioutil.ReadFile(opts.OpticalPairsFile)
+		assert.NoError(t, err)
+		assert.Equal(t,
+			"#duplicate\toriginal\tlane\ttile\tduplicate_x\tduplicate_y\toriginal_x\toriginal_y\toptical_dist\n"+
+				"oB:::1:10:4:5\toA:::1:10:1:1\t1\t10\t4\t5\t1\t1\t5\n",
+			string(contents))
+	}
+}
+
+func TestLaneMetrics(t *testing.T) {
+	records := []*sam.Record{
+		NewRecord("oA:::1:10:1:1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("oB:::1:10:4:5", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("oC:::2:10:1:1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("oD:::2:10:5000:5000", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("oA:::1:10:1:1", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("oB:::1:10:4:5", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("oC:::2:10:1:1", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("oD:::2:10:5000:5000", chr1, 100, r2R, 0, chr1, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.MetricsFile = filepath.Join(tempDir, "metrics.txt")
+		opts.LaneMetricsFile = filepath.Join(tempDir, "lane_metrics.txt")
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]map[int]*LaneMetrics{
+			"Unknown Library": {
+				1: {ReadPairsExamined: 4, ReadPairOpticalDups: 2},
+				2: {ReadPairsExamined: 4, ReadPairOpticalDups: 0},
+			},
+		}, actualMetrics.LaneMetrics)
+		assert.Equal(t, 2, actualMetrics.LibraryMetrics["Unknown Library"].ReadPairOpticalDups)
+
+		// The metrics file keeps Picard's format, and the lanes go to
+		// their own file.
+		assert.NoError(t, writeMetrics(vcontext.Background(), &opts, actualMetrics))
+		contents, err := ioutil.ReadFile(opts.MetricsFile)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(contents), "LANE")
+		assert.NoError(t, writeLaneMetrics(vcontext.Background(), &opts, actualMetrics))
+		contents, err = ioutil.ReadFile(opts.LaneMetricsFile)
+		assert.NoError(t, err)
+		assert.Equal(t,
+			"LIBRARY\tLANE\tREAD_PAIRS_EXAMINED\tREAD_PAIR_OPTICAL_DUPLICATES\tPERCENT_OPTICAL_DUPLICATION\n"+
+				"Unknown Library\t1\t2\t1\t50.000000\n"+
+				"Unknown Library\t2\t2\t0\t0.000000\n", string(contents))
+	}
+}
+
+func TestFlagstat(t *testing.T) {
+	newRecords := func() []*sam.Record {
+		qcFail1 := NewRecord("C:::1:10:1:1", chr1, 400, r1F|sam.QCFail, 50, chr2, cigar0)
+		qcFail1.MapQ = 30
+		qcFail2 := NewRecord("C:::1:10:1:1", chr2, 50, r2F|sam.QCFail, 400, chr1, cigar0)
+		qcFail2.MapQ = 3
+		return []*sam.Record{
+			NewRecord("A:::1:10:1:1", chr1, 0, r1F|sam.ProperPair, 100, chr1, cigar0),
+			NewRecord("B:::1:10:1:1", chr1, 0, r1F|sam.ProperPair, 100, chr1, cigar0),
+			NewRecord("A:::1:10:1:1", chr1, 100, r2R|sam.ProperPair, 0, chr1, cigar0),
+			NewRecord("B:::1:10:1:1", chr1, 100, r2R|sam.ProperPair, 0, chr1, cigar0),
+			NewRecord("S:::1:10:1:1", chr1, 200, s1F, 200, chr1, cigar0),
+			NewRecord("S:::1:10:1:1", chr1, 200, u2|sam.MateUnmapped, 200, chr1, cigar0),
+			NewRecord("X:::1:10:1:1", chr1, 300, sec, 300, chr1, cigar0),
+			qcFail1,
+			qcFail2,
+			NewRecord("E:::1:10:1:1", nil, -1, up1, -1, nil, nil),
+			NewRecord("E:::1:10:1:1", nil, -1, up2, -1, nil, nil),
+		}
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.FlagstatFile = filepath.Join(tempDir, "flagstat.txt")
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, newRecords()),
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, Flagstat{
+			Total:             [2]int{9, 2},
+			Primary:           [2]int{8, 2},
+			Secondary:         [2]int{1, 0},
+			Duplicates:        [2]int{2, 0},
+			PrimaryDuplicates: [2]int{2, 0},
+			Mapped:            [2]int{6, 2},
+			PrimaryMapped:     [2]int{5, 2},
+			Paired:            [2]int{8, 2},
+			Read1:             [2]int{4, 1},
+			Read2:             [2]int{4, 1},
+			ProperlyPaired:    [2]int{4, 0},
+			BothMapped:        [2]int{4, 2},
+			Singletons:        [2]int{1, 0},
+			MateDiffChr:       [2]int{0, 2},
+			MateDiffChrMapQ5:  [2]int{0, 1},
+		}, actualMetrics.Flagstat)
+
+		assert.NoError(t, writeFlagstat(vcontext.Background(), &opts, actualMetrics))
+		contents, err := ioutil.ReadFile(opts.FlagstatFile)
+		assert.NoError(t, err)
+		assert.Equal(t,
+			"9 + 2 in total (QC-passed reads + QC-failed reads)\n"+
+				"8 + 2 primary\n"+
+				"1 + 0 secondary\n"+
+				"0 + 0 supplementary\n"+
+				"2 + 0 duplicates\n"+
+				"2 + 0 primary duplicates\n"+
+				"6 + 2 mapped (66.67% : 100.00%)\n"+
+				"5 + 2 primary mapped (62.50% : 100.00%)\n"+
+				"8 + 2 paired in sequencing\n"+
+				"4 + 1 read1\n"+
+				"4 + 1 read2\n"+
+				"4 + 0 properly paired (50.00% : 0.00%)\n"+
+				"4 + 2 with itself and mate mapped\n"+
+				"1 + 0 singletons (12.50% : 0.00%)\n"+
+				"0 + 2 with mate mapped to a different chr\n"+
+				"0 + 1 with mate mapped to a different chr (mapQ>=5)\n",
+			string(contents))
+
+		// Removed duplicates are not counted.
+		opts.RemoveDups = true
+		markDuplicates = &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, newRecords()),
+			Opts:     &opts,
+		}
+		actualMetrics, err = markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, [2]int{7, 2}, actualMetrics.Flagstat.Total)
+		assert.Equal(t, [2]int{0, 0}, actualMetrics.Flagstat.Duplicates)
+	}
+}
+
 func TestOpticalHistogramMax(t *testing.T) {
 	const max = 1000
 	var records []*sam.Record
@@ -1870,7 +3155,7 @@ func TestMetricsString(t *testing.T) {
 
 func TestAlignDistCheck(t *testing.T) {
 	var (
-		max int
+		max = make(map[string]int)
 		m   sync.Mutex
 	)
 	shard := gbam.Shard{
@@ -1885,7 +3170,7 @@ func TestAlignDistCheck(t *testing.T) {
 	}
 	c := maxAlignDistCheck{
 		padding:            10,
-		globalMaxAlignDist: &max,
+		globalMaxAlignDist: max,
 		mutex:              &m,
 	}
 	assert.NoError(t, c.Process(shard, NewRecord("A", chr1, 0, r1F, 100, chr1,
@@ -1938,6 +3223,43 @@ func TestAlignDistCheck(t *testing.T) {
 			sam.NewCigarOp(sam.CigarMatch, 12),
 		})),
 		"alignment distance(%d) exceeds padding(%d) on read: %v", 11, 10, "A")
+	c.Close(shard)
+	assert.Equal(t, map[string]int{"Unknown Library": 10}, max)
+}
+
+func TestAlignDistCheckWarn(t *testing.T) {
+	var (
+		max      = make(map[string]int)
+		exceeded int
+		m        sync.Mutex
+	)
+	shard := gbam.Shard{
+		StartRef: chr1,
+		EndRef:   chr1,
+		Start:    0,
+		End:      100,
+		ShardIdx: 0,
+	}
+	c := maxAlignDistCheck{
+		padding:            10,
+		policy:             AlignDistWarn,
+		globalMaxAlignDist: max,
+		globalExceeded:     &exceeded,
+		mutex:              &m,
+	}
+	assert.NoError(t, c.Process(shard, NewRecord("A", chr1, 0, r1F, 100, chr1,
+		[]sam.CigarOp{
+			sam.NewCigarOp(sam.CigarSoftClipped, 5),
+			sam.NewCigarOp(sam.CigarMatch, 10),
+		})))
+	assert.NoError(t, c.Process(shard, NewRecord("B", chr1, 10, r1R, 100, chr1,
+		[]sam.CigarOp{
+			sam.NewCigarOp(sam.CigarMatch, 10),
+			sam.NewCigarOp(sam.CigarHardClipped, 3),
+		})))
+	c.Close(shard)
+	assert.Equal(t, map[string]int{"Unknown Library": 12}, max)
+	assert.Equal(t, 1, exceeded)
 }
 
 func TestAlignDistCheckIntegration(t *testing.T) {
@@ -1967,6 +3289,138 @@ func TestAlignDistCheckIntegration(t *testing.T) {
 	assert.Error(t, err, "alignment distance(%d) exceeds padding(%d) on read: %v", 13, 10, "A")
 }
 
+func TestAlignDistPerLibrary(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	libraryHeader := header.Clone()
+	for _, name := range []string{"rgA", "rgB"} {
+		rg, err := sam.NewReadGroup(name, "", "", "lib"+name, "", "", "", "", "", "", time.Time{}, 0)
+		assert.NoError(t, err)
+		assert.NoError(t, libraryHeader.AddReadGroup(rg))
+	}
+	rgA := NewAux("RG", "rgA")
+	rgB := NewAux("RG", "rgB")
+	clipped := []sam.CigarOp{
+		sam.NewCigarOp(sam.CigarSoftClipped, 15),
+		sam.NewCigarOp(sam.CigarMatch, 10),
+	}
+	testrecords := []*sam.Record{
+		NewRecordAux("A:1:1:1:1:1:1", chr1, 0, r1F, 20, chr1, cigar0, rgA),
+		NewRecordAux("B:1:1:1:1:1:1", chr1, 15, r1F, 30, chr1, clipped, rgB),
+		NewRecordAux("A:1:1:1:1:1:1", chr1, 20, r2R, 0, chr1, cigar0, rgA),
+		NewRecordAux("B:1:1:1:1:1:1", chr1, 30, r2R, 15, chr1, cigar0, rgB),
+	}
+
+	for _, test := range []struct {
+		policy   AlignDistPolicy
+		expected map[string]int
+	}{
+		{AlignDistFail, nil},
+		{AlignDistWarn, map[string]int{"librgA": 9, "librgB": 15}},
+	} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, 0, "bam")
+		opts.Format = "bam"
+		opts.AlignDistPolicy = test.policy
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(libraryHeader, testrecords),
+			Opts:     &opts,
+		}
+		metrics, err := markDuplicates.Mark(nil)
+		if test.expected == nil {
+			assert.Error(t, err, "policy %v", test.policy)
+			continue
+		}
+		assert.NoError(t, err, "policy %v", test.policy)
+		assert.Equal(t, test.expected, metrics.MaxAlignDist, "policy %v", test.policy)
+	}
+}
+
+func TestValidateMarked(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	testrecords := []*sam.Record{
+		NewRecord("A:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecord("B:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecord("S:::1:10:1:1", chr1, 10, s2R, 0, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+		NewRecord("B:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+		NewRecord("T:::1:10:1:1", chr1, 20, s1F, 0, chr1, cigar0),
+		NewRecord("U:::1:10:1:1", chr1, 20, s1F, 0, chr1, cigar0),
+		NewRecord("C:::1:10:1:1", chr1, 50, r1F, 55, chr2, cigar0),
+		NewRecord("D:::1:10:1:1", chr1, 50, r1F, 55, chr2, cigar0),
+		NewRecord("C:::1:10:1:1", chr2, 55, r2F, 50, chr1, cigar0),
+		NewRecord("D:::1:10:1:1", chr2, 55, r2F, 50, chr1, cigar0),
+		NewRecord("E:::1:10:1:1", nil, -1, up1, -1, nil, nil),
+		NewRecord("E:::1:10:1:1", nil, -1, up2, -1, nil, nil),
+	}
+	outputPath := NewTestOutput(tempDir, 0, "bam")
+	opts := defaultOpts
+	opts.OutputPath = outputPath
+	opts.Format = "bam"
+	markDuplicates := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(header, testrecords),
+		Opts:     &opts,
+	}
+	_, err := markDuplicates.Mark(nil)
+	assert.NoError(t, err)
+
+	// The output of the sharded pipeline should agree with the reference.
+	marked := ReadRecords(t, outputPath)
+	mismatches, err := ValidateMarked(bamprovider.NewFakeProvider(header, marked), &opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []FlagMismatch{}, mismatches)
+
+	// Flip the duplicate flag on two records, and expect them to be reported.
+	marked[1].Flags ^= sam.Duplicate
+	marked[5].Flags ^= sam.Duplicate
+	mismatches, err = ValidateMarked(bamprovider.NewFakeProvider(header, marked), &opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(mismatches))
+	assert.Equal(t, uint64(1), mismatches[0].FileIdx)
+	assert.Equal(t, "B:::1:10:1:1", mismatches[0].Name)
+	assert.Equal(t, true, mismatches[0].Expected)
+	assert.Equal(t, uint64(5), mismatches[1].FileIdx)
+	assert.Equal(t, "T:::1:10:1:1", mismatches[1].Name)
+	assert.Equal(t, false, mismatches[1].Expected)
+
+	// A record whose mate is missing is reported, even though its flag
+	// agrees with the reference.
+	marked[1].Flags ^= sam.Duplicate
+	marked[5].Flags ^= sam.Duplicate
+	var withoutMate []*sam.Record
+	for _, r := range marked {
+		if r.Ref.Name() == "chr2" && withoutMate[len(withoutMate)-1].Ref.Name() == "chr1" {
+			withoutMate = append(withoutMate, NewRecord("V:::1:10:1:1", chr1, 500, r1F, 900, chr1, cigar0))
+		}
+		withoutMate = append(withoutMate, r)
+	}
+	mismatches, err = ValidateMarked(bamprovider.NewFakeProvider(header, withoutMate), &opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(mismatches))
+	assert.Equal(t, "V:::1:10:1:1", mismatches[0].Name)
+	assert.False(t, mismatches[0].Expected)
+	assert.True(t, mismatches[0].MissingMate)
+
+	// The reference doesn't implement these options, so reject them.
+	for _, update := range []func(*Opts){
+		func(o *Opts) { o.UseUmis = true },
+		func(o *Opts) { o.UmiNPolicy = UmiNDrop },
+		func(o *Opts) { o.DownsampleFraction = 0.5 },
+		func(o *Opts) { o.CoverageMax = 100 },
+		func(o *Opts) { o.UnmappedMatePolicy = UnmappedMateFollow },
+		func(o *Opts) { o.PassThroughRefs = []string{"chr2"} },
+		func(o *Opts) { o.Regions = []string{"chr1"} },
+	} {
+		badOpts := opts
+		update(&badOpts)
+		_, err = ValidateMarked(bamprovider.NewFakeProvider(header, marked), &badOpts)
+		assert.Error(t, err)
+	}
+}
+
 func TestMetricsCollection(t *testing.T) {
 	m := MetricsCollection{
 		OpticalDistance: make([][]int64, 1),
@@ -18,17 +18,18 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"hash"
 	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/grailbio/base/errors"
-	"github.com/grailbio/base/file"
 	"github.com/grailbio/base/intervalmap"
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/base/vcontext"
@@ -73,16 +74,60 @@ type OpticalDetector interface {
 	Detect(readGroupLibrary map[string]string, pairs []DuplicateEntry, bestIndex int) []string
 }
 
+// OpticalPairDetector is an OpticalDetector that can also report
+// which readpair each optical duplicate was found to be a duplicate
+// of. It is required when Opts.OpticalPairsFile is set.
+type OpticalPairDetector interface {
+	OpticalDetector
+
+	// DetectPairs is like Detect, but returns an OpticalPair for each
+	// optical duplicate instead of just its name.
+	DetectPairs(readGroupLibrary map[string]string, pairs []DuplicateEntry, bestIndex int) []OpticalPair
+}
+
+// Action is returned by Opts.RecordPredicate to tell Mark how to
+// handle an input record.
+type Action int
+
+const (
+	// Process considers the record for duplicate detection as usual.
+	Process Action = iota
+	// PassThrough writes the record to the output without considering
+	// it for duplicate detection.
+	PassThrough
+	// Drop neither considers the record for duplicate detection nor
+	// writes it to the output.
+	Drop
+)
+
+// dropFilter is a RecordProcessor that hides the records that
+// predicate drops from the wrapped RecordProcessor, so that dropped
+// records don't count towards coverage, the maximum alignment distance
+// or the optical detector's tile bounds.
+type dropFilter struct {
+	bampair.RecordProcessor
+	predicate func(*sam.Record) Action
+}
+
+func (f *dropFilter) Process(shard bam.Shard, r *sam.Record) error {
+	if f.predicate(r) == Drop {
+		return nil
+	}
+	return f.RecordProcessor.Process(shard, r)
+}
+
 // Opts for mark-duplicates.
 type Opts struct {
 	// Commandline options.
 	BamFile                  string
 	IndexFile                string
+	Sequential               bool
 	MetricsFile              string
 	HighCoverageIntervalFile string
 	TileSizeFile             string
 	Format                   string
 	CoverageMax              int
+	CoverageExcludeSkips     bool
 	ShardSize                int
 	MinBases                 int
 	Padding                  int
@@ -93,22 +138,68 @@ type Opts struct {
 	ClearExisting            bool
 	RemoveDups               bool
 	TagDups                  bool
+	TagConfidence            bool
 	IntDI                    bool
 	UseUmis                  bool
 	UmiFile                  string
 	ScavengeUmis             int
+	UmiNPolicy               UmiNPolicy
+	AlignDistPolicy          AlignDistPolicy
+	UnmappedMatePolicy       UnmappedMatePolicy
+	CorruptBlockPolicy       CorruptBlockPolicy
 	EmitUnmodifiedFields     bool
+	FieldPolicies            map[bam.FieldType]FieldPolicy
+	FixMate                  bool
+	SortByName               bool
+	SortChunkSize            int
+	PreserveOrder            bool
+	IORetries                int
+	IORetryBackoff           time.Duration
+	EstimateFraction         float64
+	DownsampleFraction       float64
 	SeparateSingletons       bool
+	SeparateReadGroups       bool
+	UseBarcodes              bool
+	RnaSeq                   bool
+	UseSpliceJunctions       bool
+	MinMapQ                  int
+	IncludeFlags             sam.Flags
+	ExcludeFlags             sam.Flags
+	PassThroughRefs          []string
+	Regions                  []string
 	OutputPath               string
 	StrandSpecific           bool
 	OpticalHistogram         string
 	OpticalHistogramMax      int
+	OpticalPairsFile         string
+	LaneMetricsFile          string
+	BagMetrics               bool
+	UmiCollisionsFile        string
+	FlagstatFile             string
+	LogFlagstat              bool
+	QCFile                   string
+	MaxDuplication           float64
+	MaxOpticalDuplication    float64
+	MaxHighCoverageBases     int
 	Seed                     int64
 
 	// Data and operators derived from commandline options.
 	BagProcessorFactories []BagProcessorFactory
 	OpticalDetector       OpticalDetector
 	KnownUmis             []byte
+
+	// RecordPredicate, if set, is applied to each input record to
+	// decide how to handle it. It may be called more than once for
+	// the same record, so it must be deterministic. A readpair only
+	// participates in duplicate detection if RecordPredicate returns
+	// Process for both reads. Dropped records are not counted for
+	// coverage, so they never cause kept records to be subsampled.
+	RecordPredicate func(*sam.Record) Action
+
+	// Sink, if set, creates the writers for the metrics, high-coverage
+	// intervals, tile size, optical histogram, optical pairs, umi
+	// collisions and flagstat outputs, instead of writing them to files.
+	Sink Sink
 }
 
 type duplicateMatcher interface {
@@ -116,76 +207,60 @@ type duplicateMatcher interface {
 	insertPair(a, b *sam.Record, aFileIdx, bFileIdx uint64)
 	computeDupSets(*MetricsCollection)
 	nextDupSet() (*duplicateSet, bool)
-}
-
-type maxAlignDistCheck struct {
-	clearExisting      bool
-	padding            int
-	maxAlignDist       int
-	globalMaxAlignDist *int
-	mutex              *sync.Mutex
-}
-
-func (m *maxAlignDistCheck) Process(_ bam.Shard, r *sam.Record) error {
-	if m.clearExisting {
-		clearDupFlagTags(r)
-	}
-
-	d := r.Pos - bam.UnclippedFivePrimePosition(r)
-	if d < 0 {
-		d = -d
-	}
-	if d > m.padding {
-		return fmt.Errorf("5' alignment distance(%d) exceeds padding(%d) on read: %v", d, m.padding, r.Name)
-	}
-	if d > m.maxAlignDist {
-		m.maxAlignDist = d
-	}
-	return nil
-}
-
-func (m *maxAlignDistCheck) Close(_ bam.Shard) {
-	log.Debug.Printf("maximum alignment distance: %d", m.maxAlignDist)
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	if m.maxAlignDist > *m.globalMaxAlignDist {
-		*m.globalMaxAlignDist = m.maxAlignDist
-	}
+	getUmiPositions() []*UmiPosition
 }
 
 // MarkDuplicates implements duplicate marking.
 type MarkDuplicates struct {
 	Provider           bamprovider.Provider
 	Opts               *Opts
+	provider           bamprovider.Provider
 	shardList          []bam.Shard
 	highCoverageMap    coverageMap
 	readGroupLibrary   map[string]string
+	passThrough        []bool
+	gapShards          map[int]bool
 	umiCorrector       *umi.SnapCorrector
+	umiWildcard        *umiWildcardMatcher
 	distantMates       *bampair.DistantMateTable
 	shardInfo          *bampair.ShardInfo
 	globalMetrics      *MetricsCollection
-	globalMaxAlignDist int
+	workerMetrics      []*MetricsCollection
+	skipCorrupt        *skipCorruptProvider
+	globalMaxAlignDist map[string]int
+	globalExceeded     int
+	globalSpliced      *splicedEnds
+	splicedPairs       map[int][]*readPair
 	mutex              sync.Mutex
 }
 
 // Mark marks the duplicates, and returns metrics, and an error if encountered.
+// If the metrics exceed the QC thresholds in Opts, Mark returns them
+// along with a *QCError.
 func (m *MarkDuplicates) Mark(shards []bam.Shard) (*MetricsCollection, error) {
-	header, err := m.Provider.GetHeader()
+	// Wrap a copy of Provider, so that calling Mark again does not wrap
+	// it twice.
+	m.provider = m.Provider
+	m.skipCorrupt = nil
+	var input *bamFileProvider
+	if p, ok := m.provider.(*bamprovider.BAMProvider); ok && m.Opts.CorruptBlockPolicy == CorruptBlockSkip {
+		input = &bamFileProvider{BAMProvider: p}
+		m.provider = input
+	}
+	if m.Opts.IORetries > 0 {
+		m.provider = newRetryProvider(m.provider, newRetryPolicy(m.Opts))
+	}
+	if m.Opts.CorruptBlockPolicy == CorruptBlockSkip {
+		m.skipCorrupt = newSkipCorruptProvider(m.provider, input)
+		m.provider = m.skipCorrupt
+	}
+	header, err := m.provider.GetHeader()
 	if err != nil {
 		return nil, err
 	}
 
 	if shards == nil {
-		m.shardList, err = m.Provider.GenerateShards(bamprovider.GenerateShardsOpts{
-			Strategy:                           bamprovider.ByteBased,
-			Padding:                            m.Opts.Padding,
-			IncludeUnmapped:                    true,
-			BytesPerShard:                      int64(m.Opts.ShardSize),
-			MinBasesPerShard:                   m.Opts.MinBases,
-			SplitUnmappedCoords:                false,
-			SplitMappedCoords:                  false,
-			AlwaysSplitMappedAndUnmappedCoords: true,
-		})
+		m.shardList, err = generateShards(m.provider, m.Opts)
 	} else {
 		m.shardList = shards
 	}
@@ -197,56 +272,126 @@ func (m *MarkDuplicates) Mark(shards []bam.Shard) (*MetricsCollection, error) {
 	for _, readGroup := range header.RGs() {
 		m.readGroupLibrary[readGroup.Name()] = readGroup.Library()
 	}
+	m.passThrough = getPassThroughRefs(header, m.Opts.PassThroughRefs)
+
+	// Restrict the shards to the regions, and fetch the mates that lie
+	// outside them.
+	var regionMates []*sam.Record
+	if len(m.Opts.Regions) > 0 {
+		regions, err := parseRegions(header, m.Opts.Regions)
+		if err != nil {
+			return nil, err
+		}
+		m.shardList, m.gapShards = addGapShards(header, getRegionShards(m.shardList, regions))
+		if regionMates, err = m.getRegionMates(m.shardList, m.gapShards); err != nil {
+			return nil, err
+		}
+	}
 
 	// Create umi corrector.
 	if m.Opts.KnownUmis != nil {
 		m.umiCorrector = umi.NewSnapCorrector(m.Opts.KnownUmis)
+		m.umiWildcard = newUmiWildcardMatcher(m.Opts.KnownUmis)
 	}
 
 	m.globalMetrics = newMetricsCollection()
+	m.workerMetrics = make([]*MetricsCollection, m.Opts.Parallelism)
+
+	if m.Opts.EstimateFraction > 0 {
+		metrics, err := m.estimate()
+		if err != nil {
+			return nil, err
+		}
+		return metrics, checkQC(m.Opts, metrics)
+	}
+
+	// Pair the reads by name to repair mate fields that point to the
+	// wrong place, before anything relies on them to find mates.
+	if m.Opts.FixMate {
+		fixes, err := m.findMateFixes(m.provider, m.shardList)
+		if err != nil {
+			return nil, err
+		}
+		if len(fixes) > 0 {
+			m.provider = &fixMateProvider{m.provider, fixes}
+		}
+	}
 
 	// Scan the file once to find each distant mate, and save them to distantMates.
+	m.globalMaxAlignDist = make(map[string]int)
+	m.globalSpliced = newSplicedEnds()
 	log.Debug.Printf("Scanning %d shards", len(m.shardList))
 	distantMatesOpts := &bampair.Opts{
 		Parallelism: m.Opts.Parallelism,
 		DiskShards:  m.Opts.DiskMateShards,
 		ScratchDir:  m.Opts.ScratchDir,
 	}
-	coverageCounts := make(map[int][]int, len(header.Refs()))
-	for _, ref := range header.Refs() {
-		coverageCounts[ref.ID()] = make([]int, ref.Len())
-	}
+	coverageCounts := newCoverageCounts(header)
 	// distantMates creates one of each of these RecordProcessors to process each shard.
 	recordProcessors := []func() bampair.RecordProcessor{
 		func() bampair.RecordProcessor {
 			return &maxAlignDistCheck{
 				clearExisting:      m.Opts.ClearExisting,
 				padding:            m.Opts.Padding,
-				globalMaxAlignDist: &m.globalMaxAlignDist,
+				policy:             m.Opts.AlignDistPolicy,
+				readGroupLibrary:   m.readGroupLibrary,
+				globalMaxAlignDist: m.globalMaxAlignDist,
+				globalExceeded:     &m.globalExceeded,
+				globalSpliced:      m.globalSpliced,
 				mutex:              &m.mutex,
 			}
 		},
 		func() bampair.RecordProcessor {
 			return &coverageCalculator{
 				coverageCounts: &coverageCounts,
+				excludeSkips:   m.Opts.CoverageExcludeSkips,
 			}
 		},
 	}
 	if m.Opts.OpticalDetector != nil {
 		recordProcessors = append(recordProcessors, m.Opts.OpticalDetector.GetRecordProcessor)
 	}
+	if m.Opts.RecordPredicate != nil {
+		for i, newProcessor := range recordProcessors {
+			newProcessor := newProcessor
+			recordProcessors[i] = func() bampair.RecordProcessor {
+				processor := newProcessor()
+				if processor == nil {
+					return nil
+				}
+				return &dropFilter{processor, m.Opts.RecordPredicate}
+			}
+		}
+	}
 
-	distantMates, shardInfo, err := bampair.GetDistantMates(m.Provider, m.shardList,
+	scanProvider := m.provider
+	if m.gapShards != nil {
+		scanProvider = newRegionProvider(scanProvider, m.shardList, m.gapShards, regionMates)
+	}
+	if m.passThrough != nil {
+		scanProvider = &passThroughScanProvider{scanProvider, m.passThrough}
+	}
+	distantMates, shardInfo, err := bampair.GetDistantMates(scanProvider, m.shardList,
 		distantMatesOpts, recordProcessors)
 	if err != nil {
 		return nil, fmt.Errorf("failed while scanning for distant mates: %v", err)
 	}
 	m.distantMates = distantMates
 	m.shardInfo = shardInfo
-	m.globalMetrics.maxAlignDist = m.globalMaxAlignDist
+	m.globalMetrics.MaxAlignDist = m.globalMaxAlignDist
+	if m.globalExceeded > 0 {
+		log.Error.Printf("5' alignment distance exceeds padding(%d) on %d reads, "+
+			"their mates may not be resolved correctly; maximum distance per library: %v",
+			m.Opts.Padding, m.globalExceeded, m.globalMaxAlignDist)
+	}
 	if m.Opts.OpticalDetector != nil {
 		m.globalMetrics.maxX, m.globalMetrics.maxY = m.Opts.OpticalDetector.RecordProcessorsDone()
 	}
+	if len(m.globalSpliced.ends) > 0 {
+		if m.splicedPairs, err = m.findSplicedPairs(scanProvider, m.globalSpliced); err != nil {
+			return nil, err
+		}
+	}
 
 	// Determine high coverage intervals if desired.
 	if m.Opts.CoverageMax > 0 {
@@ -263,16 +408,72 @@ func (m *MarkDuplicates) Mark(shards []bam.Shard) (*MetricsCollection, error) {
 		log.Printf("shard[%d] info: %v", i, m.shardInfo.GetInfoByIdx(i))
 	}
 
+	// Mark sequential input as a single reader streams it, rather than
+	// from the spooled shards. The pam output reads the shards out of
+	// order, so it keeps reading the spooled shards.
+	if p, ok := m.Provider.(*sequentialProvider); ok && bamprovider.ParseFileType(m.Opts.Format) == bamprovider.BAM {
+		if err := p.stream(m.shardList, m.Opts); err != nil {
+			return nil, err
+		}
+	}
+
 	switch bamprovider.ParseFileType(m.Opts.Format) {
 	case bamprovider.BAM:
-		err = m.generateBAM()
+		if m.Opts.SortByName {
+			err = m.generateNameSortedBAM()
+		} else {
+			err = m.generateBAM(m.Opts.OutputPath)
+		}
 	case bamprovider.PAM:
 		err = m.generatePAM()
 	}
 	if err != nil {
 		return nil, err
 	}
-	return m.globalMetrics, nil
+	m.mergeWorkerMetrics()
+	return m.globalMetrics, checkQC(m.Opts, m.globalMetrics)
+}
+
+// getWorkerMetrics returns the MetricsCollection that worker
+// accumulates its shards' metrics in. Only worker may use it, so it
+// needs no locking.
+func (m *MarkDuplicates) getWorkerMetrics(worker int) *MetricsCollection {
+	if m.workerMetrics[worker] == nil {
+		m.workerMetrics[worker] = newMetricsCollection()
+	}
+	return m.workerMetrics[worker]
+}
+
+// mergeWorkerMetrics merges the metrics of every worker, and the
+// corrupt regions they skipped, into the global metrics. It must be
+// called after all the workers are done.
+func (m *MarkDuplicates) mergeWorkerMetrics() {
+	for i, metrics := range m.workerMetrics {
+		if metrics != nil {
+			m.globalMetrics.merge(metrics)
+			m.workerMetrics[i] = nil
+		}
+	}
+	if m.skipCorrupt != nil {
+		if header, err := m.provider.GetHeader(); err == nil {
+			m.globalMetrics.CorruptRegions = m.skipCorrupt.getRegions(header)
+		}
+	}
+}
+
+// generateShards returns the byte-based shards of provider's input
+// used by Mark.
+func generateShards(provider bamprovider.Provider, opts *Opts) ([]bam.Shard, error) {
+	return provider.GenerateShards(bamprovider.GenerateShardsOpts{
+		Strategy:                           bamprovider.ByteBased,
+		Padding:                            opts.Padding,
+		IncludeUnmapped:                    true,
+		BytesPerShard:                      int64(opts.ShardSize),
+		MinBasesPerShard:                   opts.MinBases,
+		SplitUnmappedCoords:                false,
+		SplitMappedCoords:                  false,
+		AlwaysSplitMappedAndUnmappedCoords: true,
+	})
 }
 
 type pamOutputShard struct {
@@ -317,11 +518,11 @@ func newPAMShardsWriter(header *sam.Header, fileShards []bam.Shard, readShards [
 }
 
 func (m *MarkDuplicates) generatePAM() error {
-	header, err := m.Provider.GetHeader()
+	header, err := m.provider.GetHeader()
 	if err != nil {
 		return err
 	}
-	fileShards, err := m.Provider.GetFileShards()
+	fileShards, err := m.provider.GetFileShards()
 	if err != nil {
 		return err
 	}
@@ -342,28 +543,20 @@ func (m *MarkDuplicates) generatePAM() error {
 	close(outShardCh)
 	for wi := 0; wi < m.Opts.Parallelism; wi++ {
 		wg.Add(1)
-		go func() {
+		go func(worker int) {
 			defer wg.Done()
 			for outShard := range outShardCh {
 				opts := pam.WriteOpts{
-					Range: outShard.fileRange,
-				}
-				if !m.Opts.EmitUnmodifiedFields {
-					opts.DropFields = []bam.FieldType{
-						bam.FieldMapq,
-						bam.FieldMateRefID, bam.FieldMatePos,
-						bam.FieldTempLen,
-						bam.FieldName,
-						bam.FieldSeq,
-						bam.FieldQual}
+					Range:      outShard.fileRange,
+					DropFields: pamDropFields(m.Opts),
 				}
 				writer := pam.NewWriter(opts, header, m.Opts.OutputPath)
 				for len(outShard.remaining) > 0 {
 					bs := outShard.remaining[0]
 					outShard.remaining = outShard.remaining[1:]
 					log.Debug.Printf("file %d: starting shard %s, %d remaining", outShard.index, bs.String(), len(outShard.remaining))
-					iter := m.Provider.NewIterator(bs)
-					m.processShard(iter, bs, outShard.index, func(r *sam.Record) {
+					iter := m.provider.NewIterator(bs)
+					m.processShard(iter, bs, worker, func(r *sam.Record) {
 						writer.Write(r)
 						sam.PutInFreePool(r)
 					})
@@ -373,52 +566,84 @@ func (m *MarkDuplicates) generatePAM() error {
 				e.Set(writer.Close())
 				log.Debug.Printf("file %d: all done", outShard.index)
 			}
-		}()
+		}(wi)
 	}
 	wg.Wait()
 	return e.Err()
 }
 
-func (m *MarkDuplicates) generateBAM() error {
+// generateNameSortedBAM writes the output in coordinate order to a
+// scratch file, and then sorts it by queryname into Opts.OutputPath.
+func (m *MarkDuplicates) generateNameSortedBAM() error {
+	scratchDir, err := ioutil.TempDir(m.Opts.ScratchDir, "doppelmark-sort-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(scratchDir); err != nil {
+			log.Error.Printf("error removing %s: %v", scratchDir, err)
+		}
+	}()
+
+	unsortedPath := filepath.Join(scratchDir, "unsorted.bam")
+	if err := m.generateBAM(unsortedPath); err != nil {
+		return err
+	}
+	t0 := time.Now()
+	ctx := vcontext.Background()
+	if err := sortByName(ctx, m.Opts, unsortedPath, m.Opts.OutputPath, scratchDir, m.Opts.SortChunkSize,
+		sortMergeFanIn, m.Opts.Parallelism); err != nil {
+		return err
+	}
+	log.Debug.Printf("sorted by queryname in %v", time.Since(t0))
+	return nil
+}
+
+func (m *MarkDuplicates) generateBAM(outputPath string) error {
 	ctx := vcontext.Background()
 	// Prepare outputs.
 	var outputStream io.Writer
-	if m.Opts.OutputPath == "" {
+	if outputPath == "" {
 		outputStream = os.Stdout
 	} else {
-		out, err := file.Create(ctx, m.Opts.OutputPath)
+		out, err := createOutputFile(ctx, m.Opts, outputPath)
 		if err != nil {
-			log.Fatalf("Couldn't create output file %s: %v", m.Opts.OutputPath, err)
+			log.Fatalf("Couldn't create output file %s: %v", outputPath, err)
 		}
 		defer func() {
 			if err := out.Close(ctx); err != nil {
-				log.Fatalf("close %s: %v", m.Opts.OutputPath, err)
+				log.Fatalf("close %s: %v", outputPath, err)
 			}
 		}()
 		outputStream = out.Writer(ctx)
 	}
-	header, err := m.Provider.GetHeader()
+	header, err := m.provider.GetHeader()
 	if err != nil {
-		log.Fatalf("Could not read header from provider %s: %s", m.Provider, err)
+		log.Fatalf("Could not read header from provider %s: %s", m.provider, err)
+	}
+	// Workers dispatch shards in shard order, so the writer always has the
+	// shard that it needs to commit next in progress. Unlike generatePAM,
+	// this does not start the unmapped shard first: it is the last shard
+	// in the output, so its blocks could not be committed until every
+	// other shard was, and they would fill the writer's buffer.
+	var writer *orderedBAMWriter
+	if writer, err = newOrderedBAMWriter(outputStream, gzip.DefaultCompression, m.Opts.Parallelism,
+		m.Opts.QueueLength*blocksPerQueuedShard, len(m.shardList), header); err != nil {
+		log.Fatalf("Couldn't create bam writer for %s: %v", outputPath, err)
 	}
-	var writer *bam.ShardedBAMWriter
-	if writer, err = bam.NewShardedBAMWriter(outputStream, gzip.DefaultCompression,
-		m.Opts.QueueLength, header); err != nil {
-		log.Fatalf("Couldn't create bam writer for %s: %v", m.Opts.OutputPath, err)
+
+	// A write error fails the writer too, so that workers waiting for
+	// buffer space give up, and the remaining shards are skipped.
+	e := errors.Once{}
+	fail := func(err error) {
+		e.Set(err)
+		writer.setErr(err)
 	}
 
 	// Create workers to process shards off the shardChannel.
 	t0 := time.Now()
 	var workerGroup sync.WaitGroup
 	shardChannel := make(chan bam.Shard, len(m.shardList))
-	// The last shard is the unmapped (which can be very large), so
-	// move it to the front to process it first.
-	unmappedShard := m.shardList[len(m.shardList)-1]
-	m.shardList = m.shardList[0 : len(m.shardList)-1]
-	if unmappedShard.EndRef != nil {
-		log.Fatalf("expected unmapped shard to be last, instead got %v", unmappedShard)
-	}
-	shardChannel <- unmappedShard
 	for _, shard := range m.shardList {
 		shardChannel <- shard
 	}
@@ -429,28 +654,43 @@ func (m *MarkDuplicates) generateBAM() error {
 		workerGroup.Add(1)
 		go func(worker int) {
 			defer workerGroup.Done()
-			compressor := writer.GetCompressor()
 			for {
 				shard, ok := <-shardChannel
 				if !ok {
 					break
 				}
+				if e.Err() != nil {
+					continue
+				}
 				log.Debug.Printf("starting shard %s", shard.String())
-				if err := compressor.StartShard(shard.ShardIdx); err != nil {
-					log.Fatalf("could not create bam shard: %v", err)
+				shardWriter, err := writer.startShard(shard.ShardIdx)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				// Gap shards only hold the mates of the regions' reads,
+				// so they write nothing.
+				if m.gapShards[shard.ShardIdx] {
+					if err := shardWriter.Close(); err != nil {
+						fail(fmt.Errorf("close shard writer %d: %v", shard.ShardIdx, err))
+					}
+					continue
 				}
-				iter := m.Provider.NewIterator(shard)
+				iter := m.provider.NewIterator(shard)
 				m.processShard(iter, shard, worker, func(r *sam.Record) {
-					if err := compressor.AddRecord(r); err != nil {
-						panic(err)
+					if e.Err() != nil {
+						return
+					}
+					if err := shardWriter.AddRecord(r); err != nil {
+						fail(fmt.Errorf("write shard %d: %v", shard.ShardIdx, err))
 					}
 				})
 				if err := iter.Close(); err != nil {
 					log.Fatalf("close shard %d: %s", shard.ShardIdx, err)
 				}
-				// Close the shard (this will block if the queue is full)
-				if err := compressor.CloseShard(); err != nil {
-					log.Fatalf("close shard compressor %d: %v", shard.ShardIdx, err)
+				// Flush the shard's last block (this will block if the queue is full)
+				if err := shardWriter.Close(); err != nil {
+					fail(fmt.Errorf("close shard writer %d: %v", shard.ShardIdx, err))
 				}
 			}
 		}(i)
@@ -464,41 +704,79 @@ func (m *MarkDuplicates) generateBAM() error {
 		log.Fatalf("Error while closing distant mates: %v", err)
 	}
 
-	// Wait for the writer to finish writing and then close.
+	// Wait for the writer to finish writing and then close. After a
+	// write error, this only stops the writer's goroutines.
 	if err := writer.Close(); err != nil {
-		log.Fatalf("Error while closing bam: %v", err)
+		e.Set(fmt.Errorf("close bam %s: %v", outputPath, err))
 	}
 	t2 := time.Now()
 	log.Debug.Printf("closed writer in %v ms", t2.Sub(t1))
 
-	return nil
+	return e.Err()
+}
+
+// downsampleSalt distinguishes the hash that downsamples readpairs
+// from the hash that subsamples high-coverage intervals, so that the
+// two decisions are independent.
+var downsampleSalt = []byte("downsample")
+
+// readNameFraction returns a fraction between 0 and 1 computed from the
+// hash of name, seed and salt.
+func readNameFraction(hasher hash.Hash32, name string, seed int64, salt []byte) float64 {
+	hasher.Reset()
+	if _, err := hasher.Write([]byte(name)); err != nil {
+		log.Fatalf("failed to compute hash1 on read %s: %v", name, err)
+	}
+	if err := binary.Write(hasher, binary.LittleEndian, seed); err != nil {
+		log.Fatalf("failed to compute hash2 on read %s: %v", name, err)
+	}
+	if _, err := hasher.Write(salt); err != nil {
+		log.Fatalf("failed to compute hash3 on read %s: %v", name, err)
+	}
+	return float64(hasher.Sum32()) / float64(math.MaxUint32)
 }
 
-func updateMetrics(readGroupLibrary map[string]string, MetricsCollection *MetricsCollection, record *sam.Record) {
+// updateMetrics counts record in the metrics of its library. A read
+// with a mapped mate isn't counted as examined here, since that
+// depends on both reads of the pair, see updateExaminedMetrics.
+func updateMetrics(opts *Opts, readGroupLibrary map[string]string, MetricsCollection *MetricsCollection, record *sam.Record) {
 	library := GetLibrary(readGroupLibrary, record)
 	metrics := MetricsCollection.Get(library)
 
 	if (record.Flags & sam.Unmapped) != 0 {
 		metrics.UnmappedReads++
 	} else if bam.HasNoMappedMate(record) &&
-		(record.Flags&sam.Secondary) == 0 && (record.Flags&sam.Supplementary) == 0 {
+		(record.Flags&sam.Secondary) == 0 && (record.Flags&sam.Supplementary) == 0 &&
+		participates(opts, record) {
 		metrics.UnpairedReads++
 	}
 
-	if (record.Flags&sam.Paired) != 0 &&
-		(record.Flags&sam.Unmapped) == 0 && (record.Flags&sam.MateUnmapped) == 0 &&
-		(record.Flags&sam.Secondary) == 0 && (record.Flags&sam.Supplementary) == 0 {
-		metrics.ReadPairsExamined++
-	}
 	if (record.Flags&sam.Secondary) != 0 || (record.Flags&sam.Supplementary) != 0 {
 		metrics.SecondarySupplementary++
 	}
 }
 
-// recOrMateInHighCovInterval returns true and the region's mean coverage
-// if the alignment position of r intersects highCoverageMap. If the
-// read and mate both intersect a high-coveage region, then return the
-// larger of the two mean coverage values.
+// updateExaminedMetrics counts the reads of a readpair that is
+// examined for duplicates, and that are in shard, as examined in the
+// library and, if opts.OpticalDetector is set, per-lane metrics.
+func updateExaminedMetrics(opts *Opts, shard *bam.Shard, readGroupLibrary map[string]string,
+	MetricsCollection *MetricsCollection, reads ...*sam.Record) {
+	for _, record := range reads {
+		if !shard.RecordInShard(record) {
+			continue
+		}
+		library := GetLibrary(readGroupLibrary, record)
+		MetricsCollection.Get(library).ReadPairsExamined++
+		if opts.OpticalDetector != nil {
+			MetricsCollection.GetLane(library, ParseLocation(record.Name).Lane).ReadPairsExamined++
+		}
+	}
+}
+
+// recOrMateInHighCovInterval returns true and the region if the
+// alignment position of r intersects highCoverageMap. If the read and
+// mate both intersect a high-coveage region, then return the region
+// with the larger mean coverage.
 //
 // Note that when we remove records for which recOrMateInHighCovInterval
 // returns true, the resulting coverage for the high-coverage region
@@ -524,8 +802,8 @@ func updateMetrics(readGroupLibrary map[string]string, MetricsCollection *Metric
 // Note, we cannot easily make the coverage change symmetric around
 // the high-coverage region because each BAM record contains only the
 // left-hand position of each read's mate, not the mate's length.
-func recOrMateInHighCovInterval(highCoverageMap coverageMap, r *sam.Record) (bool, float64) {
-	var coverage, mateCoverage float64
+func recOrMateInHighCovInterval(highCoverageMap coverageMap, r *sam.Record) (bool, CoverageInterval) {
+	var highCov, mateHighCov CoverageInterval
 
 	if r.Ref != nil && highCoverageMap[r.Ref.ID()] != nil {
 		entries := make([]*intervalmap.Entry, 0, 1)
@@ -535,7 +813,7 @@ func recOrMateInHighCovInterval(highCoverageMap coverageMap, r *sam.Record) (boo
 		}
 		highCoverageMap[r.Ref.ID()].Get(interval, &entries)
 		if len(entries) > 0 {
-			coverage = entries[0].Data.(float64)
+			highCov = entries[0].Data.(CoverageInterval)
 		}
 	}
 	if r.MateRef != nil && highCoverageMap[r.MateRef.ID()] != nil {
@@ -546,14 +824,48 @@ func recOrMateInHighCovInterval(highCoverageMap coverageMap, r *sam.Record) (boo
 		}
 		highCoverageMap[r.MateRef.ID()].Get(interval, &entries)
 		if len(entries) > 0 {
-			mateCoverage = entries[0].Data.(float64)
+			mateHighCov = entries[0].Data.(CoverageInterval)
 		}
 	}
 
-	if mateCoverage > coverage {
-		return true, mateCoverage
+	if mateHighCov.MeanCoverage > highCov.MeanCoverage {
+		return true, mateHighCov
+	}
+	return highCov.MeanCoverage > 0, highCov
+}
+
+// subsample decides whether downsampling and max-depth subsampling
+// remove r's readpair.  Both decisions hash the read's name, so that
+// they are the same for both ends of the readpair.  highCov is the
+// high-coverage interval that r or its mate is in, or nil if there is
+// none, in which case removed is false.
+func (m *MarkDuplicates) subsample(hasher hash.Hash32, r *sam.Record) (downsampled, removed bool, highCov *CoverageInterval) {
+	downsampled = m.Opts.DownsampleFraction > 0 &&
+		readNameFraction(hasher, r.Name, m.Opts.Seed, downsampleSalt) > m.Opts.DownsampleFraction
+	found, interval := recOrMateInHighCovInterval(m.highCoverageMap, r)
+	if !found {
+		return downsampled, false, nil
+	}
+	// Drop the readpair if the hash fraction is greater than the
+	// subsamping rate. Calculate the subsampling rate as the
+	// CoverageMax parameter divided by the actual coverage in the
+	// intersecting high-coverage region, after downsampling.
+	coverage := interval.MeanCoverage
+	if m.Opts.DownsampleFraction > 0 {
+		coverage *= m.Opts.DownsampleFraction
 	}
-	return coverage > 0, coverage
+	removed = readNameFraction(hasher, r.Name, m.Opts.Seed, nil) > float64(m.Opts.CoverageMax)/coverage
+	return downsampled, removed, &interval
+}
+
+// paddingStartFileIdx returns the file index of the first record in
+// shard's padding. In estimate mode there is no shard info, so file
+// indexes are local to the shard.
+func (m *MarkDuplicates) paddingStartFileIdx(shard *bam.Shard) uint64 {
+	if m.shardInfo == nil {
+		return 0
+	}
+	return m.shardInfo.GetInfoByShard(shard).PaddingStartFileIdx
 }
 
 func (m *MarkDuplicates) processShard(
@@ -561,23 +873,37 @@ func (m *MarkDuplicates) processShard(
 	shard bam.Shard,
 	worker int,
 	writeCallback func(*sam.Record)) {
-	header, err := m.Provider.GetHeader()
+	header, err := m.provider.GetHeader()
 	if err != nil {
 		log.Fatalf("error getting header: %v", err)
 	}
 
-	if err := m.distantMates.OpenShard(shard.ShardIdx); err != nil {
-		log.Fatalf("error opening distant mate shard: %v", err)
+	if m.distantMates != nil {
+		if err := m.distantMates.OpenShard(shard.ShardIdx); err != nil {
+			log.Fatalf("error opening distant mate shard: %v", err)
+		}
+		defer m.distantMates.CloseShard(shard.ShardIdx)
 	}
-	defer m.distantMates.CloseShard(shard.ShardIdx)
 	t0 := time.Now()
 	orderedReads := []*sam.Record{}
 	pairsByName := make(map[string]*readPair)
 	singlesByName := make(map[string]*readPair)
 
-	var matcher duplicateMatcher = newDuplicateIndex(worker, header, m.readGroupLibrary, m.Opts, m.umiCorrector)
-	MetricsCollection := newMetricsCollection()
+	var matcher duplicateMatcher = newDuplicateIndex(worker, header, m.readGroupLibrary, m.Opts, m.umiCorrector,
+		m.umiWildcard)
+	// Accumulate the shard's metrics in the worker's own
+	// MetricsCollection, so that workers never contend for a lock.
+	MetricsCollection := m.getWorkerMetrics(worker)
+	// inShardCount and writeCount are the number of input records in
+	// the shard, and the number of records written.
+	inShardCount, writeCount := 0, 0
+	write := func(r *sam.Record) {
+		MetricsCollection.Flagstat.add(r)
+		writeCallback(r)
+		writeCount++
+	}
 	pending := make(map[string]bool)
+	dropped := make(map[*sam.Record]bool)
 	readCount := 0
 
 	// readIdx is the index of each read, zeroed at the start of
@@ -589,53 +915,77 @@ func (m *MarkDuplicates) processShard(
 	hasher := fnv.New32()
 	for iter.Scan() {
 		record := iter.Record()
+		if shard.RecordInShard(record) {
+			inShardCount++
+		}
+		// Copy records on pass-through references to the output
+		// unmodified. They don't count in readIdx, since the distant
+		// mate scan never saw them.
+		if isPassThroughRef(m.passThrough, record.Ref) {
+			if shard.RecordInShard(record) {
+				orderedReads = append(orderedReads, record)
+			} else {
+				sam.PutInFreePool(record)
+			}
+			continue
+		}
 		if m.Opts.ClearExisting {
 			clearDupFlagTags(record)
 		}
 
-		// If either end of the readpair is in a high-coverage interval.
-		found, coverage := recOrMateInHighCovInterval(m.highCoverageMap, record)
-		if found {
-			// Compute a hash based on the seed and the read's name. This compute the hash
-			// based on read name so that the hash will be the same for both ends of the
-			// read pair.
-			hasher.Reset()
-			if _, err := hasher.Write([]byte(record.Name)); err != nil {
-				log.Fatalf("failed to compute hash1 on read %s: %v", record.Name, err)
+		// Downsample the readpair, and if either end of the readpair is
+		// in a high-coverage interval, subsample it.
+		downsampled, removed, highCov := m.subsample(hasher, record)
+		if highCov != nil && shard.RecordInShard(record) {
+			reads := MetricsCollection.GetHighCoverageReads(*highCov)
+			reads.Reads++
+			if removed || downsampled {
+				reads.Removed++
 			}
-			if err := binary.Write(hasher, binary.LittleEndian, m.Opts.Seed); err != nil {
-				log.Fatalf("failed to compute hash2 on read %s: %v", record.Name, err)
-			}
-			hashBytes := hasher.Sum(nil)
-
-			// Use the hash to compute a fraction between 0 and 1, and then drop the
-			// readpair if fraction is greater than the subsamping rate. Calculate the
-			// subsampling rate as the CoverageMax parameter divided by the actual coverage
-			// in the intersecting high-coverage region.
-			x := float64(binary.BigEndian.Uint32(hashBytes[:])) / float64(math.MaxUint32)
-			if x > float64(m.Opts.CoverageMax)/coverage {
-				sam.PutInFreePool(record)
-				if shard.RecordInShard(record) {
-					missingReads++
-				}
-				readIdx++
-				continue
+		}
+		if removed && !downsampled {
+			sam.PutInFreePool(record)
+			if shard.RecordInShard(record) {
+				missingReads++
 			}
+			readIdx++
+			continue
+		}
+		if downsampled {
+			sam.PutInFreePool(record)
+			readIdx++
+			continue
 		}
 
+		// In estimate mode there is no distant mate table, so ignore
+		// the readpairs that would need it.
+		if m.distantMates == nil && record.Ref != nil && !bam.HasNoMappedMate(record) &&
+			!mateInPaddedShard(&shard, record) {
+			sam.PutInFreePool(record)
+			readIdx++
+			continue
+		}
+
+		drop := m.Opts.RecordPredicate != nil && m.Opts.RecordPredicate(record) == Drop
+
 		// In the unmapped shard (record.Ref == nil), all records are in the shard.
-		if shard.RecordInShard(record) {
-			updateMetrics(m.readGroupLibrary, MetricsCollection, record)
+		if shard.RecordInShard(record) && !drop {
+			updateMetrics(m.Opts, m.readGroupLibrary, MetricsCollection, record)
 		}
 
 		// Compress reads in the unmapped shard right away instead
 		// of storing in orderedReads to limit memory consumption.
 		if record.Ref == nil && shard.RecordInShard(record) {
-			writeCallback(record)
+			if !drop {
+				write(record)
+			}
 			readIdx++
 			continue
 		}
 		orderedReads = append(orderedReads, record)
+		if drop {
+			dropped[record] = true
+		}
 
 		if (record.Flags&sam.Secondary) != 0 || (record.Flags&sam.Supplementary) != 0 {
 			log.Debug.Printf("Ignoring secondary or supplementary read: %s", record.Name)
@@ -645,14 +995,20 @@ func (m *MarkDuplicates) processShard(
 		} else if !shard.RecordInPaddedShard(record) &&
 			!mateInPaddedShard(&shard, record) {
 			log.Debug.Printf("Ignoring read outside of padding: %s", record.Name)
+		} else if !bam.HasNoMappedMate(record) && isPassThroughRef(m.passThrough, record.MateRef) {
+			log.Debug.Printf("Ignoring read whose mate is on a pass-through reference: %s", record.Name)
+		} else if bam.HasNoMappedMate(record) && !participates(m.Opts, record) {
+			log.Debug.Printf("Ignoring read that fails the read filter or predicate: %s", record.Name)
+		} else if bam.HasNoMappedMate(record) && m.applyUmiNPolicy(&shard, MetricsCollection, record) {
+			log.Debug.Printf("Ignoring read with N in its umi: %s", record.Name)
 		} else if bam.HasNoMappedMate(record) {
 			// Handle reads with an unmapped mate differently.
-			info := m.shardInfo.GetInfoByShard(&shard)
+			paddingStartFileIdx := m.paddingStartFileIdx(&shard)
 			singlesByName[record.Name] = &readPair{
 				left:        record,
-				leftFileIdx: readIdx + info.PaddingStartFileIdx,
+				leftFileIdx: readIdx + paddingStartFileIdx,
 			}
-			matcher.insertSingleton(record, readIdx+info.PaddingStartFileIdx)
+			matcher.insertSingleton(record, readIdx+paddingStartFileIdx)
 			record = nil // Don't put back in the free pool.
 		} else {
 			// If we reach here, this read is mapped, it is in the
@@ -665,22 +1021,23 @@ func (m *MarkDuplicates) processShard(
 			// Get info by shard even if this record is not in
 			// shard.  This is ok because we will correct for
 			// records we see in the padding.
-			info := m.shardInfo.GetInfoByShard(&shard)
+			paddingStartFileIdx := m.paddingStartFileIdx(&shard)
 
 			if mateInPaddedShard(&shard, record) {
-				log.Debug.Printf("read %s should be within shard %v info %v", record.Name, shard, info)
+				log.Debug.Printf("read %s should be within shard %v padding start %d", record.Name, shard,
+					paddingStartFileIdx)
 				// Mate is in this shard including padding, so check if we saw it already
 				pair, ok = pairsByName[record.Name]
 				if ok {
 					log.Debug.Printf("Found second read %s %v local readIdx %d", record.Name,
 						record.Start(), readIdx)
-					pair.addRead(record, readIdx+info.PaddingStartFileIdx)
+					pair.addRead(record, readIdx+paddingStartFileIdx)
 					completedPair = true
 					delete(pending, record.Name)
 				} else {
 					log.Debug.Printf("Found first read %s %v local readIdx %d", record.Name,
 						record.Start(), readIdx)
-					pairsByName[record.Name] = &readPair{record, nil, readIdx + info.PaddingStartFileIdx, 0}
+					pairsByName[record.Name] = &readPair{record, nil, readIdx + paddingStartFileIdx, 0}
 					pending[record.Name] = true
 				}
 			} else {
@@ -689,6 +1046,16 @@ func (m *MarkDuplicates) processShard(
 				log.Debug.Printf("read %s has distant mate: different ref %v, distance %v",
 					record.Name, record.Ref.ID() != record.MateRef.ID(), abs(record.Pos-record.MatePos))
 				mate, mateFileIdx := m.distantMates.GetMate(shard.ShardIdx, record)
+				if mate == nil && m.Opts.CorruptBlockPolicy == CorruptBlockSkip {
+					// The mate was in a skipped corrupt region, so
+					// leave the read unmarked.
+					log.Error.Printf("record %s is missing distant mate, leaving it unmarked", record.Name)
+					if shard.RecordInShard(record) {
+						MetricsCollection.MissingMates++
+					}
+					readIdx++
+					continue
+				}
 				if mate == nil {
 					log.Fatalf("record %v, is missing distant mate, check that both reads are present and "+
 						"bai index is valid", record)
@@ -704,7 +1071,7 @@ func (m *MarkDuplicates) processShard(
 				// misbehave.
 				clone := *mate
 				log.Debug.Printf("adding distant mate as pair for %s", record.Name)
-				pair = &readPair{record, nil, readIdx + info.PaddingStartFileIdx, 0}
+				pair = &readPair{record, nil, readIdx + paddingStartFileIdx, 0}
 				pair.addRead(&clone, mateFileIdx)
 
 				completedPair = true
@@ -713,11 +1080,30 @@ func (m *MarkDuplicates) processShard(
 			}
 
 			if completedPair {
-				matcher.insertPair(pair.left, pair.right, pair.leftFileIdx, pair.rightFileIdx)
+				if m.Opts.FixMate {
+					fixMate(pair.left, pair.right)
+				} else if fieldPolicy(m.Opts, bam.FieldTempLen) == FieldRegenerate {
+					fixTempLen(pair.left, pair.right)
+				}
+				// Both reads must pass the read filter and predicate
+				// for the pair to participate in duplicate detection.
+				if !participates(m.Opts, pair.left) || !participates(m.Opts, pair.right) {
+					log.Debug.Printf("Ignoring pair that fails the read filter or predicate: %s", record.Name)
+				} else {
+					updateExaminedMetrics(m.Opts, &shard, m.readGroupLibrary, MetricsCollection, pair.left, pair.right)
+					if m.applyUmiNPolicy(&shard, MetricsCollection, pair.left, pair.right) {
+						log.Debug.Printf("Ignoring pair with N in its umis: %s", record.Name)
+					} else {
+						matcher.insertPair(pair.left, pair.right, pair.leftFileIdx, pair.rightFileIdx)
+					}
+				}
 			}
 		}
 		readIdx++
 	}
+	if splicedPairs := m.splicedPairs[shard.ShardIdx]; len(splicedPairs) > 0 {
+		m.addSplicedPairs(&shard, splicedPairs, MetricsCollection, hasher, pairsByName, singlesByName, matcher)
+	}
 	if missingReads > 0 {
 		log.Printf("Ignoring %d reads in shard %d, %s:%d - %s:%d because mate is in high coverage shard",
 			missingReads, shard.ShardIdx, shard.StartRef.Name(), shard.Start, shard.EndRef.Name(), shard.End)
@@ -726,13 +1112,25 @@ func (m *MarkDuplicates) processShard(
 		log.Error.Printf("Could not find mate for pending read: %v in shard %d, %s:%d - %s:%d", name, shard.ShardIdx, shard.StartRef.Name(), shard.Start, shard.EndRef.Name(), shard.End)
 	}
 	if len(pending) > 0 {
-		log.Fatalf("Could not find mate for some reads")
+		if m.Opts.CorruptBlockPolicy != CorruptBlockSkip {
+			log.Fatalf("Could not find mate for some reads")
+		}
+		// The mates were in a skipped corrupt region, so the reads
+		// stay unmarked.
+		for name := range pending {
+			if shard.RecordInShard(pairsByName[name].left) {
+				MetricsCollection.MissingMates++
+			}
+		}
 	}
 	t1 := time.Now()
 
 	// Detect and mark duplicates.
 	dupMetrics := flagDuplicates(m.Opts, &shard, m.readGroupLibrary, singlesByName, pairsByName, matcher)
-	MetricsCollection.Merge(dupMetrics)
+	MetricsCollection.merge(dupMetrics)
+	if m.Opts.UnmappedMatePolicy == UnmappedMateFollow {
+		markUnmappedMates(orderedReads, singlesByName)
+	}
 	t2 := time.Now()
 
 	// Compress and write records.
@@ -740,21 +1138,21 @@ func (m *MarkDuplicates) processShard(
 		if r.Ref == nil {
 			continue
 		}
-		if shard.RecordInShard(r) {
-			if !m.Opts.RemoveDups || (r.Flags&sam.Duplicate) == 0 {
-				writeCallback(r)
+		if shard.RecordInShard(r) && !dropped[r] {
+			if !m.Opts.RemoveDups || (r.Flags&sam.Duplicate) == 0 || isPassThroughRef(m.passThrough, r.Ref) {
+				write(r)
 			}
 		}
 	}
 	readCount += len(orderedReads)
 	t3 := time.Now()
+	if m.Opts.PreserveOrder && writeCount != inShardCount {
+		log.Fatalf("shard %s: wrote %d of %d input records, but preserve-order requires all records",
+			shard.String(), writeCount, inShardCount)
+	}
 
-	// Update global metrics.
-	m.globalMetrics.Merge(MetricsCollection)
-	t4 := time.Now()
-
-	log.Debug.Printf("worker %d finished shard %s, reads %d, process %v , mark %v, compress %v, metrics %v, total %v",
-		worker, shard.String(), readCount, t1.Sub(t0), t2.Sub(t1), t3.Sub(t2), t4.Sub(t3), t4.Sub(t0))
+	log.Debug.Printf("worker %d finished shard %s, reads %d, process %v , mark %v, compress %v, total %v",
+		worker, shard.String(), readCount, t1.Sub(t0), t2.Sub(t1), t3.Sub(t2), t3.Sub(t0))
 }
 
 func flagRead(opts *Opts, r *sam.Record, primary, optical bool, dupSetId uint64, dupSetSize, pcrDupSetSize int,
@@ -830,13 +1228,7 @@ func SetupAndMark(ctx context.Context, provider bamprovider.Provider, opts *Opts
 	// Prepare umi inputs.
 	if len(opts.UmiFile) > 0 {
 		var err error
-		umiReader, err := file.Open(ctx, opts.UmiFile)
-		if err != nil {
-			log.Debug.Printf("Could not read umi file %s: %s", opts.UmiFile, err)
-			return err
-		}
-		defer umiReader.Close(ctx) // nolint: errcheck
-		opts.KnownUmis, err = ioutil.ReadAll(umiReader.Reader(ctx))
+		opts.KnownUmis, err = readSidecar(ctx, opts, opts.UmiFile)
 		if err != nil {
 			log.Debug.Printf("Could not read umi file %s: %s", opts.UmiFile, err)
 			return err
@@ -853,7 +1245,8 @@ func SetupAndMark(ctx context.Context, provider bamprovider.Provider, opts *Opts
 		Opts:     opts,
 	}
 	globalMetrics, err := markDuplicates.Mark(nil)
-	if err != nil {
+	qcErr, qcFailed := err.(*QCError)
+	if err != nil && !qcFailed {
 		log.Debug.Printf("Error marking duplicates: %v", err)
 		return err
 	}
@@ -869,7 +1262,8 @@ func SetupAndMark(ctx context.Context, provider bamprovider.Provider, opts *Opts
 		if err != nil {
 			return err
 		}
-		if err := writeHighCoverageIntervals(ctx, opts, header, globalMetrics); err != nil {
+		if err := WriteHighCoverageIntervals(ctx, outputSink(opts), opts.HighCoverageIntervalFile, header,
+			globalMetrics.HighCoverageIntervals, globalMetrics.HighCoverageReads); err != nil {
 			return err
 		}
 	}
@@ -883,6 +1277,37 @@ func SetupAndMark(ctx context.Context, provider bamprovider.Provider, opts *Opts
 			return err
 		}
 	}
+	if opts.OpticalPairsFile != "" {
+		if err := writeOpticalPairs(ctx, opts, globalMetrics); err != nil {
+			return err
+		}
+	}
+	if opts.LaneMetricsFile != "" {
+		if err := writeLaneMetrics(ctx, opts, globalMetrics); err != nil {
+			return err
+		}
+	}
+	if opts.UmiCollisionsFile != "" {
+		if err := writeUmiCollisions(ctx, opts, globalMetrics); err != nil {
+			return err
+		}
+	}
+	if opts.FlagstatFile != "" {
+		if err := writeFlagstat(ctx, opts, globalMetrics); err != nil {
+			return err
+		}
+	}
+	if opts.LogFlagstat {
+		log.Printf("flagstat of output:\n%s", globalMetrics.Flagstat.String())
+	}
+	if opts.QCFile != "" {
+		if err := writeQC(ctx, opts, qcErr); err != nil {
+			return err
+		}
+	}
+	if qcFailed {
+		return qcErr
+	}
 	return nil
 }
 
@@ -921,13 +1346,37 @@ func flagDuplicates(opts *Opts, shard *bam.Shard, readGroupLibrary map[string]st
 						log.Debug.Printf("marking %s as duplicate of DI %d optical %v", r.Name, dupSetId, optDups[qname])
 						flagRead(opts, r, false, optDups[qname], dupSetId, len(dupSet.pairs), len(dupSet.pairs)-len(optDups),
 							dupSet.corrected[r.Name])
-						metrics := dupMetrics.Get(GetLibrary(readGroupLibrary, r))
+						library := GetLibrary(readGroupLibrary, r)
+						metrics := dupMetrics.Get(library)
 						metrics.ReadPairDups++
 						if optDups[qname] {
 							metrics.ReadPairOpticalDups++
+							dupMetrics.GetLane(library, ParseLocation(r.Name).Lane).ReadPairOpticalDups++
 						}
 					}
+					if opts.TagConfidence {
+						tagConfidence(r, dupSet.confidences)
+					}
+				}
+			}
+		}
+		// Count each bag once, from the shard that contains the left
+		// read of its primary.
+		if opts.BagMetrics && len(dupSet.pairs) > 1 {
+			primary := pairsByName[dupSet.pairs[0]]
+			if shard.RecordInShard(primary.left) {
+				pairs := make([]*readPair, len(dupSet.pairs))
+				for i, qname := range dupSet.pairs {
+					pairs[i] = pairsByName[qname]
 				}
+				dupMetrics.GetBag(GetLibrary(readGroupLibrary, primary.left)).addBag(pairs)
+			}
+		}
+		// Report each optical pair once, from the shard that contains
+		// the left read of the duplicate.
+		for _, opticalPair := range dupSet.opticalPairs {
+			if shard.RecordInShard(pairsByName[opticalPair.Duplicate].left) {
+				dupMetrics.OpticalPairs = append(dupMetrics.OpticalPairs, opticalPair)
 			}
 		}
 		for i, qname := range dupSet.singles {
@@ -939,6 +1388,9 @@ func flagDuplicates(opts *Opts, shard *bam.Shard, readGroupLibrary map[string]st
 				// only duplicates are also mate-unmapped (this
 				// behavior is copied from picard).
 				flagRead(opts, p.left, len(dupSet.pairs) == 0 && i == 0, false, 0, -1, -1, dupSet.corrected[p.left.Name])
+				if opts.TagConfidence {
+					tagConfidence(p.left, dupSet.confidences)
+				}
 				if len(dupSet.pairs) == 0 && i > 0 || len(dupSet.pairs) > 0 {
 					metrics := dupMetrics.Get(GetLibrary(readGroupLibrary, p.left))
 					metrics.UnpairedDups++
@@ -946,5 +1398,13 @@ func flagDuplicates(opts *Opts, shard *bam.Shard, readGroupLibrary map[string]st
 			}
 		}
 	}
+	// Count each umi position once, from the shard that contains its
+	// anchor read.
+	for _, p := range matcher.getUmiPositions() {
+		if shard.RecordInShard(p.anchor) {
+			p.anchor = nil
+			dupMetrics.addUmiPosition(p)
+		}
+	}
 	return dupMetrics
 }
@@ -14,11 +14,13 @@
 package markduplicates
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
-	"os"
+	"io"
 	"sort"
+	"strings"
 	"sync"
 
 	"github.com/grailbio/base/errors"
@@ -75,9 +77,24 @@ func (m *Metrics) String() string {
 
 	return fmt.Sprintf("%d\t%d\t%d\t%d\t%d\t%d\t%d\t%0.6f\t%v", m.UnpairedReads, m.ReadPairsExamined/2,
 		m.SecondarySupplementary, m.UnmappedReads, m.UnpairedDups,
-		m.ReadPairDups/2, m.ReadPairOpticalDups/2,
-		100*(float64(m.UnpairedDups+m.ReadPairDups)/float64(m.UnpairedReads+m.ReadPairsExamined)),
-		librarySizeStr)
+		m.ReadPairDups/2, m.ReadPairOpticalDups/2, m.PercentDuplication(), librarySizeStr)
+}
+
+// PercentDuplication returns the percentage of examined mapped reads
+// that are duplicates, as reported in the PERCENT_DUPLICATION column
+// of the metrics file. It is NaN if no reads were examined.
+func (m *Metrics) PercentDuplication() float64 {
+	return 100 * (float64(m.UnpairedDups+m.ReadPairDups) / float64(m.UnpairedReads+m.ReadPairsExamined))
+}
+
+// PercentOpticalDuplication returns the percentage of examined read
+// pairs that are optical duplicates, or 0 if no read pairs were
+// examined.
+func (m *Metrics) PercentOpticalDuplication() float64 {
+	if m.ReadPairsExamined == 0 {
+		return 0
+	}
+	return 100 * float64(m.ReadPairOpticalDups) / float64(m.ReadPairsExamined)
 }
 
 // Add adds the metrics in other to m.
@@ -91,22 +108,103 @@ func (m *Metrics) Add(other *Metrics) {
 	m.ReadPairOpticalDups += other.ReadPairOpticalDups
 }
 
+// scale multiplies the counts in m by factor, rounding to the nearest
+// integer. The read pair counts, which count reads, stay even.
+func (m *Metrics) scale(factor float64) {
+	round := func(n int) int { return int(float64(n)*factor + 0.5) }
+	roundPairs := func(n int) int { return 2 * round(n/2) }
+	m.UnpairedReads = round(m.UnpairedReads)
+	m.ReadPairsExamined = roundPairs(m.ReadPairsExamined)
+	m.SecondarySupplementary = round(m.SecondarySupplementary)
+	m.UnmappedReads = round(m.UnmappedReads)
+	m.UnpairedDups = round(m.UnpairedDups)
+	m.ReadPairDups = roundPairs(m.ReadPairDups)
+	m.ReadPairOpticalDups = roundPairs(m.ReadPairOpticalDups)
+}
+
+// LaneMetrics contains the optical duplicate metrics for the reads of
+// one library in one flowcell lane.
+type LaneMetrics struct {
+	// ReadPairsExamined is the number of mapped read pairs examined
+	// in the lane. (Primary, non-supplemental).
+	ReadPairsExamined int
+
+	// ReadPairOpticalDups is the number of read pair duplicates in
+	// the lane that were caused by optical duplication.
+	ReadPairOpticalDups int
+}
+
+// String returns the lane metrics as tab-separated fields, including
+// the percentage of read pairs that are optical duplicates.
+func (m *LaneMetrics) String() string {
+	percent := 0.0
+	if m.ReadPairsExamined > 0 {
+		percent = 100 * float64(m.ReadPairOpticalDups) / float64(m.ReadPairsExamined)
+	}
+	return fmt.Sprintf("%d\t%d\t%0.6f", m.ReadPairsExamined/2, m.ReadPairOpticalDups/2, percent)
+}
+
+// scale multiplies the counts in m by factor, like Metrics.scale.
+func (m *LaneMetrics) scale(factor float64) {
+	roundPairs := func(n int) int { return 2 * int(float64(n/2)*factor+0.5) }
+	m.ReadPairsExamined = roundPairs(m.ReadPairsExamined)
+	m.ReadPairOpticalDups = roundPairs(m.ReadPairOpticalDups)
+}
+
 // MetricsCollection contains metrics computed by Mark.
 type MetricsCollection struct {
 	// Global metrics
-	maxAlignDist int
-	maxX         int
-	maxY         int
+	maxX int
+	maxY int
+
+	// MaxAlignDist contains the maximum 5' alignment distance of each
+	// library, keyed by library. Reads whose distance exceeds
+	// Opts.Padding are handled by Opts.AlignDistPolicy.
+	MaxAlignDist map[string]int
 
 	// OpticalDistance stores the number of duplicate read pairs that
 	// have the given Euclidean distance.
 	OpticalDistance [][]int64
 
+	// OpticalPairs contains each optical duplicate pair, when
+	// Opts.OpticalPairsFile is set.
+	OpticalPairs []OpticalPair
+
+	// Flagstat contains samtools flagstat counts of the output records.
+	Flagstat Flagstat
+
 	// LibraryMetrics contains per-library metrics.
 	LibraryMetrics map[string]*Metrics
 
+	// UmiN counts the reads whose umis contain N.
+	UmiN UmiNCounts
+
+	// LaneMetrics contains per-library, per-lane optical duplicate
+	// metrics, keyed by library and then lane. It is only computed
+	// when there is an OpticalDetector, since the lane is parsed
+	// from the read name.
+	LaneMetrics map[string]map[int]*LaneMetrics
+
+	// BagMetrics contains per-library statistics over the bags with
+	// more than one read pair, when Opts.BagMetrics is set.
+	BagMetrics map[string]*BagMetrics
+
+	// UmiCollisions contains per-library umi collision counts, and
+	// UmiCollisionPositions each position with more than one distinct
+	// umi, when Opts.UmiCollisionsFile is set.
+	UmiCollisions         map[string]*UmiCollisionCounts
+	UmiCollisionPositions []UmiPosition
+
+	// CorruptRegions lists the input regions that were skipped because
+	// they were corrupt, and MissingMates counts the reads left
+	// unmarked because their mates were in those regions, when
+	// Opts.CorruptBlockPolicy is CorruptBlockSkip.
+	CorruptRegions []CorruptRegion
+	MissingMates   int
+
 	// High coverage intervals and read counts.
-	HighCoverageIntervals []coverageInterval
+	HighCoverageIntervals []CoverageInterval
+	HighCoverageReads     map[CoverageInterval]*HighCoverageReads
 
 	mutex sync.Mutex
 }
@@ -114,8 +212,13 @@ type MetricsCollection struct {
 func newMetricsCollection() *MetricsCollection {
 	mc := &MetricsCollection{
 		LibraryMetrics:        make(map[string]*Metrics),
+		LaneMetrics:           make(map[string]map[int]*LaneMetrics),
+		MaxAlignDist:          make(map[string]int),
+		BagMetrics:            make(map[string]*BagMetrics),
+		UmiCollisions:         make(map[string]*UmiCollisionCounts),
 		OpticalDistance:       make([][]int64, 4),
-		HighCoverageIntervals: make([]coverageInterval, 0),
+		HighCoverageIntervals: make([]CoverageInterval, 0),
+		HighCoverageReads:     make(map[CoverageInterval]*HighCoverageReads),
 	}
 	for i := range mc.OpticalDistance {
 		mc.OpticalDistance[i] = make([]int64, 60000)
@@ -135,12 +238,66 @@ func (mc *MetricsCollection) Get(library string) *Metrics {
 	return m
 }
 
-// Merge per-library and optical distance metrics from other
-// into mc.
+// GetLane returns LaneMetrics for the given library and lane. If there
+// is no LaneMetrics for them yet, create one and return it.
+func (mc *MetricsCollection) GetLane(library string, lane int) *LaneMetrics {
+	if mc.LaneMetrics == nil {
+		mc.LaneMetrics = make(map[string]map[int]*LaneMetrics)
+	}
+	lanes, found := mc.LaneMetrics[library]
+	if !found {
+		lanes = make(map[int]*LaneMetrics)
+		mc.LaneMetrics[library] = lanes
+	}
+	m, found := lanes[lane]
+	if !found {
+		m = &LaneMetrics{}
+		lanes[lane] = m
+	}
+	return m
+}
+
+// GetBag returns BagMetrics for the given library. If there is no
+// BagMetrics for library yet, create one and return it.
+func (mc *MetricsCollection) GetBag(library string) *BagMetrics {
+	if mc.BagMetrics == nil {
+		mc.BagMetrics = make(map[string]*BagMetrics)
+	}
+	m, found := mc.BagMetrics[library]
+	if !found {
+		m = &BagMetrics{}
+		mc.BagMetrics[library] = m
+	}
+	return m
+}
+
+// GetUmiCollisions returns UmiCollisionCounts for the given library.
+// If there is no UmiCollisionCounts for library yet, create one and
+// return it.
+func (mc *MetricsCollection) GetUmiCollisions(library string) *UmiCollisionCounts {
+	if mc.UmiCollisions == nil {
+		mc.UmiCollisions = make(map[string]*UmiCollisionCounts)
+	}
+	c, found := mc.UmiCollisions[library]
+	if !found {
+		c = &UmiCollisionCounts{}
+		mc.UmiCollisions[library] = c
+	}
+	return c
+}
+
+// Merge per-library, per-lane, bag, umi collision, alignment distance
+// and optical distance metrics from other into mc. It is safe to call Merge
+// concurrently on the same mc.
 func (mc *MetricsCollection) Merge(other *MetricsCollection) {
 	mc.mutex.Lock()
 	defer mc.mutex.Unlock()
+	mc.merge(other)
+}
 
+// merge is like Merge, but without locking, for a MetricsCollection
+// owned by the caller.
+func (mc *MetricsCollection) merge(other *MetricsCollection) {
 	for library, otherMetrics := range other.LibraryMetrics {
 		existing, found := mc.LibraryMetrics[library]
 		if found {
@@ -151,7 +308,33 @@ func (mc *MetricsCollection) Merge(other *MetricsCollection) {
 			mc.LibraryMetrics[library] = &new
 		}
 	}
+	for library, otherLanes := range other.LaneMetrics {
+		for lane, otherMetrics := range otherLanes {
+			m := mc.GetLane(library, lane)
+			m.ReadPairsExamined += otherMetrics.ReadPairsExamined
+			m.ReadPairOpticalDups += otherMetrics.ReadPairOpticalDups
+		}
+	}
+	for library, otherMetrics := range other.BagMetrics {
+		mc.GetBag(library).Add(otherMetrics)
+	}
+	for library, otherCounts := range other.UmiCollisions {
+		mc.GetUmiCollisions(library).Add(otherCounts)
+	}
+	mc.UmiCollisionPositions = append(mc.UmiCollisionPositions, other.UmiCollisionPositions...)
+	for library, d := range other.MaxAlignDist {
+		if max, found := mc.MaxAlignDist[library]; !found || d > max {
+			mc.MaxAlignDist[library] = d
+		}
+	}
 	mc.HighCoverageIntervals = append(mc.HighCoverageIntervals, other.HighCoverageIntervals...)
+	for interval, otherReads := range other.HighCoverageReads {
+		mc.GetHighCoverageReads(interval).Add(otherReads)
+	}
+	mc.OpticalPairs = append(mc.OpticalPairs, other.OpticalPairs...)
+	mc.Flagstat.Add(&other.Flagstat)
+	mc.UmiN.Add(&other.UmiN)
+	mc.MissingMates += other.MissingMates
 	for i := range mc.OpticalDistance {
 		if len(mc.OpticalDistance[i]) < len(other.OpticalDistance[i]) {
 			temp := make([]int64, len(other.OpticalDistance[i]))
@@ -164,7 +347,22 @@ func (mc *MetricsCollection) Merge(other *MetricsCollection) {
 	}
 }
 
-func (mc *MetricsCollection) AddHighCovInterval(interval coverageInterval) {
+// GetHighCoverageReads returns the HighCoverageReads for interval. If
+// there is no HighCoverageReads for interval yet, create one and
+// return it.
+func (mc *MetricsCollection) GetHighCoverageReads(interval CoverageInterval) *HighCoverageReads {
+	if mc.HighCoverageReads == nil {
+		mc.HighCoverageReads = make(map[CoverageInterval]*HighCoverageReads)
+	}
+	reads, found := mc.HighCoverageReads[interval]
+	if !found {
+		reads = &HighCoverageReads{}
+		mc.HighCoverageReads[interval] = reads
+	}
+	return reads
+}
+
+func (mc *MetricsCollection) AddHighCovInterval(interval CoverageInterval) {
 	mc.mutex.Lock()
 	defer mc.mutex.Unlock()
 	mc.HighCoverageIntervals = append(mc.HighCoverageIntervals, interval)
@@ -193,8 +391,8 @@ func (mc *MetricsCollection) AddDistance(bagSize, distance int) {
 }
 
 func writeMetrics(ctx context.Context, opts *Opts, globalMetrics *MetricsCollection) (err error) {
-	var f *os.File
-	f, err = os.Create(opts.MetricsFile)
+	var f io.WriteCloser
+	f, err = createOutput(ctx, outputSink(opts), opts.MetricsFile)
 	if err != nil {
 		return errors.E(err, "Couldn't create metrics file:", opts.MetricsFile)
 	}
@@ -204,9 +402,38 @@ func writeMetrics(ctx context.Context, opts *Opts, globalMetrics *MetricsCollect
 		}
 	}()
 
+	maxAlignDist := 0
+	alignDistLibraries := make([]string, 0, len(globalMetrics.MaxAlignDist))
+	for library, d := range globalMetrics.MaxAlignDist {
+		if d > maxAlignDist {
+			maxAlignDist = d
+		}
+		alignDistLibraries = append(alignDistLibraries, library)
+	}
+	sort.Strings(alignDistLibraries)
+
 	s := "# bio-mark-duplicates\n" +
-		"# maximum 5' alignment distance: " + fmt.Sprintf("%d", globalMetrics.maxAlignDist) + "\n" +
-		"LIBRARY\tUNPAIRED_READS_EXAMINED\tREAD_PAIRS_EXAMINED\t" +
+		"# maximum 5' alignment distance: " + fmt.Sprintf("%d", maxAlignDist) + "\n"
+	for _, library := range alignDistLibraries {
+		s += fmt.Sprintf("# maximum 5' alignment distance, library %s: %d\n",
+			library, globalMetrics.MaxAlignDist[library])
+	}
+	if opts.UseUmis {
+		u := globalMetrics.UmiN
+		s += fmt.Sprintf("# umis with N (%s): reads %d, corrected %d, failed %d, dropped %d\n",
+			opts.UmiNPolicy, u.Reads, u.Corrected, u.Failed, u.Dropped)
+	}
+	if opts.CorruptBlockPolicy == CorruptBlockSkip {
+		s += fmt.Sprintf("# corrupt regions skipped: %d, reads with missing mates: %d\n",
+			len(globalMetrics.CorruptRegions), globalMetrics.MissingMates)
+		for _, r := range globalMetrics.CorruptRegions {
+			s += fmt.Sprintf("# corrupt region: %s\n", r)
+		}
+	}
+	if d, ok := opts.OpticalDetector.(*TileOpticalDetector); ok {
+		s += fmt.Sprintf("# optical duplicate distance: %d, metric: %s\n", d.OpticalDistance, d.Metric)
+	}
+	s += "LIBRARY\tUNPAIRED_READS_EXAMINED\tREAD_PAIRS_EXAMINED\t" +
 		"SECONDARY_OR_SUPPLEMENTARY_RDS\tUNMAPPED_READS\tUNPAIRED_READ_DUPLICATES\t" +
 		"READ_PAIR_DUPLICATES\tREAD_PAIR_OPTICAL_DUPLICATES\tPERCENT_DUPLICATION\t" +
 		"ESTIMATED_LIBRARY_SIZE\n"
@@ -214,20 +441,30 @@ func writeMetrics(ctx context.Context, opts *Opts, globalMetrics *MetricsCollect
 	for library, metrics := range globalMetrics.LibraryMetrics {
 		s += library + "\t" + metrics.String() + "\n"
 	}
+
+	if opts.BagMetrics {
+		s += bagMetricsSection(globalMetrics.BagMetrics)
+	}
 	if _, err = f.Write([]byte(s)); err != nil {
 		return errors.E(err, "error writing to metrics file:", opts.MetricsFile)
 	}
 	return nil
 }
 
-// writeHighCoverageIntervals writes positions as 1-based.
-func writeHighCoverageIntervals(ctx context.Context, opts *Opts, header *sam.Header,
-	globalMetrics *MetricsCollection) (err error) {
-	var f *os.File
-	f, err = os.Create(opts.HighCoverageIntervalFile)
+// WriteHighCoverageIntervals writes intervals to path using sink, or to
+// a file if sink is nil, sorted by reference and position. If path ends in ".bed", it writes a BED file
+// with 0-based, half-open positions and the mean coverage in the name
+// column, otherwise it writes a table with 1-based positions. If reads
+// is not nil, the table also has the number of reads that Mark observed
+// and removed in each interval, and the resulting mean coverage. BED
+// files leave them out, since BED gives the columns after the name
+// fixed meanings, such as the score and the strand.
+func WriteHighCoverageIntervals(ctx context.Context, sink Sink, path string, header *sam.Header,
+	intervals []CoverageInterval, reads map[CoverageInterval]*HighCoverageReads) (err error) {
+	var f io.WriteCloser
+	f, err = createOutput(ctx, sink, path)
 	if err != nil {
-		return errors.E(err, "Couldn't create high coverage intervals file:",
-			opts.HighCoverageIntervalFile)
+		return errors.E(err, "Couldn't create high coverage intervals file:", path)
 	}
 	defer func() {
 		if err2 := f.Close(); err == nil && err2 != nil {
@@ -236,29 +473,49 @@ func writeHighCoverageIntervals(ctx context.Context, opts *Opts, header *sam.Hea
 	}()
 
 	// sort just to be on the safe side.
-	sort.Slice(globalMetrics.HighCoverageIntervals, func(i, j int) bool {
-		if globalMetrics.HighCoverageIntervals[i].refId != globalMetrics.HighCoverageIntervals[j].refId {
-			return globalMetrics.HighCoverageIntervals[i].refId < globalMetrics.HighCoverageIntervals[j].refId
-		} else if globalMetrics.HighCoverageIntervals[i].start != globalMetrics.HighCoverageIntervals[j].start {
-			return globalMetrics.HighCoverageIntervals[i].start < globalMetrics.HighCoverageIntervals[j].start
+	sort.Slice(intervals, func(i, j int) bool {
+		if intervals[i].RefId != intervals[j].RefId {
+			return intervals[i].RefId < intervals[j].RefId
+		} else if intervals[i].Start != intervals[j].Start {
+			return intervals[i].Start < intervals[j].Start
 		}
-		return globalMetrics.HighCoverageIntervals[i].end < globalMetrics.HighCoverageIntervals[j].end
+		return intervals[i].End < intervals[j].End
 	})
-	s := "start_chr\tstart_chr_start\tend_chr\tend_chr_end\tmean_coverage\n"
-	for _, interval := range globalMetrics.HighCoverageIntervals {
-		s += fmt.Sprintf("%s\t%d\t%s\t%d\t%0.3f\n", header.Refs()[interval.refId].Name(), interval.start+1,
-			header.Refs()[interval.refId].Name(), interval.end+1, interval.meanCoverage)
+	bed := strings.HasSuffix(path, ".bed")
+	var s string
+	if !bed {
+		s = "start_chr\tstart_chr_start\tend_chr\tend_chr_end\tmean_coverage"
+		if reads != nil {
+			s += "\treads\tremoved_reads\tsubsampled_mean_coverage"
+		}
+		s += "\n"
+	}
+	for _, interval := range intervals {
+		name := header.Refs()[interval.RefId].Name()
+		if bed {
+			s += fmt.Sprintf("%s\t%d\t%d\t%0.3f", name, interval.Start, interval.End, interval.MeanCoverage)
+		} else {
+			s += fmt.Sprintf("%s\t%d\t%s\t%d\t%0.3f", name, interval.Start+1, name, interval.End+1,
+				interval.MeanCoverage)
+		}
+		if reads != nil && !bed {
+			r, found := reads[interval]
+			if !found {
+				r = &HighCoverageReads{}
+			}
+			s += fmt.Sprintf("\t%d\t%d\t%0.3f", r.Reads, r.Removed, r.subsampledCoverage(interval))
+		}
+		s += "\n"
 	}
 	if _, err = f.Write([]byte(s)); err != nil {
-		return errors.E(err, "error writing to high coverage interval file:",
-			opts.HighCoverageIntervalFile)
+		return errors.E(err, "error writing to high coverage interval file:", path)
 	}
 	return nil
 }
 
 func writeTileSize(ctx context.Context, opts *Opts, globalMetrics *MetricsCollection) (err error) {
-	var f *os.File
-	f, err = os.Create(opts.TileSizeFile)
+	var f io.WriteCloser
+	f, err = createOutput(ctx, outputSink(opts), opts.TileSizeFile)
 	if err != nil {
 		return errors.E(err, "Couldn't create tile size file:", opts.TileSizeFile)
 	}
@@ -275,8 +532,8 @@ func writeTileSize(ctx context.Context, opts *Opts, globalMetrics *MetricsCollec
 }
 
 func writeOpticalHistogram(ctx context.Context, opts *Opts, globalMetrics *MetricsCollection) (err error) {
-	var f *os.File
-	f, err = os.Create(opts.OpticalHistogram)
+	var f io.WriteCloser
+	f, err = createOutput(ctx, outputSink(opts), opts.OpticalHistogram)
 	if err != nil {
 		return errors.E(err, "Couldn't create optical histogram file:", opts.OpticalHistogram)
 	}
@@ -298,3 +555,96 @@ func writeOpticalHistogram(ctx context.Context, opts *Opts, globalMetrics *Metri
 	}
 	return nil
 }
+
+// writeOpticalPairs writes one line per optical duplicate pair, sorted
+// by read name.
+func writeOpticalPairs(ctx context.Context, opts *Opts, globalMetrics *MetricsCollection) (err error) {
+	var f io.WriteCloser
+	f, err = createOutput(ctx, outputSink(opts), opts.OpticalPairsFile)
+	if err != nil {
+		return errors.E(err, "Couldn't create optical pairs file:", opts.OpticalPairsFile)
+	}
+	defer func() {
+		if err2 := f.Close(); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+
+	sort.Slice(globalMetrics.OpticalPairs, func(i, j int) bool {
+		if globalMetrics.OpticalPairs[i].Duplicate != globalMetrics.OpticalPairs[j].Duplicate {
+			return globalMetrics.OpticalPairs[i].Duplicate < globalMetrics.OpticalPairs[j].Duplicate
+		}
+		return globalMetrics.OpticalPairs[i].Original < globalMetrics.OpticalPairs[j].Original
+	})
+	w := bufio.NewWriter(f)
+	if _, err = fmt.Fprintf(w, "#duplicate\toriginal\tlane\ttile\tduplicate_x\tduplicate_y\toriginal_x\toriginal_y\toptical_dist\n"); err != nil {
+		return errors.E(err, "error writing to optical pairs file:", opts.OpticalPairsFile)
+	}
+	for _, p := range globalMetrics.OpticalPairs {
+		if _, err = fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", p.Duplicate, p.Original,
+			p.DuplicateLocation.Lane, p.DuplicateLocation.TileName,
+			p.DuplicateLocation.X, p.DuplicateLocation.Y,
+			p.OriginalLocation.X, p.OriginalLocation.Y, p.Distance); err != nil {
+			return errors.E(err, "error writing to optical pairs file:", opts.OpticalPairsFile)
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return errors.E(err, "error writing to optical pairs file:", opts.OpticalPairsFile)
+	}
+	return nil
+}
+
+// writeLaneMetrics writes the optical duplicate metrics of each library
+// broken down by lane, sorted by library and lane.
+func writeLaneMetrics(ctx context.Context, opts *Opts, globalMetrics *MetricsCollection) (err error) {
+	var f io.WriteCloser
+	f, err = createOutput(ctx, outputSink(opts), opts.LaneMetricsFile)
+	if err != nil {
+		return errors.E(err, "Couldn't create lane metrics file:", opts.LaneMetricsFile)
+	}
+	defer func() {
+		if err2 := f.Close(); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+
+	s := "LIBRARY\tLANE\tREAD_PAIRS_EXAMINED\tREAD_PAIR_OPTICAL_DUPLICATES\tPERCENT_OPTICAL_DUPLICATION\n"
+	libraries := make([]string, 0, len(globalMetrics.LaneMetrics))
+	for library := range globalMetrics.LaneMetrics {
+		libraries = append(libraries, library)
+	}
+	sort.Strings(libraries)
+	for _, library := range libraries {
+		lanes := make([]int, 0, len(globalMetrics.LaneMetrics[library]))
+		for lane := range globalMetrics.LaneMetrics[library] {
+			lanes = append(lanes, lane)
+		}
+		sort.Ints(lanes)
+		for _, lane := range lanes {
+			s += fmt.Sprintf("%s\t%d\t%s\n", library, lane, globalMetrics.LaneMetrics[library][lane].String())
+		}
+	}
+	if _, err = f.Write([]byte(s)); err != nil {
+		return errors.E(err, "error writing to lane metrics file:", opts.LaneMetricsFile)
+	}
+	return nil
+}
+
+// writeFlagstat writes the flagstat counts in samtools flagstat format.
+func writeFlagstat(ctx context.Context, opts *Opts, globalMetrics *MetricsCollection) (err error) {
+	var f io.WriteCloser
+	f, err = createOutput(ctx, outputSink(opts), opts.FlagstatFile)
+	if err != nil {
+		return errors.E(err, "Couldn't create flagstat file:", opts.FlagstatFile)
+	}
+	defer func() {
+		if err2 := f.Close(); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+
+	if _, err = f.Write([]byte(globalMetrics.Flagstat.String())); err != nil {
+		return errors.E(err, "error writing to flagstat file:", opts.FlagstatFile)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newShardMetrics returns the metrics of a made up shard.
+func newShardMetrics(shardIdx int) *MetricsCollection {
+	mc := newMetricsCollection()
+	for _, library := range []string{"libA", "libB"} {
+		m := mc.Get(library)
+		m.ReadPairsExamined = 100 + shardIdx
+		m.ReadPairDups = 10 + shardIdx%7
+		m.ReadPairOpticalDups = shardIdx % 3
+		lane := mc.GetLane(library, 1+shardIdx%4)
+		lane.ReadPairsExamined = 100 + shardIdx
+		lane.ReadPairOpticalDups = shardIdx % 3
+	}
+	mc.MaxAlignDist["libA"] = shardIdx % 50
+	mc.AddDistance(2+shardIdx%8, shardIdx%100)
+	mc.Flagstat.Total[0] = 200 + shardIdx
+	return mc
+}
+
+func TestWorkerMetrics(t *testing.T) {
+	const (
+		numShards  = 100
+		numWorkers = 8
+	)
+	// Merging each shard into the global metrics gives the same
+	// result as merging each shard into its worker's metrics, and the
+	// workers' metrics into the global metrics.
+	expected := newMetricsCollection()
+	for i := 0; i < numShards; i++ {
+		expected.Merge(newShardMetrics(i))
+	}
+
+	m := &MarkDuplicates{
+		globalMetrics: newMetricsCollection(),
+		workerMetrics: make([]*MetricsCollection, numWorkers),
+	}
+	var wg sync.WaitGroup
+	for worker := 0; worker < numWorkers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := worker; i < numShards; i += numWorkers {
+				m.getWorkerMetrics(worker).merge(newShardMetrics(i))
+			}
+		}(worker)
+	}
+	wg.Wait()
+	m.mergeWorkerMetrics()
+
+	actual := m.globalMetrics
+	assert.Equal(t, expected.LibraryMetrics, actual.LibraryMetrics)
+	assert.Equal(t, expected.LaneMetrics, actual.LaneMetrics)
+	assert.Equal(t, expected.MaxAlignDist, actual.MaxAlignDist)
+	assert.Equal(t, expected.OpticalDistance, actual.OpticalDistance)
+	assert.Equal(t, expected.Flagstat, actual.Flagstat)
+	for _, metrics := range m.workerMetrics {
+		assert.Nil(t, metrics)
+	}
+}
+
+// BenchmarkMergeShardMetrics compares merging each shard's metrics
+// into the global metrics under its mutex, with accumulating them in
+// per-worker metrics that are merged once at the end.
+func BenchmarkMergeShardMetrics(b *testing.B) {
+	const shardsPerWorker = 16
+	shard := newShardMetrics(1)
+	for _, workers := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("global/workers=%d", workers), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				global := newMetricsCollection()
+				var wg sync.WaitGroup
+				for worker := 0; worker < workers; worker++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := 0; i < shardsPerWorker; i++ {
+							global.Merge(shard)
+						}
+					}()
+				}
+				wg.Wait()
+			}
+		})
+		b.Run(fmt.Sprintf("worker/workers=%d", workers), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				m := &MarkDuplicates{
+					globalMetrics: newMetricsCollection(),
+					workerMetrics: make([]*MetricsCollection, workers),
+				}
+				var wg sync.WaitGroup
+				for worker := 0; worker < workers; worker++ {
+					wg.Add(1)
+					go func(worker int) {
+						defer wg.Done()
+						for i := 0; i < shardsPerWorker; i++ {
+							m.getWorkerMetrics(worker).merge(shard)
+						}
+					}(worker)
+				}
+				wg.Wait()
+				m.mergeWorkerMetrics()
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/hts/bam"
+	"github.com/grailbio/hts/sam"
+)
+
+// defaultSortChunkSize is the default number of records that
+// sortByName sorts in memory at once.
+const defaultSortChunkSize = 1000000
+
+// sortMergeFanIn is the largest number of sorted chunks that sortByName
+// merges at once. Each open chunk holds its own bam reader buffers, so
+// when there are more chunks, sortByName first merges them in groups
+// of sortMergeFanIn into larger chunks.
+const sortMergeFanIn = 64
+
+// nameLess returns true if a sorts before b in queryname order. Records
+// are ordered by name, then read1 before read2, then primary before
+// secondary and supplementary alignments.
+func nameLess(a, b *sam.Record) bool {
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	aRead2, bRead2 := a.Flags&sam.Read2 != 0, b.Flags&sam.Read2 != 0
+	if aRead2 != bRead2 {
+		return bRead2
+	}
+	const nonPrimary = sam.Secondary | sam.Supplementary
+	return a.Flags&nonPrimary < b.Flags&nonPrimary
+}
+
+// sortByName reads the bam at inputPath and writes its records in
+// queryname order to outputPath, or stdout if outputPath is empty. It
+// sorts chunkSize records at a time in memory, writes each sorted
+// chunk to scratchDir, and then merges the chunks, at most fanIn at a
+// time. Records that compare equal keep their input order. Transient
+// errors writing outputPath are retried as configured by opts.
+func sortByName(ctx context.Context, opts *Opts, inputPath, outputPath, scratchDir string, chunkSize, fanIn, parallelism int) (err error) {
+	if chunkSize <= 0 {
+		chunkSize = defaultSortChunkSize
+	}
+	if fanIn < 2 {
+		fanIn = sortMergeFanIn
+	}
+	in, err := os.Open(inputPath)
+	if err != nil {
+		return errors.E(err, "couldn't open unsorted bam:", inputPath)
+	}
+	defer in.Close() // nolint: errcheck
+	reader, err := bam.NewReader(in, parallelism)
+	if err != nil {
+		return errors.E(err, "couldn't read unsorted bam:", inputPath)
+	}
+	defer reader.Close() // nolint: errcheck
+
+	// Write sorted chunks. The chunks have an unknown sort order so
+	// that the merger uses nameLess instead of LessByName.
+	chunkHeader := reader.Header().Clone()
+	chunkHeader.SortOrder = sam.UnknownOrder
+	var chunkPaths []string
+	chunk := make([]*sam.Record, 0, chunkSize)
+	flush := func() error {
+		sort.SliceStable(chunk, func(i, j int) bool { return nameLess(chunk[i], chunk[j]) })
+		path := filepath.Join(scratchDir, fmt.Sprintf("chunk-%d.bam", len(chunkPaths)))
+		chunkPaths = append(chunkPaths, path)
+		if err := writeRecords(path, chunkHeader, chunk, parallelism); err != nil {
+			return err
+		}
+		chunk = chunk[:0]
+		return nil
+	}
+	for {
+		r, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.E(err, "error reading unsorted bam:", inputPath)
+		}
+		chunk = append(chunk, r)
+		if len(chunk) == chunkSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if len(chunk) > 0 || len(chunkPaths) == 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	// Merge consecutive groups of chunks until at most fanIn remain.
+	// Merging consecutive chunks keeps equal records in input order.
+	for level := 0; len(chunkPaths) > fanIn; level++ {
+		log.Debug.Printf("merging %d sorted chunks in groups of %d", len(chunkPaths), fanIn)
+		var merged []string
+		for i := 0; i < len(chunkPaths); i += fanIn {
+			group := chunkPaths[i:min(i+fanIn, len(chunkPaths))]
+			path := filepath.Join(scratchDir, fmt.Sprintf("merge-%d-%d.bam", level, len(merged)))
+			merged = append(merged, path)
+			if err := mergeChunksToFile(group, path, chunkHeader, parallelism); err != nil {
+				return err
+			}
+		}
+		chunkPaths = merged
+	}
+	log.Debug.Printf("merging %d sorted chunks", len(chunkPaths))
+
+	var outputStream io.Writer
+	if outputPath == "" {
+		outputStream = os.Stdout
+	} else {
+		out, err := createOutputFile(ctx, opts, outputPath)
+		if err != nil {
+			return errors.E(err, "couldn't create output file:", outputPath)
+		}
+		defer func() {
+			if err2 := out.Close(ctx); err == nil && err2 != nil {
+				err = err2
+			}
+		}()
+		outputStream = out.Writer(ctx)
+	}
+	header := reader.Header().Clone()
+	header.SortOrder = sam.QueryName
+	if header.Version == "" {
+		// The sort order is part of the @HD line, which is only
+		// written when the version is set.
+		header.Version = "1.6"
+	}
+	writer, err := bam.NewWriter(outputStream, header, parallelism)
+	if err != nil {
+		return err
+	}
+	if err := mergeChunks(chunkPaths, func(r *sam.Record) error {
+		if err := writer.Write(r); err != nil {
+			return errors.E(err, "error writing to:", outputPath)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// mergeChunks merges the sorted chunks at paths, and calls write on
+// each record in queryname order.
+func mergeChunks(paths []string, write func(*sam.Record) error) error {
+	chunkReaders := make([]*bam.Reader, len(paths))
+	for i, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return errors.E(err, "couldn't open sorted chunk:", path)
+		}
+		defer f.Close() // nolint: errcheck
+		if chunkReaders[i], err = bam.NewReader(f, 1); err != nil {
+			return errors.E(err, "couldn't read sorted chunk:", path)
+		}
+		defer chunkReaders[i].Close() // nolint: errcheck
+	}
+	merger, err := bam.NewMerger(nameLess, chunkReaders...)
+	if err != nil {
+		return err
+	}
+	for {
+		r, err := merger.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.E(err, "error merging sorted chunks")
+		}
+		if err := write(r); err != nil {
+			return err
+		}
+	}
+}
+
+// mergeChunksToFile merges the sorted chunks at paths into a new sorted
+// chunk at path, and then removes them.
+func mergeChunksToFile(paths []string, path string, header *sam.Header, parallelism int) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.E(err, "couldn't create sorted chunk:", path)
+	}
+	defer func() {
+		if err2 := f.Close(); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	writer, err := bam.NewWriter(f, header, parallelism)
+	if err != nil {
+		return err
+	}
+	if err := mergeChunks(paths, func(r *sam.Record) error {
+		if err := writer.Write(r); err != nil {
+			return errors.E(err, "error writing sorted chunk:", path)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil {
+			return errors.E(err, "couldn't remove sorted chunk:", p)
+		}
+	}
+	return nil
+}
+
+// writeRecords writes records to a new bam file at path.
+func writeRecords(path string, header *sam.Header, records []*sam.Record, parallelism int) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.E(err, "couldn't create sorted chunk:", path)
+	}
+	defer func() {
+		if err2 := f.Close(); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	writer, err := bam.NewWriter(f, header, parallelism)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err := writer.Write(r); err != nil {
+			return errors.E(err, "error writing sorted chunk:", path)
+		}
+	}
+	return writer.Close()
+}
@@ -85,11 +85,67 @@ func (t sortingTable) Less(i, j int) bool {
 	return diff < 0
 }
 
+// OpticalPair describes a single optical duplicate found by an
+// OpticalPairDetector. Duplicate is the name of the readpair that was
+// marked as an optical duplicate of the readpair named Original, and
+// Distance is the Euclidean distance between their locations.
+type OpticalPair struct {
+	Duplicate         string
+	DuplicateLocation PhysicalLocation
+	Original          string
+	OriginalLocation  PhysicalLocation
+	Distance          int
+}
+
+// OpticalDistanceMetric is the metric that TileOpticalDetector uses to
+// measure the distance between two readpairs' locations in a tile.
+type OpticalDistanceMetric int
+
+const (
+	// OpticalChebyshev measures the larger of the X and Y distances,
+	// like Picard.
+	OpticalChebyshev OpticalDistanceMetric = iota
+	// OpticalEuclidean measures the straight line distance.
+	OpticalEuclidean
+	// OpticalManhattan measures the sum of the X and Y distances.
+	OpticalManhattan
+)
+
+var opticalDistanceMetricNames = []string{"chebyshev", "euclidean", "manhattan"}
+
+// ParseOpticalDistanceMetric returns the OpticalDistanceMetric with the
+// given name, one of "chebyshev", "euclidean", or "manhattan".
+func ParseOpticalDistanceMetric(name string) (OpticalDistanceMetric, error) {
+	i, err := parseName("optical distance metric", name, opticalDistanceMetricNames)
+	return OpticalDistanceMetric(i), err
+}
+
+func (m OpticalDistanceMetric) String() string {
+	return opticalDistanceMetricNames[m]
+}
+
+// isOpticalDup returns true if a and b are within opticalDistance of
+// each other under m.
+func (m OpticalDistanceMetric) isOpticalDup(opticalDistance int, a, b *PhysicalLocation) bool {
+	dx, dy := abs(a.X-b.X), abs(a.Y-b.Y)
+	switch m {
+	case OpticalEuclidean:
+		// Compare the squares to avoid rounding.
+		return dx*dx+dy*dy <= opticalDistance*opticalDistance
+	case OpticalManhattan:
+		return dx+dy <= opticalDistance
+	default:
+		return dx <= opticalDistance && dy <= opticalDistance
+	}
+}
+
 // TileOpticalDetector detects optical duplicates with a tile. For two
 // reads to be optical duplicates, their tile, lane, surface, library,
-// and read orientations must be identical
+// and read orientations must be identical, and their locations must be
+// within OpticalDistance of each other under Metric.
 type TileOpticalDetector struct {
 	OpticalDistance int
+	Metric          OpticalDistanceMetric
 }
 
 // GetRecordProcessor implements OpticalDetector.
@@ -104,6 +160,16 @@ func (t *TileOpticalDetector) RecordProcessorsDone() (int, int) {
 
 // Detect implements OpticalDetector.
 func (t *TileOpticalDetector) Detect(readGroupLibrary map[string]string, duplicates []DuplicateEntry, bestIndex int) []string {
+	pairs := t.DetectPairs(readGroupLibrary, duplicates, bestIndex)
+	duplicateNames := make([]string, len(pairs))
+	for i, p := range pairs {
+		duplicateNames[i] = p.Duplicate
+	}
+	return duplicateNames
+}
+
+// DetectPairs implements OpticalPairDetector.
+func (t *TileOpticalDetector) DetectPairs(readGroupLibrary map[string]string, duplicates []DuplicateEntry, bestIndex int) []OpticalPair {
 	// Split duplicates by tile number into batches before marking the
 	// optical duplicates.  We split by tile to reduce the cost of
 	// comparing each pair against the other pairs.
@@ -118,7 +184,16 @@ func (t *TileOpticalDetector) Detect(readGroupLibrary map[string]string, duplica
 	batches := make(map[batchKey]sortingTable)
 	var bestBatchKey batchKey
 	bestName := ""
-	duplicateNames := make([]string, 0)
+	opticalPairs := make([]OpticalPair, 0)
+	addPair := func(duplicate, original *sortingEntry) {
+		opticalPairs = append(opticalPairs, OpticalPair{
+			Duplicate:         duplicate.pair.Left.R.Name,
+			DuplicateLocation: duplicate.location,
+			Original:          original.pair.Left.R.Name,
+			OriginalLocation:  original.location,
+			Distance:          opticalDistance(&duplicate.location, &original.location),
+		})
+	}
 	for i, pair := range duplicates {
 		p := pair.(IndexedPair)
 		location := ParseLocation(pair.Name())
@@ -176,10 +251,10 @@ func (t *TileOpticalDetector) Detect(readGroupLibrary map[string]string, duplica
 				if bestIdx == i {
 					continue
 				}
-				if isOpticalDup(t.OpticalDistance, &batch[bestIdx].location, &batch[i].location) {
+				if t.Metric.isOpticalDup(t.OpticalDistance, &batch[bestIdx].location, &batch[i].location) {
 					foundOptical = true
 					batch[i].duplicate = true
-					duplicateNames = append(duplicateNames, batch[i].pair.Left.R.Name)
+					addPair(&batch[i], &batch[bestIdx])
 					if log.At(log.Debug) {
 						log.Debug.Printf("optical dups: %s %s (dup)", batch[bestIdx].pair.Left.R.Name,
 							batch[i].pair.Left.R.Name)
@@ -200,11 +275,11 @@ func (t *TileOpticalDetector) Detect(readGroupLibrary map[string]string, duplica
 				if batch[i].duplicate && batch[j].duplicate {
 					continue
 				}
-				if isOpticalDup(t.OpticalDistance, &batch[i].location, &batch[j].location) {
+				if t.Metric.isOpticalDup(t.OpticalDistance, &batch[i].location, &batch[j].location) {
 					if batch[j].duplicate {
 						foundOptical = true
 						batch[i].duplicate = true
-						duplicateNames = append(duplicateNames, batch[i].pair.Left.R.Name)
+						addPair(&batch[i], &batch[j])
 						if log.At(log.Debug) {
 							log.Debug.Printf("optical dups: %s %s (dup)", batch[j].pair.Left.R.Name,
 								batch[i].pair.Left.R.Name)
@@ -212,7 +287,7 @@ func (t *TileOpticalDetector) Detect(readGroupLibrary map[string]string, duplica
 					} else {
 						foundOptical = true
 						batch[j].duplicate = true
-						duplicateNames = append(duplicateNames, batch[j].pair.Left.R.Name)
+						addPair(&batch[j], &batch[i])
 						if log.At(log.Debug) {
 							log.Debug.Printf("optical dups: %s %s (dup)", batch[i].pair.Left.R.Name,
 								batch[j].pair.Left.R.Name)
@@ -229,9 +304,5 @@ func (t *TileOpticalDetector) Detect(readGroupLibrary map[string]string, duplica
 			}
 		}
 	}
-	return duplicateNames
-}
-
-func isOpticalDup(opticalDistance int, a, b *PhysicalLocation) bool {
-	return abs(a.X-b.X) <= opticalDistance && abs(a.Y-b.Y) <= opticalDistance
+	return opticalPairs
 }
@@ -0,0 +1,69 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grailbio/base/vcontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpticalDistanceMetric(t *testing.T) {
+	for _, name := range []string{"chebyshev", "euclidean", "manhattan"} {
+		metric, err := ParseOpticalDistanceMetric(name)
+		assert.NoError(t, err)
+		assert.Equal(t, name, metric.String())
+	}
+	_, err := ParseOpticalDistanceMetric("hamming")
+	assert.Error(t, err)
+
+	// b is 30 pixels from a along x and 40 along y, so it is 40 away
+	// by chebyshev, 50 by euclidean and 70 by manhattan.
+	a := &PhysicalLocation{X: 100, Y: 100}
+	b := &PhysicalLocation{X: 130, Y: 60}
+	tests := []struct {
+		metric   OpticalDistanceMetric
+		distance int
+		expected bool
+	}{
+		{OpticalChebyshev, 40, true},
+		{OpticalChebyshev, 39, false},
+		{OpticalEuclidean, 50, true},
+		{OpticalEuclidean, 49, false},
+		{OpticalManhattan, 70, true},
+		{OpticalManhattan, 69, false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.metric.isOpticalDup(test.distance, a, b),
+			"metric %v, distance %d", test.metric, test.distance)
+		assert.Equal(t, test.expected, test.metric.isOpticalDup(test.distance, b, a),
+			"metric %v, distance %d", test.metric, test.distance)
+	}
+}
+
+func TestOpticalDistanceMetricInMetrics(t *testing.T) {
+	memory := &MemorySink{}
+	opts := defaultOpts
+	opts.MetricsFile = "metrics"
+	opts.Sink = memory
+	opts.OpticalDetector = &TileOpticalDetector{OpticalDistance: 100, Metric: OpticalEuclidean}
+
+	assert.NoError(t, writeMetrics(vcontext.Background(), &opts, newMetricsCollection()))
+	b, ok := memory.Get("metrics")
+	assert.True(t, ok)
+	assert.True(t, strings.Contains(string(b), "# optical duplicate distance: 100, metric: euclidean\n"),
+		"metrics: %s", b)
+}
@@ -0,0 +1,314 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bio/encoding/bgzf"
+	htsbam "github.com/grailbio/hts/bam"
+	"github.com/grailbio/hts/sam"
+)
+
+// bgzfEOF is the empty bgzf block that terminates a bam file.
+var bgzfEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43,
+	0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// blocksPerQueuedShard is the number of bgzf blocks that
+// Opts.QueueLength allows to be buffered for each queued shard.
+const blocksPerQueuedShard = 64
+
+// orderedBAMWriter writes a bam file from shards that are processed
+// concurrently. Each shard writer splits its shard's records into
+// blocks of uncompressed data, a pool of goroutines compresses the
+// blocks into bgzf in parallel, and a single goroutine commits the
+// compressed blocks to the output in shard order, and within each
+// shard in block order. A shard's blocks are committed as soon as
+// they are compressed, so a large shard does not need to be buffered
+// in its entirety.
+//
+// At most maxBlocks blocks are buffered at any time, except that the
+// shard being committed is never blocked. Shards must be started in
+// shard order, so that the shard being committed is always in
+// progress, and the writer cannot deadlock. Every shard index in
+// [0, numShards) must be started and closed exactly once; Close
+// reports a shard that was not.
+type orderedBAMWriter struct {
+	w         io.Writer
+	maxBlocks int
+	numShards int
+
+	compress chan *bgzfBlock
+	compressors,
+	committer sync.WaitGroup
+
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	shards   map[int]*orderedShard
+	next     int  // the shard being committed.
+	buffered int  // blocks that have not been committed.
+	closing  bool // set by Close, after which no blocks are added.
+	err      error
+}
+
+// bgzfBlock is one bgzf block of a shard. data holds the uncompressed
+// data until done is closed, and the compressed data after.
+type bgzfBlock struct {
+	data []byte
+	err  error
+	done chan struct{}
+}
+
+type orderedShard struct {
+	blocks    []*bgzfBlock
+	committed int
+	closed    bool
+}
+
+// newOrderedBAMWriter returns an orderedBAMWriter that writes header
+// and then numShards shards to w, using parallelism goroutines to
+// compress them.
+func newOrderedBAMWriter(w io.Writer, gzLevel, parallelism, maxBlocks, numShards int,
+	header *sam.Header) (*orderedBAMWriter, error) {
+	bw := &orderedBAMWriter{
+		w:         w,
+		maxBlocks: maxBlocks,
+		numShards: numShards + 1,
+		compress:  make(chan *bgzfBlock, parallelism),
+		shards:    make(map[int]*orderedShard),
+	}
+	bw.cond = sync.NewCond(&bw.mutex)
+	for i := 0; i < parallelism; i++ {
+		bw.compressors.Add(1)
+		go func() {
+			defer bw.compressors.Done()
+			for block := range bw.compress {
+				block.data, block.err = compressBlock(block.data, gzLevel)
+				close(block.done)
+			}
+		}()
+	}
+	bw.committer.Add(1)
+	go func() {
+		defer bw.committer.Done()
+		bw.commit()
+	}()
+
+	// The header is shard -1, and is committed before shard 0.
+	sw, err := bw.startShard(-1)
+	if err == nil {
+		err = header.EncodeBinary(sw)
+	}
+	if err == nil {
+		err = sw.Close()
+	}
+	if err != nil {
+		// Stop the committer and the compressors.
+		bw.setErr(err)
+		bw.Close() // nolint: errcheck
+		return nil, err
+	}
+	return bw, nil
+}
+
+// compressBlock returns data compressed into a single bgzf block.
+func compressBlock(data []byte, gzLevel int) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := bgzf.NewWriter(&buf, gzLevel)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.CloseWithoutTerminator(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// startShard returns a writer for the shard with the given index.
+func (bw *orderedBAMWriter) startShard(shardIdx int) (*orderedShardWriter, error) {
+	seq := shardIdx + 1
+	bw.mutex.Lock()
+	defer bw.mutex.Unlock()
+	if seq < 0 || seq >= bw.numShards {
+		return nil, errors.E(errors.Invalid, fmt.Sprintf("shard %d is out of range", shardIdx))
+	}
+	if bw.shards[seq] != nil || seq < bw.next {
+		return nil, errors.E(errors.Invalid, fmt.Sprintf("shard %d was already started", shardIdx))
+	}
+	shard := &orderedShard{}
+	bw.shards[seq] = shard
+	bw.cond.Broadcast()
+	return &orderedShardWriter{bw: bw, seq: seq, shard: shard}, nil
+}
+
+// setErr fails the writer with err, unless it already failed.
+func (bw *orderedBAMWriter) setErr(err error) {
+	bw.mutex.Lock()
+	defer bw.mutex.Unlock()
+	if bw.err == nil {
+		bw.err = err
+	}
+	bw.cond.Broadcast()
+}
+
+// addBlock queues data to be compressed and committed as the next
+// block of shard seq. It blocks while too many blocks are buffered,
+// unless seq is the shard being committed.
+func (bw *orderedBAMWriter) addBlock(seq int, shard *orderedShard, data []byte) error {
+	block := &bgzfBlock{data: data, done: make(chan struct{})}
+	bw.mutex.Lock()
+	for bw.err == nil && bw.buffered >= bw.maxBlocks && seq != bw.next {
+		bw.cond.Wait()
+	}
+	if bw.err != nil {
+		bw.mutex.Unlock()
+		return bw.err
+	}
+	bw.buffered++
+	shard.blocks = append(shard.blocks, block)
+	bw.cond.Broadcast()
+	bw.mutex.Unlock()
+
+	bw.compress <- block
+	return nil
+}
+
+// closeShard marks shard as complete, so the committer moves on to the
+// next shard once it has committed all the blocks of shard.
+func (bw *orderedBAMWriter) closeShard(shard *orderedShard) error {
+	bw.mutex.Lock()
+	defer bw.mutex.Unlock()
+	shard.closed = true
+	bw.cond.Broadcast()
+	return bw.err
+}
+
+// commit writes the blocks of each shard to the output, in order.
+func (bw *orderedBAMWriter) commit() {
+	bw.mutex.Lock()
+	defer bw.mutex.Unlock()
+	for bw.next < bw.numShards && bw.err == nil {
+		shard := bw.shards[bw.next]
+		if shard == nil || (shard.committed == len(shard.blocks) && !shard.closed) {
+			if bw.closing {
+				// No more blocks will arrive, so the shard would
+				// never be committed.
+				bw.err = errors.E(errors.Invalid, fmt.Sprintf("shard %d was never closed", bw.next-1))
+				bw.cond.Broadcast()
+				break
+			}
+			bw.cond.Wait()
+			continue
+		}
+		if shard.committed == len(shard.blocks) {
+			delete(bw.shards, bw.next)
+			bw.next++
+			bw.cond.Broadcast()
+			continue
+		}
+
+		block := shard.blocks[shard.committed]
+		bw.mutex.Unlock()
+		<-block.done
+		err := block.err
+		if err == nil {
+			_, err = bw.w.Write(block.data)
+		}
+		bw.mutex.Lock()
+		if err != nil {
+			bw.err = errors.E(err, "write bam block")
+		}
+		shard.blocks[shard.committed] = nil
+		shard.committed++
+		bw.buffered--
+		bw.cond.Broadcast()
+	}
+}
+
+// Close waits for every shard to be committed, and then terminates the
+// bam file. Every shard must have been closed, and Close returns an
+// error if one was not.
+func (bw *orderedBAMWriter) Close() error {
+	bw.mutex.Lock()
+	bw.closing = true
+	bw.cond.Broadcast()
+	bw.mutex.Unlock()
+	bw.committer.Wait()
+	close(bw.compress)
+	bw.compressors.Wait()
+	if bw.err != nil {
+		return bw.err
+	}
+	_, err := bw.w.Write(bgzfEOF)
+	return err
+}
+
+// orderedShardWriter writes the records of one shard to an
+// orderedBAMWriter. It is not safe for concurrent use.
+type orderedShardWriter struct {
+	bw    *orderedBAMWriter
+	seq   int
+	shard *orderedShard
+	buf   bytes.Buffer
+}
+
+// Write appends p to the shard's uncompressed data.
+func (w *orderedShardWriter) Write(p []byte) (int, error) {
+	n, _ := w.buf.Write(p)
+	return n, w.flushBlocks()
+}
+
+// AddRecord writes r to the shard.
+func (w *orderedShardWriter) AddRecord(r *sam.Record) error {
+	if err := htsbam.Marshal(r, &w.buf); err != nil {
+		return err
+	}
+	return w.flushBlocks()
+}
+
+// flushBlocks queues each full block of the shard's uncompressed data
+// for compression.
+func (w *orderedShardWriter) flushBlocks() error {
+	for w.buf.Len() >= bgzf.DefaultUncompressedBlockSize {
+		data := make([]byte, bgzf.DefaultUncompressedBlockSize)
+		copy(data, w.buf.Next(bgzf.DefaultUncompressedBlockSize))
+		if err := w.bw.addBlock(w.seq, w.shard, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close queues the remaining data of the shard, and marks the shard as
+// complete.
+func (w *orderedShardWriter) Close() error {
+	if w.buf.Len() > 0 {
+		data := make([]byte, w.buf.Len())
+		copy(data, w.buf.Bytes())
+		w.buf.Reset()
+		if err := w.bw.addBlock(w.seq, w.shard, data); err != nil {
+			return err
+		}
+	}
+	return w.bw.closeShard(w.shard)
+}
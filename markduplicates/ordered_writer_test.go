@@ -0,0 +1,161 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/base/errors"
+	htsbam "github.com/grailbio/hts/bam"
+	"github.com/grailbio/hts/sam"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderedBAMWriter(t *testing.T) {
+	chr1, err := sam.NewReference("chr1", "", "", 100000000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1})
+	assert.NoError(t, err)
+
+	const numShards = 4
+	const recordsPerShard = 3000
+
+	for _, maxBlocks := range []int{1, 2, 1000} {
+		var out bytes.Buffer
+		writer, err := newOrderedBAMWriter(&out, 1, 3, maxBlocks, numShards, header)
+		assert.NoError(t, err)
+
+		// Start the shards in order, but fill them concurrently, so
+		// that later shards finish first.
+		var wg sync.WaitGroup
+		for i := 0; i < numShards; i++ {
+			shardWriter, err := writer.startShard(i)
+			assert.NoError(t, err)
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < recordsPerShard*(numShards-i); j++ {
+					name := fmt.Sprintf("shard%d-read%d", i, j)
+					r := NewRecord(name, chr1, i*1000000+j, sam.Paired|sam.Read1, -1, nil, cigar0)
+					assert.NoError(t, shardWriter.AddRecord(r))
+				}
+				assert.NoError(t, shardWriter.Close())
+			}(i)
+		}
+		wg.Wait()
+		assert.NoError(t, writer.Close())
+		assert.True(t, bytes.HasSuffix(out.Bytes(), bgzfEOF))
+
+		reader, err := htsbam.NewReader(&out, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(reader.Header().Refs()))
+		for i := 0; i < numShards; i++ {
+			for j := 0; j < recordsPerShard*(numShards-i); j++ {
+				r, err := reader.Read()
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, fmt.Sprintf("shard%d-read%d", i, j), r.Name)
+				assert.Equal(t, i*1000000+j, r.Pos)
+			}
+		}
+		_, err = reader.Read()
+		assert.Equal(t, io.EOF, err)
+	}
+}
+
+// errWriter fails every write after the first.
+type errWriter struct {
+	writes int
+}
+
+func (w *errWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes > 1 {
+		return 0, errors.E("write failed")
+	}
+	return len(p), nil
+}
+
+func TestOrderedBAMWriterError(t *testing.T) {
+	chr1, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1})
+	assert.NoError(t, err)
+
+	writer, err := newOrderedBAMWriter(&errWriter{}, 1, 2, 1, 2, header)
+	assert.NoError(t, err)
+
+	// Shard 1 waits for shard 0 to be committed, until writing shard 0
+	// fails.
+	shard0, err := writer.startShard(0)
+	assert.NoError(t, err)
+	shard1, err := writer.startShard(1)
+	assert.NoError(t, err)
+	addRecords := func(w *orderedShardWriter) error {
+		for j := 0; j < 5000; j++ {
+			r := NewRecord(fmt.Sprintf("read%d", j), chr1, j%1000, sam.Paired|sam.Read1, -1, nil, cigar0)
+			if err := w.AddRecord(r); err != nil {
+				return err
+			}
+		}
+		return w.Close()
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Error(t, addRecords(shard1))
+	}()
+	// Shard 0 is never blocked, so it may finish before the writer
+	// fails.
+	addRecords(shard0) // nolint: errcheck
+	wg.Wait()
+	assert.Error(t, writer.Close())
+}
+
+func TestOrderedBAMWriterMissingShard(t *testing.T) {
+	chr1, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1})
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	writer, err := newOrderedBAMWriter(&out, 1, 2, 10, 3, header)
+	assert.NoError(t, err)
+
+	_, err = writer.startShard(3)
+	assert.Error(t, err)
+	_, err = writer.startShard(-2)
+	assert.Error(t, err)
+	shard0, err := writer.startShard(0)
+	assert.NoError(t, err)
+	_, err = writer.startShard(0)
+	assert.Error(t, err)
+	assert.NoError(t, shard0.Close())
+
+	// Shard 1 is started but never closed, and shard 2 is never
+	// started, so Close fails instead of waiting for them.
+	_, err = writer.startShard(1)
+	assert.NoError(t, err)
+	err = writer.Close()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "shard 1 was never closed")
+	}
+	assert.False(t, bytes.HasSuffix(out.Bytes(), bgzfEOF))
+}
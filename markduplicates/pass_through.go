@@ -0,0 +1,101 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+)
+
+// validatePassThroughRefs checks that each of patterns is a valid
+// reference name pattern.
+func validatePassThroughRefs(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pass-through-refs pattern %s: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// getPassThroughRefs returns, for each reference in header indexed by
+// its id, whether its name matches one of patterns, or nil if there
+// are no patterns.
+func getPassThroughRefs(header *sam.Header, patterns []string) []bool {
+	if len(patterns) == 0 {
+		return nil
+	}
+	passThrough := make([]bool, len(header.Refs()))
+	for _, ref := range header.Refs() {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, ref.Name()); matched {
+				passThrough[ref.ID()] = true
+				break
+			}
+		}
+	}
+	return passThrough
+}
+
+// isPassThroughRef returns true if ref is one of passThrough's
+// references.
+func isPassThroughRef(passThrough []bool, ref *sam.Reference) bool {
+	return ref != nil && passThrough != nil && passThrough[ref.ID()]
+}
+
+// passThroughScanProvider is a Provider that hides the records on
+// pass-through references from the distant mate scan, so they are
+// never stored as distant mates or counted for coverage.
+type passThroughScanProvider struct {
+	bamprovider.Provider
+	passThrough []bool
+}
+
+func (p *passThroughScanProvider) NewIterator(shard bam.Shard) bamprovider.Iterator {
+	if shard.StartRef != nil && shard.EndRef != nil && shard.StartRef.ID() == shard.EndRef.ID() &&
+		isPassThroughRef(p.passThrough, shard.StartRef) {
+		// Don't read shards that hold nothing but pass-through records.
+		return &emptyIterator{}
+	}
+	return &passThroughScanIterator{p.Provider.NewIterator(shard), p.passThrough}
+}
+
+// passThroughScanIterator is an Iterator that skips the records on
+// pass-through references.
+type passThroughScanIterator struct {
+	bamprovider.Iterator
+	passThrough []bool
+}
+
+func (i *passThroughScanIterator) Scan() bool {
+	for i.Iterator.Scan() {
+		if !isPassThroughRef(i.passThrough, i.Iterator.Record().Ref) {
+			return true
+		}
+		sam.PutInFreePool(i.Iterator.Record())
+	}
+	return false
+}
+
+// emptyIterator is an Iterator with no records.
+type emptyIterator struct{}
+
+func (i *emptyIterator) Scan() bool          { return false }
+func (i *emptyIterator) Record() *sam.Record { return nil }
+func (i *emptyIterator) Err() error          { return nil }
+func (i *emptyIterator) Close() error        { return nil }
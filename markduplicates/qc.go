@@ -0,0 +1,139 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/grailbio/base/errors"
+)
+
+// Names of the metrics checked against the QC thresholds.
+const (
+	qcDuplication        = "PERCENT_DUPLICATION"
+	qcOpticalDuplication = "PERCENT_OPTICAL_DUPLICATION"
+	qcHighCoverageBases  = "HIGH_COVERAGE_BASES"
+)
+
+// QCFailure describes a metric that exceeds its QC threshold.
+type QCFailure struct {
+	// Library is the library whose metric exceeds the threshold, or
+	// empty for a metric of the whole input.
+	Library string `json:"library,omitempty"`
+	// Metric is the name of the metric, for example
+	// PERCENT_DUPLICATION.
+	Metric    string  `json:"metric"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+}
+
+func (f QCFailure) String() string {
+	if f.Library == "" {
+		return fmt.Sprintf("%s %g exceeds %g", f.Metric, f.Value, f.Threshold)
+	}
+	return fmt.Sprintf("%s %g exceeds %g in library %s", f.Metric, f.Value, f.Threshold, f.Library)
+}
+
+// QCError is returned by Mark, along with the metrics, when the
+// metrics exceed the QC thresholds in Opts. The output is complete
+// when Mark returns a QCError.
+type QCError struct {
+	Failures []QCFailure
+}
+
+func (e *QCError) Error() string {
+	reasons := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		reasons[i] = f.String()
+	}
+	return "QC failed: " + strings.Join(reasons, "; ")
+}
+
+// validateQCThresholds checks the QC thresholds in opts.
+func validateQCThresholds(opts *Opts) error {
+	if opts.MaxDuplication < 0 || opts.MaxDuplication > 100 {
+		return fmt.Errorf("max-duplication must be a percentage between 0 and 100")
+	}
+	if opts.MaxOpticalDuplication < 0 || opts.MaxOpticalDuplication > 100 {
+		return fmt.Errorf("max-optical-duplication must be a percentage between 0 and 100")
+	}
+	if opts.MaxHighCoverageBases < 0 {
+		return fmt.Errorf("max-high-coverage-bases must be non-negative")
+	}
+	return nil
+}
+
+// checkQC returns a QCError if metrics exceed any of the QC thresholds
+// in opts, and nil otherwise. A threshold of 0 is not checked.
+func checkQC(opts *Opts, metrics *MetricsCollection) error {
+	var failures []QCFailure
+	libraries := make([]string, 0, len(metrics.LibraryMetrics))
+	for library := range metrics.LibraryMetrics {
+		libraries = append(libraries, library)
+	}
+	sort.Strings(libraries)
+	for _, library := range libraries {
+		m := metrics.LibraryMetrics[library]
+		if d := m.PercentDuplication(); opts.MaxDuplication > 0 && d > opts.MaxDuplication {
+			failures = append(failures, QCFailure{library, qcDuplication, d, opts.MaxDuplication})
+		}
+		if d := m.PercentOpticalDuplication(); opts.MaxOpticalDuplication > 0 && d > opts.MaxOpticalDuplication {
+			failures = append(failures, QCFailure{library, qcOpticalDuplication, d, opts.MaxOpticalDuplication})
+		}
+	}
+	if opts.MaxHighCoverageBases > 0 {
+		bases := 0
+		for _, interval := range metrics.HighCoverageIntervals {
+			bases += interval.End - interval.Start
+		}
+		if bases > opts.MaxHighCoverageBases {
+			failures = append(failures, QCFailure{"", qcHighCoverageBases, float64(bases),
+				float64(opts.MaxHighCoverageBases)})
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	return &QCError{failures}
+}
+
+// writeQC writes the QC status to opts.QCFile as a json object, for
+// example {"status":"fail","failures":[{"library":"lib1",
+// "metric":"PERCENT_DUPLICATION","value":41.5,"threshold":30}]}.
+func writeQC(ctx context.Context, opts *Opts, qcErr *QCError) (err error) {
+	var f io.WriteCloser
+	f, err = createOutput(ctx, outputSink(opts), opts.QCFile)
+	if err != nil {
+		return errors.E(err, "Couldn't create qc file:", opts.QCFile)
+	}
+	defer func() {
+		if err2 := f.Close(); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	status := struct {
+		Status   string      `json:"status"`
+		Failures []QCFailure `json:"failures"`
+	}{"pass", []QCFailure{}}
+	if qcErr != nil {
+		status.Status = "fail"
+		status.Failures = qcErr.Failures
+	}
+	return json.NewEncoder(f).Encode(status)
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"testing"
+
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckQC(t *testing.T) {
+	metrics := newMetricsCollection()
+	lib1 := metrics.Get("lib1")
+	lib1.ReadPairsExamined = 100
+	lib1.ReadPairDups = 40
+	lib1.ReadPairOpticalDups = 10
+	lib2 := metrics.Get("lib2")
+	lib2.ReadPairsExamined = 100
+	lib2.ReadPairDups = 20
+	metrics.AddHighCovInterval(CoverageInterval{RefId: 0, Start: 100, End: 300})
+	metrics.AddHighCovInterval(CoverageInterval{RefId: 1, Start: 0, End: 50})
+
+	for _, test := range []struct {
+		maxDuplication, maxOpticalDuplication float64
+		maxHighCoverageBases                  int
+		expected                              []QCFailure
+	}{
+		{0, 0, 0, nil},
+		{50, 20, 250, nil},
+		{30, 0, 0, []QCFailure{{"lib1", qcDuplication, 40, 30}}},
+		{10, 5, 249, []QCFailure{
+			{"lib1", qcDuplication, 40, 10},
+			{"lib1", qcOpticalDuplication, 10, 5},
+			{"lib2", qcDuplication, 20, 10},
+			{"", qcHighCoverageBases, 250, 249},
+		}},
+	} {
+		opts := defaultOpts
+		opts.MaxDuplication = test.maxDuplication
+		opts.MaxOpticalDuplication = test.maxOpticalDuplication
+		opts.MaxHighCoverageBases = test.maxHighCoverageBases
+		err := checkQC(&opts, metrics)
+		if test.expected == nil {
+			assert.NoError(t, err)
+			continue
+		}
+		assert.Equal(t, &QCError{test.expected}, err)
+	}
+}
+
+func TestWriteQC(t *testing.T) {
+	memory := &MemorySink{}
+	opts := defaultOpts
+	opts.QCFile = "qc"
+	opts.Sink = memory
+
+	assert.NoError(t, writeQC(vcontext.Background(), &opts, nil))
+	b, ok := memory.Get("qc")
+	assert.True(t, ok)
+	assert.Equal(t, `{"status":"pass","failures":[]}`+"\n", string(b))
+
+	qcErr := &QCError{[]QCFailure{{"lib1", qcDuplication, 40, 30}}}
+	assert.NoError(t, writeQC(vcontext.Background(), &opts, qcErr))
+	b, ok = memory.Get("qc")
+	assert.True(t, ok)
+	assert.Equal(t, `{"status":"fail","failures":[{"library":"lib1","metric":"PERCENT_DUPLICATION",`+
+		`"value":40,"threshold":30}]}`+"\n", string(b))
+	assert.Equal(t, "QC failed: PERCENT_DUPLICATION 40 exceeds 30 in library lib1", qcErr.Error())
+}
+
+func TestMarkQCFailure(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	records := []*sam.Record{
+		NewRecord("A:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecord("B:1:1:1:1:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecord("A:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+		NewRecord("B:1:1:1:1:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+	}
+	for testIdx, maxDuplication := range []float64{60, 40} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.Format = "bam"
+		opts.MaxDuplication = maxDuplication
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, records),
+			Opts:     &opts,
+		}
+		metrics, err := markDuplicates.Mark(nil)
+		// The metrics and output are complete even when QC fails.
+		assert.NotNil(t, metrics)
+		assert.Equal(t, 4, len(ReadRecords(t, opts.OutputPath)))
+		if maxDuplication > 50 {
+			assert.NoError(t, err)
+			continue
+		}
+		qcErr, ok := err.(*QCError)
+		assert.True(t, ok, "err: %v", err)
+		if ok {
+			assert.Equal(t, []QCFailure{{"Unknown Library", qcDuplication, 50, 40}}, qcErr.Failures)
+		}
+	}
+}
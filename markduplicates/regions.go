@@ -0,0 +1,372 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bio/biopb"
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+)
+
+// regionLookupGap is the largest distance between two mates outside
+// the regions that are fetched by the same lookup. Mates that are
+// closer than this share one index query.
+const regionLookupGap = 1000
+
+// region is a 0-based, half-open range of positions on ref.
+type region struct {
+	ref        *sam.Reference
+	start, end int
+}
+
+// parseRegions parses samtools-style region strings, and returns the
+// regions sorted by coordinate, with overlapping regions merged.
+func parseRegions(header *sam.Header, strs []string) ([]region, error) {
+	refs := make(map[string]*sam.Reference)
+	for _, ref := range header.Refs() {
+		refs[ref.Name()] = ref
+	}
+	var regions []region
+	for _, s := range strs {
+		r, err := parseRegion(refs, s)
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, r)
+	}
+	sort.SliceStable(regions, func(i, j int) bool {
+		if regions[i].ref.ID() != regions[j].ref.ID() {
+			return regions[i].ref.ID() < regions[j].ref.ID()
+		}
+		return regions[i].start < regions[j].start
+	})
+	var merged []region
+	for _, r := range regions {
+		if n := len(merged); n > 0 && merged[n-1].ref == r.ref && r.start <= merged[n-1].end {
+			if r.end > merged[n-1].end {
+				merged[n-1].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged, nil
+}
+
+// parseRegion parses a region string of the form "chr", "chr:start"
+// or "chr:start-end", where start and end are 1-based and inclusive,
+// and may contain commas.
+func parseRegion(refs map[string]*sam.Reference, s string) (region, error) {
+	// A reference name may itself contain a colon, so try the whole
+	// string first.
+	if ref, ok := refs[s]; ok {
+		return region{ref, 0, ref.Len()}, nil
+	}
+	colon := strings.LastIndexByte(s, ':')
+	if colon < 0 {
+		return region{}, fmt.Errorf("region %s: unknown reference", s)
+	}
+	ref, ok := refs[s[:colon]]
+	if !ok {
+		return region{}, fmt.Errorf("region %s: unknown reference %s", s, s[:colon])
+	}
+	parsePos := func(pos string) (int, error) {
+		v, err := strconv.Atoi(strings.Replace(pos, ",", "", -1))
+		if err != nil || v <= 0 {
+			return 0, fmt.Errorf("region %s: invalid position %s", s, pos)
+		}
+		return v, nil
+	}
+	r := region{ref: ref, end: ref.Len()}
+	positions := strings.SplitN(s[colon+1:], "-", 2)
+	start, err := parsePos(positions[0])
+	if err != nil {
+		return region{}, err
+	}
+	r.start = start - 1
+	if len(positions) == 2 && positions[1] != "" {
+		end, err := parsePos(positions[1])
+		if err != nil {
+			return region{}, err
+		}
+		r.end = min(end, ref.Len())
+	}
+	if r.start >= r.end {
+		return region{}, fmt.Errorf("region %s is empty", s)
+	}
+	return r, nil
+}
+
+// getRegionShards intersects the mapped shards with regions, and
+// returns the resulting shards in coordinate order. Each returned
+// shard lies on a single reference.
+func getRegionShards(shards []bam.Shard, regions []region) []bam.Shard {
+	var regionShards []bam.Shard
+	for _, shard := range shards {
+		if shard.StartRef == nil {
+			continue
+		}
+		for _, r := range regions {
+			id := r.ref.ID()
+			if id < shard.StartRef.ID() || (shard.EndRef != nil && id > shard.EndRef.ID()) {
+				continue
+			}
+			start, end := 0, r.ref.Len()
+			if id == shard.StartRef.ID() {
+				start = shard.Start
+			}
+			if shard.EndRef != nil && id == shard.EndRef.ID() {
+				end = shard.End
+			}
+			if r.start > start {
+				start = r.start
+			}
+			if r.end < end {
+				end = r.end
+			}
+			if start >= end {
+				continue
+			}
+			regionShards = append(regionShards, bam.Shard{
+				StartRef: r.ref,
+				EndRef:   r.ref,
+				Start:    start,
+				End:      end,
+				Padding:  shard.Padding,
+			})
+		}
+	}
+	return regionShards
+}
+
+// addGapShards returns regionShards interleaved with unpadded shards
+// that cover the rest of each mapped reference, so that every mate
+// position falls in some shard, and the indexes of the added gap
+// shards. The returned shards are numbered in order.
+func addGapShards(header *sam.Header, regionShards []bam.Shard) ([]bam.Shard, map[int]bool) {
+	var shards []bam.Shard
+	gaps := make(map[int]bool)
+	addGap := func(ref *sam.Reference, start, end int) {
+		if start < end {
+			gaps[len(shards)] = true
+			shards = append(shards, bam.Shard{StartRef: ref, EndRef: ref, Start: start, End: end})
+		}
+	}
+	i := 0
+	for _, ref := range header.Refs() {
+		pos := 0
+		for ; i < len(regionShards) && regionShards[i].StartRef == ref; i++ {
+			addGap(ref, pos, regionShards[i].Start)
+			shards = append(shards, regionShards[i])
+			pos = regionShards[i].End
+		}
+		addGap(ref, pos, ref.Len())
+	}
+	for idx := range shards {
+		shards[idx].ShardIdx = idx
+	}
+	return shards, gaps
+}
+
+// mateKey identifies a primary read by its name and read1 flag, such
+// as the mate that a read is looking for.
+type mateKey struct {
+	name  string
+	read1 bool
+}
+
+// getRegionMates returns the primary mates, in file order, of the
+// reads in the region shards whose mates lie outside every region
+// shard. It scans the region shards to find the mates' positions, and
+// then reads only the parts of the input around those positions.
+func (m *MarkDuplicates) getRegionMates(shards []bam.Shard, gaps map[int]bool) ([]*sam.Record, error) {
+	inRegion := func(coord biopb.Coord) bool {
+		i := sort.Search(len(shards), func(i int) bool {
+			return bam.NewCoord(shards[i].EndRef, shards[i].End, 0).GT(coord)
+		})
+		return i < len(shards) && !gaps[i] && shards[i].CoordInShard(0, coord)
+	}
+
+	// Find the positions of the mates outside the regions.
+	wanted := make(map[mateKey]biopb.Coord)
+	var mutex sync.Mutex
+	shardChannel := make(chan bam.Shard, len(shards))
+	for _, shard := range shards {
+		if !gaps[shard.ShardIdx] {
+			shardChannel <- shard
+		}
+	}
+	close(shardChannel)
+	var workerGroup sync.WaitGroup
+	var errs []error
+	for i := 0; i < m.Opts.Parallelism; i++ {
+		workerGroup.Add(1)
+		go func() {
+			defer workerGroup.Done()
+			found := make(map[mateKey]biopb.Coord)
+			for shard := range shardChannel {
+				iter := m.provider.NewIterator(shard)
+				for iter.Scan() {
+					record := iter.Record()
+					if record.Flags&(sam.Secondary|sam.Supplementary|sam.Unmapped) == 0 &&
+						!bam.HasNoMappedMate(record) &&
+						!isPassThroughRef(m.passThrough, record.Ref) &&
+						!isPassThroughRef(m.passThrough, record.MateRef) {
+						mateCoord := bam.NewCoord(record.MateRef, record.MatePos, 0)
+						if !inRegion(mateCoord) {
+							found[mateKey{record.Name, record.Flags&sam.Read1 == 0}] = mateCoord
+						}
+					}
+					sam.PutInFreePool(record)
+				}
+				if err := iter.Close(); err != nil {
+					mutex.Lock()
+					errs = append(errs, fmt.Errorf("scan region shard %v: %v", shard, err))
+					mutex.Unlock()
+				}
+			}
+			mutex.Lock()
+			for k, v := range found {
+				wanted[k] = v
+			}
+			mutex.Unlock()
+		}()
+	}
+	workerGroup.Wait()
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	// Group the mate positions into lookups, and read each lookup from
+	// the index.
+	header, err := m.provider.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	coords := make([]biopb.Coord, 0, len(wanted))
+	for _, coord := range wanted {
+		coords = append(coords, coord)
+	}
+	sort.Slice(coords, func(i, j int) bool { return coords[i].LT(coords[j]) })
+	var lookups []bam.Shard
+	for _, coord := range coords {
+		pos := int(coord.Pos)
+		if n := len(lookups); n > 0 && lookups[n-1].StartRef.ID() == int(coord.RefId) &&
+			pos < lookups[n-1].End+regionLookupGap {
+			lookups[n-1].End = pos + 1
+			continue
+		}
+		ref := header.Refs()[coord.RefId]
+		lookups = append(lookups, bam.Shard{StartRef: ref, EndRef: ref, Start: pos, End: pos + 1})
+	}
+	log.Debug.Printf("fetching %d mates outside the regions with %d lookups", len(wanted), len(lookups))
+
+	var mates []*sam.Record
+	for _, lookup := range lookups {
+		iter := m.provider.NewIterator(lookup)
+		for iter.Scan() {
+			record := iter.Record()
+			key := mateKey{record.Name, record.Flags&sam.Read1 != 0}
+			coord, ok := wanted[key]
+			if ok && record.Flags&(sam.Secondary|sam.Supplementary) == 0 &&
+				coord.EQ(bam.CoordFromSAMRecord(record, 0)) {
+				mates = append(mates, record)
+				delete(wanted, key)
+			} else {
+				sam.PutInFreePool(record)
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, fmt.Errorf("fetch mates in %v: %v", lookup, err)
+		}
+	}
+	// wanted now holds the mates that were not found.
+	if len(wanted) > 0 {
+		var missing mateKey
+		for key := range wanted {
+			if missing.name == "" || key.name < missing.name {
+				missing = key
+			}
+		}
+		if m.Opts.CorruptBlockPolicy != CorruptBlockSkip {
+			return nil, fmt.Errorf("found only %d of %d mates outside the regions, could not find mate of read %s at %v",
+				len(mates), len(mates)+len(wanted), missing.name, wanted[missing])
+		}
+		log.Error.Printf("found only %d of %d mates outside the regions, leaving reads such as %s unmarked",
+			len(mates), len(mates)+len(wanted), missing.name)
+	}
+	return mates, nil
+}
+
+// regionProvider is a Provider for the distant mate scan of a run
+// restricted to regions. It reads the gap shards from the mates that
+// getRegionMates fetched, instead of from the input.
+type regionProvider struct {
+	bamprovider.Provider
+	// gapMates holds the fetched mates in each gap shard, by shard
+	// index. They are split up front, because the scan returns the
+	// records of each shard to the free pool as it goes.
+	gapMates map[int][]*sam.Record
+}
+
+func newRegionProvider(provider bamprovider.Provider, shards []bam.Shard, gaps map[int]bool,
+	mates []*sam.Record) *regionProvider {
+	p := &regionProvider{provider, make(map[int][]*sam.Record)}
+	for _, shard := range shards {
+		if !gaps[shard.ShardIdx] {
+			continue
+		}
+		search := func(pos int) int {
+			coord := bam.NewCoord(shard.StartRef, pos, 0)
+			return sort.Search(len(mates), func(i int) bool {
+				return bam.CoordFromSAMRecord(mates[i], 0).GE(coord)
+			})
+		}
+		p.gapMates[shard.ShardIdx] = mates[search(shard.Start):search(shard.End)]
+	}
+	return p
+}
+
+func (p *regionProvider) NewIterator(shard bam.Shard) bamprovider.Iterator {
+	if mates, ok := p.gapMates[shard.ShardIdx]; ok {
+		return &recordsIterator{records: mates}
+	}
+	return p.Provider.NewIterator(shard)
+}
+
+// recordsIterator is an Iterator over records in memory.
+type recordsIterator struct {
+	records []*sam.Record
+	record  *sam.Record
+}
+
+func (i *recordsIterator) Scan() bool {
+	if len(i.records) == 0 {
+		return false
+	}
+	i.record, i.records = i.records[0], i.records[1:]
+	return true
+}
+
+func (i *recordsIterator) Record() *sam.Record { return i.record }
+func (i *recordsIterator) Err() error          { return nil }
+func (i *recordsIterator) Close() error        { return nil }
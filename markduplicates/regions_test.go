@@ -0,0 +1,166 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRegions(t *testing.T) {
+	tests := []struct {
+		regions  []string
+		expected []region
+	}{
+		{[]string{"chr1"}, []region{{chr1, 0, 1000}}},
+		{[]string{"chr2:101"}, []region{{chr2, 100, 2000}}},
+		{[]string{"chr2:1,001-1,500"}, []region{{chr2, 1000, 1500}}},
+		{[]string{"chr1:901-5000"}, []region{{chr1, 900, 1000}}},
+		// Regions are sorted, and overlapping regions are merged.
+		{[]string{"chr2:1-10", "chr1:50-100", "chr1:1-60"}, []region{{chr1, 0, 100}, {chr2, 0, 10}}},
+	}
+	for _, test := range tests {
+		regions, err := parseRegions(header, test.regions)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, regions, "regions %v", test.regions)
+	}
+
+	for _, bad := range []string{"chr3", "chr3:1-10", "chr1:0-10", "chr1:10-5", "chr1:a-10", "chr1:2000"} {
+		_, err := parseRegions(header, []string{bad})
+		assert.Error(t, err, "region %s", bad)
+	}
+}
+
+func TestRegionShards(t *testing.T) {
+	shards := []gbam.Shard{
+		{StartRef: chr1, EndRef: chr1, Start: 0, End: 500, Padding: 10, ShardIdx: 0},
+		{StartRef: chr1, EndRef: chr2, Start: 500, End: 100, Padding: 10, ShardIdx: 1},
+		{StartRef: chr2, EndRef: nil, Start: 100, End: 0, Padding: 10, ShardIdx: 2},
+		{StartRef: nil, EndRef: nil, Start: 0, End: math.MaxInt32, ShardIdx: 3},
+	}
+	regions, err := parseRegions(header, []string{"chr1:401-600", "chr2:51-150"})
+	assert.NoError(t, err)
+	actual, gaps := addGapShards(header, getRegionShards(shards, regions))
+
+	expected := []gbam.Shard{
+		{StartRef: chr1, EndRef: chr1, Start: 0, End: 400, ShardIdx: 0},
+		{StartRef: chr1, EndRef: chr1, Start: 400, End: 500, Padding: 10, ShardIdx: 1},
+		{StartRef: chr1, EndRef: chr1, Start: 500, End: 600, Padding: 10, ShardIdx: 2},
+		{StartRef: chr1, EndRef: chr1, Start: 600, End: 1000, ShardIdx: 3},
+		{StartRef: chr2, EndRef: chr2, Start: 0, End: 50, ShardIdx: 4},
+		{StartRef: chr2, EndRef: chr2, Start: 50, End: 100, Padding: 10, ShardIdx: 5},
+		{StartRef: chr2, EndRef: chr2, Start: 100, End: 150, Padding: 10, ShardIdx: 6},
+		{StartRef: chr2, EndRef: chr2, Start: 150, End: 2000, ShardIdx: 7},
+	}
+	assert.Equal(t, expected, actual)
+	assert.Equal(t, map[int]bool{0: true, 3: true, 4: true, 7: true}, gaps)
+}
+
+func TestMarkRegions(t *testing.T) {
+	// newRecords returns the sequential test records, plus duplicates
+	// of the readpairs between chr1 and chr2, in coordinate order.
+	newRecords := func() []*sam.Record {
+		records := sequentialTestRecords()
+		for pos := 0; pos < 30; pos += 7 {
+			name := fmt.Sprintf("E%d:1:1:1:1:1:1", pos)
+			records = append(records, NewRecord(name, chr1, 900+pos, r1F, pos, chr2, cigar0))
+			records = append(records, NewRecord(name, chr2, pos, r2R, 900+pos, chr1, cigar0))
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			a, b := gbam.CoordFromSAMRecord(records[i], 0), gbam.CoordFromSAMRecord(records[j], 0)
+			return a.LT(b)
+		})
+		return records
+	}
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	mark := func(i int, regions []string, shards []gbam.Shard) []*sam.Record {
+		opts := defaultOpts
+		opts.Format = "bam"
+		opts.OutputPath = NewTestOutput(tempDir, i, "bam")
+		opts.Regions = regions
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, newRecords()),
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(shards)
+		assert.NoError(t, err)
+		return ReadRecords(t, opts.OutputPath)
+	}
+	full := mark(0, nil, nil)
+
+	splitShards := []gbam.Shard{
+		{StartRef: chr1, EndRef: chr1, Start: 0, End: 250, Padding: 10, ShardIdx: 0},
+		{StartRef: chr1, EndRef: chr2, Start: 250, End: 20, Padding: 10, ShardIdx: 1},
+		{StartRef: chr2, EndRef: chr2, Start: 20, End: 2000, Padding: 10, ShardIdx: 2},
+		{StartRef: nil, EndRef: nil, Start: 0, End: math.MaxInt32, ShardIdx: 3},
+	}
+	regionStrs := []string{"chr1:201-600", "chr2:1-50"}
+	regions, err := parseRegions(header, regionStrs)
+	assert.NoError(t, err)
+	for testIdx, shards := range [][]gbam.Shard{nil, splitShards} {
+		// The region run flags the records in the regions just like
+		// the full run.
+		var expected []string
+		dups := 0
+		for _, r := range full {
+			for _, region := range regions {
+				if r.Ref != nil && r.Ref.Name() == region.ref.Name() && r.Pos >= region.start && r.Pos < region.end {
+					expected = append(expected, fmt.Sprintf("%s %v:%d %v", r.Name, r.Ref.Name(), r.Pos, r.Flags))
+					if r.Flags&sam.Duplicate != 0 {
+						dups++
+					}
+				}
+			}
+		}
+		var actual []string
+		for _, r := range mark(testIdx+1, regionStrs, shards) {
+			actual = append(actual, fmt.Sprintf("%s %v:%d %v", r.Name, r.Ref.Name(), r.Pos, r.Flags))
+		}
+		assert.Equal(t, expected, actual, "shards %v", shards)
+		assert.True(t, dups > 0)
+	}
+}
+
+func TestMarkRegionsMissingMate(t *testing.T) {
+	// M's mate is outside the region, but is not in the input.
+	records := append(sequentialTestRecords(),
+		NewRecord("M:1:1:1:1:1:1", chr1, 300, r1F, 1500, chr2, cigar0))
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := gbam.CoordFromSAMRecord(records[i], 0), gbam.CoordFromSAMRecord(records[j], 0)
+		return a.LT(b)
+	})
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	opts := defaultOpts
+	opts.Format = "bam"
+	opts.OutputPath = NewTestOutput(tempDir, 0, "bam")
+	opts.Regions = []string{"chr1:201-600"}
+	markDuplicates := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(header, records),
+		Opts:     &opts,
+	}
+	_, err := markDuplicates.Mark(nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "could not find mate of read M:1:1:1:1:1:1")
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/retry"
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+)
+
+// maxRetryBackoff is the maximum time to wait between two tries.
+const maxRetryBackoff = 2 * time.Minute
+
+// transientMessages are substrings of error messages from cloud
+// storage that indicate the operation may succeed if retried.
+var transientMessages = []string{
+	"connection reset",
+	"broken pipe",
+	"unexpected EOF",
+	"503",
+	"SlowDown",
+	"ServiceUnavailable",
+	"InternalError",
+	"RequestTimeout",
+}
+
+// isTransient returns true if err is likely to go away when the
+// operation that caused it is retried.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.IsTemporary(err) || errors.Is(errors.Net, err) ||
+		errors.Is(errors.Unavailable, err) || errors.Is(errors.Timeout, err) {
+		return true
+	}
+	msg := err.Error()
+	for _, m := range transientMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// newRetryPolicy returns the retry policy for opts, which allows
+// opts.IORetries retries with jittered exponential backoff starting at
+// opts.IORetryBackoff.
+func newRetryPolicy(opts *Opts) retry.Policy {
+	return retry.MaxTries(retry.Jitter(retry.Backoff(opts.IORetryBackoff, maxRetryBackoff, 2), 0.25),
+		opts.IORetries)
+}
+
+// retryProvider is a Provider that retries transient errors while
+// reading the header, generating shards, and iterating over records.
+type retryProvider struct {
+	bamprovider.Provider
+	policy retry.Policy
+}
+
+// newRetryProvider returns a Provider that wraps provider and retries
+// transient errors according to policy.
+func newRetryProvider(provider bamprovider.Provider, policy retry.Policy) bamprovider.Provider {
+	return &retryProvider{provider, policy}
+}
+
+// do calls fn until it succeeds, returns an error that is not
+// transient, or the retry policy gives up.
+func (p *retryProvider) do(what string, fn func() error) error {
+	for retries := 0; ; retries++ {
+		err := fn()
+		if !isTransient(err) {
+			return err
+		}
+		log.Error.Printf("%s failed with transient error, retry %d: %v", what, retries, err)
+		if err2 := retry.Wait(vcontext.Background(), p.policy, retries); err2 != nil {
+			return errors.E(err, err2.Error())
+		}
+	}
+}
+
+func (p *retryProvider) GetHeader() (header *sam.Header, err error) {
+	err = p.do("reading header", func() error {
+		header, err = p.Provider.GetHeader()
+		return err
+	})
+	return
+}
+
+func (p *retryProvider) GenerateShards(opts bamprovider.GenerateShardsOpts) (shards []bam.Shard, err error) {
+	err = p.do("generating shards", func() error {
+		shards, err = p.Provider.GenerateShards(opts)
+		return err
+	})
+	return
+}
+
+func (p *retryProvider) NewIterator(shard bam.Shard) bamprovider.Iterator {
+	// A streamed shard can't be reopened, and the stream retries by
+	// itself.
+	if s, ok := p.Provider.(*sequentialProvider); ok && s.isStreaming() {
+		return s.NewIterator(shard)
+	}
+	return &retryIterator{
+		provider: p,
+		shard:    shard,
+		iter:     p.Provider.NewIterator(shard),
+	}
+}
+
+// retryIterator is an Iterator that, on a transient error, reopens the
+// shard at the coordinate of the last record it returned and resumes
+// after that record.
+type retryIterator struct {
+	provider *retryProvider
+	shard    bam.Shard
+	iter     bamprovider.Iterator
+	record   *sam.Record
+	// n is the number of records returned so far, and lastRef, lastPos
+	// and sameCoord are the coordinate of the last record returned, and
+	// the number of records returned at that coordinate.
+	n         int
+	lastRef   *sam.Reference
+	lastPos   int
+	sameCoord int
+	retries   int
+	err       error
+}
+
+func (i *retryIterator) Scan() bool {
+	for i.iter != nil {
+		if i.iter.Scan() {
+			i.record = i.iter.Record()
+			ref, pos := recordCoord(i.record)
+			if i.n > 0 && ref.ID() == i.lastRef.ID() && pos == i.lastPos {
+				i.sameCoord++
+			} else {
+				i.lastRef, i.lastPos, i.sameCoord = ref, pos, 1
+			}
+			i.n++
+			return true
+		}
+		err := i.iter.Close()
+		i.iter = nil
+		if !isTransient(err) {
+			i.err = err
+			return false
+		}
+		log.Error.Printf("reading shard %s failed with transient error after %d records, retry %d: %v",
+			i.shard.String(), i.n, i.retries, err)
+		if err2 := retry.Wait(vcontext.Background(), i.provider.policy, i.retries); err2 != nil {
+			i.err = errors.E(err, err2.Error())
+			return false
+		}
+		i.retries++
+		i.reopen()
+	}
+	return false
+}
+
+// recordCoord returns the reference and position that determine r's
+// place in a coordinate sorted input.
+func recordCoord(r *sam.Record) (*sam.Reference, int) {
+	if r.Ref == nil {
+		return nil, 0
+	}
+	return r.Ref, r.Pos
+}
+
+// reopen opens a new iterator that starts at the coordinate of the last
+// record returned, and skips the records at that coordinate that were
+// already returned.
+func (i *retryIterator) reopen() {
+	if i.n == 0 {
+		i.iter = i.provider.Provider.NewIterator(i.shard)
+		return
+	}
+	resume := i.shard
+	resume.StartRef = i.lastRef
+	resume.Start = i.lastPos
+	resume.StartSeq = 0
+	if i.lastRef.ID() == i.shard.StartRef.ID() && i.lastPos == i.shard.PaddedStart() {
+		resume.StartSeq = i.shard.StartSeq
+	}
+	resume.End = i.shard.PaddedEnd()
+	resume.Padding = 0
+	i.iter = i.provider.Provider.NewIterator(resume)
+
+	skipped := 0
+	for skipped < i.sameCoord && i.iter.Scan() {
+		r := i.iter.Record()
+		ref, pos := recordCoord(r)
+		sam.PutInFreePool(r)
+		if ref.ID() != i.lastRef.ID() || pos != i.lastPos {
+			break
+		}
+		skipped++
+	}
+	if skipped < i.sameCoord && i.iter.Err() == nil {
+		i.iter.Close() // nolint: errcheck
+		i.iter = nil
+		i.err = errors.E(errors.Integrity, "shard", i.shard.String(),
+			"has fewer records after reopening")
+	}
+}
+
+func (i *retryIterator) Record() *sam.Record {
+	return i.record
+}
+
+func (i *retryIterator) Err() error {
+	if i.iter != nil {
+		return i.iter.Err()
+	}
+	return i.err
+}
+
+func (i *retryIterator) Close() error {
+	if i.iter != nil {
+		i.err = i.iter.Close()
+		i.iter = nil
+	}
+	return i.err
+}
+
+// createWithRetries creates path, retrying transient errors when
+// opts.IORetries is set.
+func createWithRetries(ctx context.Context, opts *Opts, path string) (file.File, error) {
+	for retries := 0; ; retries++ {
+		out, err := file.Create(ctx, path)
+		if err == nil || !isTransient(err) || opts.IORetries == 0 {
+			return out, err
+		}
+		log.Error.Printf("creating %s failed with transient error, retry %d: %v", path, retries, err)
+		if err2 := retry.Wait(ctx, newRetryPolicy(opts), retries); err2 != nil {
+			return nil, errors.E(err, err2.Error())
+		}
+	}
+}
+
+// openWithRetries opens path, retrying transient errors when
+// opts.IORetries is set.
+func openWithRetries(ctx context.Context, opts *Opts, path string) (file.File, error) {
+	for retries := 0; ; retries++ {
+		in, err := file.Open(ctx, path)
+		if err == nil || !isTransient(err) || opts.IORetries == 0 {
+			return in, err
+		}
+		log.Error.Printf("opening %s failed with transient error, retry %d: %v", path, retries, err)
+		if err2 := retry.Wait(ctx, newRetryPolicy(opts), retries); err2 != nil {
+			return nil, errors.E(err, err2.Error())
+		}
+	}
+}
+
+// createOutputFile creates the output file at path. When opts.IORetries
+// is set and path is not local, the writes go to a spool file in
+// opts.ScratchDir, and Close uploads the spool file to path. Cloud
+// storage only commits an object when it is closed, and a failed
+// upload can't be resumed, so Close retries the whole upload on
+// transient errors.
+func createOutputFile(ctx context.Context, opts *Opts, path string) (file.File, error) {
+	if scheme, _, err := file.ParsePath(path); err != nil || scheme == "" || opts.IORetries == 0 {
+		return createWithRetries(ctx, opts, path)
+	}
+	dir, err := ioutil.TempDir(opts.ScratchDir, "doppelmark-upload-")
+	if err != nil {
+		return nil, err
+	}
+	spool, err := file.Create(ctx, filepath.Join(dir, "spool"))
+	if err != nil {
+		os.RemoveAll(dir) // nolint: errcheck
+		return nil, err
+	}
+	return &uploadFile{File: spool, opts: opts, path: path, dir: dir}, nil
+}
+
+// uploadFile is a file.File that writes to a local spool file in dir,
+// and uploads it to path on Close.
+type uploadFile struct {
+	file.File
+	opts *Opts
+	path string
+	dir  string
+}
+
+func (f *uploadFile) String() string {
+	return f.path
+}
+
+func (f *uploadFile) Name() string {
+	return f.path
+}
+
+func (f *uploadFile) Discard(ctx context.Context) {
+	f.File.Discard(ctx)
+	os.RemoveAll(f.dir) // nolint: errcheck
+}
+
+func (f *uploadFile) Close(ctx context.Context) error {
+	defer os.RemoveAll(f.dir) // nolint: errcheck
+	if err := f.File.Close(ctx); err != nil {
+		return err
+	}
+	for retries := 0; ; retries++ {
+		err := f.upload(ctx)
+		if !isTransient(err) {
+			return err
+		}
+		log.Error.Printf("uploading %s failed with transient error, retry %d: %v", f.path, retries, err)
+		if err2 := retry.Wait(ctx, newRetryPolicy(f.opts), retries); err2 != nil {
+			return errors.E(err, err2.Error())
+		}
+	}
+}
+
+// upload copies the spool file to path.
+func (f *uploadFile) upload(ctx context.Context) error {
+	in, err := os.Open(f.File.Name())
+	if err != nil {
+		return err
+	}
+	defer in.Close() // nolint: errcheck
+	out, err := createWithRetries(ctx, f.opts, f.path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out.Writer(ctx), in); err != nil {
+		out.Discard(ctx)
+		return err
+	}
+	return out.Close(ctx)
+}
@@ -0,0 +1,336 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/retry"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyProvider returns iterators that fail with err after
+// failAfter records, for the first failures iterators it creates. It
+// records the shards that it opens.
+type flakyProvider struct {
+	bamprovider.Provider
+	failAfter int
+	err       error
+
+	mu       sync.Mutex
+	failures int
+	shards   []gbam.Shard
+}
+
+func (p *flakyProvider) NewIterator(shard gbam.Shard) bamprovider.Iterator {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.shards = append(p.shards, shard)
+	iter := p.Provider.NewIterator(shard)
+	if p.failures == 0 {
+		return iter
+	}
+	p.failures--
+	return &flakyIterator{Iterator: iter, remaining: p.failAfter, err: p.err}
+}
+
+type flakyIterator struct {
+	bamprovider.Iterator
+	remaining int
+	err       error
+	failed    bool
+}
+
+func (i *flakyIterator) Scan() bool {
+	if i.remaining == 0 {
+		i.failed = true
+		return false
+	}
+	i.remaining--
+	return i.Iterator.Scan()
+}
+
+func (i *flakyIterator) Err() error {
+	if i.failed {
+		return i.err
+	}
+	return i.Iterator.Err()
+}
+
+func (i *flakyIterator) Close() error {
+	if err := i.Iterator.Close(); err != nil {
+		return err
+	}
+	return i.Err()
+}
+
+// flakyFiles is the file implementation for the "flaky" scheme. It
+// stores files on the local filesystem, fails to close the first
+// closeFailures files it creates, and fails to read the first
+// readFailures files it opens after readFailAfter bytes, with a
+// transient error.
+var flakyFiles = &flakyImpl{Implementation: file.FindImplementation("")}
+
+func init() {
+	file.RegisterImplementation("flaky", func() file.Implementation { return flakyFiles })
+}
+
+type flakyImpl struct {
+	file.Implementation
+
+	mu            sync.Mutex
+	closeFailures int
+	creates       int
+	readFailures  int
+	readFailAfter int
+}
+
+func (impl *flakyImpl) Open(ctx context.Context, path string, opts ...file.Opts) (file.File, error) {
+	f, err := impl.Implementation.Open(ctx, strings.TrimPrefix(path, "flaky://"), opts...)
+	if err != nil {
+		return nil, err
+	}
+	impl.mu.Lock()
+	defer impl.mu.Unlock()
+	if impl.readFailures == 0 {
+		return f, nil
+	}
+	impl.readFailures--
+	return &flakyReadFile{File: f, remaining: impl.readFailAfter}, nil
+}
+
+func (impl *flakyImpl) Create(ctx context.Context, path string, opts ...file.Opts) (file.File, error) {
+	f, err := impl.Implementation.Create(ctx, strings.TrimPrefix(path, "flaky://"), opts...)
+	if err != nil {
+		return nil, err
+	}
+	impl.mu.Lock()
+	defer impl.mu.Unlock()
+	impl.creates++
+	if impl.closeFailures == 0 {
+		return f, nil
+	}
+	impl.closeFailures--
+	return &flakyFile{f}, nil
+}
+
+type flakyFile struct {
+	file.File
+}
+
+func (f *flakyFile) Close(ctx context.Context) error {
+	f.File.Discard(ctx)
+	return errors.E(errors.Net, "connection reset by peer")
+}
+
+type flakyReadFile struct {
+	file.File
+	remaining int
+}
+
+func (f *flakyReadFile) Reader(ctx context.Context) io.ReadSeeker {
+	return &flakyReader{ReadSeeker: f.File.Reader(ctx), remaining: &f.remaining}
+}
+
+type flakyReader struct {
+	io.ReadSeeker
+	remaining *int
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	if *r.remaining <= 0 {
+		return 0, errors.E(errors.Net, "connection reset by peer")
+	}
+	if len(p) > *r.remaining {
+		p = p[:*r.remaining]
+	}
+	n, err := r.ReadSeeker.Read(p)
+	*r.remaining -= n
+	return n, err
+}
+
+func TestUploadRetries(t *testing.T) {
+	ctx := context.Background()
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	scratchDir := filepath.Join(tempDir, "scratch")
+	assert.NoError(t, os.Mkdir(scratchDir, 0755))
+	opts := defaultOpts
+	opts.ScratchDir = scratchDir
+	opts.IORetries = 2
+	opts.IORetryBackoff = time.Millisecond
+
+	write := func(path, contents string) error {
+		f, err := createOutputFile(ctx, &opts, "flaky://"+path)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Writer(ctx).Write([]byte(contents)); err != nil {
+			return err
+		}
+		return f.Close(ctx)
+	}
+
+	// Two failed uploads are retried from the start.
+	flakyFiles.closeFailures, flakyFiles.creates = 2, 0
+	path := filepath.Join(tempDir, "a.txt")
+	assert.NoError(t, write(path, "hello"))
+	assert.Equal(t, 3, flakyFiles.creates)
+	contents, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(contents))
+
+	// Too many failed uploads are returned.
+	flakyFiles.closeFailures, flakyFiles.creates = 3, 0
+	path = filepath.Join(tempDir, "b.txt")
+	assert.Error(t, write(path, "hello"))
+	assert.Equal(t, 3, flakyFiles.creates)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// The sink outputs are uploaded with retries too.
+	flakyFiles.closeFailures, flakyFiles.creates = 1, 0
+	path = filepath.Join(tempDir, "c.txt")
+	w, err := NewFileSink(&opts).Create(ctx, "flaky://"+path)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("world"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, 2, flakyFiles.creates)
+	contents, err = ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(contents))
+
+	// The spool files are removed.
+	spools, err := ioutil.ReadDir(scratchDir)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(spools))
+}
+
+func TestRetryIterator(t *testing.T) {
+	records := []*sam.Record{
+		NewRecord("A", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecord("B", chr1, 5, r1F, 10, chr1, cigar0),
+		NewRecord("A", chr1, 10, r2R, 0, chr1, cigar0),
+		NewRecord("B", chr1, 10, r2R, 5, chr1, cigar0),
+	}
+	policy := retry.MaxTries(nil, 2)
+	transient := errors.E(errors.Net, "connection reset by peer")
+
+	scanNames := func(provider bamprovider.Provider) ([]string, error) {
+		iter := provider.NewIterator(gbam.UniversalShard(header))
+		var names []string
+		for iter.Scan() {
+			names = append(names, fmt.Sprintf("%s:%d", iter.Record().Name, iter.Record().Pos))
+		}
+		return names, iter.Close()
+	}
+	expected := []string{"A:0", "B:5", "A:10", "B:10"}
+
+	// Two transient failures are retried, and resume after the last
+	// record returned.
+	provider := &flakyProvider{
+		Provider:  bamprovider.NewFakeProvider(header, records),
+		failAfter: 1,
+		err:       transient,
+		failures:  2,
+	}
+	names, err := scanNames(newRetryProvider(provider, policy))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, names)
+
+	// A failure after a record that shares its coordinate with the next
+	// one resumes at that coordinate, and skips only the records at that
+	// coordinate that were already returned.
+	provider.failAfter = 3
+	provider.failures = 1
+	provider.shards = nil
+	names, err = scanNames(newRetryProvider(provider, policy))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, names)
+	assert.Equal(t, 2, len(provider.shards))
+	assert.Equal(t, "chr1", provider.shards[1].StartRef.Name())
+	assert.Equal(t, 10, provider.shards[1].Start)
+
+	// Too many transient failures are returned.
+	provider.failAfter = 1
+	provider.failures = 3
+	names, err = scanNames(newRetryProvider(provider, policy))
+	assert.Error(t, err)
+	assert.Equal(t, expected[:1], names)
+
+	// Other errors are not retried.
+	provider.failures = 1
+	provider.err = errors.E(errors.Integrity, "bad checksum")
+	names, err = scanNames(newRetryProvider(provider, policy))
+	assert.True(t, errors.Is(errors.Integrity, err))
+	assert.Equal(t, expected[:1], names)
+}
+
+func TestMarkWithIORetries(t *testing.T) {
+	records := []*sam.Record{
+		NewRecord("A:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecord("B:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+		NewRecord("B:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+	}
+	provider := &flakyProvider{
+		Provider:  bamprovider.NewFakeProvider(header, records),
+		failAfter: 2,
+		err:       errors.E(errors.Unavailable, "503 Service Unavailable"),
+		failures:  2,
+	}
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	opts := defaultOpts
+	outputPath := NewTestOutput(tempDir, 0, "bam")
+	opts.OutputPath = "flaky://" + outputPath
+	opts.ScratchDir = tempDir
+	opts.Format = "bam"
+	opts.IORetries = 2
+	opts.IORetryBackoff = time.Millisecond
+	flakyFiles.closeFailures = 1
+	markDuplicates := &MarkDuplicates{
+		Provider: provider,
+		Opts:     &opts,
+	}
+	_, err := markDuplicates.Mark(nil)
+	assert.NoError(t, err)
+	// Mark leaves Provider as it was, so that it can be called again.
+	assert.True(t, markDuplicates.Provider == provider)
+
+	// The failed upload of the output was retried.
+	assert.Equal(t, 0, flakyFiles.closeFailures)
+
+	actualRecords := ReadRecords(t, outputPath)
+	assert.Equal(t, 4, len(actualRecords))
+	for i, r := range actualRecords {
+		assert.Equal(t, i%2 == 1, r.Flags&sam.Duplicate != 0)
+	}
+}
@@ -0,0 +1,468 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	htsbam "github.com/grailbio/hts/bam"
+	"github.com/grailbio/hts/sam"
+)
+
+// sequentialProvider is a Provider for a coordinate-sorted bam file
+// that has no index. GenerateShards streams the whole file once from a
+// single reader, chooses the shard boundaries as it goes, and spools
+// the records of each padded shard to a local file in scratchDir.
+// NewIterator then reads a shard from its spool file, so that the
+// passes before marking, such as the distant mate scan, can read the
+// shards in parallel and in any order. The marking pass instead
+// streams the file again from a single reader, and hands each shard
+// to the workers as it is cut; see stream.
+type sequentialProvider struct {
+	path        string
+	scratchDir  string
+	parallelism int
+
+	mutex     sync.Mutex
+	header    *sam.Header
+	shardOpts bamprovider.GenerateShardsOpts
+	shards    []bam.Shard
+	spoolDir  string
+	// streaming is the stream that NewIterator reads the shards from,
+	// once stream is called.
+	streaming *shardStream
+	err       errors.Once
+}
+
+// NewSequentialProvider returns a Provider that reads the bam file at
+// path without an index. The first call to GenerateShards streams the
+// whole file, using parallelism goroutines to decompress it, and
+// spools it to a temporary directory in scratchDir, which the marking
+// pass or Close removes. The spooled shards need about as much local
+// disk as the input file.
+func NewSequentialProvider(path, scratchDir string, parallelism int) bamprovider.Provider {
+	return &sequentialProvider{
+		path:        path,
+		scratchDir:  scratchDir,
+		parallelism: parallelism,
+	}
+}
+
+// open opens the input file, and returns a reader positioned after the
+// header.
+func (p *sequentialProvider) open() (*htsbam.Reader, func() error, error) {
+	ctx := vcontext.Background()
+	f, err := file.Open(ctx, p.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := htsbam.NewReader(f.Reader(ctx), p.parallelism)
+	if err != nil {
+		f.Close(ctx) // nolint: errcheck
+		return nil, nil, errors.E(err, "read header of", p.path)
+	}
+	return reader, func() error {
+		err := reader.Close()
+		if err2 := f.Close(ctx); err == nil {
+			err = err2
+		}
+		return err
+	}, nil
+}
+
+// FileInfo implements bamprovider.Provider.
+func (p *sequentialProvider) FileInfo() (bamprovider.FileInfo, error) {
+	info, err := file.Stat(vcontext.Background(), p.path)
+	if err != nil {
+		return bamprovider.FileInfo{}, err
+	}
+	return bamprovider.FileInfo{ModTime: info.ModTime(), Size: info.Size()}, nil
+}
+
+// GetHeader implements bamprovider.Provider.
+func (p *sequentialProvider) GetHeader() (*sam.Header, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.header == nil {
+		reader, closeReader, err := p.open()
+		if err != nil {
+			return nil, err
+		}
+		p.header = reader.Header()
+		if err := closeReader(); err != nil {
+			return nil, err
+		}
+	}
+	return p.header, nil
+}
+
+// GenerateShards implements bamprovider.Provider. It ignores
+// opts.Strategy, and ends each mapped shard at the first position
+// after it holds at least opts.BytesPerShard of uncompressed records
+// and covers at least max(opts.MinBasesPerShard, opts.Padding) bases.
+// The unmapped reads are in a single shard after the mapped shards.
+// Every call must pass the same opts.
+func (p *sequentialProvider) GenerateShards(opts bamprovider.GenerateShardsOpts) ([]bam.Shard, error) {
+	if _, err := p.GetHeader(); err != nil {
+		return nil, err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.shards == nil {
+		// Spool the shards on the first call, and again once a marking
+		// pass has streamed the input and removed them.
+		p.stopStream()
+		if opts.BytesPerShard <= 0 {
+			opts.BytesPerShard = bamprovider.DefaultBytesPerShard
+		}
+		if opts.MinBasesPerShard <= 0 {
+			opts.MinBasesPerShard = bamprovider.DefaultMinBasesPerShard
+		}
+		spoolDir, err := ioutil.TempDir(p.scratchDir, "sequential")
+		if err != nil {
+			return nil, err
+		}
+		shards, err := p.spool(spoolDir, opts)
+		if err != nil {
+			os.RemoveAll(spoolDir) // nolint: errcheck
+			return nil, err
+		}
+		p.shardOpts, p.shards, p.spoolDir = opts, shards, spoolDir
+	} else if opts.Padding != p.shardOpts.Padding {
+		return nil, fmt.Errorf("sequential provider generated shards with padding %d, not %d",
+			p.shardOpts.Padding, opts.Padding)
+	}
+	if !opts.IncludeUnmapped {
+		return p.shards[:len(p.shards)-1], nil
+	}
+	return p.shards, nil
+}
+
+// spoolPath returns the path of the spool file of shard shardIdx.
+func spoolPath(spoolDir string, shardIdx int) string {
+	return filepath.Join(spoolDir, fmt.Sprintf("shard-%d.bam", shardIdx))
+}
+
+// spoolShard is a shard whose records are being written to its spool
+// file.
+type spoolShard struct {
+	shard  bam.Shard
+	bytes  int64
+	f      *os.File
+	writer *htsbam.Writer
+}
+
+// spool reads the input file and writes the records of each padded
+// shard to its spool file in spoolDir.
+func (p *sequentialProvider) spool(spoolDir string, opts bamprovider.GenerateShardsOpts) ([]bam.Shard, error) {
+	reader, closeReader, err := p.open()
+	if err != nil {
+		return nil, err
+	}
+	defer closeReader() // nolint: errcheck
+	header := reader.Header()
+	minBases := opts.MinBasesPerShard
+	if opts.Padding > minBases {
+		minBases = opts.Padding
+	}
+
+	var (
+		shards []bam.Shard
+		// prev is the previous shard of the same reference, which still
+		// takes the records in its end padding, and cur is the current
+		// shard.
+		prev, cur *spoolShard
+		// window holds the records of cur that are within padding of
+		// the last position, which are also in the start padding of the
+		// shard that follows cur.
+		window  []*sam.Record
+		lastRef = -1
+		lastPos = -1
+		// unmapped is the first unmapped read, if any.
+		unmapped *sam.Record
+	)
+	startShard := func(ref *sam.Reference, start int) error {
+		shard := bam.Shard{
+			StartRef: ref,
+			EndRef:   ref,
+			Start:    start,
+			ShardIdx: len(shards),
+		}
+		if ref != nil {
+			shard.Padding = opts.Padding
+		}
+		f, err := os.Create(spoolPath(spoolDir, shard.ShardIdx))
+		if err != nil {
+			return err
+		}
+		writer, err := htsbam.NewWriterLevel(f, header, gzip.BestSpeed, 1)
+		if err != nil {
+			f.Close() // nolint: errcheck
+			return err
+		}
+		shards = append(shards, shard)
+		cur = &spoolShard{shard: shard, f: f, writer: writer}
+		return nil
+	}
+	closeShard := func(s *spoolShard, end int) error {
+		if s == nil {
+			return nil
+		}
+		shards[s.shard.ShardIdx].End = end
+		err := s.writer.Close()
+		if err2 := s.f.Close(); err == nil {
+			err = err2
+		}
+		return err
+	}
+	// finishRef ends the shards of the reference lastRef, and adds a
+	// shard for each reference up to ref that has no records.
+	finishRef := func(ref int) error {
+		if lastRef >= 0 {
+			if err := closeShard(prev, shards[cur.shard.ShardIdx].Start); err != nil {
+				return err
+			}
+			if err := closeShard(cur, header.Refs()[lastRef].Len()); err != nil {
+				return err
+			}
+			prev, cur, window = nil, nil, nil
+		}
+		for id := lastRef + 1; id < ref; id++ {
+			if header.Refs()[id].Len() == 0 {
+				continue
+			}
+			if err := startShard(header.Refs()[id], 0); err != nil {
+				return err
+			}
+			if err := closeShard(cur, header.Refs()[id].Len()); err != nil {
+				return err
+			}
+			cur = nil
+		}
+		return nil
+	}
+
+	for {
+		r, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		refID := r.Ref.ID()
+		if refID < 0 {
+			refID = len(header.Refs())
+		}
+		if refID < lastRef || (refID == lastRef && r.Pos < lastPos) {
+			return nil, fmt.Errorf("%s is not sorted by coordinate at read %s", p.path, r.Name)
+		}
+		if refID != lastRef {
+			if err := finishRef(refID); err != nil {
+				return nil, err
+			}
+			lastRef, lastPos = refID, -1
+			if r.Ref == nil {
+				unmapped = r
+				break
+			}
+			if err := startShard(r.Ref, 0); err != nil {
+				return nil, err
+			}
+		} else if r.Pos > lastPos && cur.bytes >= opts.BytesPerShard && r.Pos-cur.shard.Start >= minBases {
+			// Start a new shard at r, and copy the records in its start
+			// padding.
+			if err := closeShard(prev, cur.shard.Start); err != nil {
+				return nil, err
+			}
+			prev = cur
+			if err := startShard(r.Ref, r.Pos); err != nil {
+				return nil, err
+			}
+			for _, w := range window {
+				if w.Pos >= r.Pos-opts.Padding {
+					if err := cur.writer.Write(w); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		if r.Pos > lastPos {
+			lastPos = r.Pos
+			for len(window) > 0 && window[0].Pos < lastPos-opts.Padding {
+				window = window[1:]
+			}
+		}
+
+		if prev != nil && r.Pos < cur.shard.Start+opts.Padding {
+			if err := prev.writer.Write(r); err != nil {
+				return nil, err
+			}
+		}
+		if err := cur.writer.Write(r); err != nil {
+			return nil, err
+		}
+		cur.bytes += recordSize(r)
+		window = append(window, r)
+	}
+
+	// Write the unmapped reads, which follow the mapped reads in the
+	// file, to the unmapped shard.
+	if unmapped == nil {
+		if err := finishRef(len(header.Refs())); err != nil {
+			return nil, err
+		}
+	}
+	if err := startShard(nil, 0); err != nil {
+		return nil, err
+	}
+	for r := unmapped; r != nil; {
+		if r.Ref != nil {
+			return nil, fmt.Errorf("%s is not sorted by coordinate at read %s", p.path, r.Name)
+		}
+		if err := cur.writer.Write(r); err != nil {
+			return nil, err
+		}
+		if r, err = reader.Read(); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if err := closeShard(cur, math.MaxInt32); err != nil {
+		return nil, err
+	}
+	bam.ValidateShardList(header, shards, opts.Padding)
+	log.Printf("spooled %s into %d shards in %s", p.path, len(shards), spoolDir)
+	return shards, nil
+}
+
+// recordSize returns the approximate size of r in a bam file, before
+// compression.
+func recordSize(r *sam.Record) int64 {
+	size := 36 + len(r.Name) + 1 + 4*len(r.Cigar) + (r.Seq.Length+1)/2 + len(r.Qual)
+	for _, aux := range r.AuxFields {
+		size += len(aux)
+	}
+	return int64(size)
+}
+
+// GetFileShards implements bamprovider.Provider.
+func (p *sequentialProvider) GetFileShards() ([]bam.Shard, error) {
+	header, err := p.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	return []bam.Shard{bam.UniversalShard(header)}, nil
+}
+
+// NewIterator implements bamprovider.Provider. shard must be one of
+// the shards returned by GenerateShards, or once stream is called, one
+// of the shards passed to it.
+func (p *sequentialProvider) NewIterator(shard bam.Shard) bamprovider.Iterator {
+	p.mutex.Lock()
+	spoolDir, shards, streaming := p.spoolDir, p.shards, p.streaming
+	p.mutex.Unlock()
+	if streaming != nil {
+		return streaming.newIterator(shard)
+	}
+	if shard.ShardIdx >= len(shards) || shards[shard.ShardIdx] != shard {
+		err := fmt.Errorf("sequential provider cannot read shard %s, which GenerateShards did not return",
+			shard.String())
+		p.err.Set(err)
+		return bamprovider.NewErrorIterator(err)
+	}
+	f, err := os.Open(spoolPath(spoolDir, shard.ShardIdx))
+	if err != nil {
+		p.err.Set(err)
+		return bamprovider.NewErrorIterator(err)
+	}
+	reader, err := htsbam.NewReader(f, 1)
+	if err != nil {
+		f.Close() // nolint: errcheck
+		p.err.Set(err)
+		return bamprovider.NewErrorIterator(err)
+	}
+	return &spoolIterator{provider: p, f: f, reader: reader}
+}
+
+// Close implements bamprovider.Provider. It stops the stream, and
+// removes the spooled shards.
+func (p *sequentialProvider) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.stopStream()
+	if p.spoolDir != "" {
+		p.err.Set(os.RemoveAll(p.spoolDir))
+		p.spoolDir, p.shards = "", nil
+	}
+	return p.err.Err()
+}
+
+// spoolIterator reads the records of a shard from its spool file.
+type spoolIterator struct {
+	provider *sequentialProvider
+	f        *os.File
+	reader   *htsbam.Reader
+	record   *sam.Record
+	err      error
+}
+
+// Scan implements bamprovider.Iterator.
+func (i *spoolIterator) Scan() bool {
+	if i.err != nil {
+		return false
+	}
+	i.record, i.err = i.reader.Read()
+	return i.err == nil
+}
+
+// Record implements bamprovider.Iterator.
+func (i *spoolIterator) Record() *sam.Record {
+	return i.record
+}
+
+// Err implements bamprovider.Iterator.
+func (i *spoolIterator) Err() error {
+	if i.err == io.EOF {
+		return nil
+	}
+	return i.err
+}
+
+// Close implements bamprovider.Iterator.
+func (i *spoolIterator) Close() error {
+	err := i.Err()
+	if err2 := i.reader.Close(); err == nil {
+		err = err2
+	}
+	if err2 := i.f.Close(); err == nil {
+		err = err2
+	}
+	i.provider.err.Set(err)
+	return err
+}
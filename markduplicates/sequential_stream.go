@@ -0,0 +1,370 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/retry"
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	htsbam "github.com/grailbio/hts/bam"
+	"github.com/grailbio/hts/sam"
+)
+
+// errStreamStopped is the error of the shards that a stream did not
+// cut before it was stopped.
+var errStreamStopped = fmt.Errorf("sequential provider stream was stopped")
+
+// stream makes NewIterator read shards, which must be in coordinate
+// order, from a new single reader over the input, instead of from the
+// spool files, and removes the spool files. Each shard can then be
+// read once. The stream cuts the shards in order, and hands each to
+// the iterator of its shard as soon as it is cut. It cuts at most
+// opts.Parallelism+1 shards ahead of the shards whose iterators are
+// closed, so it only keeps the shards being marked and the padding
+// window of the next shard in memory. When opts.IORetries is set, the
+// stream reopens the input after a transient error, and skips the
+// records that it already read.
+//
+// The passes before marking read the shards from the spool files,
+// since they read them in parallel and not in order.
+func (p *sequentialProvider) stream(shards []bam.Shard, opts *Opts) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.stopStream()
+	if p.spoolDir != "" {
+		if err := os.RemoveAll(p.spoolDir); err != nil {
+			return err
+		}
+		p.spoolDir, p.shards = "", nil
+	}
+	s := &shardStream{
+		provider: p,
+		shards:   shards,
+		index:    make(map[int]int, len(shards)),
+		cut:      make([]chan streamedShard, len(shards)),
+		opened:   make([]bool, len(shards)),
+		tokens:   make(chan struct{}, opts.Parallelism+1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	for i, shard := range shards {
+		s.index[shard.ShardIdx] = i
+		s.cut[i] = make(chan streamedShard, 1)
+	}
+	if opts.IORetries > 0 {
+		s.policy = newRetryPolicy(opts)
+	}
+	p.streaming = s
+	go s.run()
+	return nil
+}
+
+// stopStream stops the stream, if there is one, and waits for it to
+// close its reader. The caller must hold p.mutex.
+func (p *sequentialProvider) stopStream() {
+	if p.streaming == nil {
+		return
+	}
+	close(p.streaming.done)
+	<-p.streaming.stopped
+	p.streaming = nil
+}
+
+// isStreaming returns true once stream is called.
+func (p *sequentialProvider) isStreaming() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.streaming != nil
+}
+
+// shardStream cuts the records that a single reader reads from the
+// input into padded shards.
+type shardStream struct {
+	provider *sequentialProvider
+	shards   []bam.Shard
+	// index maps the ShardIdx of each shard to its index in shards.
+	index map[int]int
+	// cut holds the records of each shard once it is cut.
+	cut []chan streamedShard
+	// tokens holds a token for each shard that is cut and whose
+	// iterator is not closed yet.
+	tokens chan struct{}
+	// done is closed to stop the stream, and stopped is closed once it
+	// has stopped.
+	done    chan struct{}
+	stopped chan struct{}
+	policy  retry.Policy
+
+	mutex  sync.Mutex
+	opened []bool
+
+	// reader reads the input, closeReader closes it, and n is the
+	// number of records read so far.
+	reader      *htsbam.Reader
+	closeReader func() error
+	n           int
+	retries     int
+}
+
+// streamedShard holds the records of a shard, in file order. token is
+// set if the shard holds one of the stream's tokens.
+type streamedShard struct {
+	records []*sam.Record
+	err     error
+	token   bool
+}
+
+// run cuts each shard in order, and then closes the reader.
+func (s *shardStream) run() {
+	defer close(s.stopped)
+	var (
+		// window holds the records that were read but not handed to a
+		// shard yet, and the records of the last shard cut that are
+		// also in the padding of the next one.
+		window []*sam.Record
+		err    error
+	)
+	for i := range s.shards {
+		if err != nil {
+			s.cut[i] <- streamedShard{err: err}
+			continue
+		}
+		select {
+		case s.tokens <- struct{}{}:
+		case <-s.done:
+			err = errStreamStopped
+			s.cut[i] <- streamedShard{err: err}
+			continue
+		}
+		var records []*sam.Record
+		records, window, err = s.cutShard(i, window)
+		s.cut[i] <- streamedShard{records: records, err: err, token: true}
+	}
+	for _, r := range window {
+		sam.PutInFreePool(r)
+	}
+	if s.reader != nil {
+		if err := s.closeReader(); err != nil {
+			s.provider.err.Set(err)
+		}
+	}
+}
+
+// cutShard returns the records of the padded shard s.shards[i], and
+// the new window. It gives the shard the window records and the
+// records read from the input that are in its padded range, and it
+// keeps the records that are also in the padding of the next shard in
+// the window, giving the shard copies of them instead.
+func (s *shardStream) cutShard(i int, window []*sam.Record) ([]*sam.Record, []*sam.Record, error) {
+	shard := &s.shards[i]
+	start := bam.NewCoord(shard.StartRef, shard.PaddedStart(), 0)
+	end := bam.NewCoord(shard.EndRef, shard.PaddedEnd(), 0)
+	// Drop the records that are in none of the remaining shards.
+	for len(window) > 0 && bam.CoordFromSAMRecord(window[0], 0).LT(start) {
+		sam.PutInFreePool(window[0])
+		window = window[1:]
+	}
+	// Read the records up to the first one after the padded shard.
+	for len(window) == 0 || bam.CoordFromSAMRecord(window[len(window)-1], 0).LT(end) {
+		r, err := s.read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, window, err
+		}
+		if coord := bam.CoordFromSAMRecord(r, 0); coord.LT(start) {
+			sam.PutInFreePool(r)
+			continue
+		}
+		window = append(window, r)
+	}
+
+	var records []*sam.Record
+	consumed := 0
+	for _, r := range window {
+		coord := bam.CoordFromSAMRecord(r, 0)
+		if !coord.LT(end) {
+			break
+		}
+		if i+1 < len(s.shards) {
+			next := &s.shards[i+1]
+			if !coord.LT(bam.NewCoord(next.StartRef, next.PaddedStart(), 0)) {
+				records = append(records, cloneRecord(r))
+				continue
+			}
+		}
+		records = append(records, r)
+		consumed++
+	}
+	return records, window[consumed:], nil
+}
+
+// read returns the next record of the input, or io.EOF. On a transient
+// error, it reopens the input and skips the records that it already
+// read, as s.policy allows.
+func (s *shardStream) read() (*sam.Record, error) {
+	for {
+		r, err := s.tryRead()
+		if err == nil || err == io.EOF || s.policy == nil || !isTransient(err) {
+			return r, err
+		}
+		log.Error.Printf("streaming %s failed with transient error after %d records, retry %d: %v",
+			s.provider.path, s.n, s.retries, err)
+		if s.reader != nil {
+			s.closeReader() // nolint: errcheck
+			s.reader = nil
+		}
+		if err2 := retry.Wait(vcontext.Background(), s.policy, s.retries); err2 != nil {
+			return nil, errors.E(err, err2.Error())
+		}
+		s.retries++
+	}
+}
+
+// tryRead opens the input if it is not open, skipping the first s.n
+// records, and reads the next record.
+func (s *shardStream) tryRead() (*sam.Record, error) {
+	if s.reader == nil {
+		reader, closeReader, err := s.provider.open()
+		if err != nil {
+			return nil, err
+		}
+		s.reader, s.closeReader = reader, closeReader
+		for skipped := 0; skipped < s.n; skipped++ {
+			r, err := s.reader.Read()
+			if err == io.EOF {
+				return nil, errors.E(errors.Integrity, s.provider.path, "has fewer records after reopening")
+			}
+			if err != nil {
+				return nil, err
+			}
+			sam.PutInFreePool(r)
+		}
+	}
+	r, err := s.reader.Read()
+	if err == nil {
+		s.n++
+	}
+	return r, err
+}
+
+// newIterator returns an iterator over the records of shard, which
+// must be one of the stream's shards, and not opened before.
+func (s *shardStream) newIterator(shard bam.Shard) bamprovider.Iterator {
+	i, ok := s.index[shard.ShardIdx]
+	if !ok || s.shards[i] != shard {
+		return bamprovider.NewErrorIterator(fmt.Errorf(
+			"sequential provider cannot stream shard %s, which was not passed to stream", shard.String()))
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.opened[i] {
+		return bamprovider.NewErrorIterator(fmt.Errorf(
+			"sequential provider cannot stream shard %s twice", shard.String()))
+	}
+	s.opened[i] = true
+	return &streamIterator{stream: s, index: i}
+}
+
+// streamIterator iterates over the records of a streamed shard. The
+// first call to Scan waits until the stream has cut the shard.
+type streamIterator struct {
+	stream   *shardStream
+	index    int
+	received bool
+	shard    streamedShard
+	record   *sam.Record
+	closed   bool
+}
+
+// receive waits until the stream has cut the shard.
+func (i *streamIterator) receive() {
+	if i.received {
+		return
+	}
+	i.received = true
+	select {
+	case i.shard = <-i.stream.cut[i.index]:
+	case <-i.stream.stopped:
+		select {
+		case i.shard = <-i.stream.cut[i.index]:
+		default:
+			i.shard.err = errStreamStopped
+		}
+	}
+}
+
+// Scan implements bamprovider.Iterator.
+func (i *streamIterator) Scan() bool {
+	i.receive()
+	if i.shard.err != nil || len(i.shard.records) == 0 {
+		return false
+	}
+	i.record = i.shard.records[0]
+	i.shard.records = i.shard.records[1:]
+	return true
+}
+
+// Record implements bamprovider.Iterator.
+func (i *streamIterator) Record() *sam.Record {
+	return i.record
+}
+
+// Err implements bamprovider.Iterator.
+func (i *streamIterator) Err() error {
+	return i.shard.err
+}
+
+// Close implements bamprovider.Iterator. It frees the records that
+// were not scanned, and lets the stream cut another shard.
+func (i *streamIterator) Close() error {
+	if i.closed {
+		return i.shard.err
+	}
+	i.closed = true
+	i.receive()
+	for _, r := range i.shard.records {
+		sam.PutInFreePool(r)
+	}
+	i.shard.records = nil
+	if i.shard.token {
+		<-i.stream.tokens
+	}
+	return i.shard.err
+}
+
+// cloneRecord returns a deep copy of r, so that r and the copy can be
+// modified and freed independently.
+func cloneRecord(r *sam.Record) *sam.Record {
+	c := sam.GetFromFreePool()
+	*c = *r
+	c.Scratch = nil
+	c.Cigar = append(sam.Cigar(nil), r.Cigar...)
+	c.Seq.Seq = append([]sam.Doublet(nil), r.Seq.Seq...)
+	c.Qual = append([]byte(nil), r.Qual...)
+	c.AuxFields = make(sam.AuxFields, len(r.AuxFields))
+	for j, aux := range r.AuxFields {
+		c.AuxFields[j] = append(sam.Aux(nil), aux...)
+	}
+	return c
+}
@@ -0,0 +1,183 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// streamTestShardOpts cuts sequentialTestRecords into several shards.
+var streamTestShardOpts = bamprovider.GenerateShardsOpts{
+	Padding:          10,
+	IncludeUnmapped:  true,
+	BytesPerShard:    1000,
+	MinBasesPerShard: 50,
+}
+
+// paddedShardRecords returns the records of each padded shard, in
+// order.
+func paddedShardRecords(records []*sam.Record, shards []bam.Shard) [][]string {
+	expected := make([][]string, len(shards))
+	for i, shard := range shards {
+		for _, r := range records {
+			if shard.RecordInPaddedShard(r) {
+				expected[i] = append(expected[i], fmt.Sprintf("%s %v:%d", r.Name, r.Ref.Name(), r.Pos))
+			}
+		}
+	}
+	return expected
+}
+
+func TestSequentialProviderStream(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	records := sequentialTestRecords()
+	path := filepath.Join(tempDir, "in.bam")
+	writeBAM(t, path, records)
+
+	provider := NewSequentialProvider(path, tempDir, 2)
+	shards, err := provider.GenerateShards(streamTestShardOpts)
+	assert.NoError(t, err)
+	assert.True(t, len(shards) > 4, "shards: %v", shards)
+	assert.NoError(t, provider.(*sequentialProvider).stream(shards, &Opts{Parallelism: 2}))
+
+	// Streaming removes the spooled shards.
+	spooled, err := filepath.Glob(filepath.Join(tempDir, "sequential*"))
+	assert.NoError(t, err)
+	assert.Empty(t, spooled)
+
+	// Workers that take the shards in order read the records of each
+	// padded shard, and never share a record with another shard.
+	var (
+		mutex  sync.Mutex
+		actual = make([][]string, len(shards))
+		seen   = make(map[*sam.Record]bool)
+		wg     sync.WaitGroup
+	)
+	shardChannel := make(chan bam.Shard, len(shards))
+	for _, shard := range shards {
+		shardChannel <- shard
+	}
+	close(shardChannel)
+	for worker := 0; worker < 3; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for shard := range shardChannel {
+				iter := provider.NewIterator(shard)
+				for iter.Scan() {
+					r := iter.Record()
+					mutex.Lock()
+					assert.False(t, seen[r])
+					seen[r] = true
+					actual[shard.ShardIdx] = append(actual[shard.ShardIdx],
+						fmt.Sprintf("%s %v:%d", r.Name, r.Ref.Name(), r.Pos))
+					mutex.Unlock()
+				}
+				assert.NoError(t, iter.Close())
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, paddedShardRecords(records, shards), actual)
+
+	// A shard can only be streamed once.
+	iter := provider.NewIterator(shards[0])
+	assert.False(t, iter.Scan())
+	assert.Error(t, iter.Close())
+	assert.NoError(t, provider.Close())
+}
+
+func TestSequentialProviderStreamStop(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	path := filepath.Join(tempDir, "in.bam")
+	writeBAM(t, path, sequentialTestRecords())
+
+	provider := NewSequentialProvider(path, tempDir, 1)
+	shards, err := provider.GenerateShards(streamTestShardOpts)
+	assert.NoError(t, err)
+	assert.NoError(t, provider.(*sequentialProvider).stream(shards, &Opts{Parallelism: 0}))
+
+	// The stream cuts only one shard ahead of the open iterators, so it
+	// waits for the first shard's iterator to be closed.
+	first := provider.NewIterator(shards[0])
+	assert.True(t, first.Scan())
+	second := provider.NewIterator(shards[1])
+
+	// Close stops the waiting stream, and the shards that it didn't cut
+	// fail.
+	assert.NoError(t, provider.Close())
+	assert.NoError(t, first.Close())
+	assert.False(t, second.Scan())
+	assert.Equal(t, errStreamStopped, second.Close())
+}
+
+func TestSequentialProviderStreamRetries(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	// Give the records long random names, so that the input has several
+	// bgzf blocks, and fails after the first.
+	records := sequentialTestRecords()
+	rng := rand.New(rand.NewSource(1))
+	names := make(map[string]string)
+	for _, r := range records {
+		if names[r.Name] == "" {
+			name := make([]byte, 200)
+			for i := range name {
+				name[i] = byte('a' + rng.Intn(26))
+			}
+			names[r.Name] = string(name)
+		}
+		r.Name = names[r.Name]
+	}
+	path := filepath.Join(tempDir, "in.bam")
+	writeBAM(t, path, records)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+
+	provider := NewSequentialProvider("flaky://"+path, tempDir, 1)
+	shards, err := provider.GenerateShards(streamTestShardOpts)
+	assert.NoError(t, err)
+
+	// The stream reopens the input after the transient error, and
+	// resumes after the records that it already read.
+	flakyFiles.readFailures, flakyFiles.readFailAfter = 1, int(info.Size())-100
+	opts := &Opts{Parallelism: 1, IORetries: 1, IORetryBackoff: time.Millisecond}
+	assert.NoError(t, provider.(*sequentialProvider).stream(shards, opts))
+	actual := make([][]string, len(shards))
+	for i, shard := range shards {
+		iter := provider.NewIterator(shard)
+		for iter.Scan() {
+			r := iter.Record()
+			actual[i] = append(actual[i], fmt.Sprintf("%s %v:%d", r.Name, r.Ref.Name(), r.Pos))
+		}
+		assert.NoError(t, iter.Close())
+	}
+	assert.Equal(t, 0, flakyFiles.readFailures)
+	assert.Equal(t, paddedShardRecords(records, shards), actual)
+	assert.NoError(t, provider.Close())
+}
@@ -0,0 +1,189 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/bam"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeBAM writes records to a bam file at path, without an index.
+func writeBAM(t *testing.T, path string, records []*sam.Record) {
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	w, err := bam.NewWriter(f, header, 1)
+	assert.NoError(t, err)
+	for _, r := range records {
+		assert.NoError(t, w.Write(r))
+	}
+	assert.NoError(t, w.Close())
+	assert.NoError(t, f.Close())
+}
+
+// sequentialTestRecords returns readpairs spread over chr1 and chr2,
+// some with distant mates, and unmapped readpairs.
+func sequentialTestRecords() []*sam.Record {
+	var records []*sam.Record
+	for pos := 0; pos < 900; pos += 4 {
+		if pos < 800 {
+			name := fmt.Sprintf("A%d:1:1:1:1:1:1", pos)
+			records = append(records, NewRecord(name, chr1, pos, r1F, pos+100, chr1, cigar0))
+		}
+		if pos >= 100 {
+			mate := fmt.Sprintf("A%d:1:1:1:1:1:1", pos-100)
+			records = append(records, NewRecord(mate, chr1, pos, r2R, pos-100, chr1, cigar0))
+		}
+		// A duplicate of every fifth readpair.
+		if pos%20 == 0 && pos < 300 {
+			dup := fmt.Sprintf("D%d:1:1:1:1:1:1", pos)
+			records = append(records, NewRecord(dup, chr1, pos, r1F, pos+100, chr1, cigar0))
+		}
+		if pos%20 == 0 && pos >= 100 && pos < 400 {
+			dup := fmt.Sprintf("D%d:1:1:1:1:1:1", pos-100)
+			records = append(records, NewRecord(dup, chr1, pos, r2R, pos-100, chr1, cigar0))
+		}
+	}
+	// Distant mates on chr2.
+	for pos := 0; pos < 100; pos += 7 {
+		name := fmt.Sprintf("B%d:1:1:1:1:1:1", pos)
+		records = append(records, NewRecord(name, chr1, 900+pos, r1F, pos, chr2, cigar0))
+	}
+	for pos := 0; pos < 100; pos += 7 {
+		name := fmt.Sprintf("B%d:1:1:1:1:1:1", pos)
+		records = append(records, NewRecord(name, chr2, pos, r2R, 900+pos, chr1, cigar0))
+	}
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("U%d:1:1:1:1:1:1", i)
+		records = append(records, NewRecord(name, nil, -1, up1, -1, nil, nil))
+		records = append(records, NewRecord(name, nil, -1, up2, -1, nil, nil))
+	}
+	return records
+}
+
+func TestSequentialProviderShards(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	records := sequentialTestRecords()
+	path := filepath.Join(tempDir, "in.bam")
+	writeBAM(t, path, records)
+
+	provider := NewSequentialProvider(path, tempDir, 2)
+	shards, err := provider.GenerateShards(bamprovider.GenerateShardsOpts{
+		Padding:          10,
+		IncludeUnmapped:  true,
+		BytesPerShard:    1000,
+		MinBasesPerShard: 50,
+	})
+	assert.NoError(t, err)
+	assert.True(t, len(shards) > 4, "shards: %v", shards)
+
+	// The mapped shards cover chr1 and chr2 without gaps, and the
+	// unmapped shard is last.
+	for i, shard := range shards {
+		assert.Equal(t, i, shard.ShardIdx)
+		if i > 0 && shard.StartRef != nil && shard.StartRef == shards[i-1].EndRef {
+			assert.Equal(t, shards[i-1].End, shard.Start)
+		}
+		if i < len(shards)-1 && shard.EndRef != shards[i+1].StartRef {
+			assert.Equal(t, shard.EndRef.Len(), shard.End)
+		}
+	}
+	assert.Nil(t, shards[len(shards)-1].StartRef)
+
+	// Each shard iterates over the records in the padded shard, in
+	// order.
+	for _, shard := range shards {
+		var expected []string
+		for _, r := range records {
+			if shard.RecordInPaddedShard(r) {
+				expected = append(expected, fmt.Sprintf("%s %v:%d", r.Name, r.Ref.Name(), r.Pos))
+			}
+		}
+		var actual []string
+		iter := provider.NewIterator(shard)
+		for iter.Scan() {
+			r := iter.Record()
+			actual = append(actual, fmt.Sprintf("%s %v:%d", r.Name, r.Ref.Name(), r.Pos))
+		}
+		assert.NoError(t, iter.Close())
+		assert.Equal(t, expected, actual, "shard %v", shard)
+	}
+
+	// Close removes the spooled shards.
+	assert.NoError(t, provider.Close())
+	spooled, err := filepath.Glob(filepath.Join(tempDir, "sequential*"))
+	assert.NoError(t, err)
+	assert.Empty(t, spooled)
+}
+
+func TestSequentialProviderUnsorted(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	path := filepath.Join(tempDir, "in.bam")
+	writeBAM(t, path, []*sam.Record{
+		NewRecord("A:1:1:1:1:1:1", chr1, 10, r1F, 0, chr1, cigar0),
+		NewRecord("A:1:1:1:1:1:1", chr1, 0, r2R, 10, chr1, cigar0),
+	})
+
+	provider := NewSequentialProvider(path, tempDir, 1)
+	_, err := provider.GenerateShards(bamprovider.GenerateShardsOpts{IncludeUnmapped: true})
+	assert.Error(t, err)
+	assert.NoError(t, provider.Close())
+}
+
+func TestSequentialMark(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	path := filepath.Join(tempDir, "in.bam")
+	writeBAM(t, path, sequentialTestRecords())
+
+	mark := func(provider bamprovider.Provider, i int) ([]*sam.Record, *MetricsCollection) {
+		opts := defaultOpts
+		opts.Parallelism = 3
+		opts.MinBases = 50
+		opts.ShardSize = 1000
+		opts.Format = "bam"
+		opts.OutputPath = NewTestOutput(tempDir, i, "bam")
+		opts.ScratchDir = tempDir
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		metrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.NoError(t, provider.Close())
+		return ReadRecords(t, opts.OutputPath), metrics
+	}
+
+	// The sequential provider marks the same duplicates as the fake
+	// provider, which reads the whole input as a single mapped shard.
+	expected, expectedMetrics := mark(bamprovider.NewFakeProvider(header, sequentialTestRecords()), 0)
+	actual, actualMetrics := mark(NewSequentialProvider(path, tempDir, 2), 1)
+	assert.Equal(t, len(expected), len(actual))
+	for i := range expected {
+		if i < len(actual) {
+			assert.Equal(t, expected[i].String(), actual[i].String())
+		}
+	}
+	assert.Equal(t, expectedMetrics.LibraryMetrics, actualMetrics.LibraryMetrics)
+	assert.True(t, expectedMetrics.LibraryMetrics["Unknown Library"].ReadPairDups > 0)
+}
@@ -0,0 +1,49 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"io/ioutil"
+
+	"github.com/grailbio/base/compress"
+	"github.com/grailbio/base/errors"
+)
+
+// readSidecar returns the contents of the text input at path, such as
+// the umi file. path may be a local path or any URL scheme registered
+// with grailbio/base/file, such as s3://. The contents are
+// decompressed if they are gzip, zstd or bzip2 compressed, which is
+// detected from their header rather than from the name of path.
+func readSidecar(ctx context.Context, opts *Opts, path string) (data []byte, err error) {
+	in, err := openWithRetries(ctx, opts, path)
+	if err != nil {
+		return nil, errors.E(err, "Couldn't open", path)
+	}
+	defer func() {
+		if err2 := in.Close(ctx); err == nil && err2 != nil {
+			err = errors.E(err2, "Couldn't close", path)
+		}
+	}()
+	r, _ := compress.NewReader(in.Reader(ctx))
+	data, err = ioutil.ReadAll(r)
+	// Some formats only report corruption on Close.
+	if err2 := r.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, errors.E(err, "Couldn't read", path)
+	}
+	return data, nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/base/compress/zstd"
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadSidecar(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	umis := []byte("AAC\nCCG\nGGT\nTTA\n")
+
+	var gzipped bytes.Buffer
+	w := gzip.NewWriter(&gzipped)
+	_, err := w.Write(umis)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	zstded, err := zstd.CompressLevel(nil, umis, -1)
+	assert.NoError(t, err)
+
+	// Compression is detected from the contents, not the file name.
+	for name, data := range map[string][]byte{
+		"umis.txt":    umis,
+		"umis.txt.gz": gzipped.Bytes(),
+		"umis.zst":    zstded,
+		"umis.bin":    gzipped.Bytes(),
+	} {
+		path := filepath.Join(tempDir, name)
+		assert.NoError(t, ioutil.WriteFile(path, data, 0644))
+		actual, err := readSidecar(vcontext.Background(), &defaultOpts, path)
+		assert.NoError(t, err, name)
+		assert.Equal(t, umis, actual, name)
+	}
+
+	_, err = readSidecar(vcontext.Background(), &defaultOpts, filepath.Join(tempDir, "missing.txt"))
+	assert.Error(t, err)
+}
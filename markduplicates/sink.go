@@ -0,0 +1,163 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/grailbio/base/file"
+)
+
+// Sink creates the writers for the auxiliary outputs of SetupAndMark,
+// such as the metrics, high-coverage intervals and optical histogram
+// files. Each output is identified by the path given in Opts.
+type Sink interface {
+	// Create returns a writer for the output at path. The output is
+	// complete once the writer is closed.
+	Create(ctx context.Context, path string) (io.WriteCloser, error)
+}
+
+// FileSink writes each output to the file at its path. It supports
+// local paths and any URL scheme registered with grailbio/base/file,
+// such as s3://. FileSink is the default Sink.
+type FileSink struct {
+	// opts configures the retries of transient errors, if it is set.
+	opts *Opts
+}
+
+// NewFileSink returns a FileSink that retries transient errors while
+// creating and uploading outputs, as configured by opts.IORetries and
+// opts.IORetryBackoff.
+func NewFileSink(opts *Opts) FileSink {
+	return FileSink{opts: opts}
+}
+
+// Create implements Sink.
+func (s FileSink) Create(ctx context.Context, path string) (io.WriteCloser, error) {
+	opts := s.opts
+	if opts == nil {
+		opts = &Opts{}
+	}
+	f, err := createOutputFile(ctx, opts, path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{Writer: f.Writer(ctx), f: f, ctx: ctx}, nil
+}
+
+type fileWriter struct {
+	io.Writer
+	f   file.File
+	ctx context.Context
+}
+
+func (w *fileWriter) Close() error {
+	return w.f.Close(w.ctx)
+}
+
+// MemorySink keeps each output in memory, so that library callers can
+// inspect the outputs without writing and reading back files. It is
+// safe for concurrent use.
+type MemorySink struct {
+	mutex   sync.Mutex
+	outputs map[string][]byte
+}
+
+// Create implements Sink.
+func (s *MemorySink) Create(_ context.Context, path string) (io.WriteCloser, error) {
+	return &memoryWriter{sink: s, path: path}, nil
+}
+
+// Get returns the contents of the output at path, and false if the
+// output has not been closed yet.
+func (s *MemorySink) Get(path string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	b, ok := s.outputs[path]
+	return b, ok
+}
+
+type memoryWriter struct {
+	bytes.Buffer
+	sink *MemorySink
+	path string
+}
+
+func (w *memoryWriter) Close() error {
+	w.sink.mutex.Lock()
+	defer w.sink.mutex.Unlock()
+	if w.sink.outputs == nil {
+		w.sink.outputs = make(map[string][]byte)
+	}
+	w.sink.outputs[w.path] = w.Bytes()
+	return nil
+}
+
+// MultiSink writes each output to every one of its Sinks, for example
+// to both a FileSink and a MemorySink.
+type MultiSink []Sink
+
+// Create implements Sink.
+func (s MultiSink) Create(ctx context.Context, path string) (io.WriteCloser, error) {
+	w := &multiWriter{}
+	writers := make([]io.Writer, 0, len(s))
+	for _, sink := range s {
+		sw, err := sink.Create(ctx, path)
+		if err != nil {
+			w.Close() // nolint: errcheck
+			return nil, err
+		}
+		w.closers = append(w.closers, sw)
+		writers = append(writers, sw)
+	}
+	w.Writer = io.MultiWriter(writers...)
+	return w, nil
+}
+
+type multiWriter struct {
+	io.Writer
+	closers []io.Closer
+}
+
+// Close closes every writer, and returns the first error.
+func (w *multiWriter) Close() error {
+	var err error
+	for _, c := range w.closers {
+		if err2 := c.Close(); err == nil && err2 != nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// createOutput returns a writer for the output at path using sink, or
+// a FileSink if sink is nil.
+func createOutput(ctx context.Context, sink Sink, path string) (io.WriteCloser, error) {
+	if sink == nil {
+		return FileSink{}.Create(ctx, path)
+	}
+	return sink.Create(ctx, path)
+}
+
+// outputSink returns opts.Sink, or if it is nil, a FileSink that
+// retries transient errors as configured by opts.
+func outputSink(opts *Opts) Sink {
+	if opts.Sink == nil {
+		return NewFileSink(opts)
+	}
+	return opts.Sink
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSinks(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	ctx := vcontext.Background()
+
+	// MemorySink only returns an output once it is closed.
+	memory := &MemorySink{}
+	w, err := memory.Create(ctx, "a")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, ok := memory.Get("a")
+	assert.False(t, ok)
+	assert.NoError(t, w.Close())
+	b, ok := memory.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "hello", string(b))
+
+	// MultiSink writes to every sink.
+	path := filepath.Join(tempDir, "b")
+	w, err = MultiSink{FileSink{}, memory}.Create(ctx, path)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("world"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	b, err = ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(b))
+	b, ok = memory.Get(path)
+	assert.True(t, ok)
+	assert.Equal(t, "world", string(b))
+
+	// MultiSink fails if any sink fails.
+	_, err = MultiSink{memory, errSink{}}.Create(ctx, "c")
+	assert.Error(t, err)
+}
+
+type errSink struct{}
+
+func (errSink) Create(context.Context, string) (io.WriteCloser, error) {
+	return nil, errors.E(errors.Unavailable, "sink unavailable")
+}
+
+func TestWriteMetricsToSink(t *testing.T) {
+	memory := &MemorySink{}
+	opts := defaultOpts
+	opts.MetricsFile = "metrics"
+	opts.OpticalHistogram = "histogram"
+	opts.Sink = memory
+
+	metrics := newMetricsCollection()
+	metrics.Get("lib1").ReadPairsExamined = 4
+	metrics.AddDistance(2, 3)
+	assert.NoError(t, writeMetrics(vcontext.Background(), &opts, metrics))
+	assert.NoError(t, writeOpticalHistogram(vcontext.Background(), &opts, metrics))
+
+	b, ok := memory.Get("metrics")
+	assert.True(t, ok)
+	assert.Contains(t, string(b), "\nlib1\t0\t2\t")
+	b, ok = memory.Get("histogram")
+	assert.True(t, ok)
+	assert.True(t, strings.HasPrefix(string(b), "#bag_size_range\toptical_dist\tcount\n"))
+	assert.Contains(t, string(b), "bagsize-2\t3\t1\n")
+}
@@ -0,0 +1,281 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"hash"
+	"sort"
+	"sync"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+)
+
+// A spliced reverse read's unclipped 5' position includes the reference
+// skips of its introns, so it can be much further than the padding from
+// its alignment position. The shard that writes such a read then cannot
+// see the reads that share its 5' position, and the shards that write
+// those reads cannot see it. Instead of requiring the padding to cover
+// every intron, Mark records the 5' ends of these reads while scanning
+// for distant mates, collects every readpair with a read at one of those
+// ends in one more pass, and adds the readpairs that a shard cannot see
+// to the shard's duplicate matcher, the same way it adds distant mates.
+
+// fivePrimeEnd is the reference, strand and unclipped 5' position of a
+// read.
+type fivePrimeEnd struct {
+	refID   int
+	pos     int
+	reverse bool
+}
+
+func newFivePrimeEnd(r *sam.Record) fivePrimeEnd {
+	return fivePrimeEnd{r.Ref.ID(), bam.UnclippedFivePrimePosition(r), bam.IsReversedRead(r)}
+}
+
+// referenceSkips returns the total length of r's reference skips.
+func referenceSkips(r *sam.Record) int {
+	skips := 0
+	for _, co := range r.Cigar {
+		if co.Type() == sam.CigarSkipped {
+			skips += co.Len()
+		}
+	}
+	return skips
+}
+
+// isPrimaryMapped returns true if r is mapped, and neither secondary
+// nor supplementary.
+func isPrimaryMapped(r *sam.Record) bool {
+	return r.Flags&(sam.Secondary|sam.Supplementary|sam.Unmapped) == 0
+}
+
+// splicedEnds holds the 5' ends of the primary reads whose 5' alignment
+// distance exceeds the padding only because of their reference skips,
+// and the keys of those reads.
+type splicedEnds struct {
+	ends  map[fivePrimeEnd]bool
+	reads map[mateKey]bool
+}
+
+func newSplicedEnds() *splicedEnds {
+	return &splicedEnds{make(map[fivePrimeEnd]bool), make(map[mateKey]bool)}
+}
+
+func (s *splicedEnds) add(r *sam.Record) {
+	s.ends[newFivePrimeEnd(r)] = true
+	s.reads[mateKey{r.Name, r.Flags&sam.Read1 != 0}] = true
+}
+
+func (s *splicedEnds) merge(other *splicedEnds) {
+	for end := range other.ends {
+		s.ends[end] = true
+	}
+	for key := range other.reads {
+		s.reads[key] = true
+	}
+}
+
+// splicedRead is a read collected by findSplicedPairs, with the index
+// of its shard and its index among the records of that shard.
+type splicedRead struct {
+	r        *sam.Record
+	shardIdx int
+	localIdx uint64
+}
+
+// findSplicedPairs returns, by shard index, the readpairs and the
+// mate-unmapped reads with a read at one of the 5' ends in spliced,
+// that the shard needs to mark its reads at those ends, but cannot see
+// because none of their reads are in its padded shard. It reads
+// provider, which must return the records of the distant mate scan, so
+// that file indexes agree with m.shardInfo.
+func (m *MarkDuplicates) findSplicedPairs(provider bamprovider.Provider,
+	spliced *splicedEnds) (map[int][]*readPair, error) {
+	// The reads that share a 5' end with a spliced read are within the
+	// padding of that end, unless they are spliced too, so their mates
+	// point to within the padding of the end. Mate strands are not
+	// always set, so this ignores them.
+	endPositions := make(map[int][]int)
+	for end := range spliced.ends {
+		endPositions[end.refID] = append(endPositions[end.refID], end.pos)
+	}
+	for _, positions := range endPositions {
+		sort.Ints(positions)
+	}
+	mateNearEnd := func(r *sam.Record) bool {
+		positions := endPositions[r.MateRef.ID()]
+		i := sort.SearchInts(positions, r.MatePos-m.Opts.Padding)
+		return i < len(positions) && positions[i] <= r.MatePos+m.Opts.Padding
+	}
+
+	// Collect the reads at the ends, and the reads that may be their
+	// mates, with their indexes in their shards.
+	var (
+		mutex sync.Mutex
+		reads []splicedRead
+		errs  []error
+	)
+	shardChannel := make(chan bam.Shard, len(m.shardList))
+	for _, shard := range m.shardList {
+		if shard.StartRef != nil {
+			shardChannel <- shard
+		}
+	}
+	close(shardChannel)
+	var workerGroup sync.WaitGroup
+	for i := 0; i < m.Opts.Parallelism; i++ {
+		workerGroup.Add(1)
+		go func() {
+			defer workerGroup.Done()
+			var found []splicedRead
+			for shard := range shardChannel {
+				unpadded := shard
+				unpadded.Padding = 0
+				iter := provider.NewIterator(unpadded)
+				localIdx := uint64(0)
+				for iter.Scan() {
+					record := iter.Record()
+					if isPrimaryMapped(record) && (spliced.ends[newFivePrimeEnd(record)] ||
+						(!bam.HasNoMappedMate(record) &&
+							(spliced.reads[mateKey{record.Name, record.Flags&sam.Read1 == 0}] || mateNearEnd(record)))) {
+						found = append(found, splicedRead{record, shard.ShardIdx, localIdx})
+					} else {
+						sam.PutInFreePool(record)
+					}
+					localIdx++
+				}
+				if err := iter.Close(); err != nil {
+					mutex.Lock()
+					errs = append(errs, fmt.Errorf("scan shard %v for spliced reads: %v", shard, err))
+					mutex.Unlock()
+				}
+			}
+			mutex.Lock()
+			reads = append(reads, found...)
+			mutex.Unlock()
+		}()
+	}
+	workerGroup.Wait()
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	byKey := make(map[mateKey]*splicedRead, len(reads))
+	for i := range reads {
+		r := reads[i].r
+		byKey[mateKey{r.Name, r.Flags&sam.Read1 != 0}] = &reads[i]
+	}
+	fileIdx := func(read *splicedRead) uint64 {
+		return m.shardInfo.GetInfoByIdx(read.shardIdx).ShardStartFileIdx + read.localIdx
+	}
+
+	// Group the readpairs and mate-unmapped reads by their ends, and
+	// find the shards that write a read at each end.
+	groups := make(map[fivePrimeEnd][]*readPair)
+	writers := make(map[fivePrimeEnd]map[int]bool)
+	pairs := make(map[string]*readPair)
+	for i := range reads {
+		read := &reads[i]
+		end := newFivePrimeEnd(read.r)
+		if !spliced.ends[end] {
+			continue
+		}
+		var p *readPair
+		if bam.HasNoMappedMate(read.r) {
+			p = &readPair{left: read.r, leftFileIdx: fileIdx(read)}
+		} else if p = pairs[read.r.Name]; p == nil {
+			mate := byKey[mateKey{read.r.Name, read.r.Flags&sam.Read1 == 0}]
+			if mate == nil {
+				if m.Opts.CorruptBlockPolicy == CorruptBlockSkip {
+					log.Error.Printf("spliced read %s is missing its mate, leaving it unmarked", read.r.Name)
+					continue
+				}
+				return nil, fmt.Errorf("could not find mate of read %s with spliced 5' end %v", read.r.Name, end)
+			}
+			p = &readPair{left: read.r, leftFileIdx: fileIdx(read)}
+			p.addRead(mate.r, fileIdx(mate))
+			pairs[read.r.Name] = p
+		}
+		groups[end] = append(groups[end], p)
+		if writers[end] == nil {
+			writers[end] = make(map[int]bool)
+		}
+		writers[end][read.shardIdx] = true
+	}
+
+	// Each shard that writes a read at an end needs every readpair at
+	// the end, but it already sees those with a read in its padded
+	// shard.
+	splicedPairs := make(map[int][]*readPair)
+	type shardPair struct {
+		shardIdx int
+		pair     *readPair
+	}
+	added := make(map[shardPair]bool)
+	for end, group := range groups {
+		for shardIdx := range writers[end] {
+			shard := m.shardInfo.GetInfoByIdx(shardIdx).Shard
+			for _, p := range group {
+				if shard.RecordInPaddedShard(p.left) || (p.right != nil && shard.RecordInPaddedShard(p.right)) ||
+					added[shardPair{shardIdx, p}] {
+					continue
+				}
+				added[shardPair{shardIdx, p}] = true
+				splicedPairs[shardIdx] = append(splicedPairs[shardIdx], p)
+			}
+		}
+	}
+	log.Debug.Printf("found %d spliced 5' ends beyond the padding, adding %d readpairs to %d shards",
+		len(spliced.ends), len(added), len(splicedPairs))
+	return splicedPairs, nil
+}
+
+// addSplicedPairs adds the readpairs and mate-unmapped reads that
+// findSplicedPairs found for shard to matcher, unless the read filter,
+// the record predicate, downsampling, max-depth subsampling or the umi
+// N policy leave them out. None of their reads are in the padded
+// shard, so they are never written or counted in the metrics.
+func (m *MarkDuplicates) addSplicedPairs(shard *bam.Shard, splicedPairs []*readPair, metrics *MetricsCollection,
+	hasher hash.Hash32, pairsByName, singlesByName map[string]*readPair, matcher duplicateMatcher) {
+	for _, p := range splicedPairs {
+		name := p.left.Name
+		// The reads are not in the padded shard, so they don't count
+		// in the high-coverage metrics.
+		downsampled, removed, _ := m.subsample(hasher, p.left)
+		if downsampled || removed || !participates(m.Opts, p.left) ||
+			(p.right != nil && !participates(m.Opts, p.right)) {
+			continue
+		}
+		// Clone the reads, since other shards use them too.
+		left := *p.left
+		if p.right == nil {
+			if singlesByName[name] != nil || m.applyUmiNPolicy(shard, metrics, &left) {
+				continue
+			}
+			singlesByName[name] = &readPair{left: &left, leftFileIdx: p.leftFileIdx}
+			matcher.insertSingleton(&left, p.leftFileIdx)
+			continue
+		}
+		right := *p.right
+		if pairsByName[name] != nil || m.applyUmiNPolicy(shard, metrics, &left, &right) {
+			continue
+		}
+		pairsByName[name] = &readPair{&left, &right, p.leftFileIdx, p.rightFileIdx}
+		matcher.insertPair(&left, &right, p.leftFileIdx, p.rightFileIdx)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/sam"
+)
+
+var orientationNames = []string{"F", "R", "FF", "FR", "RF", "RR"}
+
+// UmiPosition describes the readpairs, or the reads with unmapped
+// mates, that share a duplicate position, and how many distinct umis
+// they carry after umi correction. A position with more than one umi
+// is a umi collision: distinct molecules that would have been
+// considered duplicates without umis.
+type UmiPosition struct {
+	Library     string
+	Ref         string
+	Pos         int
+	MateRef     string
+	MatePos     int
+	Orientation Orientation
+	// Umis is the number of distinct corrected umis at the position.
+	Umis int
+	// Entries is the number of readpairs or reads at the position.
+	Entries int
+
+	refID int
+	// anchor is the left read of the entry with the lowest file
+	// index. The position is counted by the shard that contains it,
+	// which then clears anchor, since the record doesn't outlive the
+	// shard.
+	anchor *sam.Record
+}
+
+// UmiCollisionCounts contains the per-library umi collision counts.
+type UmiCollisionCounts struct {
+	// Positions is the number of duplicate positions examined.
+	Positions int
+	// Collisions is the number of those positions with more than one
+	// distinct umi.
+	Collisions int
+	// CollisionUmis is the total number of distinct umis at the
+	// collision positions.
+	CollisionUmis int
+	// MaxUmis is the largest number of distinct umis at any position.
+	MaxUmis int
+}
+
+// add counts p in c.
+func (c *UmiCollisionCounts) add(p *UmiPosition) {
+	c.Positions++
+	if p.Umis > 1 {
+		c.Collisions++
+		c.CollisionUmis += p.Umis
+	}
+	if p.Umis > c.MaxUmis {
+		c.MaxUmis = p.Umis
+	}
+}
+
+// Add adds the counts in other to c.
+func (c *UmiCollisionCounts) Add(other *UmiCollisionCounts) {
+	c.Positions += other.Positions
+	c.Collisions += other.Collisions
+	c.CollisionUmis += other.CollisionUmis
+	if other.MaxUmis > c.MaxUmis {
+		c.MaxUmis = other.MaxUmis
+	}
+}
+
+// String returns the counts as tab-separated columns, with the percent
+// of positions that are collisions, and the mean number of umis at
+// the collision positions.
+func (c *UmiCollisionCounts) String() string {
+	percent, mean := 0.0, 0.0
+	if c.Positions > 0 {
+		percent = 100 * float64(c.Collisions) / float64(c.Positions)
+	}
+	if c.Collisions > 0 {
+		mean = float64(c.CollisionUmis) / float64(c.Collisions)
+	}
+	return fmt.Sprintf("%d\t%d\t%.2f\t%.2f\t%d", c.Positions, c.Collisions, percent, mean, c.MaxUmis)
+}
+
+// addUmiPosition counts p in the umi collision counts of its library,
+// and keeps p if it is a collision.
+func (mc *MetricsCollection) addUmiPosition(p *UmiPosition) {
+	mc.GetUmiCollisions(p.Library).add(p)
+	if p.Umis > 1 {
+		mc.UmiCollisionPositions = append(mc.UmiCollisionPositions, *p)
+	}
+}
+
+// newUmiPosition returns the UmiPosition of entries, which share a
+// duplicate position and fall into umis distinct umi groups.
+func newUmiPosition(readGroupLibrary map[string]string, entries []DuplicateEntry, umis int) *UmiPosition {
+	first := entries[0]
+	for _, e := range entries[1:] {
+		if e.FileIdx() < first.FileIdx() {
+			first = e
+		}
+	}
+	p := &UmiPosition{MateRef: "*", MatePos: -1, Umis: umis, Entries: len(entries)}
+	switch e := first.(type) {
+	case IndexedPair:
+		p.anchor = e.Left.R
+		p.Pos = bam.UnclippedFivePrimePosition(e.Left.R)
+		p.MateRef = e.Right.R.Ref.Name()
+		p.MatePos = bam.UnclippedFivePrimePosition(e.Right.R)
+		p.Orientation = orientationBytePair(bam.IsReversedRead(e.Left.R), bam.IsReversedRead(e.Right.R))
+	case IndexedSingle:
+		p.anchor = e.R
+		p.Pos = bam.UnclippedFivePrimePosition(e.R)
+		p.Orientation = orientationByteSingle(bam.IsReversedRead(e.R))
+	}
+	p.Ref, p.refID = p.anchor.Ref.Name(), p.anchor.Ref.ID()
+	p.Library = GetLibrary(readGroupLibrary, p.anchor)
+	return p
+}
+
+// writeUmiCollisions writes the per-library umi collision counts, and
+// then each collision position, to opts.UmiCollisionsFile.
+func writeUmiCollisions(ctx context.Context, opts *Opts, globalMetrics *MetricsCollection) (err error) {
+	var f io.WriteCloser
+	f, err = createOutput(ctx, outputSink(opts), opts.UmiCollisionsFile)
+	if err != nil {
+		return errors.E(err, "Couldn't create umi collisions file:", opts.UmiCollisionsFile)
+	}
+	defer func() {
+		if err2 := f.Close(); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+
+	libraries := make([]string, 0, len(globalMetrics.UmiCollisions))
+	for library := range globalMetrics.UmiCollisions {
+		libraries = append(libraries, library)
+	}
+	sort.Strings(libraries)
+	collisions := globalMetrics.UmiCollisionPositions
+	sort.Slice(collisions, func(i, j int) bool {
+		a, b := collisions[i], collisions[j]
+		if a.Library != b.Library {
+			return a.Library < b.Library
+		}
+		if a.refID != b.refID {
+			return a.refID < b.refID
+		}
+		if a.Pos != b.Pos {
+			return a.Pos < b.Pos
+		}
+		if a.Orientation != b.Orientation {
+			return a.Orientation < b.Orientation
+		}
+		if a.MateRef != b.MateRef {
+			return a.MateRef < b.MateRef
+		}
+		return a.MatePos < b.MatePos
+	})
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "LIBRARY\tPOSITIONS\tCOLLISION_POSITIONS\tPERCENT_COLLISION_POSITIONS\tMEAN_COLLISION_UMIS\tMAX_UMIS\n")
+	for _, library := range libraries {
+		fmt.Fprintf(w, "%s\t%s\n", library, globalMetrics.UmiCollisions[library].String())
+	}
+	fmt.Fprintf(w, "\nLIBRARY\tREF\tPOS\tMATE_REF\tMATE_POS\tORIENTATION\tUMIS\tENTRIES\n")
+	for _, c := range collisions {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\t%d\t%d\n", c.Library, c.Ref, c.Pos+1, c.MateRef, c.MatePos+1,
+			orientationNames[c.Orientation], c.Umis, c.Entries)
+	}
+	if err = w.Flush(); err != nil {
+		return errors.E(err, "error writing to umi collisions file:", opts.UmiCollisionsFile)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"testing"
+
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUmiCollisions(t *testing.T) {
+	records := []*sam.Record{
+		NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecord("B:1:1:1:1:1:1:AAC+CCG", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecord("C:1:1:1:1:1:1:GGT+TTA", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 10, r2R, 0, chr1, cigar0),
+		NewRecord("B:1:1:1:1:1:1:AAC+CCG", chr1, 10, r2R, 0, chr1, cigar0),
+		NewRecord("C:1:1:1:1:1:1:GGT+TTA", chr1, 10, r2R, 0, chr1, cigar0),
+		NewRecord("X:1:1:1:1:1:1:AAC+CCG", chr1, 50, r1F, 60, chr1, cigar0),
+		NewRecord("X:1:1:1:1:1:1:AAC+CCG", chr1, 60, r2R, 50, chr1, cigar0),
+	}
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	memory := &MemorySink{}
+	opts := defaultOpts
+	opts.OutputPath = NewTestOutput(tempDir, 0, "bam")
+	opts.Format = "bam"
+	opts.UseUmis = true
+	opts.UmiCollisionsFile = "umi-collisions"
+	opts.Sink = memory
+	markDuplicates := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(header, records),
+		Opts:     &opts,
+	}
+	metrics, err := markDuplicates.Mark(nil)
+	assert.NoError(t, err)
+
+	// A and B share a umi and C has another at the same position, so
+	// that position is a collision. X is alone at its position.
+	assert.Equal(t, map[string]*UmiCollisionCounts{
+		"Unknown Library": {Positions: 2, Collisions: 1, CollisionUmis: 2, MaxUmis: 2},
+	}, metrics.UmiCollisions)
+
+	assert.NoError(t, writeUmiCollisions(vcontext.Background(), &opts, metrics))
+	b, ok := memory.Get("umi-collisions")
+	assert.True(t, ok)
+	assert.Equal(t, "LIBRARY\tPOSITIONS\tCOLLISION_POSITIONS\tPERCENT_COLLISION_POSITIONS\tMEAN_COLLISION_UMIS\tMAX_UMIS\n"+
+		"Unknown Library\t2\t1\t50.00\t2.00\t2\n"+
+		"\n"+
+		"LIBRARY\tREF\tPOS\tMATE_REF\tMATE_POS\tORIENTATION\tUMIS\tENTRIES\n"+
+		"Unknown Library\tchr1\t1\tchr1\t20\tFR\t2\t3\n", string(b))
+}
+
+func TestUmiCollisionCountsAdd(t *testing.T) {
+	c := UmiCollisionCounts{Positions: 4, Collisions: 1, CollisionUmis: 3, MaxUmis: 3}
+	c.Add(&UmiCollisionCounts{Positions: 6, Collisions: 2, CollisionUmis: 4, MaxUmis: 2})
+	assert.Equal(t, UmiCollisionCounts{Positions: 10, Collisions: 3, CollisionUmis: 7, MaxUmis: 3}, c)
+	assert.Equal(t, "10\t3\t30.00\t2.33\t3", c.String())
+}
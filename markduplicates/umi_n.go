@@ -0,0 +1,174 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"strings"
+
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/sam"
+)
+
+// UmiNPolicy tells Mark how to handle reads whose umis contain N.
+type UmiNPolicy int
+
+const (
+	// UmiNSplit corrects umis containing N like other umis, and if
+	// correction fails, never considers the read a duplicate of
+	// another read.
+	UmiNSplit UmiNPolicy = iota
+	// UmiNWildcard corrects umis containing N only by letting each N
+	// match any base, instead of snapping them to the closest known
+	// umi. If exactly one known umi matches, the umi is corrected to
+	// it, otherwise the umi is left uncorrected, and the read is never
+	// considered a duplicate of another read.
+	UmiNWildcard
+	// UmiNFail sets the QC fail flag on the read, and excludes it
+	// from duplicate detection.
+	UmiNFail
+	// UmiNDrop excludes the read from duplicate detection.
+	UmiNDrop
+)
+
+var umiNPolicyNames = []string{"split", "wildcard", "fail", "drop"}
+
+// ParseUmiNPolicy returns the UmiNPolicy with the given name, one of
+// "split", "wildcard", "fail", or "drop".
+func ParseUmiNPolicy(name string) (UmiNPolicy, error) {
+	i, err := parseName("umi N policy", name, umiNPolicyNames)
+	return UmiNPolicy(i), err
+}
+
+func (p UmiNPolicy) String() string {
+	return umiNPolicyNames[p]
+}
+
+// UmiNCounts contains the number of reads whose umis contain N, and
+// how they were handled.
+type UmiNCounts struct {
+	// Reads is the number of reads examined whose umis contain N.
+	Reads int
+	// Corrected is the number of those reads whose umis were
+	// corrected by UmiNWildcard.
+	Corrected int
+	// Failed is the number of those reads flagged by UmiNFail.
+	Failed int
+	// Dropped is the number of those reads excluded by UmiNDrop.
+	Dropped int
+}
+
+// Add adds the counts in other to c.
+func (c *UmiNCounts) Add(other *UmiNCounts) {
+	c.Reads += other.Reads
+	c.Corrected += other.Corrected
+	c.Failed += other.Failed
+	c.Dropped += other.Dropped
+}
+
+// umiWildcardMatcher matches umis containing N against the known
+// umis, treating N as a wildcard.
+type umiWildcardMatcher struct {
+	known []string
+}
+
+// newUmiWildcardMatcher returns a umiWildcardMatcher for the newline
+// separated known umis in knownUmis.
+func newUmiWildcardMatcher(knownUmis []byte) *umiWildcardMatcher {
+	m := &umiWildcardMatcher{}
+	for _, umi := range strings.Split(string(knownUmis), "\n") {
+		if umi = strings.ToUpper(strings.TrimSpace(umi)); umi != "" {
+			m.known = append(m.known, umi)
+		}
+	}
+	return m
+}
+
+// match returns the known umi that matches umi when each N in umi
+// matches any base, and true if there is exactly one such known umi.
+// Otherwise it returns umi and false.
+func (m *umiWildcardMatcher) match(umi string) (string, bool) {
+	umi = strings.ToUpper(umi)
+	found := ""
+	for _, known := range m.known {
+		if len(known) != len(umi) {
+			continue
+		}
+		matches := true
+		for i := range umi {
+			if umi[i] != 'N' && umi[i] != known[i] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			if found != "" {
+				return umi, false
+			}
+			found = known
+		}
+	}
+	if found == "" {
+		return umi, false
+	}
+	return found, true
+}
+
+// matchName returns true if every umi in the read name that contains N
+// has a unique wildcard match.
+func (m *umiWildcardMatcher) matchName(name string) bool {
+	umis := umiRe.FindStringSubmatch(getUmiField(name))
+	for _, umi := range umis[1:] {
+		if strings.ContainsAny(umi, "Nn") {
+			if _, ok := m.match(umi); !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// umiHasN returns true if either umi in the read name contains N.
+func umiHasN(name string) bool {
+	umis := umiRe.FindStringSubmatch(getUmiField(name))
+	return umis != nil && strings.ContainsAny(umis[0], "Nn")
+}
+
+// applyUmiNPolicy applies Opts.UmiNPolicy to reads, which are either a
+// singleton or the two reads of a readpair, and counts the reads in
+// shard whose umis contain N in metrics. It returns true if the reads
+// must be excluded from duplicate detection.
+func (m *MarkDuplicates) applyUmiNPolicy(shard *bam.Shard, metrics *MetricsCollection, reads ...*sam.Record) bool {
+	if !m.Opts.UseUmis || !umiHasN(reads[0].Name) {
+		return false
+	}
+	corrected := m.Opts.UmiNPolicy == UmiNWildcard && m.umiWildcard.matchName(reads[0].Name)
+	for _, r := range reads {
+		if !shard.RecordInShard(r) {
+			continue
+		}
+		metrics.UmiN.Reads++
+		switch m.Opts.UmiNPolicy {
+		case UmiNWildcard:
+			if corrected {
+				metrics.UmiN.Corrected++
+			}
+		case UmiNFail:
+			r.Flags |= sam.QCFail
+			metrics.UmiN.Failed++
+		case UmiNDrop:
+			metrics.UmiN.Dropped++
+		}
+	}
+	return m.Opts.UmiNPolicy == UmiNFail || m.Opts.UmiNPolicy == UmiNDrop
+}
@@ -0,0 +1,52 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUmiNPolicy(t *testing.T) {
+	for _, policy := range []UmiNPolicy{UmiNSplit, UmiNWildcard, UmiNFail, UmiNDrop} {
+		parsed, err := ParseUmiNPolicy(policy.String())
+		assert.NoError(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+	_, err := ParseUmiNPolicy("ignore")
+	assert.Error(t, err)
+}
+
+func TestUmiWildcardMatch(t *testing.T) {
+	m := newUmiWildcardMatcher([]byte("AAC\nACC\ngtt\n\n"))
+	for _, test := range []struct {
+		umi      string
+		expected string
+		ok       bool
+	}{
+		{"NAC", "AAC", true},
+		{"ANC", "", false},
+		{"nTT", "GTT", true},
+		{"NNN", "", false},
+		{"NNNN", "", false},
+		{"TNN", "", false},
+	} {
+		actual, ok := m.match(test.umi)
+		assert.Equal(t, test.ok, ok, test.umi)
+		if ok {
+			assert.Equal(t, test.expected, actual, test.umi)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"github.com/grailbio/hts/sam"
+)
+
+// UnmappedMatePolicy tells Mark how to flag an unmapped read whose
+// mate is mapped. Such a read is placed at its mate's position, but
+// never participates in duplicate detection itself.
+type UnmappedMatePolicy int
+
+const (
+	// UnmappedMateUnmarked always leaves the unmapped read unmarked.
+	UnmappedMateUnmarked UnmappedMatePolicy = iota
+	// UnmappedMateFollow marks the unmapped read as a duplicate when
+	// its mapped mate is marked as a duplicate, like Picard. When
+	// Opts.RemoveDups is set, the unmapped read is removed along with
+	// its mate.
+	UnmappedMateFollow
+)
+
+var unmappedMatePolicyNames = []string{"unmarked", "mate"}
+
+// ParseUnmappedMatePolicy returns the UnmappedMatePolicy with the
+// given name, one of "unmarked" or "mate".
+func ParseUnmappedMatePolicy(name string) (UnmappedMatePolicy, error) {
+	i, err := parseName("unmapped mate policy", name, unmappedMatePolicyNames)
+	return UnmappedMatePolicy(i), err
+}
+
+func (p UnmappedMatePolicy) String() string {
+	return unmappedMatePolicyNames[p]
+}
+
+// markUnmappedMates sets the duplicate flag on each unmapped read in
+// records whose mapped mate in singlesByName is flagged as a
+// duplicate.
+func markUnmappedMates(records []*sam.Record, singlesByName map[string]*readPair) {
+	for _, r := range records {
+		if r.Flags&sam.Unmapped == 0 || r.Flags&sam.MateUnmapped != 0 ||
+			r.Flags&(sam.Secondary|sam.Supplementary) != 0 {
+			continue
+		}
+		mate, found := singlesByName[r.Name]
+		if found && mate.left.Flags&sam.Duplicate != 0 {
+			r.Flags |= sam.Duplicate
+		}
+	}
+}
@@ -16,6 +16,7 @@ package markduplicates
 import (
 	"fmt"
 
+	"github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/bio/encoding/bamprovider"
 )
 
@@ -35,7 +36,26 @@ func validate(opts *Opts) error {
 	if opts.MinBases <= 0 {
 		return fmt.Errorf("min-bases should be positive")
 	}
-	if opts.IndexFile == "" {
+	if opts.MinMapQ < 0 || opts.MinMapQ > 255 {
+		return fmt.Errorf("min-mapq must be between 0 and 255")
+	}
+	if opts.IncludeFlags&opts.ExcludeFlags != 0 {
+		return fmt.Errorf("include-flags and exclude-flags must not share flags")
+	}
+	if opts.IORetries < 0 {
+		return fmt.Errorf("io-retries must be non-negative")
+	}
+	if opts.IORetries > 0 && opts.IORetryBackoff <= 0 {
+		return fmt.Errorf("io-retry-backoff must be positive")
+	}
+	if opts.Sequential {
+		if opts.IndexFile != "" {
+			return fmt.Errorf("sequential is set, but it reads no index")
+		}
+		if bamprovider.GuessFileType(opts.BamFile) == bamprovider.PAM {
+			return fmt.Errorf("sequential is set, but it only reads bam files")
+		}
+	} else if opts.IndexFile == "" {
 		opts.IndexFile = opts.BamFile + ".bai"
 	}
 	if len(opts.UmiFile) > 0 && !opts.UseUmis {
@@ -47,6 +67,107 @@ func validate(opts *Opts) error {
 	if opts.ScavengeUmis > -1 && opts.UmiFile == "" {
 		return fmt.Errorf("scavenge-umis is set, but umi-file is empty")
 	}
+	if opts.UmiNPolicy != UmiNSplit && !opts.UseUmis {
+		return fmt.Errorf("umi-n-policy is set, but use-umis is false")
+	}
+	if opts.UmiNPolicy == UmiNWildcard && opts.UmiFile == "" {
+		return fmt.Errorf("umi-n-policy is wildcard, but umi-file is empty")
+	}
+	if opts.TagConfidence && opts.UmiFile == "" {
+		return fmt.Errorf("tag-confidence is set, but umi-file is empty")
+	}
+	if err := validateFieldPolicies(opts); err != nil {
+		return err
+	}
+	if err := validatePassThroughRefs(opts.PassThroughRefs); err != nil {
+		return err
+	}
+	if err := validateQCThresholds(opts); err != nil {
+		return err
+	}
+	if opts.UseSpliceJunctions && !opts.RnaSeq {
+		return fmt.Errorf("use-splice-junctions is set, but rna-seq is false")
+	}
+	if opts.RnaSeq {
+		opts.CoverageExcludeSkips = true
+	}
+	if opts.OpticalPairsFile != "" {
+		if _, ok := opts.OpticalDetector.(OpticalPairDetector); !ok {
+			return fmt.Errorf("optical-pairs is set, but the optical detector does not report pairs")
+		}
+	}
+	if opts.LaneMetricsFile != "" && opts.OpticalDetector == nil {
+		return fmt.Errorf("lane-metrics is set, but optical duplicate detection is disabled")
+	}
+	if opts.UmiCollisionsFile != "" && !opts.UseUmis {
+		return fmt.Errorf("umi-collisions is set, but use-umis is false")
+	}
+	if opts.SortByName && bamprovider.ParseFileType(opts.Format) != bamprovider.BAM {
+		return fmt.Errorf("sort-by-name requires bam output format")
+	}
+	if opts.CorruptBlockPolicy == CorruptBlockSkip && opts.Sequential {
+		return fmt.Errorf("corrupt-block-policy is skip, but sequential can't seek past corrupt blocks")
+	}
+	if opts.PreserveOrder {
+		if opts.CorruptBlockPolicy == CorruptBlockSkip {
+			return fmt.Errorf("preserve-order is set, but corrupt-block-policy skip removes records")
+		}
+		if opts.RemoveDups {
+			return fmt.Errorf("preserve-order is set, but remove-dups removes records")
+		}
+		if opts.RecordPredicate != nil {
+			return fmt.Errorf("preserve-order is set, but RecordPredicate may drop records")
+		}
+		if opts.CoverageMax > 0 {
+			return fmt.Errorf("preserve-order is set, but max-depth must be 0 to disable subsampling")
+		}
+		if opts.DownsampleFraction > 0 && opts.DownsampleFraction < 1 {
+			return fmt.Errorf("preserve-order is set, but downsample-fraction removes records")
+		}
+		if opts.FixMate {
+			return fmt.Errorf("preserve-order is set, but fix-mate modifies fields other than flags and tags")
+		}
+		if fieldPolicy(opts, bam.FieldTempLen) == FieldRegenerate {
+			return fmt.Errorf("preserve-order is set, but field-policy regenerates templen")
+		}
+		if opts.SortByName {
+			return fmt.Errorf("preserve-order is set, but sort-by-name reorders records")
+		}
+		if bamprovider.ParseFileType(opts.Format) == bamprovider.PAM && len(pamDropFields(opts)) > 0 {
+			return fmt.Errorf("preserve-order is set, but pam output requires emit-unmodified-fields")
+		}
+	}
+	if len(opts.Regions) > 0 {
+		if opts.Sequential {
+			return fmt.Errorf("regions is set, but sequential reads no index to look up mates")
+		}
+		if opts.EstimateFraction > 0 {
+			return fmt.Errorf("regions is set, but estimate-fraction samples the whole input")
+		}
+		if opts.CoverageMax > 0 {
+			return fmt.Errorf("regions is set, but max-depth must be 0 to disable subsampling")
+		}
+		if opts.FixMate {
+			return fmt.Errorf("regions is set, but fix-mate reads the whole input to pair reads by name")
+		}
+		if bamprovider.ParseFileType(opts.Format) == bamprovider.PAM {
+			return fmt.Errorf("regions requires bam output format")
+		}
+	}
+	if opts.DownsampleFraction < 0 || opts.DownsampleFraction > 1 {
+		return fmt.Errorf("downsample-fraction must be between 0 and 1")
+	}
+	if opts.EstimateFraction < 0 || opts.EstimateFraction > 1 {
+		return fmt.Errorf("estimate-fraction must be between 0 and 1")
+	}
+	if opts.EstimateFraction > 0 {
+		if opts.SortByName || opts.PreserveOrder {
+			return fmt.Errorf("estimate-fraction is set, but it writes no output to sort or preserve")
+		}
+		if opts.FlagstatFile != "" || opts.LogFlagstat {
+			return fmt.Errorf("estimate-fraction is set, but flagstat requires output")
+		}
+	}
 	if bamprovider.ParseFileType(opts.Format) == bamprovider.Unknown {
 		return fmt.Errorf("unknown outputformat %s", opts.Format)
 	}
@@ -0,0 +1,237 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+)
+
+// FlagMismatch describes a record whose duplicate flag disagrees with
+// the duplicate flag computed by the reference implementation.
+type FlagMismatch struct {
+	// FileIdx is the index of the record in the input.
+	FileIdx  uint64
+	Name     string
+	Ref      string
+	Pos      int
+	Flags    sam.Flags
+	Expected bool
+	// MissingMate is set if the record has a mapped mate that isn't in
+	// the input, so its expected flag can't be computed.
+	MissingMate bool
+}
+
+// String returns a tab separated representation of m.
+func (m FlagMismatch) String() string {
+	return fmt.Sprintf("%d\t%s\t%s\t%d\t%d\t%v\t%v\t%v", m.FileIdx, m.Name, m.Ref, m.Pos+1, m.Flags,
+		m.Flags&sam.Duplicate != 0, m.Expected, m.MissingMate)
+}
+
+// ValidateMarked reads an already marked bam from provider, re-derives
+// the expected duplicate flags with a simple single-threaded, in-memory
+// reference implementation, and returns the records whose duplicate
+// flag differs from the expected value, and the records whose mates
+// are missing from the input.
+//
+// The reference implementation honors opts.StrandSpecific,
+// opts.SeparateSingletons, opts.SeparateReadGroups, opts.UseBarcodes,
+// opts.UseSpliceJunctions, the read filter options, and
+// opts.RecordPredicate. It does not support UMIs, bag processors,
+// downsampling, max-depth subsampling, the "mate" unmapped mate
+// policy, pass-through references or regions, and returns an error if
+// any of them is set. Since primaries are chosen by base quality, the
+// input must contain base qualities.
+func ValidateMarked(provider bamprovider.Provider, opts *Opts) ([]FlagMismatch, error) {
+	if opts.UseUmis || opts.UmiNPolicy != UmiNSplit || len(opts.BagProcessorFactories) > 0 {
+		return nil, fmt.Errorf("validation does not support umis or bag processors")
+	}
+	if opts.DownsampleFraction > 0 {
+		return nil, fmt.Errorf("validation does not support downsample-fraction")
+	}
+	if opts.CoverageMax > 0 {
+		return nil, fmt.Errorf("validation does not support subsampling, max-depth must be 0")
+	}
+	if opts.UnmappedMatePolicy != UnmappedMateUnmarked {
+		return nil, fmt.Errorf("validation does not support unmapped-mate-policy %v", opts.UnmappedMatePolicy)
+	}
+	if len(opts.PassThroughRefs) > 0 {
+		return nil, fmt.Errorf("validation does not support pass-through-refs")
+	}
+	if len(opts.Regions) > 0 {
+		return nil, fmt.Errorf("validation does not support regions")
+	}
+	header, err := provider.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*sam.Record
+	iter := provider.NewIterator(bam.UniversalShard(header))
+	for iter.Scan() {
+		records = append(records, iter.Record())
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	log.Debug.Printf("validating duplicate flags of %d records", len(records))
+
+	mismatches := make([]FlagMismatch, 0)
+	duplicates, missingMates := referenceDuplicates(records, opts)
+	for i, expected := range duplicates {
+		r := records[i]
+		if (r.Flags&sam.Duplicate != 0) != expected || missingMates[i] {
+			mismatches = append(mismatches, FlagMismatch{
+				FileIdx:     uint64(i),
+				Name:        r.Name,
+				Ref:         r.Ref.Name(),
+				Pos:         r.Pos,
+				Flags:       r.Flags,
+				Expected:    expected,
+				MissingMate: missingMates[i],
+			})
+		}
+	}
+	return mismatches, nil
+}
+
+// referenceDuplicates returns, for each record in records, whether the
+// record should be marked as a duplicate, and whether the record's
+// mapped mate is missing. records must contain the entire input in
+// file order.
+func referenceDuplicates(records []*sam.Record, opts *Opts) (duplicates, missingMates []bool) {
+	type entry struct {
+		left, right int // indexes into records, right is -1 for singles.
+	}
+	readGroup := func(r *sam.Record) string {
+		if !opts.SeparateReadGroups {
+			return ""
+		}
+		readGroup, _ := getReadGroup(r)
+		return readGroup
+	}
+	barcode := func(r *sam.Record) string {
+		if !opts.UseBarcodes {
+			return ""
+		}
+		return getBarcode(r)
+	}
+	junctions := func(r *sam.Record) string {
+		if !opts.UseSpliceJunctions {
+			return ""
+		}
+		return getSpliceJunctions(r)
+	}
+	strandOf := func(r *sam.Record) strand {
+		if !opts.StrandSpecific {
+			return 0
+		}
+		return r1Strand(r)
+	}
+	score := func(e entry) int {
+		s := baseQScore(records[e.left])
+		if e.right >= 0 {
+			s += baseQScore(records[e.right])
+		}
+		return s
+	}
+	// best returns the index of the primary entry, choosing by score,
+	// and breaking ties by the file index of the left read.
+	best := func(entries []entry) int {
+		bestIndex := 0
+		for i := range entries {
+			si, sb := score(entries[i]), score(entries[bestIndex])
+			if si > sb || (si == sb && entries[i].left < entries[bestIndex].left) {
+				bestIndex = i
+			}
+		}
+		return bestIndex
+	}
+
+	firstMates := map[string]int{}
+	pairs := map[duplicateKey][]entry{}
+	singles := map[duplicateKey][]entry{}
+	for i, r := range records {
+		if r.Flags&(sam.Unmapped|sam.Secondary|sam.Supplementary) != 0 {
+			continue
+		}
+		if bam.HasNoMappedMate(r) {
+			if !participates(opts, r) {
+				continue
+			}
+			k := duplicateKey{r.Ref.ID(), bam.UnclippedFivePrimePosition(r), -1, -1,
+				orientationByteSingle(bam.IsReversedRead(r)), strandOf(r), readGroup(r), barcode(r), junctions(r), ""}
+			singles[k] = append(singles[k], entry{i, -1})
+			continue
+		}
+		j, ok := firstMates[r.Name]
+		if !ok {
+			firstMates[r.Name] = i
+			continue
+		}
+		delete(firstMates, r.Name)
+		if !participates(opts, records[j]) || !participates(opts, r) {
+			continue
+		}
+
+		left, right := IndexedSingle{records[j], uint64(j)}, IndexedSingle{r, uint64(i)}
+		if !left.lessThan(right) {
+			left, right = right, left
+		}
+		k := duplicateKey{
+			left.R.Ref.ID(), bam.UnclippedFivePrimePosition(left.R),
+			right.R.Ref.ID(), bam.UnclippedFivePrimePosition(right.R),
+			orientationBytePair(bam.IsReversedRead(left.R), bam.IsReversedRead(right.R)),
+			strandOf(left.R), readGroup(left.R), barcode(left.R),
+			junctions(left.R), junctions(right.R),
+		}
+		pairs[k] = append(pairs[k], entry{int(left.FileIdx_), int(right.FileIdx_)})
+	}
+	missingMates = make([]bool, len(records))
+	for name, i := range firstMates {
+		log.Error.Printf("reference validation could not find mate for %s", name)
+		missingMates[i] = true
+	}
+
+	duplicates = make([]bool, len(records))
+	pairEnds := map[duplicateKey]bool{}
+	for k, entries := range pairs {
+		bestIndex := best(entries)
+		for i, e := range entries {
+			if i != bestIndex {
+				duplicates[e.left] = true
+				duplicates[e.right] = true
+			}
+		}
+		pairEnds[duplicateKey{k.leftRefId, k.leftPos, -1, -1, leftOrientation(k.Orientation), k.Strand, k.readGroup, k.barcode, k.leftJunctions, ""}] = true
+		pairEnds[duplicateKey{k.rightRefId, k.rightPos, -1, -1, rightOrientation(k.Orientation), k.Strand, k.readGroup, k.barcode, k.rightJunctions, ""}] = true
+	}
+	for k, entries := range singles {
+		// Singles are always duplicates of a matching pair.
+		bestIndex := best(entries)
+		if pairEnds[k] && !opts.SeparateSingletons {
+			bestIndex = -1
+		}
+		for i, e := range entries {
+			if i != bestIndex {
+				duplicates[e.left] = true
+			}
+		}
+	}
+	return duplicates, missingMates
+}